@@ -0,0 +1,91 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Queries several expressions in one request, returning the series of every
+// expression keyed by the alias it's given in aliases, which maps aliases to
+// expressions. Every expression is wrapped in alias() with a generated name,
+// overriding any alias() of its own, so results never depend on how Graphite
+// names a series. An expression must result in at most one series, ie.
+// wildcards must be aggregated; otherwise the query fails. Expressions
+// matching nothing are left out of the result.
+func (g *Client) QueryAliased(aliases map[string]string, interval TimeInterval, opts ...QueryOption) (map[string]Datapoints, error) {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	targets := make([]string, len(names))
+	byKey := make(map[string]string, len(names))
+	for i, name := range names {
+		key := "alias" + strconv.Itoa(i)
+		targets[i] = fmt.Sprintf("alias(%s,%q)", aliases[name], key)
+		byKey[key] = name
+	}
+
+	series, err := g.QueryMulti(targets, interval, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]Datapoints, len(names))
+	for _, s := range series {
+		name, ok := byKey[s.Target]
+		if !ok {
+			return nil, fmt.Errorf("Unexpected Graphite response. Unknown target %q.", s.Target)
+		}
+		if _, seen := res[name]; seen {
+			return nil, fmt.Errorf("Expression %q for %q resulted in more than one series.", aliases[name], name)
+		}
+		s.Target = name
+		res[name] = s
+	}
+	return res, nil
+}
+
+// Returned by QueryFirstNonEmpty when no target has a non-null datapoint.
+var ErrAllEmpty = errors.New("All targets are empty.")
+
+// Queries all qs in one request, returning the series of the first one, in
+// order, having at least one non-null datapoint. Useful for falling back to an
+// old metric name during a rename. Like with QueryAliased, every target must
+// result in at most one series. The returned series is named by its target. If
+// all are empty, the series of the first target is returned together with
+// ErrAllEmpty.
+func (g *Client) QueryFirstNonEmpty(qs []string, interval TimeInterval, opts ...QueryOption) (Datapoints, error) {
+	if len(qs) == 0 {
+		return Datapoints{}, errors.New("No targets given.")
+	}
+
+	aliases := make(map[string]string, len(qs))
+	for i, q := range qs {
+		aliases[strconv.Itoa(i)] = q
+	}
+	series, err := g.QueryAliased(aliases, interval, opts...)
+	if err != nil {
+		return Datapoints{}, err
+	}
+
+	for i, q := range qs {
+		s, ok := series[strconv.Itoa(i)]
+		if !ok {
+			continue
+		}
+		s.Target = q
+		if _, _, nonEmpty, err := s.LastNonNullFloat(); err != nil {
+			return Datapoints{}, fmt.Errorf("Unable to convert %q: %w", q, err)
+		} else if nonEmpty {
+			return s, nil
+		}
+	}
+
+	first := series["0"]
+	first.Target = qs[0]
+	return first, ErrAllEmpty
+}
@@ -0,0 +1,150 @@
+package infrastructure
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Mimics Graphite's alias(), returning a series per target unless the
+// aliased expression contains "multi".
+var aliasTarget = regexp.MustCompile(`^alias\((.*),"([^"]*)"\)$`)
+
+func newAliasServer(t *testing.T, received *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*received = r.Form["target"]
+		var series []string
+		for i, target := range r.Form["target"] {
+			m := aliasTarget.FindStringSubmatch(target)
+			if m == nil {
+				t.Error("Unexpected target:", target)
+				continue
+			}
+			n := 1
+			if strings.Contains(m[1], "multi") {
+				n = 2
+			}
+			if strings.Contains(m[1], "nothing") {
+				n = 0
+			}
+			for j := 0; j < n; j++ {
+				series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [[%d, 1409763000]]}`, m[2], i))
+			}
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+}
+
+func TestQueryAliased(t *testing.T) {
+	t.Parallel()
+
+	var received []string
+	ts := newAliasServer(t, &received)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409763060, 0)}
+	res, err := c.QueryAliased(map[string]string{
+		"requests": `sumSeries(app.*.req)`,
+		"errors":   `alias(sumSeries(app.{a,b}.err),"some \"quoted\" name")`,
+		"none":     `nothing.*`,
+	}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`alias(alias(sumSeries(app.{a,b}.err),"some \"quoted\" name"),"alias0")`,
+		`alias(nothing.*,"alias1")`,
+		`alias(sumSeries(app.*.req),"alias2")`,
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Error("Unexpected targets:", received)
+	}
+
+	if len(res) != 2 {
+		t.Fatal("Unexpected result:", res)
+	}
+	for name, value := range map[string]int64{"errors": 0, "requests": 2} {
+		points, err := res[name].AsInts()
+		if err != nil || len(points) != 1 || *points[0].Value != value {
+			t.Error("Unexpected points:", name, points, err)
+		}
+		if res[name].Target != name {
+			t.Error("Unexpected target:", res[name].Target)
+		}
+	}
+
+	if _, err := c.QueryAliased(map[string]string{"a": "app.multi.*"}, interval); err == nil {
+		t.Error("Expected error for multiple series.")
+	}
+}
+
+func TestQueryFirstNonEmpty(t *testing.T) {
+	t.Parallel()
+
+	// Datapoints by expression. Expressions without any match nothing.
+	datapoints := map[string]string{
+		"new.nulls": `[[null, 1409763000], [null, 1409763060]]`,
+		"old.name":  `[[null, 1409763000], [3, 1409763060]]`,
+		"other":     `[[4, 1409763000]]`,
+		"empty":     `[]`,
+	}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		var series []string
+		for _, target := range r.Form["target"] {
+			m := aliasTarget.FindStringSubmatch(target)
+			if m == nil {
+				t.Error("Unexpected target:", target)
+				continue
+			}
+			if points, ok := datapoints[m[1]]; ok {
+				series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": %s}`, m[2], points))
+			}
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	// The preferred target exists, but is all nulls.
+	s, err := c.QueryFirstNonEmpty([]string{"missing", "new.nulls", "old.name", "other"}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, ok, err := s.LastNonNullInt(); s.Target != "old.name" || !ok || value != 3 || err != nil {
+		t.Error("Unexpected series:", s.Target, value, ok, err)
+	}
+	if requests != 1 {
+		t.Error("Expected a single request:", requests)
+	}
+
+	s, err = c.QueryFirstNonEmpty([]string{"new.nulls", "empty", "missing"}, interval)
+	if err != ErrAllEmpty || s.Target != "new.nulls" || s.Len() != 2 {
+		t.Error("Unexpected result:", s.Target, s.Len(), err)
+	}
+	s, err = c.QueryFirstNonEmpty([]string{"missing", "new.nulls"}, interval)
+	if err != ErrAllEmpty || s.Target != "missing" || !s.IsEmpty() {
+		t.Error("Unexpected result:", s.Target, s.Len(), err)
+	}
+
+	if _, err := c.QueryFirstNonEmpty(nil, interval); err == nil {
+		t.Error("Expected error.")
+	}
+}
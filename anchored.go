@@ -0,0 +1,48 @@
+package infrastructure
+
+import (
+	"errors"
+	httpurl "net/url"
+	"strconv"
+	"time"
+)
+
+// Like QuerySince, but the interval is computed once, when called, and sent
+// as absolute from and until timestamps. Retries, and the requests of queries
+// split by MaxTargetsPerRequest, all cover exactly the same interval.
+//
+// QuerySince leaves computing the interval to Graphite, which does so when it
+// parses the request. That tolerates clock skew between the client and
+// Graphite, but the interval drifts with queueing and retries. Anchored
+// queries are consistent instead, which matters for short lookbacks, ie.
+// aggregation jobs that must cover every minute exactly once, but depend on
+// the clocks of the client and Graphite agreeing.
+func (g *Client) QuerySinceAnchored(q string, ago time.Duration, opts ...QueryOption) Datapoints {
+	queryPart, err := anchoredQueryPart([]string{q}, ago, g.now())
+	if err != nil {
+		return Datapoints{err: err}
+	}
+
+	points, err := g.render([]string{q}, queryPart, nil, opts)
+	return parseSingleGraphiteResponse(points, err, g.requireDatapoints(opts))
+}
+
+// Like QueryMultiSince, but anchored. See QuerySinceAnchored.
+func (g *Client) QueryMultiSinceAnchored(q []string, ago time.Duration, opts ...QueryOption) (MultiDatapoints, error) {
+	queryPart, err := anchoredQueryPart(q, ago, g.now())
+	if err != nil {
+		return nil, err
+	}
+	return g.render(q, queryPart, nil, opts)
+}
+
+func anchoredQueryPart(q []string, ago time.Duration, now time.Time) (httpurl.Values, error) {
+	if ago.Nanoseconds() <= 0 {
+		return nil, errors.New("Duration is expected to be positive.")
+	}
+
+	queryPart := constructQueryPart(q)
+	queryPart.Add("from", strconv.FormatInt(now.Add(-ago).Unix(), 10))
+	queryPart.Add("until", strconv.FormatInt(now.Unix(), 10))
+	return queryPart, nil
+}
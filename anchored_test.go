@@ -0,0 +1,66 @@
+package infrastructure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuerySinceAnchored(t *testing.T) {
+	t.Parallel()
+
+	var froms, untils []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		froms = append(froms, r.FormValue("from"))
+		untils = append(untils, r.FormValue("until"))
+		if len(froms)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithRetryPolicy(DefaultRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Letting time pass between retries.
+	now := time.Unix(1409763000, 0)
+	c.clock = func() time.Time { return now }
+	c.sleeper = func(ctx context.Context, d time.Duration) error {
+		now = now.Add(time.Minute)
+		return nil
+	}
+
+	if points, err := c.QuerySinceAnchored("a", 5*time.Minute).AsInts(); err != nil || len(points) != 1 {
+		t.Fatal("Unexpected response:", points, err)
+	}
+	if len(froms) != 3 {
+		t.Fatal("Unexpected number of requests:", len(froms))
+	}
+	for i := range froms {
+		if froms[i] != froms[0] || untils[i] != untils[0] {
+			t.Error("Interval changed between retries:", froms, untils)
+		}
+	}
+	from, _ := strconv.ParseInt(froms[0], 10, 64)
+	until, _ := strconv.ParseInt(untils[0], 10, 64)
+	if from != 1409762700 || until != 1409763000 {
+		t.Error("Unexpected interval:", froms[0], untils[0])
+	}
+
+	if _, err := c.QueryMultiSinceAnchored([]string{"a"}, 5*time.Minute); err != nil {
+		t.Error(err)
+	}
+	if len(froms) != 6 || froms[3] != "1409762820" || froms[3] != froms[5] {
+		t.Error("Unexpected intervals:", froms)
+	}
+
+	if _, err := c.QueryMultiSinceAnchored([]string{"a"}, 0); err == nil {
+		t.Error("Expected error.")
+	}
+}
@@ -0,0 +1,159 @@
+package infrastructure
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	httpurl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Caches decoded render responses in memory, serving repeated queries without
+// requests to Graphite. Set as Client.Cache. Safe for concurrent use and for
+// sharing between Clients.
+//
+// Queries are keyed by the URL, credentials and headers of the Client and
+// the query, so Clients sharing a cache never serve each other responses they
+// might not be allowed to see. They're also keyed by their render parameters
+// with targets sorted, so a hit
+// might return the series in another order than requested. Relative queries
+// are additionally keyed by the current time rounded down to ttl, so they are
+// never served from an earlier time window.
+type QueryCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// Least recently used at the back.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	series  MultiDatapoints
+	expires time.Time
+}
+
+// Creates a cache keeping responses for ttl. When full, the least recently
+// used response is evicted. A non-positive maxEntries means unlimited.
+func NewQueryCache(ttl time.Duration, maxEntries int) *QueryCache {
+	return &QueryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Number of queries served from the cache.
+func (c *QueryCache) Hits() int64 {
+	return c.hits.Load()
+}
+
+// Number of queries not found in the cache.
+func (c *QueryCache) Misses() int64 {
+	return c.misses.Load()
+}
+
+// Number of cached responses, including expired ones not evicted yet.
+func (c *QueryCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// Removes all cached responses.
+func (c *QueryCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// The normalized key of a render query. scope identifies everything else the
+// response depends on, see Client.cacheScope.
+func (c *QueryCache) key(scope string, query httpurl.Values) string {
+	normalized := make(httpurl.Values, len(query)+1)
+	for k, v := range query {
+		normalized[k] = v
+	}
+	targets := append([]string(nil), query["target"]...)
+	sort.Strings(targets)
+	normalized["target"] = targets
+
+	if from := query.Get("from"); strings.HasPrefix(from, "-") || query.Get("until") == "" {
+		bucket := c.now().UnixNano()
+		if c.ttl > 0 {
+			bucket -= bucket % int64(c.ttl)
+		}
+		normalized.Set("now", strconv.FormatInt(bucket, 10))
+	}
+
+	// Encode sorts by key.
+	return scope + "?" + normalized.Encode()
+}
+
+func (c *QueryCache) get(key string) (MultiDatapoints, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if ok && c.now().Before(e.Value.(*cacheEntry).expires) {
+		c.lru.MoveToFront(e)
+		c.hits.Add(1)
+		// Copying to not have callers modify the cached slice.
+		return append(MultiDatapoints{}, e.Value.(*cacheEntry).series...), true
+	}
+	if ok {
+		c.remove(e)
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+func (c *QueryCache) put(key string, series MultiDatapoints) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &cacheEntry{key, append(MultiDatapoints{}, series...), c.now().Add(c.ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *QueryCache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// A digest of what a render response depends on besides its parameters: the
+// URL, the credentials and the headers of the request.
+func (g *Client) cacheScope(o queryOptions) string {
+	h := sha256.New()
+	fmt.Fprintln(h, g.URL.String())
+	if g.basicAuth != nil {
+		password, _ := g.basicAuth.Password()
+		fmt.Fprintf(h, "%q %q\n", g.basicAuth.Username(), password)
+	}
+	// Write sorts by key.
+	requestOptionsFrom(o.ctx).header.Write(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
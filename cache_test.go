@@ -0,0 +1,165 @@
+package infrastructure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCountingServer(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}, {"target": "b", "datapoints": []}]`))
+	}))
+}
+
+func TestQueryCache(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := newCountingServer(t, &requests)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1409763000, 0)
+	c.Cache = NewQueryCache(time.Minute, 2)
+	c.Cache.now = func() time.Time { return now }
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	for i := 0; i < 2; i++ {
+		series, err := c.QueryMulti([]string{"a", "b"}, interval)
+		if err != nil || len(series) != 2 {
+			t.Fatal("Unexpected result:", series, err)
+		}
+		// Must not affect the cached response.
+		series[0] = Datapoints{}
+	}
+	// Same query with targets in another order.
+	if series, err := c.QueryMulti([]string{"b", "a"}, interval); err != nil || series[0].Target != "a" {
+		t.Error("Unexpected result:", series, err)
+	}
+	if requests != 1 || c.Cache.Hits() != 2 || c.Cache.Misses() != 1 {
+		t.Error("Unexpected counts:", requests, c.Cache.Hits(), c.Cache.Misses())
+	}
+
+	// Another format is another query.
+	if _, err := c.QueryMulti([]string{"a", "b"}, interval, WithLocation(time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Error("Unexpected number of requests:", requests)
+	}
+
+	// Expiry.
+	now = now.Add(time.Minute)
+	if _, err := c.QueryMulti([]string{"a", "b"}, interval); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 {
+		t.Error("Expected expired entry to be refetched:", requests)
+	}
+
+	// Evicting the least recently used.
+	if _, err := c.QueryMulti([]string{"c"}, interval); err != nil {
+		t.Fatal(err)
+	}
+	if c.Cache.Len() != 2 {
+		t.Error("Unexpected number of entries:", c.Cache.Len())
+	}
+
+	c.Cache.Purge()
+	if c.Cache.Len() != 0 {
+		t.Error("Expected empty cache:", c.Cache.Len())
+	}
+	if _, err := c.QueryMulti([]string{"c"}, interval); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 5 {
+		t.Error("Expected purged entry to be refetched:", requests)
+	}
+}
+
+func TestQueryCacheRelative(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := newCountingServer(t, &requests)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// At the start of a bucket.
+	now := time.Unix(1409760000, 0)
+	c.Cache = NewQueryCache(time.Hour, 0)
+	c.Cache.now = func() time.Time { return now }
+
+	query := func() {
+		if _, err := c.QueryMultiSince([]string{"a", "b"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query()
+	now = now.Add(30 * time.Minute)
+	query()
+	if requests != 1 {
+		t.Error("Expected a hit within the same bucket:", requests)
+	}
+
+	// The next bucket, while the previous entry hasn't expired yet.
+	now = now.Add(30 * time.Minute)
+	query()
+	if requests != 2 {
+		t.Error("Expected a miss in the next bucket:", requests)
+	}
+}
+
+func TestQueryCacheShared(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := newCountingServer(t, &requests)
+	defer ts.Close()
+
+	cache := NewQueryCache(time.Minute, 10)
+	alice, err := New(ts.URL, WithBasicAuth("alice", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.Cache = cache
+	bob := alice.Clone(WithBasicAuth("bob", "secret"))
+	bob.Cache = cache
+	aliceAgain, err := New(ts.URL, WithBasicAuth("alice", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceAgain.Cache = cache
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	for i, query := range []struct {
+		client   *Client
+		opts     []QueryOption
+		requests int32
+	}{
+		{alice, nil, 1},
+		{bob, nil, 2},
+		{aliceAgain, nil, 2},
+		{alice, []QueryOption{WithHeader("X-Tenant", "a")}, 3},
+		{alice, []QueryOption{WithHeader("X-Tenant", "b")}, 4},
+		{aliceAgain, []QueryOption{WithHeader("X-Tenant", "a")}, 4},
+	} {
+		if _, err := query.client.QueryMulti([]string{"a", "b"}, interval, query.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&requests); n != query.requests {
+			t.Error("Unexpected number of requests:", i, n)
+		}
+	}
+}
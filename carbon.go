@@ -0,0 +1,326 @@
+package infrastructure
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errInterrupted = errors.New("Write was interrupted.")
+
+// The wire protocol used when writing to Carbon.
+type CarbonProtocol int
+
+const (
+	// Newline separated "path value timestamp" lines. Carbon usually
+	// listens for these on port 2003.
+	PlaintextProtocol CarbonProtocol = iota
+
+	// Length prefixed pickled batches of metrics. Carbon usually listens for
+	// these on port 2004.
+	PickleProtocol
+)
+
+// State of the connection held by a CarbonWriter.
+type CarbonConnState int32
+
+const (
+	CarbonDisconnected CarbonConnState = iota
+	CarbonConnected
+	// A write or dial failed and the writer is waiting to dial again.
+	CarbonReconnecting
+)
+
+func (s CarbonConnState) String() string {
+	switch s {
+	case CarbonDisconnected:
+		return "disconnected"
+	case CarbonConnected:
+		return "connected"
+	case CarbonReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// A single value to be written to Carbon.
+type Metric struct {
+	Path  string
+	Value float64
+	Time  time.Time
+
+	// Optional Graphite 1.1 tags. Written as "path;key=value" with keys
+	// sorted.
+	Tags map[string]string
+}
+
+// Writes metrics to a Carbon daemon over TCP. A single connection is kept
+// open between calls and CarbonWriter is safe for concurrent use.
+//
+// When a write fails the connection is closed and re-dialed, waiting
+// InitialBackoff before the first attempt and doubling the wait for every
+// following attempt up to MaxBackoff. After a partial write, sending resumes
+// from the first line (or pickle batch) that wasn't completely written.
+// Carbon discards incomplete lines of closed connections, so a line is never
+// glued together from two writes.
+type CarbonWriter struct {
+	Address  string
+	Protocol CarbonProtocol
+
+	// Timeout for dialing and for every write. Zero means no timeout.
+	Timeout time.Duration
+
+	// Prepended to every metric path, separated by exactly one dot. Ie.
+	// "prod.myservice".
+	Prefix string
+
+	// Sanitize every segment of metric paths (including Prefix) using
+	// SanitizeMetricSegment before writing them.
+	Sanitize bool
+
+	// Number of times to reconnect and retry within a single Send/SendMany.
+	// Zero means failing immediately.
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	mu            sync.Mutex
+	conn          net.Conn
+	everConnected bool
+
+	// The current connection and whether writes fail until Close, for
+	// interrupt, which can't wait for mu.
+	active      atomic.Pointer[net.Conn]
+	interrupted atomic.Bool
+
+	state      atomic.Int32
+	reconnects atomic.Uint64
+
+	// Overridable for testing.
+	dial  func(network, address string, timeout time.Duration) (net.Conn, error)
+	sleep func(time.Duration)
+}
+
+// Create a new CarbonWriter writing to address, ie. "localhost:2003".
+// Connection is established lazily on first write. The writer retries up to
+// three times, backing off from 100 milliseconds up to 5 seconds.
+func NewCarbonWriter(address string, protocol CarbonProtocol) *CarbonWriter {
+	return &CarbonWriter{
+		Address:        address,
+		Protocol:       protocol,
+		MaxRetries:     3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		dial:           net.DialTimeout,
+		sleep:          time.Sleep,
+	}
+}
+
+// The current state of the underlying connection.
+func (w *CarbonWriter) State() CarbonConnState {
+	return CarbonConnState(w.state.Load())
+}
+
+// Number of times a lost connection has been re-established.
+func (w *CarbonWriter) Reconnects() uint64 {
+	return w.reconnects.Load()
+}
+
+// Write a single metric to Carbon.
+func (w *CarbonWriter) Send(path string, value float64, t time.Time) error {
+	return w.SendMany([]Metric{{Path: path, Value: value, Time: t}})
+}
+
+// Write a single tagged metric to Carbon, ie. "disk.used;dc=dc1;host=web01".
+// Tags are validated using ValidateTag.
+func (w *CarbonWriter) SendTagged(path string, tags map[string]string, value float64, t time.Time) error {
+	return w.SendMany([]Metric{{Path: path, Value: value, Time: t, Tags: tags}})
+}
+
+// Write multiple metrics to Carbon. With PickleProtocol all metrics are
+// written as a single batch.
+func (w *CarbonWriter) SendMany(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	records, err := w.encode(metrics)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	backoff := w.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		var err error
+		records, err = w.write(records)
+		if err == nil {
+			return nil
+		}
+		if attempt >= w.MaxRetries || w.interrupted.Load() {
+			return err
+		}
+
+		w.state.Store(int32(CarbonReconnecting))
+		sleep := w.sleep
+		if sleep == nil {
+			sleep = time.Sleep
+		}
+		sleep(backoff)
+		backoff *= 2
+		if w.MaxBackoff > 0 && backoff > w.MaxBackoff {
+			backoff = w.MaxBackoff
+		}
+	}
+}
+
+// Write datapoints to Carbon under path, using the time of every datapoint as
+// its timestamp. Datapoints without a value are skipped.
+func (w *CarbonWriter) SendFloatDatapoints(path string, points []FloatDatapoint) error {
+	metrics := make([]Metric, 0, len(points))
+	for _, point := range points {
+		if point.Value != nil {
+			metrics = append(metrics, Metric{Path: path, Value: *point.Value, Time: point.Time})
+		}
+	}
+	return w.SendMany(metrics)
+}
+
+// Write datapoints to Carbon under path, using the time of every datapoint as
+// its timestamp. Datapoints without a value are skipped.
+func (w *CarbonWriter) SendIntDatapoints(path string, points []IntDatapoint) error {
+	metrics := make([]Metric, 0, len(points))
+	for _, point := range points {
+		if point.Value != nil {
+			metrics = append(metrics, Metric{Path: path, Value: float64(*point.Value), Time: point.Time})
+		}
+	}
+	return w.SendMany(metrics)
+}
+
+// Close the underlying connection, if any. The CarbonWriter can still be used
+// afterwards, in which case a new connection is established.
+func (w *CarbonWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.everConnected = false
+	w.interrupted.Store(false)
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.disconnect()
+	return err
+}
+
+// Makes a write in progress fail, and every following write fail without
+// retrying, until Close is called. Doesn't wait for a dial in progress.
+func (w *CarbonWriter) interrupt() {
+	w.interrupted.Store(true)
+	if conn := w.active.Load(); conn != nil {
+		(*conn).SetDeadline(time.Now())
+	}
+}
+
+// Writes records, returning the ones that weren't completely written.
+func (w *CarbonWriter) write(records [][]byte) ([][]byte, error) {
+	if w.interrupted.Load() {
+		return records, errInterrupted
+	}
+	if err := w.connect(); err != nil {
+		return records, err
+	}
+
+	if w.Timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.Timeout))
+	}
+	// Checked again since the deadline might have replaced interrupt's.
+	if w.interrupted.Load() {
+		return records, errInterrupted
+	}
+	n, err := w.conn.Write(bytes.Join(records, nil))
+	if err == nil {
+		return nil, nil
+	}
+
+	for len(records) > 0 && n >= len(records[0]) {
+		n -= len(records[0])
+		records = records[1:]
+	}
+	w.conn.Close()
+	w.disconnect()
+	return records, err
+}
+
+func (w *CarbonWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+
+	dial := w.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	conn, err := dial("tcp", w.Address, w.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if w.everConnected {
+		w.reconnects.Add(1)
+	}
+	w.everConnected = true
+	w.conn = conn
+	w.active.Store(&conn)
+	w.state.Store(int32(CarbonConnected))
+	return nil
+}
+
+func (w *CarbonWriter) disconnect() {
+	w.conn = nil
+	w.active.Store(nil)
+	w.state.Store(int32(CarbonDisconnected))
+}
+
+// Encodes metrics into records that must each be written in full.
+func (w *CarbonWriter) encode(metrics []Metric) ([][]byte, error) {
+	rewritten := make([]Metric, len(metrics))
+	for i, m := range metrics {
+		m.Path = prefixMetricPath(w.Prefix, m.Path)
+		if w.Sanitize {
+			m.Path = sanitizeMetricPath(m.Path)
+		}
+		if len(m.Tags) > 0 {
+			tags := m.Tags
+			if w.Sanitize {
+				tags = sanitizeTags(tags)
+			}
+			var err error
+			if m.Path, err = taggedMetricPath(m.Path, tags); err != nil {
+				return nil, err
+			}
+		}
+		rewritten[i] = m
+	}
+	metrics = rewritten
+
+	if w.Protocol == PickleProtocol {
+		return [][]byte{pickleFrame(metrics)}, nil
+	}
+
+	records := make([][]byte, len(metrics))
+	for i, m := range metrics {
+		records[i] = []byte(plaintextLine(m))
+	}
+	return records, nil
+}
+
+func plaintextLine(m Metric) string {
+	return m.Path + " " + strconv.FormatFloat(m.Value, 'g', -1, 64) + " " + strconv.FormatInt(m.Time.Unix(), 10) + "\n"
+}
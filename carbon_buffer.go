@@ -0,0 +1,332 @@
+package infrastructure
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrWriterClosed = errors.New("Writer is closed.")
+
+var ErrCloseTimeout = errors.New("Timed out writing queued metrics on close.")
+
+// Decides which metrics are dropped when the queue of a BufferedCarbonWriter
+// is full.
+type OverflowPolicy int
+
+const (
+	// Discard the metrics being sent, keeping the queue intact.
+	DropNewest OverflowPolicy = iota
+	// Discard the oldest queued metrics to make room for the ones being sent.
+	DropOldest
+)
+
+type BufferOpts struct {
+	// How often queued metrics are written. Defaults to one second.
+	FlushInterval time.Duration
+
+	// Metrics are written as soon as this many are queued, and never more
+	// than this many in a single write. Defaults to 1000.
+	MaxBatchSize int
+
+	// Called with errors from background flushes, which would otherwise be
+	// lost. Optional.
+	OnError func(error)
+
+	// Maximum number of queued metrics. Zero means unbounded.
+	MaxQueueSize int
+
+	// What to drop when MaxQueueSize is reached.
+	Overflow OverflowPolicy
+
+	// How long Send may wait for a flush to make room in a full queue before
+	// the Overflow policy kicks in. Zero means never waiting.
+	EnqueueTimeout time.Duration
+
+	// How long Close may spend writing queued metrics. Defaults to 30
+	// seconds.
+	CloseTimeout time.Duration
+}
+
+// Counters of a BufferedCarbonWriter. Every accepted metric is eventually
+// counted as either sent, dropped or failed, unless it's still queued.
+type BufferStats struct {
+	// Metrics passed to Send/SendMany before Close.
+	Accepted uint64
+	// Metrics successfully written to Carbon.
+	Sent uint64
+	// Metrics discarded due to a full queue, including failed metrics that
+	// didn't fit back into it.
+	Dropped uint64
+	// Metrics discarded since writing them failed while closing.
+	Failed uint64
+	// Metrics currently queued.
+	QueueDepth int
+}
+
+// Queues metrics in memory and writes them to Carbon in batches from a
+// background goroutine. Send never waits for the network. BufferedCarbonWriter
+// is safe for concurrent use.
+type BufferedCarbonWriter struct {
+	writer *CarbonWriter
+	opts   BufferOpts
+
+	mu     sync.Mutex
+	queue  []Metric
+	closed bool
+
+	// Closed and replaced every time the queue is emptied.
+	drained chan struct{}
+
+	accepted atomic.Uint64
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+
+	// Makes sure batches are written in the order they were queued.
+	flushMu sync.Mutex
+
+	full chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Create a new BufferedCarbonWriter writing through w. The background
+// goroutine runs until Close is called.
+func NewBufferedCarbonWriter(w *CarbonWriter, opts BufferOpts) *BufferedCarbonWriter {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.MaxBatchSize <= 0 {
+		opts.MaxBatchSize = 1000
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = 30 * time.Second
+	}
+	b := &BufferedCarbonWriter{
+		writer:  w,
+		opts:    opts,
+		drained: make(chan struct{}),
+		full:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.loop()
+	return b
+}
+
+// Queue a single metric for writing.
+func (b *BufferedCarbonWriter) Send(path string, value float64, t time.Time) error {
+	return b.SendMany([]Metric{{Path: path, Value: value, Time: t}})
+}
+
+// Queue multiple metrics for writing. If the queue is full, this waits at most
+// EnqueueTimeout for room before dropping metrics according to the overflow
+// policy.
+func (b *BufferedCarbonWriter) SendMany(metrics []Metric) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrWriterClosed
+	}
+
+	if b.opts.MaxQueueSize > 0 && b.opts.EnqueueTimeout > 0 && len(b.queue)+len(metrics) > b.opts.MaxQueueSize {
+		timeout := time.NewTimer(b.opts.EnqueueTimeout)
+		defer timeout.Stop()
+
+		for timedOut := false; !timedOut && len(b.queue)+len(metrics) > b.opts.MaxQueueSize; {
+			drained := b.drained
+			b.mu.Unlock()
+
+			b.requestFlush()
+			select {
+			case <-drained:
+			case <-timeout.C:
+				timedOut = true
+			}
+
+			b.mu.Lock()
+			if b.closed {
+				b.mu.Unlock()
+				return ErrWriterClosed
+			}
+		}
+	}
+
+	b.enqueue(metrics)
+	full := len(b.queue) >= b.opts.MaxBatchSize
+	b.mu.Unlock()
+
+	if full {
+		b.requestFlush()
+	}
+	return nil
+}
+
+// The current counters.
+func (b *BufferedCarbonWriter) Stats() BufferStats {
+	b.mu.Lock()
+	depth := len(b.queue)
+	b.mu.Unlock()
+
+	return BufferStats{
+		Accepted:   b.accepted.Load(),
+		Sent:       b.sent.Load(),
+		Dropped:    b.dropped.Load(),
+		Failed:     b.failed.Load(),
+		QueueDepth: depth,
+	}
+}
+
+// Must be called with b.mu held.
+func (b *BufferedCarbonWriter) enqueue(metrics []Metric) {
+	b.accepted.Add(uint64(len(metrics)))
+
+	max := b.opts.MaxQueueSize
+	if max <= 0 || len(b.queue)+len(metrics) <= max {
+		b.queue = append(b.queue, metrics...)
+		return
+	}
+
+	switch b.opts.Overflow {
+	case DropOldest:
+		if len(metrics) > max {
+			b.dropped.Add(uint64(len(metrics) - max))
+			metrics = metrics[len(metrics)-max:]
+		}
+		evict := len(b.queue) + len(metrics) - max
+		b.dropped.Add(uint64(evict))
+		b.queue = append(b.queue[evict:], metrics...)
+	default:
+		room := max - len(b.queue)
+		if room < 0 {
+			room = 0
+		}
+		b.dropped.Add(uint64(len(metrics) - room))
+		b.queue = append(b.queue, metrics[:room]...)
+	}
+}
+
+func (b *BufferedCarbonWriter) requestFlush() {
+	select {
+	case b.full <- struct{}{}:
+	default:
+		// A flush is already pending.
+	}
+}
+
+// Write all queued metrics, blocking until done. Stops at the first write
+// error and returns it. The metrics that weren't written are put back first in
+// the queue, subject to MaxQueueSize and the Overflow policy, and retried on
+// the next flush. Metrics might be written twice if a write fails midway.
+func (b *BufferedCarbonWriter) Flush() error {
+	return b.flush(false)
+}
+
+// Writes all queued metrics. The final flush of Close counts the metrics that
+// weren't written as failed, since nothing would retry them.
+func (b *BufferedCarbonWriter) flush(final bool) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	queue := b.queue
+	b.queue = nil
+	close(b.drained)
+	b.drained = make(chan struct{})
+	b.mu.Unlock()
+
+	for len(queue) > 0 {
+		n := b.opts.MaxBatchSize
+		if n > len(queue) {
+			n = len(queue)
+		}
+		if err := b.writer.SendMany(queue[:n]); err != nil {
+			if final {
+				b.failed.Add(uint64(len(queue)))
+			} else {
+				b.requeue(queue)
+			}
+			return err
+		}
+		b.sent.Add(uint64(n))
+		queue = queue[n:]
+	}
+	return nil
+}
+
+// Puts metrics back in front of the queue.
+func (b *BufferedCarbonWriter) requeue(metrics []Metric) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if max := b.opts.MaxQueueSize; max > 0 && len(b.queue)+len(metrics) > max {
+		room := max - len(b.queue)
+		if room < 0 {
+			room = 0
+		}
+		b.dropped.Add(uint64(len(metrics) - room))
+		if b.opts.Overflow == DropOldest {
+			metrics = metrics[len(metrics)-room:]
+		} else {
+			metrics = metrics[:room]
+		}
+	}
+	b.queue = append(metrics[:len(metrics):len(metrics)], b.queue...)
+}
+
+// Stop the background goroutine, write everything still queued and close the
+// underlying CarbonWriter. Subsequent sends return ErrWriterClosed. Metrics
+// that can't be written are counted as failed. If writing takes longer than
+// CloseTimeout, the write in progress is interrupted and ErrCloseTimeout is
+// returned without waiting for it.
+func (b *BufferedCarbonWriter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrWriterClosed
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done)
+	closed := make(chan error, 1)
+	go func() {
+		b.wg.Wait()
+		err := b.flush(true)
+		if closeErr := b.writer.Close(); err == nil {
+			err = closeErr
+		}
+		closed <- err
+	}()
+
+	timeout := time.NewTimer(b.opts.CloseTimeout)
+	defer timeout.Stop()
+	select {
+	case err := <-closed:
+		return err
+	case <-timeout.C:
+		b.writer.interrupt()
+		return ErrCloseTimeout
+	}
+}
+
+func (b *BufferedCarbonWriter) loop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.full:
+		}
+		if err := b.Flush(); err != nil && b.opts.OnError != nil {
+			b.opts.OnError(err)
+		}
+	}
+}
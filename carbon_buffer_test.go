@@ -0,0 +1,295 @@
+package infrastructure
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a CarbonWriter whose connection is one end of an in-memory pipe.
+// Writes block until the returned end is read from, simulating a stalled
+// network.
+func newPipeCarbonWriter() (*CarbonWriter, net.Conn) {
+	client, server := net.Pipe()
+	w := NewCarbonWriter("pipe", PlaintextProtocol)
+	w.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return client, nil
+	}
+	return w, server
+}
+
+func TestBufferedCarbonWriterFlushesTailOnClose(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	b := NewBufferedCarbonWriter(NewCarbonWriter(l.Addr().String(), PlaintextProtocol), BufferOpts{
+		FlushInterval: time.Hour,
+		MaxBatchSize:  100,
+	})
+	for i := 0; i < 3; i++ {
+		if err := b.Send("a.b", float64(i), time.Unix(1409763000, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "a.b 0 1409763000\na.b 1 1409763000\na.b 2 1409763000\n"
+	if s := l.next(t); s != expected {
+		t.Errorf("Got: %q Expected: %q", s, expected)
+	}
+
+	if err := b.Send("a.b", 1, time.Now()); err != ErrWriterClosed {
+		t.Error("Expected ErrWriterClosed, got:", err)
+	}
+}
+
+func TestBufferedCarbonWriterFlushesFullBatch(t *testing.T) {
+	t.Parallel()
+
+	w, server := newPipeCarbonWriter()
+	b := NewBufferedCarbonWriter(w, BufferOpts{
+		FlushInterval: time.Hour,
+		MaxBatchSize:  2,
+	})
+	defer b.Close()
+
+	b.Send("a", 1, time.Unix(1, 0))
+	b.Send("b", 2, time.Unix(2, 0))
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(server)
+	for _, expected := range []string{"a 1 1\n", "b 2 2\n"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("Got: %q Expected: %q", line, expected)
+		}
+	}
+	go r.WriteTo(ioutil.Discard)
+}
+
+func TestBufferedCarbonWriterSendDoesNotBlockOnStalledNetwork(t *testing.T) {
+	t.Parallel()
+
+	w, server := newPipeCarbonWriter()
+	b := NewBufferedCarbonWriter(w, BufferOpts{
+		FlushInterval: time.Millisecond,
+		MaxBatchSize:  10,
+	})
+
+	// Nobody is reading from server, so the background flush is stuck.
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		if err := b.Send("a.b", float64(i), time.Unix(1409763000, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Send blocked for:", d)
+	}
+
+	received := make(chan int)
+	go func() {
+		lines := 0
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "a.b ") {
+				lines++
+			}
+		}
+		received <- lines
+	}()
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := <-received; lines != 1000 {
+		t.Error("Lost metrics. Received:", lines)
+	}
+}
+
+func TestBufferedCarbonWriterOverflow(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		expected []string
+	}{
+		{DropNewest, []string{"0", "1", "2", "3", "4"}},
+		{DropOldest, []string{"3", "4", "5", "6", "7"}},
+	} {
+		w, server := newPipeCarbonWriter()
+		b := NewBufferedCarbonWriter(w, BufferOpts{
+			FlushInterval: time.Hour,
+			MaxBatchSize:  100,
+			MaxQueueSize:  5,
+			Overflow:      test.policy,
+		})
+
+		for i := 0; i < 8; i++ {
+			b.Send("a", float64(i), time.Unix(1, 0))
+		}
+		stats := b.Stats()
+		if stats.Accepted != 8 || stats.Dropped != 3 || stats.QueueDepth != 5 || stats.Sent != 0 {
+			t.Errorf("Unexpected stats for policy %d: %+v", test.policy, stats)
+		}
+
+		received := make(chan []string)
+		go func() {
+			var values []string
+			scanner := bufio.NewScanner(server)
+			for scanner.Scan() {
+				values = append(values, strings.Fields(scanner.Text())[1])
+			}
+			received <- values
+		}()
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if values := <-received; strings.Join(values, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Unexpected values for policy %d: %v", test.policy, values)
+		}
+
+		stats = b.Stats()
+		if stats.Sent != 5 || stats.QueueDepth != 0 {
+			t.Errorf("Unexpected stats for policy %d after close: %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestBufferedCarbonWriterEnqueueTimeout(t *testing.T) {
+	t.Parallel()
+
+	w, server := newPipeCarbonWriter()
+	b := NewBufferedCarbonWriter(w, BufferOpts{
+		FlushInterval:  time.Hour,
+		MaxBatchSize:   100,
+		MaxQueueSize:   2,
+		EnqueueTimeout: 50 * time.Millisecond,
+	})
+
+	// The third send makes the stalled background flush pick up the first
+	// two metrics. Nothing drains the queue after that, so the last two sends
+	// time out and are dropped.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		b.Send("a", float64(i), time.Unix(1, 0))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Send blocked for:", d)
+	}
+	if stats := b.Stats(); stats.Dropped != 2 || stats.QueueDepth != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	go ioutil.ReadAll(server)
+	b.Close()
+	if stats := b.Stats(); stats.Accepted != stats.Sent+stats.Dropped+stats.Failed {
+		t.Errorf("Counters don't add up: %+v", stats)
+	}
+}
+
+func TestBufferedCarbonWriterRequeuesFailedBatch(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		expected string
+	}{
+		{DropNewest, "0,1,3"},
+		{DropOldest, "1,2,3"},
+	} {
+		client, server := net.Pipe()
+		var b *BufferedCarbonWriter
+		down := true
+		w := NewCarbonWriter("pipe", PlaintextProtocol)
+		w.MaxRetries = 0
+		w.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+			if down {
+				// Queued while the failing batch is being written.
+				b.Send("a", 3, time.Unix(1, 0))
+				return nil, errors.New("Connection refused.")
+			}
+			return client, nil
+		}
+		b = NewBufferedCarbonWriter(w, BufferOpts{
+			FlushInterval: time.Hour,
+			MaxBatchSize:  2,
+			MaxQueueSize:  3,
+			Overflow:      test.policy,
+		})
+
+		for i := 0; i < 3; i++ {
+			b.Send("a", float64(i), time.Unix(1, 0))
+		}
+		// The failed metrics are put back ahead of the newer one, and the one
+		// not fitting is dropped.
+		if err := b.Flush(); err == nil {
+			t.Fatal("Expected an error.")
+		}
+		if stats := b.Stats(); stats.Dropped != 1 || stats.Failed != 0 || stats.QueueDepth != 3 {
+			t.Errorf("Unexpected stats for policy %d: %+v", test.policy, stats)
+		}
+
+		down = false
+		received := make(chan []string)
+		go func() {
+			var values []string
+			scanner := bufio.NewScanner(server)
+			for scanner.Scan() {
+				values = append(values, strings.Fields(scanner.Text())[1])
+			}
+			received <- values
+		}()
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if values := strings.Join(<-received, ","); values != test.expected {
+			t.Errorf("Unexpected values for policy %d: %v", test.policy, values)
+		}
+		if stats := b.Stats(); stats.Sent != 3 || stats.QueueDepth != 0 {
+			t.Errorf("Unexpected stats for policy %d after close: %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestBufferedCarbonWriterCloseTimeout(t *testing.T) {
+	t.Parallel()
+
+	w, server := newPipeCarbonWriter()
+	defer server.Close()
+	b := NewBufferedCarbonWriter(w, BufferOpts{
+		FlushInterval: time.Hour,
+		CloseTimeout:  50 * time.Millisecond,
+	})
+	for i := 0; i < 3; i++ {
+		b.Send("a", float64(i), time.Unix(1, 0))
+	}
+
+	// Nobody is reading from server, and writes have no timeout.
+	start := time.Now()
+	if err := b.Close(); err != ErrCloseTimeout {
+		t.Error("Expected ErrCloseTimeout, got:", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("Close blocked for:", d)
+	}
+
+	// The interrupted write fails without being retried.
+	for deadline := time.Now().Add(5 * time.Second); b.Stats().Failed != 3; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Unexpected stats: %+v", b.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,270 @@
+package infrastructure
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fake Carbon daemon accepting one connection and capturing everything
+// written to it until the connection is closed.
+type carbonListener struct {
+	net.Listener
+	received chan []byte
+}
+
+func newCarbonListener(t *testing.T) *carbonListener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &carbonListener{l, make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(conn)
+				cl.received <- b
+			}()
+		}
+	}()
+	return cl
+}
+
+func (l *carbonListener) next(t *testing.T) string {
+	select {
+	case b := <-l.received:
+		return string(b)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for carbon data.")
+	}
+	return ""
+}
+
+func TestCarbonWriterPlaintext(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	if err := w.Send("a.b", 1.5, time.Unix(1409763000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SendMany([]Metric{{Path: "c", Value: 3, Time: time.Unix(1409763001, 0)}, {Path: "d", Value: 1e21, Time: time.Unix(1409763002, 0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "a.b 1.5 1409763000\nc 3 1409763001\nd 1e+21 1409763002\n"
+	if s := l.next(t); s != expected {
+		t.Errorf("Got: %q Expected: %q", s, expected)
+	}
+}
+
+func TestCarbonWriterPickle(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PickleProtocol)
+	if err := w.SendMany(pickleFixtures[2].metrics); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := l.next(t)
+	if len(s) < 4 || s[4:] != pickleFixtures[2].expected {
+		t.Errorf("Unexpected pickle frame: %q", s)
+	}
+}
+
+// A net.Conn accepting at most limit bytes before failing.
+type limitedConn struct {
+	net.Conn
+	limit   int
+	written bytes.Buffer
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if c.limit >= 0 && len(b) > c.limit {
+		c.written.Write(b[:c.limit])
+		n := c.limit
+		c.limit = 0
+		return n, errors.New("connection reset")
+	}
+	c.written.Write(b)
+	return len(b), nil
+}
+
+func (c *limitedConn) Close() error                       { return nil }
+func (c *limitedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestCarbonWriterResumesFromLineBoundary(t *testing.T) {
+	first := &limitedConn{limit: 20}
+	second := &limitedConn{limit: -1}
+	conns := []net.Conn{first, second}
+
+	var sleeps []time.Duration
+	w := NewCarbonWriter("fake", PlaintextProtocol)
+	w.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn := conns[0]
+		conns = conns[1:]
+		return conn, nil
+	}
+	w.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	err := w.SendMany([]Metric{
+		{Path: "first", Value: 1, Time: time.Unix(1409763000, 0)},
+		{Path: "second", Value: 2, Time: time.Unix(1409763000, 0)},
+		{Path: "third", Value: 3, Time: time.Unix(1409763000, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "first 1 1409763000\n" is 19 bytes, so a single byte of the second
+	// line made it through the first connection.
+	if s := first.written.String(); s != "first 1 1409763000\ns" {
+		t.Errorf("Unexpected first connection data: %q", s)
+	}
+	if s := second.written.String(); s != "second 2 1409763000\nthird 3 1409763000\n" {
+		t.Errorf("Unexpected second connection data: %q", s)
+	}
+	if n := w.Reconnects(); n != 1 {
+		t.Error("Unexpected reconnect count:", n)
+	}
+	if s := w.State(); s != CarbonConnected {
+		t.Error("Unexpected state:", s)
+	}
+	if len(sleeps) != 1 || sleeps[0] != w.InitialBackoff {
+		t.Error("Unexpected backoff:", sleeps)
+	}
+}
+
+func TestCarbonWriterBackoffIsCapped(t *testing.T) {
+	var sleeps []time.Duration
+	w := NewCarbonWriter("fake", PlaintextProtocol)
+	w.MaxRetries = 5
+	w.InitialBackoff = time.Second
+	w.MaxBackoff = 3 * time.Second
+	w.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	w.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	if err := w.Send("a", 1, time.Now()); err == nil {
+		t.Fatal("Expected error.")
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second, 3 * time.Second}
+	if fmt.Sprint(sleeps) != fmt.Sprint(expected) {
+		t.Error("Unexpected backoff:", sleeps)
+	}
+	if s := w.State(); s != CarbonReconnecting {
+		t.Error("Unexpected state:", s)
+	}
+}
+
+func TestCarbonWriterReconnectsAfterConnectionDrop(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string)
+	go func() {
+		// Read a bit of the first connection, then drop it mid-batch.
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 100))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+
+		conn, err = l.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	w.InitialBackoff = time.Millisecond
+	metrics := make([]Metric, 200000)
+	for i := range metrics {
+		metrics[i] = Metric{Path: "some.metric", Value: float64(i), Time: time.Unix(1409763000, 0)}
+	}
+	if err := w.SendMany(metrics); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	var s string
+	select {
+	case s = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for carbon data.")
+	}
+
+	if w.Reconnects() != 1 {
+		t.Error("Unexpected reconnect count:", w.Reconnects())
+	}
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "some.metric ") || !strings.HasSuffix(line, " 1409763000") {
+			t.Fatalf("Corrupt line: %q", line)
+		}
+	}
+	if last := lines[len(lines)-1]; last != "some.metric 199999 1409763000" {
+		t.Errorf("Unexpected last line: %q", last)
+	}
+}
+
+func TestCarbonWriterSendDatapoints(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	err := w.SendFloatDatapoints("floats", []FloatDatapoint{
+		{time.Unix(1409763000, 0), makeFloat64Pointer(1.5)},
+		{time.Unix(1409763060, 0), nil},
+		{time.Unix(1409763120, 0), makeFloat64Pointer(-2)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SendIntDatapoints("ints", []IntDatapoint{
+		{time.Unix(1409763000, 0), nil},
+		{time.Unix(1409763060, 0), makeInt64Pointer(741)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	expected := "floats 1.5 1409763000\nfloats -2 1409763120\nints 741 1409763060\n"
+	if s := l.next(t); s != expected {
+		t.Errorf("Got: %q Expected: %q", s, expected)
+	}
+}
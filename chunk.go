@@ -0,0 +1,136 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Like QueryFloats, but splits interval into sub-intervals of length chunk,
+// queried one at a time. Useful for long intervals that make Graphite time
+// out or hit its fetch limits. See QueryMultiChunked.
+func (g *Client) QueryChunked(ctx context.Context, q string, interval TimeInterval, chunk time.Duration, opts ...QueryOption) ([]FloatDatapoint, error) {
+	series, err := g.QueryMultiChunked(ctx, []string{q}, interval, chunk, opts...)
+	return parseSingleGraphiteResponse(series, err, g.requireDatapoints(opts)).AsFloats()
+}
+
+// Like QueryMulti, but splits interval into sub-intervals of length chunk,
+// queried one at a time. The datapoints of every target are concatenated, with
+// a datapoint on the boundary of two chunks only included once. Targets are
+// ordered by first appearance. If a chunk fails, the error names its
+// sub-interval.
+func (g *Client) QueryMultiChunked(ctx context.Context, q []string, interval TimeInterval, chunk time.Duration, opts ...QueryOption) (MultiDatapoints, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+	if chunk <= 0 {
+		return nil, errors.New("Chunk is expected to be positive.")
+	}
+	opts = append(opts[:len(opts):len(opts)], WithContext(ctx))
+
+	var targets []string
+	builders := make(map[string]*datapointsBuilder)
+	lasts := make(map[string]int64)
+
+	for _, sub := range interval.Split(chunk) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		series, err := g.QueryMulti(q, sub, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query %s to %s: %w", sub.From.Format(time.RFC3339), sub.To.Format(time.RFC3339), err)
+		}
+
+		for _, s := range series {
+			b, seen := builders[s.Target]
+			if !seen {
+				b = &datapointsBuilder{}
+				builders[s.Target] = b
+				targets = append(targets, s.Target)
+			}
+			last, hasLast := lasts[s.Target]
+			err := scanDatapoints(s.points, func(value []byte, t time.Time) error {
+				if unix := t.Unix(); !hasLast || unix > last {
+					b.add(value, unix)
+					last, hasLast = unix, true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if hasLast {
+				lasts[s.Target] = last
+			}
+		}
+	}
+
+	res := make(MultiDatapoints, len(targets))
+	for i, target := range targets {
+		res[i] = builders[target].datapoints(target)
+	}
+	return res, nil
+}
+
+// Like QueryChunked, but streams the datapoints, including nulls, rather than
+// keeping them all in memory. Datapoints are delivered in strictly increasing
+// time order, with a datapoint on the boundary of two chunks only delivered
+// once. Sending blocks until the datapoint is received, so a slow reader
+// slows down the export.
+//
+// The datapoints channel is closed once the export is done. The error
+// channel then receives the error that stopped the export, if any, and is
+// closed. Cancelling ctx stops the export, even while blocked on sending.
+func (g *Client) Export(ctx context.Context, q string, interval TimeInterval, chunk time.Duration, opts ...QueryOption) (<-chan FloatDatapoint, <-chan error) {
+	points := make(chan FloatDatapoint)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		err := g.export(ctx, q, interval, chunk, opts, points)
+		close(points)
+		if err != nil {
+			errs <- err
+		}
+	}()
+	return points, errs
+}
+
+func (g *Client) export(ctx context.Context, q string, interval TimeInterval, chunk time.Duration, opts []QueryOption, out chan<- FloatDatapoint) error {
+	if err := interval.Check(); err != nil {
+		return err
+	}
+	if chunk <= 0 {
+		return errors.New("Chunk is expected to be positive.")
+	}
+	opts = append(opts[:len(opts):len(opts)], WithContext(ctx))
+
+	var last time.Time
+	for _, sub := range interval.Split(chunk) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		points, err := g.QueryFloats(q, sub, opts...)
+		if err != nil {
+			return fmt.Errorf("Unable to query %s to %s: %w", sub.From.Format(time.RFC3339), sub.To.Format(time.RFC3339), err)
+		}
+		if !isSortedPoints(points) {
+			sortPoints(points)
+		}
+
+		for _, point := range points {
+			if !last.IsZero() && !point.Time.After(last) {
+				continue
+			}
+			select {
+			case out <- point:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			last = point.Time
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryChunked(t *testing.T) {
+	t.Parallel()
+
+	ts := newMinutelyRenderServer(t)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2014, time.September, 3, 10, 0, 0, 0, time.UTC)
+	interval := TimeInterval{from, from.Add(150 * time.Minute)}
+	points, err := c.QueryChunked(context.Background(), "a.b", interval, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No duplicate nor missing timestamps on the chunk boundaries.
+	if len(points) != 151 {
+		t.Fatal("Unexpected number of points:", len(points))
+	}
+	for i, point := range points {
+		if expected := from.Add(time.Duration(i) * time.Minute); !point.Time.Equal(expected) {
+			t.Fatal("Unexpected time:", i, point.Time)
+		}
+	}
+
+	multi, err := c.QueryMultiChunked(context.Background(), []string{"a.b", "c.d"}, interval, 45*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := multi.Targets(); len(targets) != 2 || targets[0] != "a.b" || targets[1] != "c.d" {
+		t.Error("Unexpected targets:", targets)
+	}
+	// Ints stay ints.
+	ints, err := multi[1].AsInts(StrictInts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 151 || ints[1].Value == nil || *ints[1].Value != from.Unix()+60 {
+		t.Error("Unexpected points:", len(ints))
+	}
+}
+
+func TestQueryChunkedFailure(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"target": "a.b", "datapoints": []}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2014, time.September, 3, 10, 0, 0, 0, time.UTC)
+	interval := TimeInterval{from, from.Add(3 * time.Hour)}
+	_, err = c.QueryChunked(context.Background(), "a.b", interval, time.Hour)
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !strings.Contains(err.Error(), "2014-09-03T11:00:00Z to 2014-09-03T12:00:00Z") {
+		t.Error("Sub-interval not named:", err)
+	}
+	if requests != 2 {
+		t.Error("Expected to abort after failure:", requests)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.QueryChunked(ctx, "a.b", interval, time.Hour); err != context.Canceled {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.QueryChunked(context.Background(), "a.b", interval, 0); err == nil {
+		t.Error("Expected error for non-positive chunk.")
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	ts := newMinutelyRenderServer(t)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2014, time.September, 3, 10, 0, 0, 0, time.UTC)
+	interval := TimeInterval{from, from.Add(10 * time.Hour)}
+	points, errs := c.Export(context.Background(), "a.b", interval, 45*time.Minute)
+
+	n := 0
+	var last time.Time
+	for point := range points {
+		if n > 0 && !point.Time.After(last) {
+			t.Fatal("Points not strictly increasing:", last, point.Time)
+		}
+		if expected := from.Add(time.Duration(n) * time.Minute); !point.Time.Equal(expected) {
+			t.Fatal("Unexpected time:", n, point.Time)
+		}
+		if (point.Value == nil) != (point.Time.Unix()/60%10 == 0) {
+			t.Error("Unexpected value:", point.Time, point.Value)
+		}
+		last = point.Time
+		n++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n != 601 {
+		t.Error("Unexpected number of points:", n)
+	}
+}
+
+func TestExportCancel(t *testing.T) {
+	t.Parallel()
+
+	ts := newMinutelyRenderServer(t)
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2014, time.September, 3, 10, 0, 0, 0, time.UTC)
+	interval := TimeInterval{from, from.Add(10 * time.Hour)}
+	ctx, cancel := context.WithCancel(context.Background())
+	points, errs := c.Export(ctx, "a.b", interval, time.Hour)
+
+	// Blocked on sending until received.
+	<-points
+	cancel()
+	for range points {
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Error("Unexpected error:", err)
+	}
+
+	points, errs = c.Export(context.Background(), "a.b", interval, 0)
+	if _, ok := <-points; ok {
+		t.Error("Expected no points.")
+	}
+	if err := <-errs; err == nil {
+		t.Error("Expected error for non-positive chunk.")
+	}
+}
@@ -0,0 +1,200 @@
+package infrastructure
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot of the requests made by a Client. See Client.Stats.
+type ClientStats struct {
+	RenderRequests int64
+	FindRequests   int64
+
+	// Requests failing without a response, ie. on connection errors.
+	NetworkErrors int64
+	// Responses with a 4xx status.
+	ClientErrors int64
+	// Responses with a 5xx status.
+	ServerErrors int64
+	// Responses that couldn't be read or decoded, not counting cancelled
+	// requests.
+	DecodeErrors int64
+
+	// Time until response headers were received, in total and for the last
+	// request.
+	TotalLatency time.Duration
+	LastLatency  time.Duration
+
+	// Response body bytes read, before decompression.
+	BytesRead int64
+
+	// Requests retried according to Client.RetryPolicy. Every attempt is
+	// also counted as a request.
+	Retries int64
+
+	// Requests whose response body hasn't been closed yet.
+	InFlight int64
+}
+
+type clientStats struct {
+	renderRequests atomic.Int64
+	findRequests   atomic.Int64
+	networkErrors  atomic.Int64
+	clientErrors   atomic.Int64
+	serverErrors   atomic.Int64
+	decodeErrors   atomic.Int64
+	totalLatency   atomic.Int64
+	lastLatency    atomic.Int64
+	bytesRead      atomic.Int64
+	inFlight       atomic.Int64
+	retries        atomic.Int64
+}
+
+// A snapshot of the requests made so far. Always zero for Clients not created
+// using New, NewFromURL or Clone. Clones keep their own statistics.
+func (g *Client) Stats() ClientStats {
+	s := g.stats
+	if s == nil {
+		return ClientStats{}
+	}
+	return ClientStats{
+		RenderRequests: s.renderRequests.Load(),
+		FindRequests:   s.findRequests.Load(),
+		NetworkErrors:  s.networkErrors.Load(),
+		ClientErrors:   s.clientErrors.Load(),
+		ServerErrors:   s.serverErrors.Load(),
+		DecodeErrors:   s.decodeErrors.Load(),
+		TotalLatency:   time.Duration(s.totalLatency.Load()),
+		LastLatency:    time.Duration(s.lastLatency.Load()),
+		BytesRead:      s.bytesRead.Load(),
+		InFlight:       s.inFlight.Load(),
+		Retries:        s.retries.Load(),
+	}
+}
+
+func (s *clientStats) start() {
+	if s != nil {
+		s.inFlight.Add(1)
+	}
+}
+
+// Ends a request whose response won't be wrapped in a countingBody.
+func (s *clientStats) finish() {
+	if s != nil {
+		s.inFlight.Add(-1)
+	}
+}
+
+func (s *clientStats) retry() {
+	if s != nil {
+		s.retries.Add(1)
+	}
+}
+
+// Observes a request started using start. Unless err is set, the request is
+// in flight until its countingBody is closed.
+func (s *clientStats) observe(endpoint string, latency time.Duration, resp *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.inFlight.Add(-1)
+	}
+	switch endpoint {
+	case "/render":
+		s.renderRequests.Add(1)
+	case "/metrics/find":
+		s.findRequests.Add(1)
+	}
+	s.totalLatency.Add(int64(latency))
+	s.lastLatency.Store(int64(latency))
+
+	switch {
+	case err != nil:
+		s.networkErrors.Add(1)
+	case resp.StatusCode >= 500:
+		s.serverErrors.Add(1)
+	case resp.StatusCode >= 400:
+		s.clientErrors.Add(1)
+	}
+}
+
+// Counts err, if any, as a decode error unless ctx was cancelled.
+func (s *clientStats) observeDecode(ctx context.Context, err error) {
+	if s != nil && err != nil && ctx.Err() == nil {
+		s.decodeErrors.Add(1)
+	}
+}
+
+// Counts the bytes read from a response body.
+type countingBody struct {
+	io.ReadCloser
+	stats  *clientStats
+	closed atomic.Bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.stats.bytesRead.Add(int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.stats.inFlight.Add(-1)
+	}
+	return b.ReadCloser.Close()
+}
+
+// Publishes the statistics of the Client, see Stats, as an expvar.Map named
+// prefix, ie. visible at /debug/vars. The map is updated live. Publishing
+// another Client under the same prefix replaces the first one. Fails if
+// prefix is used by another kind of expvar.
+func (g *Client) PublishExpvar(prefix string) error {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	m, ok := expvar.Get(prefix).(*expvar.Map)
+	if !ok {
+		if expvar.Get(prefix) != nil {
+			return fmt.Errorf("Expvar %q already exists.", prefix)
+		}
+		m = expvar.NewMap(prefix)
+	}
+
+	for name, value := range map[string]func(s ClientStats) int64{
+		"requests":       func(s ClientStats) int64 { return s.RenderRequests + s.FindRequests },
+		"errors":         func(s ClientStats) int64 { return s.NetworkErrors + s.ClientErrors + s.ServerErrors + s.DecodeErrors },
+		"bytes":          func(s ClientStats) int64 { return s.BytesRead },
+		"in_flight":      func(s ClientStats) int64 { return s.InFlight },
+		"retries":        func(s ClientStats) int64 { return s.Retries },
+		"latency_ns":     func(s ClientStats) int64 { return int64(s.TotalLatency) },
+		"render":         func(s ClientStats) int64 { return s.RenderRequests },
+		"find":           func(s ClientStats) int64 { return s.FindRequests },
+		"network_errors": func(s ClientStats) int64 { return s.NetworkErrors },
+		"client_errors":  func(s ClientStats) int64 { return s.ClientErrors },
+		"server_errors":  func(s ClientStats) int64 { return s.ServerErrors },
+		"decode_errors":  func(s ClientStats) int64 { return s.DecodeErrors },
+	} {
+		m.Set(name, expvar.Func(func() interface{} { return value(g.Stats()) }))
+	}
+	m.Set("cache_hits", expvar.Func(func() interface{} { return g.cacheCount((*QueryCache).Hits) }))
+	m.Set("cache_misses", expvar.Func(func() interface{} { return g.cacheCount((*QueryCache).Misses) }))
+	return nil
+}
+
+// Serializes PublishExpvar's check-then-publish.
+var expvarLock sync.Mutex
+
+func (g *Client) cacheCount(count func(*QueryCache) int64) int64 {
+	if g.Cache == nil {
+		return 0
+	}
+	return count(g.Cache)
+}
@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"context"
+	"time"
+)
+
+type CopyOptions struct {
+	// Length of the interval queried from the source in a single request.
+	// Defaults to 24 hours.
+	ChunkSize time.Duration
+}
+
+type CopyStats struct {
+	// Number of distinct series written to the destination.
+	Series int
+	// Number of non-null datapoints written to the destination.
+	Points int
+}
+
+// Copy targets from one Graphite to another. Every series returned from src is
+// written to dst under its own target name, preserving timestamps and
+// skipping null values. Long intervals are queried in chunks of
+// opts.ChunkSize. Datapoints returned by two adjacent chunks are only written
+// once.
+func Copy(ctx context.Context, src *Client, dst *CarbonWriter, targets []string, interval TimeInterval, opts CopyOptions) (CopyStats, error) {
+	var stats CopyStats
+	if err := interval.Check(); err != nil {
+		return stats, err
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 24 * time.Hour
+	}
+
+	// Used to skip datapoints already written by the previous chunk.
+	lastWritten := make(map[string]time.Time)
+
+	for _, chunk := range interval.Split(opts.ChunkSize) {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		series, err := src.QueryMulti(targets, chunk, WithContext(ctx))
+		if err != nil {
+			return stats, err
+		}
+
+		for _, s := range series {
+			points, err := s.AsFloats()
+			if err != nil {
+				return stats, err
+			}
+
+			last, seen := lastWritten[s.Target]
+			if !seen {
+				stats.Series++
+			}
+			fresh := make([]FloatDatapoint, 0, len(points))
+			for _, point := range points {
+				if point.Value == nil || (seen && !point.Time.After(last)) {
+					continue
+				}
+				fresh = append(fresh, point)
+				last = point.Time
+			}
+			lastWritten[s.Target] = last
+
+			if err := dst.SendFloatDatapoints(s.Target, fresh); err != nil {
+				return stats, err
+			}
+			stats.Points += len(fresh)
+		}
+	}
+
+	return stats, nil
+}
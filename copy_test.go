@@ -0,0 +1,103 @@
+package infrastructure
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serves a minutely series per requested target, inclusive of both from and
+// until, which are taken to be in UTC. Every tenth point is null.
+func newMinutelyRenderServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, err := time.ParseInLocation("15:04_20060102", r.FormValue("from"), time.UTC)
+		if err != nil {
+			t.Error(err)
+		}
+		until, err := time.ParseInLocation("15:04_20060102", r.FormValue("until"), time.UTC)
+		if err != nil {
+			t.Error(err)
+		}
+
+		var series []string
+		for _, target := range r.Form["target"] {
+			var points []string
+			for ts := from; !ts.After(until); ts = ts.Add(time.Minute) {
+				if ts.Unix()/60%10 == 0 {
+					points = append(points, fmt.Sprintf("[null, %d]", ts.Unix()))
+				} else {
+					points = append(points, fmt.Sprintf("[%d, %d]", ts.Unix(), ts.Unix()))
+				}
+			}
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [%s]}`, target, strings.Join(points, ",")))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+}
+
+func TestCopy(t *testing.T) {
+	t.Parallel()
+
+	ts := newMinutelyRenderServer(t)
+	defer ts.Close()
+	src, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newCarbonListener(t)
+	defer l.Close()
+	dst := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+
+	from := time.Date(2014, time.September, 3, 10, 0, 0, 0, time.UTC)
+	interval := TimeInterval{from, from.Add(3 * time.Hour)}
+	stats, err := Copy(context.Background(), src, dst, []string{"a.b", "c.d"}, interval, CopyOptions{ChunkSize: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+
+	// 181 minutes, inclusive, of which 19 are null.
+	if stats.Series != 2 || stats.Points != 2*(181-19) {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(l.next(t)))
+	lines := 0
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		value, _ := strconv.ParseFloat(fields[1], 64)
+		if strconv.FormatFloat(value, 'f', -1, 64) != fields[2] {
+			t.Error("Timestamp not preserved:", scanner.Text())
+		}
+		key := fields[0] + " " + fields[2]
+		if seen[key] {
+			t.Error("Duplicate datapoint:", key)
+		}
+		seen[key] = true
+		lines++
+	}
+	if lines != stats.Points {
+		t.Error("Unexpected number of lines:", lines)
+	}
+}
+
+func TestCopyCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	now := time.Now()
+	_, err := Copy(ctx, &Client{}, NewCarbonWriter("localhost:0", PlaintextProtocol), []string{"a"}, TimeInterval{now.Add(-time.Hour), now}, CopyOptions{})
+	if err != context.Canceled {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,66 @@
+package infrastructure
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const graphiteCSVTimeFormat = "2006-01-02 15:04:05"
+
+// Decodes a format=csv render response, ie. rows of
+//
+//	target,2006-01-02 15:04:05,value
+//
+// Rows are grouped by target, in the order each target first appears. An
+// empty value is a null. Datetimes are parsed in loc, or time.Local if nil.
+func decodeCSVResponse(r io.Reader, loc *time.Location) (MultiDatapoints, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.ReuseRecord = true
+
+	var order []string
+	builders := make(map[string]*datapointsBuilder)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return MultiDatapoints{}, err
+		}
+		target, datetime, value := record[0], record[1], record[2]
+
+		t, err := time.ParseInLocation(graphiteCSVTimeFormat, datetime, loc)
+		if err != nil {
+			return MultiDatapoints{}, fmt.Errorf("Unexpected Graphite response. Malformed datetime %q.", datetime)
+		}
+		var v []byte
+		if value != "" {
+			v = []byte(value)
+			if !isJSONNumber(v) {
+				return MultiDatapoints{}, errors.New("Value not a number.")
+			}
+		}
+
+		b, ok := builders[target]
+		if !ok {
+			b = &datapointsBuilder{}
+			builders[target] = b
+			order = append(order, target)
+		}
+		b.add(v, t.Unix())
+	}
+
+	datapoints := make(MultiDatapoints, 0, len(order))
+	for _, target := range order {
+		datapoints = append(datapoints, builders[target].datapoints(target))
+	}
+	return datapoints, nil
+}
@@ -0,0 +1,107 @@
+package infrastructure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// As returned by graphite-web for two targets, with rows interleaved the way
+// a merged response might be.
+const csvFixture = "a.b,2014-09-03 10:00:00,1.5\r\n" +
+	"\"c,d\",2014-09-03 10:00:00,7\r\n" +
+	"a.b,2014-09-03 10:01:00,\r\n" +
+	"\"c,d\",2014-09-03 10:01:00,\r\n" +
+	"a.b,2014-09-03 10:02:00,3.0\r\n"
+
+func TestDecodeCSVResponse(t *testing.T) {
+	t.Parallel()
+
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	response, err := decodeCSVResponse(strings.NewReader(csvFixture), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 || response[0].Target != "a.b" || response[1].Target != "c,d" {
+		t.Fatal("Unexpected response:", response)
+	}
+
+	floats, err := response[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(floats) != 3 {
+		t.Fatal("Unexpected number of points:", len(floats))
+	}
+	if *floats[0].Value != 1.5 || floats[1].Value != nil || *floats[2].Value != 3 {
+		t.Error("Unexpected values:", floats)
+	}
+	if expected := time.Date(2014, time.September, 3, 8, 1, 0, 0, time.UTC); !floats[1].Time.Equal(expected) {
+		t.Error("Unexpected time:", floats[1].Time)
+	}
+
+	ints, err := response[1].AsInts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 2 || *ints[0].Value != 7 || ints[1].Value != nil {
+		t.Error("Unexpected points:", ints)
+	}
+}
+
+func TestDecodeCSVResponseMalformed(t *testing.T) {
+	t.Parallel()
+
+	for _, body := range []string{
+		"a.b,2014-09-03 10:00:00\r\n",
+		"a.b,20140903 10:00,1\r\n",
+		"a.b,2014-09-03 10:00:00,None\r\n",
+		"a.b,2014-09-03 10:00:00,1\r\na.b\r\n",
+	} {
+		if _, err := decodeCSVResponse(strings.NewReader(body), nil); err == nil {
+			t.Errorf("Expected error for %q.", body)
+		}
+	}
+
+	if response, err := decodeCSVResponse(strings.NewReader(""), nil); err != nil || len(response) != 0 {
+		t.Error("Unexpected response for empty body:", response, err)
+	}
+}
+
+func TestQueryCSV(t *testing.T) {
+	t.Parallel()
+
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("format") != "csv" {
+			t.Error("Unexpected format:", r.FormValue("format"))
+		}
+		if r.FormValue("tz") != "UTC+2" {
+			t.Error("Unexpected tz:", r.FormValue("tz"))
+		}
+		if r.FormValue("from") != "10:00_20140903" {
+			t.Error("Unexpected from:", r.FormValue("from"))
+		}
+		w.Write([]byte(csvFixture))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2014, time.September, 3, 8, 0, 0, 0, time.UTC)
+	points, err := c.QueryMulti([]string{"a.b", "c,d"}, TimeInterval{from, from.Add(2 * time.Minute)}, WithFormat(FormatCSV), WithLocation(loc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	floats, err := points.AsMap()["a.b"].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(floats) != 3 || !floats[0].Time.Equal(from) {
+		t.Error("Unexpected points:", floats)
+	}
+}
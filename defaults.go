@@ -0,0 +1,30 @@
+package infrastructure
+
+import "errors"
+
+var errNoDefaultInterval = errors.New("No default interval. See WithDefaultLookback and WithDefaultInterval.")
+
+// Like Query and QuerySince, but for the Client's default interval. With
+// WithDefaultLookback, the lookback is relative to the time of the query.
+// With WithDefaultInterval, the same absolute interval is always queried.
+// Fails if the Client has no default interval.
+func (g *Client) QueryDefault(q string, opts ...QueryOption) Datapoints {
+	switch {
+	case g.defaultInterval != nil:
+		return g.Query(q, *g.defaultInterval, opts...)
+	case g.defaultLookback != 0:
+		return g.QuerySince(q, g.defaultLookback, opts...)
+	}
+	return Datapoints{err: errNoDefaultInterval}
+}
+
+// Like QueryDefault, but for multiple series. See QueryMulti.
+func (g *Client) QueryMultiDefault(q []string, opts ...QueryOption) (MultiDatapoints, error) {
+	switch {
+	case g.defaultInterval != nil:
+		return g.QueryMulti(q, *g.defaultInterval, opts...)
+	case g.defaultLookback != 0:
+		return g.QueryMultiSince(q, g.defaultLookback, opts...)
+	}
+	return nil, errNoDefaultInterval
+}
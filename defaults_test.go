@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQueryDefault(t *testing.T) {
+	t.Parallel()
+
+	forms := make(chan url.Values, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		forms <- r.Form
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+
+	interval := TimeInterval{time.Date(2014, 9, 3, 10, 0, 0, 0, time.Local), time.Date(2014, 9, 3, 11, 0, 0, 0, time.Local)}
+	for _, test := range []struct {
+		opts  []ClientOption
+		from  string
+		until string
+	}{
+		{[]ClientOption{WithDefaultLookback(15 * time.Minute)}, "-15minutes", ""},
+		{[]ClientOption{WithDefaultInterval(interval)}, "10:00_20140903", "11:00_20140903"},
+		// The last one wins.
+		{[]ClientOption{WithDefaultInterval(interval), WithDefaultLookback(time.Hour)}, "-1hours", ""},
+		{[]ClientOption{WithDefaultLookback(time.Hour), WithDefaultInterval(interval)}, "10:00_20140903", "11:00_20140903"},
+	} {
+		c, err := New(ts.URL, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if points, err := c.QueryDefault("a").AsInts(); err != nil || len(points) != 1 {
+			t.Error("Unexpected response:", points, err)
+		}
+		if _, err := c.QueryMultiDefault([]string{"a", "b"}); err != nil {
+			t.Error(err)
+		}
+		for i := 0; i < 2; i++ {
+			form := <-forms
+			if form.Get("from") != test.from || form.Get("until") != test.until {
+				t.Error("Unexpected interval:", form)
+			}
+		}
+
+		// Explicit intervals win.
+		c.QuerySince("a", 5*time.Minute)
+		if form := <-forms; form.Get("from") != "-5minutes" || form.Get("until") != "" {
+			t.Error("Unexpected interval:", form)
+		}
+		c.QueryMulti([]string{"a"}, TimeInterval{interval.From.Add(time.Hour), interval.To.Add(time.Hour)})
+		if form := <-forms; form.Get("from") != "11:00_20140903" || form.Get("until") != "12:00_20140903" {
+			t.Error("Unexpected interval:", form)
+		}
+	}
+}
+
+func TestQueryDefaultMissing(t *testing.T) {
+	t.Parallel()
+
+	c, err := New("http://localhost:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.QueryDefault("a").Err(); err != errNoDefaultInterval {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.QueryMultiDefault([]string{"a"}); err != errNoDefaultInterval {
+		t.Error("Unexpected error:", err)
+	}
+}
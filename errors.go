@@ -0,0 +1,266 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Returned for requests made after Client.Close.
+var ErrClientClosed = errors.New("Client is closed.")
+
+// Returned, wrapped in a *RedirectError, when Graphite redirects a request
+// made using NoRedirects.
+var ErrRedirect = errors.New("Unexpected redirect.")
+
+type RedirectError struct {
+	StatusCode int
+	// The URL redirected to.
+	Location string
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("Unexpected redirect with status %d to %s.", e.StatusCode, e.Location)
+}
+
+func (e *RedirectError) Unwrap() error {
+	return ErrRedirect
+}
+
+// Returned when a query expecting one series matches none.
+var ErrNoTargets = errors.New("Unexpected Graphite response. No targets were matched.")
+
+// Returned, wrapped in an *EmptySeriesError, when a query expecting one series
+// gets a series without datapoints. See WithEmptySeriesError.
+var ErrEmptySeries = errors.New("Empty series.")
+
+type EmptySeriesError struct {
+	Target string
+}
+
+func (e *EmptySeriesError) Error() string {
+	return fmt.Sprintf("Series %q has no datapoints.", e.Target)
+}
+
+func (e *EmptySeriesError) Unwrap() error {
+	return ErrEmptySeries
+}
+
+// Returned, wrapped in a *MissingTargetsError, when Graphite returns no
+// series for some targets. See WithRequireAllTargets.
+var ErrMissingTargets = errors.New("Missing targets.")
+
+type MissingTargetsError struct {
+	Targets []string
+}
+
+func (e *MissingTargetsError) Error() string {
+	return fmt.Sprintf("No series returned for %s.", strings.Join(e.Targets, ", "))
+}
+
+func (e *MissingTargetsError) Unwrap() error {
+	return ErrMissingTargets
+}
+
+// Returned, wrapped in a *ResponseTooLargeError, when a response exceeds
+// Client.MaxResponseBytes.
+var ErrResponseTooLarge = errors.New("Response too large.")
+
+type ResponseTooLargeError struct {
+	Limit   int64
+	Targets []string
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("Response for %s exceeded the limit of %d bytes.", strings.Join(e.Targets, ", "), e.Limit)
+}
+
+func (e *ResponseTooLargeError) Unwrap() error {
+	return ErrResponseTooLarge
+}
+
+// A response body failing with a *ResponseTooLargeError, rather than
+// silently truncating the body, when more than limit bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	targets   []string
+}
+
+func newLimitedBody(body io.ReadCloser, limit int64, targets []string) *limitedBody {
+	return &limitedBody{body, limit, limit, targets}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, &ResponseTooLargeError{b.limit, b.targets}
+	}
+	// Reading one byte past the limit to detect bodies exceeding it.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return 0, &ResponseTooLargeError{b.limit, b.targets}
+	}
+	return n, err
+}
+
+// Number of bytes of the response body kept by HTTPError.
+const httpErrorBodySize = 512
+
+// Number of bytes of an HTML or plain text error response scanned for an
+// error message. Django's debug pages put the exception far into the page.
+const httpErrorScanSize = 64 << 10
+
+// Maximum length of HTTPError.Message.
+const httpErrorMessageSize = 512
+
+// Returned when Graphite responds with a non-2xx status, or with an
+// unexpected content type.
+type HTTPError struct {
+	StatusCode  int
+	Status      string
+	ContentType string
+	// The beginning of the response body.
+	Body string
+	// The exception message, ie. "movingAverage requires 2 arguments", if
+	// one could be extracted from an HTML or plain text traceback.
+	Message   string
+	Targets   []string
+	RequestID string
+}
+
+func newHTTPError(resp *http.Response, targets []string, requestID string) *HTTPError {
+	e := &HTTPError{
+		StatusCode:  resp.StatusCode,
+		Status:      resp.Status,
+		ContentType: resp.Header.Get("Content-Type"),
+		Targets:     targets,
+		RequestID:   requestID,
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(e.ContentType)
+	isText := mediaType == "text/html" || mediaType == "text/plain"
+	limit := int64(httpErrorBodySize)
+	if isText {
+		limit = httpErrorScanSize
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+
+	e.Body = string(body[:min(len(body), httpErrorBodySize)])
+	if isText {
+		e.Message = extractErrorMessage(string(body))
+	}
+	return e
+}
+
+func (e *HTTPError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("Graphite responded %s for %s (request ID %s): %s", e.Status, strings.Join(e.Targets, ", "), e.RequestID, e.Message)
+	}
+	return fmt.Sprintf("Graphite responded %s (%s) for %s (request ID %s): %s", e.Status, e.ContentType, strings.Join(e.Targets, ", "), e.RequestID, e.Body)
+}
+
+// Returned when a request fails without a response, ie. on connection
+// errors.
+type RequestError struct {
+	RequestID string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("Request %s failed: %v", e.RequestID, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// Django's debug page.
+	djangoExceptionValue = regexp.MustCompile(`(?s)Exception Value:\s*</th>\s*<td>\s*<pre[^>]*>(.*?)</pre>`)
+	djangoExceptionPre   = regexp.MustCompile(`(?s)<pre class="exception_value">(.*?)</pre>`)
+
+	htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// Best-effort extraction of the exception message of an HTML or plain text
+// error page. Empty if none was found.
+func extractErrorMessage(body string) string {
+	var message string
+	if m := djangoExceptionValue.FindStringSubmatch(body); m != nil {
+		message = m[1]
+	} else if m := djangoExceptionPre.FindStringSubmatch(body); m != nil {
+		message = m[1]
+	} else {
+		message = tracebackMessage(html.UnescapeString(htmlTag.ReplaceAllString(body, "")))
+	}
+
+	message = strings.TrimSpace(html.UnescapeString(htmlTag.ReplaceAllString(message, "")))
+	if len(message) > httpErrorMessageSize {
+		message = message[:httpErrorMessageSize] + "..."
+	}
+	return message
+}
+
+// The last line of a Python traceback, ie. "ValueError: message". Frames are
+// indented, so it's the first unindented line after the header.
+func tracebackMessage(text string) string {
+	i := strings.LastIndex(text, "Traceback (most recent call last):")
+	if i < 0 {
+		return ""
+	}
+	lines := strings.Split(text[i:], "\n")
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			return line
+		}
+	}
+	return ""
+}
+
+// Returned by AsInts with StrictInts when a value isn't an exact integer.
+// Callers might want to fall back to AsFloats.
+type NotIntegerError struct {
+	Target string
+	Time   time.Time
+	// The value as returned by Graphite.
+	Value string
+}
+
+func (e *NotIntegerError) Error() string {
+	return fmt.Sprintf("Value %s of %q at %s is not an integer.", e.Value, e.Target, e.Time.Format(time.RFC3339))
+}
+
+// Returned, wrapped in a *ValueOverflowError, when a value doesn't fit in the
+// requested type.
+var ErrValueOverflow = errors.New("Value overflow.")
+
+// Returned by AsInts for values out of range for an int64, or floats that
+// have lost so much precision that their integral part is off. Returned by
+// AsFloats for values out of range for a float64.
+type ValueOverflowError struct {
+	Target string
+	Time   time.Time
+	// The value as returned by Graphite.
+	Value string
+}
+
+func (e *ValueOverflowError) Error() string {
+	return fmt.Sprintf("Value %s of %q at %s can't be represented.", e.Value, e.Target, e.Time.Format(time.RFC3339))
+}
+
+func (e *ValueOverflowError) Unwrap() error {
+	return ErrValueOverflow
+}
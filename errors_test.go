@@ -0,0 +1,71 @@
+package infrastructure
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		fixture     string
+		contentType string
+		expected    string
+	}{
+		{"testdata/traceback_django.html", "text/html; charset=utf-8", "movingAverage() takes at least 2 arguments (1 given)"},
+		{"testdata/traceback_pre.html", "text/html", `InputParameterError: Invalid parameters for function "movingAverage"`},
+		{"testdata/traceback_pre.html", "application/octet-stream", ""},
+	} {
+		body, err := ioutil.ReadFile(test.fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(body)
+		}))
+		c, err := New(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.QueryMultiSince([]string{"movingAverage(a.b)"}, time.Hour)
+		ts.Close()
+
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatal("Unexpected error:", err)
+		}
+		if httpErr.Message != test.expected {
+			t.Errorf("%s: unexpected message: %q", test.fixture, httpErr.Message)
+		}
+		if len(httpErr.Body) != httpErrorBodySize || !strings.HasPrefix(string(body), httpErr.Body) {
+			t.Errorf("%s: unexpected body: %q", test.fixture, httpErr.Body)
+		}
+		if test.expected != "" && !strings.Contains(err.Error(), test.expected) {
+			t.Error("Message not in error:", err)
+		}
+	}
+}
+
+func TestExtractErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	text := "Traceback (most recent call last):\n  File \"x.py\", line 1, in <module>\n    f()\nValueError: bad input\n"
+	if m := extractErrorMessage(text); m != "ValueError: bad input" {
+		t.Error("Unexpected message:", m)
+	}
+	if m := extractErrorMessage("<html><body>Nothing to see here.</body></html>"); m != "" {
+		t.Error("Unexpected message:", m)
+	}
+	if m := extractErrorMessage("<pre class=\"exception_value\">" + strings.Repeat("x", 1000) + "</pre>"); len(m) != httpErrorMessageSize+len("...") {
+		t.Error("Expected truncated message:", len(m))
+	}
+}
@@ -0,0 +1,169 @@
+package infrastructure
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// The value types As can convert datapoints to.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// A datapoint with a value of type T. A nil Value means null.
+type Datapoint[T Number] struct {
+	Time  time.Time
+	Value *T
+}
+
+// Converts the datapoints of d to values of type T. For integer types, float
+// values are truncated towards zero just like AsInts, unless StrictInts is
+// given. Values that don't fit in T, ie. 300 for an int8 or a negative value
+// for an unsigned type, fail with a *ValueOverflowError. Integer types can at
+// most hold values within the range of an int64. Float values are rounded to
+// the nearest float32 for float32.
+func As[T Number](d Datapoints, opts ...ConvertOption) ([]Datapoint[T], error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	o := newConvertOptions(opts)
+	points := []Datapoint[T]{}
+	if len(d.points) > 0 {
+		var err error
+		if points, err = parsePoints[T](d.points, o.strictInts); err != nil {
+			return nil, d.withTarget(err)
+		}
+	}
+
+	if o.sortDedup {
+		if !isSortedPoints(points) {
+			sortPoints(points)
+		}
+		return dedupPoints(points, o.dedupPolicy), nil
+	}
+	return points, nil
+}
+
+// A datapoint with a value of type T, like Datapoint, but with null
+// represented by Valid being false rather than by a nil pointer. Converting to
+// Points only allocates the slice itself.
+type Point[T Number] struct {
+	Time time.Time
+	// Zero if not Valid.
+	Value T
+	Valid bool
+}
+
+// Like As, but to Points. Valid is false exactly where As gives a nil Value.
+func AsPoints[T Number](d Datapoints, opts ...ConvertOption) ([]Point[T], error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	o := newConvertOptions(opts)
+	if o.sortDedup {
+		// Rare enough to not warrant sorting and deduplicating Points too.
+		datapoints, err := As[T](d, opts...)
+		if err != nil {
+			return nil, err
+		}
+		points := make([]Point[T], len(datapoints))
+		for i, datapoint := range datapoints {
+			points[i].Time = datapoint.Time
+			if datapoint.Value != nil {
+				points[i].Value, points[i].Valid = *datapoint.Value, true
+			}
+		}
+		return points, nil
+	}
+
+	points := make([]Point[T], 0, countDatapoints(d.points))
+	if len(d.points) == 0 {
+		return points, nil
+	}
+	err := scanDatapoints(d.points, func(value []byte, t time.Time) error {
+		point := Point[T]{Time: t}
+		if value != nil {
+			v, err := parseValue[T](value, t, o.strictInts)
+			if err != nil {
+				return err
+			}
+			point.Value, point.Valid = v, true
+		}
+		points = append(points, point)
+		return nil
+	})
+	if err != nil {
+		return nil, d.withTarget(err)
+	}
+	return points, nil
+}
+
+// Parses a datapoints array. See As for semantics.
+func parsePoints[T Number](data []byte, strict bool) ([]Datapoint[T], error) {
+	n := countDatapoints(data)
+	points := make([]Datapoint[T], 0, n)
+
+	// Values point into a single backing array instead of being allocated one
+	// by one.
+	values := make([]T, 0, n)
+
+	err := scanDatapoints(data, func(value []byte, t time.Time) error {
+		point := Datapoint[T]{Time: t}
+		if value != nil {
+			v, err := parseValue[T](value, t, strict)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+			point.Value = &values[len(values)-1]
+		}
+		points = append(points, point)
+		return nil
+	})
+	return points, err
+}
+
+func parseValue[T Number](value []byte, t time.Time, strict bool) (T, error) {
+	// Integer division truncates.
+	isFloat := T(1)/2 != 0
+
+	if isFloat {
+		f, err := parseFloatValue(value, t)
+		if err != nil {
+			return 0, err
+		}
+		v := T(f)
+		if math.IsInf(float64(v), 0) {
+			// Only float32 can end up here.
+			return 0, &ValueOverflowError{Time: t, Value: string(value)}
+		}
+		return v, nil
+	}
+
+	i, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		f, err := parseFloatValue(value, t)
+		if err != nil {
+			return 0, err
+		}
+		// From 2^53, a float can't tell whether the value was an exact
+		// integer.
+		if strict && (f != math.Trunc(f) || math.Abs(f) >= 1<<53) {
+			return 0, &NotIntegerError{Time: t, Value: string(value)}
+		}
+		var ok bool
+		if i, ok = truncateFloatValue(value, f); !ok {
+			return 0, &ValueOverflowError{Time: t, Value: string(value)}
+		}
+	}
+
+	v := T(i)
+	if int64(v) != i || (v < 0) != (i < 0) {
+		return 0, &ValueOverflowError{Time: t, Value: string(value)}
+	}
+	return v, nil
+}
@@ -0,0 +1,195 @@
+package infrastructure
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestAs(t *testing.T) {
+	t.Parallel()
+
+	d := Datapoints{Target: "a", points: []byte("[[1.9, 1409763000], [null, 1409763060], [-3, 1409763120]]")}
+
+	ints, err := As[int](d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncated just like AsInts.
+	if len(ints) != 3 || *ints[0].Value != 1 || ints[1].Value != nil || *ints[2].Value != -3 {
+		t.Error("Unexpected points:", ints)
+	}
+	if ints[2].Time.Unix() != 1409763120 {
+		t.Error("Unexpected time:", ints[2].Time)
+	}
+
+	floats, err := As[float32](d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *floats[0].Value != float32(1.9) || *floats[2].Value != -3 {
+		t.Error("Unexpected points:", floats)
+	}
+
+	if _, err := As[int](d, StrictInts()); err == nil {
+		t.Error("Expected error in strict mode.")
+	}
+
+	// Named types work too.
+	type bytes uint32
+	if _, err := As[bytes](Datapoints{Target: "a", points: []byte("[[7, 1409763000]]")}); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestAsPoints(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		points string
+		opts   []ConvertOption
+	}{
+		{"[[1.9, 1409763000], [null, 1409763060], [-3, 1409763120], [0, 1409763180]]", nil},
+		{"[[1.9, 1409763000], [null, 1409763060], [-3, 1409763120], [0, 1409763180]]", []ConvertOption{StrictInts()}},
+		{"[[null, 1409763060], [2, 1409763000], [3, 1409763060]]", []ConvertOption{SortAndDedup(KeepFirst)}},
+		{"[]", nil},
+		{"null", nil},
+		{"", nil},
+	} {
+		d := Datapoints{Target: "a", points: []byte(test.points)}
+		for _, float := range []bool{true, false} {
+			var expected []Datapoint[float64]
+			var actual []Point[float64]
+			var expectedErr, actualErr error
+			if float {
+				expected, expectedErr = d.AsFloats(test.opts...)
+				actual, actualErr = d.AsFloatPoints(test.opts...)
+			} else {
+				ints, err := d.AsInts(test.opts...)
+				expected, expectedErr = intsAsFloats(ints), err
+				intPoints, err := d.AsIntPoints(test.opts...)
+				actual, actualErr = intPointsAsFloats(intPoints), err
+			}
+
+			if (expectedErr == nil) != (actualErr == nil) {
+				t.Errorf("Unexpected error for %s: %v, expected %v", test.points, actualErr, expectedErr)
+				continue
+			}
+			if len(actual) != len(expected) {
+				t.Errorf("Unexpected points for %s: %v", test.points, actual)
+				continue
+			}
+			for i := range expected {
+				if !actual[i].Time.Equal(expected[i].Time) || actual[i].Valid != (expected[i].Value != nil) {
+					t.Errorf("Unexpected point for %s: %v", test.points, actual[i])
+				} else if expected[i].Value != nil && actual[i].Value != *expected[i].Value {
+					t.Errorf("Unexpected value for %s: %v", test.points, actual[i])
+				} else if expected[i].Value == nil && actual[i].Value != 0 {
+					t.Errorf("Expected zero value for %s: %v", test.points, actual[i])
+				}
+			}
+		}
+	}
+
+	// Errors name the target.
+	_, err := AsPoints[int8](Datapoints{Target: "a", points: []byte("[[300, 1409763000]]")})
+	var overflow *ValueOverflowError
+	if !errors.As(err, &overflow) || overflow.Target != "a" {
+		t.Error("Unexpected error:", err)
+	}
+	failed := errors.New("Failed.")
+	if _, err := (Datapoints{err: failed}).AsFloatPoints(); err != failed {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func intsAsFloats(points []IntDatapoint) []FloatDatapoint {
+	floats := make([]FloatDatapoint, len(points))
+	for i, point := range points {
+		floats[i].Time = point.Time
+		if point.Value != nil {
+			v := float64(*point.Value)
+			floats[i].Value = &v
+		}
+	}
+	return floats
+}
+
+func intPointsAsFloats(points []IntPoint) []FloatPoint {
+	floats := make([]FloatPoint, len(points))
+	for i, point := range points {
+		floats[i] = FloatPoint{point.Time, float64(point.Value), point.Valid}
+	}
+	return floats
+}
+
+func BenchmarkAsFloats(b *testing.B) {
+	d := benchmarkDatapoints(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.AsFloats(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAsFloatPoints(b *testing.B) {
+	d := benchmarkDatapoints(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := d.AsFloatPoints(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A series of 10000 datapoints, every tenth of them null.
+func benchmarkDatapoints(b *testing.B) Datapoints {
+	response, err := decodeGraphiteResponse(bytes.NewReader(syntheticGraphiteResponse(1, 10000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return response[0]
+}
+
+func TestAsOverflow(t *testing.T) {
+	t.Parallel()
+
+	for _, fixture := range []struct {
+		points string
+		as     func(Datapoints) error
+	}{
+		{"[[2147483648, 1409763000]]", func(d Datapoints) error { _, err := As[int32](d); return err }},
+		{"[[-2147483649, 1409763000]]", func(d Datapoints) error { _, err := As[int32](d); return err }},
+		{"[[2147483648.5, 1409763000]]", func(d Datapoints) error { _, err := As[int32](d); return err }},
+		{"[[300, 1409763000]]", func(d Datapoints) error { _, err := As[int8](d); return err }},
+		{"[[-1, 1409763000]]", func(d Datapoints) error { _, err := As[uint64](d); return err }},
+		{"[[1e39, 1409763000]]", func(d Datapoints) error { _, err := As[float32](d); return err }},
+	} {
+		err := fixture.as(Datapoints{Target: "a", points: []byte(fixture.points)})
+		var overflow *ValueOverflowError
+		if !errors.As(err, &overflow) || overflow.Target != "a" {
+			t.Errorf("Unexpected error for %s: %v", fixture.points, err)
+		}
+	}
+
+	if points, err := As[int32](Datapoints{Target: "a", points: []byte("[[2147483647, 1409763000]]")}); err != nil || *points[0].Value != math.MaxInt32 {
+		t.Error("Unexpected result:", points, err)
+	}
+}
+
+func TestAsFloat32Rounding(t *testing.T) {
+	t.Parallel()
+
+	// Not representable as a float32, so rounded to the nearest one.
+	points, err := As[float32](Datapoints{Target: "a", points: []byte("[[16777217, 1409763000], [0.1, 1409763060]]")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *points[0].Value != 16777216 || *points[1].Value != float32(0.1) {
+		t.Error("Unexpected values:", *points[0].Value, *points[1].Value)
+	}
+}
@@ -0,0 +1,119 @@
+package infrastructure
+
+import (
+	"context"
+	"io/ioutil"
+	"mime"
+	httpurl "net/url"
+	"strconv"
+)
+
+const (
+	formatPNG Format = "png"
+	formatSVG Format = "svg"
+)
+
+// Options for rendered graphs. Zero values are left to Graphite's defaults.
+// See the Graphite render API documentation for details.
+type GraphOptions struct {
+	Width  int
+	Height int
+	Title  string
+	// Colors are either names, ie. "black", or hex codes without '#'.
+	BgColor string
+	FgColor string
+	// "slope", "staircase" or "connected".
+	LineMode   string
+	HideLegend bool
+	YMin       *float64
+	YMax       *float64
+
+	// Any other render parameters. Replaces parameters set by the fields
+	// above.
+	Extra httpurl.Values
+}
+
+func (o GraphOptions) apply(query httpurl.Values) {
+	if o.Width > 0 {
+		query.Set("width", strconv.Itoa(o.Width))
+	}
+	if o.Height > 0 {
+		query.Set("height", strconv.Itoa(o.Height))
+	}
+	if o.Title != "" {
+		query.Set("title", o.Title)
+	}
+	if o.BgColor != "" {
+		query.Set("bgcolor", o.BgColor)
+	}
+	if o.FgColor != "" {
+		query.Set("fgcolor", o.FgColor)
+	}
+	if o.LineMode != "" {
+		query.Set("lineMode", o.LineMode)
+	}
+	if o.HideLegend {
+		query.Set("hideLegend", "true")
+	}
+	if o.YMin != nil {
+		query.Set("yMin", strconv.FormatFloat(*o.YMin, 'g', -1, 64))
+	}
+	if o.YMax != nil {
+		query.Set("yMax", strconv.FormatFloat(*o.YMax, 'g', -1, 64))
+	}
+	for key, values := range o.Extra {
+		query[key] = values
+	}
+}
+
+// Renders targets as a PNG image. Graphite responds with an HTML page for some
+// failures, so any response that isn't an image/png fails with an
+// *HTTPError.
+func (g *Client) RenderPNG(targets []string, interval TimeInterval, opts GraphOptions) ([]byte, error) {
+	return g.renderGraph(targets, interval, opts, formatPNG, "image/png")
+}
+
+// Like RenderPNG, but renders an SVG document. Any response that isn't an
+// image/svg+xml fails with an *HTTPError.
+func (g *Client) RenderSVG(targets []string, interval TimeInterval, opts GraphOptions) ([]byte, error) {
+	return g.renderGraph(targets, interval, opts, formatSVG, "image/svg+xml")
+}
+
+// The URL of the PNG graph RenderPNG would fetch, ie. to open in a browser or
+// to embed in a dashboard. Every reserved character, including spaces and '#'
+// inside targets, is percent-encoded, so the URL survives being pasted as is.
+// Doesn't include the Client's credentials.
+func (g *Client) RenderURL(targets []string, interval TimeInterval, opts GraphOptions) (string, error) {
+	if err := interval.Check(); err != nil {
+		return "", err
+	}
+	url := g.endpointURL("/render", graphQueryPart(targets, interval, opts, formatPNG))
+	return url.String(), nil
+}
+
+func graphQueryPart(targets []string, interval TimeInterval, opts GraphOptions, format Format) httpurl.Values {
+	query := constructQueryPart(targets)
+	query.Set("format", string(format))
+	query.Add("from", graphiteDateFormat(interval.From))
+	query.Add("until", graphiteDateFormat(interval.To))
+	opts.apply(query)
+	return query
+}
+
+func (g *Client) renderGraph(targets []string, interval TimeInterval, opts GraphOptions, format Format, contentType string) ([]byte, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+
+	query := graphQueryPart(targets, interval, opts, format)
+	resp, err := g.do(context.Background(), "/render", query, targets)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != contentType {
+		return nil, newHTTPError(resp, targets, resp.Request.Header.Get(g.requestIDHeaderName()))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
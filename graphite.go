@@ -2,153 +2,397 @@ package infrastructure
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	httpurl "net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// A Graphite client. Safe for concurrent use, as long as its fields aren't
+// modified once it's in use. Prefer configuring it using ClientOptions passed
+// to New or NewFromURL.
 type Client struct {
-	URL    httpurl.URL
+	URL httpurl.URL
+	// Used for all requests. http.DefaultClient if nil.
 	Client *http.Client
+
+	// Maximum number of bytes read from a single response body. Larger
+	// responses fail with a *ResponseTooLargeError. Zero, the default, means
+	// unlimited. Setting a limit is recommended since a careless wildcard
+	// query can make Graphite return gigabytes.
+	MaxResponseBytes int64
+
+	// By default, responses are explicitly requested gzip compressed and
+	// transparently decompressed. Unlike the compression handled by
+	// http.Transport, this also works with custom transports.
+	DisableCompression bool
+
+	// Maximum number of targets in a single render request. Queries with
+	// more targets are split into several requests, made one at a time,
+	// whose series are concatenated. Zero, the default, means unlimited.
+	MaxTargetsPerRequest int
+
+	// If set, decoded render responses are cached. Not used for QueryRaw
+	// and the other methods returning undecoded responses.
+	Cache *QueryCache
+
+	// Decides whether failed requests are retried. Requests aren't retried
+	// if nil, the default. See DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// Sent as basic auth with every request. See WithBasicAuth.
+	basicAuth *httpurl.Userinfo
+
+	// nil for Clients not created by a constructor.
+	stats  *clientStats
+	closer *clientCloser
+
+	// Whether Client.Transport was created by the Client's options, rather
+	// than passed by the user or shared with the Client it was cloned from.
+	ownsTransport bool
+
+	// See WithRequestIDHeader and WithRequestIDGenerator.
+	requestIDHeader    string
+	requestIDGenerator func() string
+
+	// See WithDefaultEmptySeriesError.
+	emptySeriesError bool
+
+	// See WithDefaultLookback and WithDefaultInterval. At most one is set.
+	defaultLookback time.Duration
+	defaultInterval *TimeInterval
+
+	// Waits between retries and tells the time, ie. for retry budgets and
+	// anchored queries. Replaced in tests.
+	sleeper func(ctx context.Context, d time.Duration) error
+	clock   func() time.Time
 }
 
 // Create a new Client from a given URL. The URL is the base adress to
 // Graphite, ie. without "/render" suffix etc.
-func New(url string) (*Client, error) {
+func New(url string, opts ...ClientOption) (*Client, error) {
 	u, err := httpurl.Parse(url)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		URL:    *u,
-		Client: &http.Client{},
-	}, nil
+	return NewFromURL(*u, opts...), nil
+}
+
+// A copy of g with opts applied. The copy shares g's transport, and with it
+// its connections, but is otherwise independent; modifying either doesn't
+// affect the other. A cache is copied empty, with the same configuration.
+func (g *Client) Clone(opts ...ClientOption) *Client {
+	clone := *g
+	if g.URL.User != nil {
+		user := *g.URL.User
+		clone.URL.User = &user
+	}
+	if g.Client != nil {
+		client := *g.Client
+		clone.Client = &client
+	}
+	if g.Cache != nil {
+		clone.Cache = NewQueryCache(g.Cache.ttl, g.Cache.maxEntries)
+	}
+	clone.stats = &clientStats{}
+	clone.closer = newClientCloser()
+	clone.ownsTransport = false
+	for _, opt := range opts {
+		opt(&clone)
+	}
+	return &clone
+}
+
+// Releases the resources of the Client: stops the Pollers and Watches using
+// it and closes its idle connections. Later requests fail with
+// ErrClientClosed; requests in flight aren't cancelled.
+//
+// Idle connections are only closed if the Client's transport was created by
+// its options, ie. WithMaxIdleConnsPerHost or a "unix" URL. An http.Client
+// passed using WithHTTPClient, http.DefaultTransport and the transport shared
+// with the Client it was cloned from are left as is, since others might be
+// using them. Closing a Client doesn't close its clones. Closing more than
+// once, or a Client not created by a constructor, has no effect. Always
+// returns nil.
+func (g *Client) Close() error {
+	if g.closer == nil {
+		return nil
+	}
+	g.closer.once.Do(func() {
+		close(g.closer.done)
+		if g.ownsTransport {
+			g.Client.CloseIdleConnections()
+		}
+	})
+	return nil
+}
+
+type clientCloser struct {
+	once sync.Once
+	// Closed by Client.Close.
+	done chan struct{}
+}
+
+func newClientCloser() *clientCloser {
+	return &clientCloser{done: make(chan struct{})}
+}
+
+// Closed once the Client is closed. nil, which blocks forever, for Clients not
+// created by a constructor.
+func (g *Client) closed() <-chan struct{} {
+	if g.closer == nil {
+		return nil
+	}
+	return g.closer.done
 }
 
+// The series of a render response, in the order returned by Graphite. The same
+// target might occur more than once, ie. with overlapping storage schemas
+// behind carbon-relay. See DedupTargets.
 type MultiDatapoints []Datapoints
 
-func (m MultiDatapoints) asMap() map[string]Datapoints {
-	res := make(map[string]Datapoints)
+// The series keyed by target. If the same target occurs more than once, the
+// last one wins.
+func (m MultiDatapoints) AsMap() map[string]Datapoints {
+	res := make(map[string]Datapoints, len(m))
 	for _, point := range m {
 		res[point.Target] = point
 	}
 	return res
 }
 
-// Create a new Client from a given URL. The URL is the base adress to
-// Graphite, ie. without "/render" suffix etc.
-func NewFromURL(url httpurl.URL) *Client {
-	return &Client{url, &http.Client{}}
+// Converts every series using AsFloats, keyed by target. Like AsMap, the last
+// one wins if the same target occurs more than once. Fails on the first series
+// that can't be converted unless PartialResults is given.
+func (m MultiDatapoints) AsFloatsMap(opts ...ConvertOption) (map[string][]FloatDatapoint, error) {
+	res := make(map[string][]FloatDatapoint, len(m))
+	err := m.convertEach(opts, func(d Datapoints) error {
+		points, err := d.AsFloats()
+		if err == nil {
+			res[d.Target] = points
+		}
+		return err
+	})
+	return res, err
 }
 
-type TimeInterval struct {
-	From time.Time
-	To   time.Time
+// Like AsFloatsMap, but converts every series using AsInts.
+func (m MultiDatapoints) AsIntsMap(opts ...ConvertOption) (map[string][]IntDatapoint, error) {
+	res := make(map[string][]IntDatapoint, len(m))
+	err := m.convertEach(opts, func(d Datapoints) error {
+		points, err := d.AsInts()
+		if err == nil {
+			res[d.Target] = points
+		}
+		return err
+	})
+	return res, err
 }
 
-func (t *TimeInterval) Check() error {
-	if t.From.After(t.To) {
-		return errors.New("From must be before To.")
+func (m MultiDatapoints) convertEach(opts []ConvertOption, convert func(Datapoints) error) error {
+	o := newConvertOptions(opts)
+	var errs []error
+	for _, d := range m {
+		if err := convert(d); err != nil {
+			err = fmt.Errorf("Unable to convert %q: %w", d.Target, err)
+			if !o.partial {
+				return err
+			}
+			errs = append(errs, err)
+		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func graphiteDateFormat(t time.Time) string {
-	return fmt.Sprintf("%02d:%02d_%d%02d%02d", t.Hour(), t.Minute(), t.Year(), t.Month(), t.Day())
+// The targets of the series, in response order. A target occurring more than
+// once, which misbehaving relays can cause, is only included once, at its
+// first position.
+func (m MultiDatapoints) Targets() []string {
+	targets := make([]string, 0, len(m))
+	seen := make(map[string]bool, len(m))
+	for _, point := range m {
+		if !seen[point.Target] {
+			seen[point.Target] = true
+			targets = append(targets, point.Target)
+		}
+	}
+	return targets
+}
+
+// Whether any of the series has the given target.
+func (m MultiDatapoints) ContainsTarget(target string) bool {
+	_, ok := m.ByTarget(target)
+	return ok
+}
+
+// Look up a single series by target. Like AsMap, the last one wins if the
+// same target occurs more than once.
+func (m MultiDatapoints) ByTarget(target string) (Datapoints, bool) {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i].Target == target {
+			return m[i], true
+		}
+	}
+	return Datapoints{}, false
+}
+
+// The series having the tag key set to value, in response order. Series
+// without tags, ie. from Graphite versions before 1.1, never match.
+func (m MultiDatapoints) FilterByTag(key, value string) MultiDatapoints {
+	res := MultiDatapoints{}
+	for _, d := range m {
+		if v, ok := d.Tags[key]; ok && v == value {
+			res = append(res, d)
+		}
+	}
+	return res
 }
 
-type FloatDatapoint struct {
-	Time  time.Time
-	Value *float64
+// Create a new Client from a given URL. The URL is the base adress to
+// Graphite, ie. without "/render" suffix etc. Credentials in the URL are
+// removed from it and used as basic auth, keeping them out of request URLs.
+//
+// A "unix" URL, ie. "unix:///var/run/graphite.sock", connects to Graphite
+// listening on the Unix domain socket at its path. Requests are made to the
+// root of the server, with the URL's host, if any, as Host header and
+// "localhost" otherwise, ie. "unix://graphite.example.com/var/run/graphite.sock".
+// The socket is dialed by the Client's transport, which must be an
+// *http.Transport or nil, so it's set up after opts are applied.
+func NewFromURL(url httpurl.URL, opts ...ClientOption) *Client {
+	g := &Client{URL: url, Client: &http.Client{}, stats: &clientStats{}, closer: newClientCloser()}
+	if url.User != nil {
+		password, _ := url.User.Password()
+		g.basicAuth = httpurl.UserPassword(url.User.Username(), password)
+		g.URL.User = nil
+	}
+	var socket string
+	if url.Scheme == "unix" {
+		socket = url.Path
+		g.URL = httpurl.URL{Scheme: "http", Host: url.Host}
+		if g.URL.Host == "" {
+			g.URL.Host = "localhost"
+		}
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if socket != "" {
+		g.setDialContext(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		})
+	}
+	return g
 }
 
-type IntDatapoint struct {
-	Time  time.Time
-	Value *int64
+// Like NewFromURL, but takes the URL as returned by url.Parse. The URL is
+// copied, so modifying it afterwards doesn't affect the Client.
+func NewFromURLPtr(url *httpurl.URL, opts ...ClientOption) *Client {
+	return NewFromURL(*url, opts...)
 }
 
+func graphiteDateFormat(t time.Time) string {
+	return fmt.Sprintf("%02d:%02d_%d%02d%02d", t.Hour(), t.Minute(), t.Year(), t.Month(), t.Day())
+}
+
+type FloatDatapoint = Datapoint[float64]
+
+type IntDatapoint = Datapoint[int64]
+
+type FloatPoint = Point[float64]
+
+type IntPoint = Point[int64]
+
 type Datapoints struct {
 	// Previous error to make single queries nicer to work with.
 	err    error
 	Target string
-	points [][]interface{}
+	// The tags of the series, as returned by Graphite 1.1 and later, ie.
+	// {"name": "a.b", "dc": "eu"}. nil for older Graphite versions and for
+	// formats other than JSON.
+	Tags map[string]string
+
+	// The raw JSON datapoints array. Decoded first when AsInts or AsFloats is
+	// called, making it cheap to fetch many targets but only use a few.
+	points json.RawMessage
 }
 
-func (d Datapoints) AsInts() ([]IntDatapoint, error) {
-	if d.err != nil {
-		return nil, d.err
-	}
+// Converts the datapoints to ints. Float values are truncated towards zero
+// unless StrictInts is given. Same as As[int64].
+func (d Datapoints) AsInts(opts ...ConvertOption) ([]IntDatapoint, error) {
+	return As[int64](d, opts...)
+}
 
-	points := make([]IntDatapoint, 0, len(d.points))
-	for _, point := range d.points {
-		jsonUnixTime, ok := point[1].(json.Number)
-		if !ok {
-			return nil, errors.New("Unix timestamp not number.")
-		}
-		unixTime, err := jsonUnixTime.Int64()
-		if err != nil {
-			return nil, errors.New("Unix time not proper number.")
-		}
+// Converts the datapoints to floats. Same as As[float64].
+func (d Datapoints) AsFloats(opts ...ConvertOption) ([]FloatDatapoint, error) {
+	return As[float64](d, opts...)
+}
 
-		var value *int64
-		if point[0] != nil {
-			jsonValue, ok := point[0].(json.Number)
-			if !ok {
-				return nil, errors.New("Value not a number.")
-			}
-			value = new(int64)
-			*value, err = jsonValue.Int64()
-			if err != nil {
-				floatVal, err := jsonValue.Float64()
-				if err != nil {
-					return nil, errors.New("Value not proper number.")
-				}
-				*value = int64(floatVal)
-			}
-		}
-		points = append(points, IntDatapoint{time.Unix(unixTime, 0), value})
+// Like AsFloats, but to FloatPoints. Same as AsPoints[float64].
+func (d Datapoints) AsFloatPoints(opts ...ConvertOption) ([]FloatPoint, error) {
+	return AsPoints[float64](d, opts...)
+}
+
+// Like AsInts, but to IntPoints. Same as AsPoints[int64].
+func (d Datapoints) AsIntPoints(opts ...ConvertOption) ([]IntPoint, error) {
+	return AsPoints[int64](d, opts...)
+}
+
+// Sets the target of conversion errors that carry one.
+func (d Datapoints) withTarget(err error) error {
+	var notInteger *NotIntegerError
+	if errors.As(err, &notInteger) {
+		notInteger.Target = d.Target
+	}
+	var overflow *ValueOverflowError
+	if errors.As(err, &overflow) {
+		overflow.Target = d.Target
 	}
+	return err
+}
 
-	return points, nil
+// The error of a failed query, or of a series that couldn't be decoded. Such
+// Datapoints have no datapoints.
+func (d Datapoints) Err() error {
+	return d.err
 }
 
-func (d Datapoints) AsFloats() ([]FloatDatapoint, error) {
+// Number of datapoints, including nulls. Zero if the query failed.
+func (d Datapoints) Len() int {
 	if d.err != nil {
-		return nil, d.err
+		return 0
 	}
+	return countDatapoints(d.points)
+}
 
-	points := make([]FloatDatapoint, 0, len(d.points))
-	for _, point := range d.points {
-		jsonUnixTime, ok := point[1].(json.Number)
-		if !ok {
-			return nil, errors.New("Unix timestamp not number.")
-		}
-		unixTime, err := jsonUnixTime.Int64()
-		if err != nil {
-			return nil, errors.New("Unix time not proper number.")
-		}
+// Whether there are no datapoints at all, including nulls.
+func (d Datapoints) IsEmpty() bool {
+	return d.Len() == 0
+}
 
-		var value *float64
-		if point[0] != nil {
-			jsonValue, ok := point[0].(json.Number)
-			if !ok {
-				return nil, errors.New("Value not a number.")
-			}
-			value = new(float64)
-			*value, err = jsonValue.Float64()
-			if err != nil {
-				return nil, errors.New("Value not proper number.")
-			}
-		}
-		points = append(points, FloatDatapoint{time.Unix(unixTime, 0), value})
+// The timestamps of the first and last datapoint, without converting the rest.
+// ok is false if there are no datapoints or the query failed.
+func (d Datapoints) TimeRange() (from, to time.Time, ok bool) {
+	if d.err != nil {
+		return
 	}
-
-	return points, nil
+	first, last, ok := firstAndLastTimestamps(d.points)
+	if !ok {
+		return
+	}
+	return time.Unix(first, 0), time.Unix(last, 0), true
 }
 
 func constructQueryPart(qs []string) httpurl.Values {
@@ -166,219 +410,628 @@ type FindResultItem struct {
 	Id            string
 	Expandable    bool
 	AllowChildren bool
+
+	// The JSON fields missing from the response, which some Graphite
+	// implementations leave out. A missing "id" defaults
+	// to Text, and missing "expandable" and "allowChildren" to whether the
+	// item is a branch, ie. not Leaf. nil if no field was missing.
+	Defaulted []string
 }
 
-// Used to map isLeaf from integer to
+// Used to map isLeaf from integer to. Pointers are nil for missing fields.
 type rawFindResultItem struct {
-	Leaf          int    `json:"leaf"`
-	Text          string `json:"text"`
-	Id            string `json:"id"`
-	Expandable    int    `json:"expandable"`
-	AllowChildren int    `json:"allowChildren"`
+	Leaf          flexibleBool  `json:"leaf"`
+	Text          string        `json:"text"`
+	Id            *string       `json:"id"`
+	Expandable    *flexibleBool `json:"expandable"`
+	AllowChildren *flexibleBool `json:"allowChildren"`
 }
 
-type FindOpts struct {
-	From  *time.Time
-	Until *time.Time
+// A boolean decoded from JSON booleans, numbers and the strings "0", "1",
+// "true" and "false", since Graphite implementations disagree on how to
+// encode find results. Non-zero numbers are true.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`, `"1"`:
+		*b = true
+		return nil
+	case "false", `"false"`, `"0"`, "null":
+		*b = false
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("Unable to decode %s as a boolean.", data)
+	}
+	*b = f != 0
+	return nil
 }
 
-func (g *Client) Find(query string, opts *FindOpts) ([]FindResultItem, error) {
-	// Cloning to be able to modify.
-	url := g.URL
-	url.Path = path.Join(url.Path, "/metrics/find")
-
+// Finds the metrics matching query, ie. "servers.*". See WithFindFrom and
+// WithFindUntil for limiting the search by time.
+func (g *Client) Find(query string, opts ...QueryOption) ([]FindResultItem, error) {
+	o := newQueryOptions(opts)
+	if err := o.validateTargets([]string{query}); err != nil {
+		return nil, err
+	}
 	queryvalues := make(httpurl.Values)
 	queryvalues.Add("query", query)
-	if opts != nil && opts.From != nil {
-		queryvalues.Add("from", graphiteDateFormat(*opts.From))
+	if o.findFrom != nil {
+		queryvalues.Add("from", graphiteDateFormat(*o.findFrom))
 	}
-	if opts != nil && opts.Until != nil {
-		queryvalues.Add("until", graphiteDateFormat(*opts.Until))
+	if o.findUntil != nil {
+		queryvalues.Add("until", graphiteDateFormat(*o.findUntil))
 	}
-	url.RawQuery = queryvalues.Encode()
 
-	resp, err := g.Client.Get(url.String())
+	body, err := g.get(o.ctx, "/metrics/find", queryvalues, []string{query})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
+	items, err := decodeFindResponse(body)
+	g.stats.observeDecode(o.ctx, err)
+	return items, err
+}
+
+func decodeFindResponse(r io.Reader) ([]FindResultItem, error) {
 	var res []rawFindResultItem
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&res)
-	if err != nil {
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
 		return nil, err
 	}
 
 	realResult := make([]FindResultItem, len(res))
 	for i, item := range res {
-		realResult[i].Id = item.Id
-		realResult[i].Leaf = item.Leaf > 0
-		realResult[i].Text = item.Text
-		realResult[i].Expandable = item.Expandable > 0
-		realResult[i].AllowChildren = item.AllowChildren > 0
+		r := &realResult[i]
+		r.Leaf = bool(item.Leaf)
+		r.Text = item.Text
+
+		r.Id = item.Text
+		if item.Id != nil {
+			r.Id = *item.Id
+		} else {
+			r.Defaulted = append(r.Defaulted, "id")
+		}
+		r.Expandable = !r.Leaf
+		if item.Expandable != nil {
+			r.Expandable = bool(*item.Expandable)
+		} else {
+			r.Defaulted = append(r.Defaulted, "expandable")
+		}
+		r.AllowChildren = !r.Leaf
+		if item.AllowChildren != nil {
+			r.AllowChildren = bool(*item.AllowChildren)
+		} else {
+			r.Defaulted = append(r.Defaulted, "allowChildren")
+		}
 	}
-
 	return realResult, nil
 }
 
 // Helper method to make it easier to create an interface for Client.
-func (g *Client) QueryInts(q string, interval TimeInterval) ([]IntDatapoint, error) {
-	return g.Query(q, interval).AsInts()
+func (g *Client) QueryInts(q string, interval TimeInterval, opts ...QueryOption) ([]IntDatapoint, error) {
+	return g.Query(q, interval, opts...).AsInts()
 }
 
 // Helper method to make it easier to create an interface for Client.
-func (g *Client) QueryFloats(q string, interval TimeInterval) ([]FloatDatapoint, error) {
-	return g.Query(q, interval).AsFloats()
+func (g *Client) QueryFloats(q string, interval TimeInterval, opts ...QueryOption) ([]FloatDatapoint, error) {
+	return g.Query(q, interval, opts...).AsFloats()
 }
 
 // Helper method to make it easier to create an interface for Client.
-func (g *Client) QueryIntsSince(q string, ago time.Duration) ([]IntDatapoint, error) {
-	return g.QuerySince(q, ago).AsInts()
+func (g *Client) QueryIntsSince(q string, ago time.Duration, opts ...QueryOption) ([]IntDatapoint, error) {
+	return g.QuerySince(q, ago, opts...).AsInts()
 }
 
 // Helper method to make it easier to create an interface for Client.
-func (g *Client) QueryFloatsSince(q string, ago time.Duration) ([]FloatDatapoint, error) {
-	return g.QuerySince(q, ago).AsFloats()
+func (g *Client) QueryFloatsSince(q string, ago time.Duration, opts ...QueryOption) ([]FloatDatapoint, error) {
+	return g.QuerySince(q, ago, opts...).AsFloats()
 }
 
-// Fetches one or multiple Graphite series. Deferring identifying whether the
-// result are ints of floats to later. Useful in clients that executes adhoc
-// queries.
-func (g *Client) QueryMulti(q []string, interval TimeInterval) (MultiDatapoints, error) {
-	if err := interval.Check(); err != nil {
+// Like QueryFloats, but for multiple targets, keyed by target. Fails on the
+// first series that can't be converted, naming its target. See AsFloatsMap.
+func (g *Client) QueryFloatsMulti(qs []string, interval TimeInterval, opts ...QueryOption) (map[string][]FloatDatapoint, error) {
+	points, err := g.QueryMulti(qs, interval, opts...)
+	if err != nil {
 		return nil, err
 	}
+	return points.AsFloatsMap()
+}
 
-	// Cloning to be able to modify.
-	url := g.URL
-
-	url.Path = path.Join(url.Path, "/render")
-
-	queryPart := constructQueryPart(q)
-	queryPart.Add("from", graphiteDateFormat(interval.From))
-	queryPart.Add("until", graphiteDateFormat(interval.To))
-	url.RawQuery = queryPart.Encode()
+// Like QueryFloatsMulti, but for ints.
+func (g *Client) QueryIntsMulti(qs []string, interval TimeInterval, opts ...QueryOption) (map[string][]IntDatapoint, error) {
+	points, err := g.QueryMulti(qs, interval, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return points.AsIntsMap()
+}
 
-	resp, err := g.Client.Get(url.String())
+// Like QueryFloatsMulti, but for the last ago.
+func (g *Client) QueryFloatsMultiSince(qs []string, ago time.Duration, opts ...QueryOption) (map[string][]FloatDatapoint, error) {
+	points, err := g.QueryMultiSince(qs, ago, opts...)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return points.AsFloatsMap()
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// Like QueryIntsMulti, but for the last ago.
+func (g *Client) QueryIntsMultiSince(qs []string, ago time.Duration, opts ...QueryOption) (map[string][]IntDatapoint, error) {
+	points, err := g.QueryMultiSince(qs, ago, opts...)
 	if err != nil {
 		return nil, err
 	}
+	return points.AsIntsMap()
+}
+
+// The current value of q, ie. its last non-null value within lookback. See
+// Datapoints.LastNonNullFloat.
+func (g *Client) LatestFloat(q string, lookback time.Duration) (float64, time.Time, bool, error) {
+	return g.QuerySince(q, lookback).LastNonNullFloat()
+}
 
-	return parseGraphiteResponse(body)
+// Like LatestFloat, but for ints.
+func (g *Client) LatestInt(q string, lookback time.Duration) (int64, time.Time, bool, error) {
+	return g.QuerySince(q, lookback).LastNonNullInt()
 }
 
 // Fetches one or multiple Graphite series. Deferring identifying whether the
 // result are ints of floats to later. Useful in clients that executes adhoc
 // queries.
-func (g *Client) QueryMultiSince(q []string, ago time.Duration) (MultiDatapoints, error) {
-	if ago.Nanoseconds() <= 0 {
-		return nil, errors.New("Duration is expected to be positive.")
+//
+// A series that can't be decoded doesn't fail the others. It's returned with
+// its Err set, together with an error joining the errors of all such series.
+// A target given more than once is only requested once, see
+// WithDuplicateTargets.
+func (g *Client) QueryMulti(q []string, interval TimeInterval, opts ...QueryOption) (MultiDatapoints, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
 	}
 
-	// Cloning to be able to modify.
-	url := g.URL
+	return g.render(q, constructQueryPart(q), &interval, opts)
+}
 
-	url.Path = path.Join(url.Path, "/render")
+// Fetches one or multiple Graphite series. Deferring identifying whether the
+// result are ints of floats to later. Useful in clients that executes adhoc
+// queries.
+func (g *Client) QueryMultiSince(q []string, ago time.Duration, opts ...QueryOption) (MultiDatapoints, error) {
+	queryPart, err := sinceQueryPart(q, ago)
+	if err != nil {
+		return nil, err
+	}
+	return g.render(q, queryPart, nil, opts)
+}
 
-	queryPart := constructQueryPart(q)
-	queryPart.Add("from", graphiteSinceString(ago))
-	url.RawQuery = queryPart.Encode()
+// Like QueryMulti, but returns the JSON response body as is. Useful for
+// proxying render results without decoding and re-encoding them. The response
+// is always requested as JSON, regardless of WithFormat.
+func (g *Client) QueryRaw(q []string, interval TimeInterval, opts ...QueryOption) (json.RawMessage, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+	return g.queryRaw(q, constructQueryPart(q), &interval, opts)
+}
 
-	resp, err := g.Client.Get(url.String())
+// Like QueryMultiSince, but returns the JSON response body as is. See QueryRaw.
+func (g *Client) QueryRawSince(q []string, ago time.Duration, opts ...QueryOption) (json.RawMessage, error) {
+	queryPart, err := sinceQueryPart(q, ago)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return g.queryRaw(q, queryPart, nil, opts)
+}
+
+func (g *Client) queryRaw(q []string, queryPart httpurl.Values, interval *TimeInterval, opts []QueryOption) (json.RawMessage, error) {
+	o := newQueryOptions(opts)
+	o.format = FormatJSON
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := g.renderBody(q, queryPart, interval, o)
 	if err != nil {
 		return nil, err
 	}
+	defer body.Close()
 
-	return parseGraphiteResponse(body)
+	return ioutil.ReadAll(body)
 }
 
 // Fetches a Graphite result only expecting one timeseries. Deferring
 // identifying whether the result are ints of floats to later. Useful in
 // clients that executes adhoc queries.
-func (g *Client) Query(q string, interval TimeInterval) Datapoints {
+func (g *Client) Query(q string, interval TimeInterval, opts ...QueryOption) Datapoints {
 	if err := interval.Check(); err != nil {
-		return Datapoints{err, "", nil}
+		return Datapoints{err: err}
 	}
 
-	// Cloning to be able to modify.
-	url := g.URL
+	points, err := g.render([]string{q}, constructQueryPart([]string{q}), &interval, opts)
+	return parseSingleGraphiteResponse(points, err, g.requireDatapoints(opts))
+}
 
-	url.Path = path.Join(url.Path, "/render")
+// The render parameters for querying q since ago. Shared by all the Since
+// methods.
+func sinceQueryPart(q []string, ago time.Duration) (httpurl.Values, error) {
+	if ago.Nanoseconds() <= 0 {
+		return nil, errors.New("Duration is expected to be positive.")
+	}
+
+	queryPart := constructQueryPart(q)
+	queryPart.Add("from", graphiteSinceString(ago))
+	return queryPart, nil
+}
+
+// Formats ago as a relative time, ie. "-36hours". See graphiteDuration.
+func graphiteSinceString(ago time.Duration) string {
+	return "-" + graphiteDuration(ago)
+}
 
-	queryPart := constructQueryPart([]string{q})
-	queryPart.Add("from", graphiteDateFormat(interval.From))
-	queryPart.Add("until", graphiteDateFormat(interval.To))
-	url.RawQuery = queryPart.Encode()
+// Formats d in the largest of days, hours, minutes and seconds that
+// represents it exactly, ie. "36hours". d is first rounded to the nearest
+// second, with halves rounded up, and to at least one second.
+func graphiteDuration(d time.Duration) string {
+	seconds := int64(max(d.Round(time.Second), time.Second) / time.Second)
+	switch {
+	case seconds%(24*60*60) == 0:
+		return fmt.Sprintf("%ddays", seconds/(24*60*60))
+	case seconds%(60*60) == 0:
+		return fmt.Sprintf("%dhours", seconds/(60*60))
+	case seconds%60 == 0:
+		return fmt.Sprintf("%dminutes", seconds/60)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
 
-	resp, err := g.Client.Get(url.String())
+func (g *Client) QuerySince(q string, ago time.Duration, opts ...QueryOption) Datapoints {
+	queryPart, err := sinceQueryPart([]string{q}, ago)
 	if err != nil {
-		return Datapoints{err, "", nil}
+		return Datapoints{err: err}
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	points, err := g.render([]string{q}, queryPart, nil, opts)
+	return parseSingleGraphiteResponse(points, err, g.requireDatapoints(opts))
+}
+
+// Fetches q from fromAgo ago until untilAgo ago, ie. the previous hour with
+// fromAgo 2 hours and untilAgo 1 hour. Both are sent as relative times, see
+// QuerySince.
+func (g *Client) QueryBetweenAgo(q string, fromAgo, untilAgo time.Duration, opts ...QueryOption) Datapoints {
+	queryPart, err := betweenAgoQueryPart([]string{q}, fromAgo, untilAgo)
 	if err != nil {
-		return Datapoints{err, "", nil}
+		return Datapoints{err: err}
 	}
 
-	points, err := parseGraphiteResponse(body)
-	return parseSingleGraphiteResponse(points, err)
+	points, err := g.render([]string{q}, queryPart, nil, opts)
+	return parseSingleGraphiteResponse(points, err, g.requireDatapoints(opts))
 }
 
-func graphiteSinceString(duration time.Duration) string {
-	return fmt.Sprintf("%dminutes", -int(duration.Minutes()+0.5))
+// Like QueryBetweenAgo, but for multiple series.
+func (g *Client) QueryMultiBetweenAgo(q []string, fromAgo, untilAgo time.Duration, opts ...QueryOption) (MultiDatapoints, error) {
+	queryPart, err := betweenAgoQueryPart(q, fromAgo, untilAgo)
+	if err != nil {
+		return nil, err
+	}
+	return g.render(q, queryPart, nil, opts)
 }
 
-func (g *Client) QuerySince(q string, ago time.Duration) Datapoints {
-	if ago.Nanoseconds() <= 0 {
-		return Datapoints{errors.New("Duration is expected to be positive."), "", nil}
+func betweenAgoQueryPart(q []string, fromAgo, untilAgo time.Duration) (httpurl.Values, error) {
+	if untilAgo < 0 {
+		return nil, errors.New("Until is expected to be non-negative.")
+	}
+	if fromAgo <= untilAgo {
+		return nil, errors.New("From is expected to be before until.")
+	}
+
+	queryPart, err := sinceQueryPart(q, fromAgo)
+	if err != nil {
+		return nil, err
+	}
+	if untilAgo > 0 {
+		queryPart.Add("until", graphiteSinceString(untilAgo))
+	}
+	return queryPart, nil
+}
+
+// Issues render requests and decodes the responses. interval is nil for
+// relative queries, which set from themselves.
+func (g *Client) render(targets []string, queryPart httpurl.Values, interval *TimeInterval, opts []QueryOption) (MultiDatapoints, error) {
+	series, err := g.renderRequests(targets, queryPart, interval, opts)
+	if (err == nil || len(series) > 0) && newQueryOptions(opts).requireAll {
+		if missing := missingTargets(targets, series); len(missing) > 0 {
+			err = errors.Join(err, &MissingTargetsError{missing})
+		}
+	}
+	return series, err
+}
+
+// The targets without glob characters or function calls, ie. "a.b", that no
+// series is named after.
+func missingTargets(targets []string, series MultiDatapoints) []string {
+	returned := make(map[string]bool, len(series))
+	for _, s := range series {
+		returned[s.Target] = true
+	}
+	var missing []string
+	for _, target := range targets {
+		if !strings.ContainsAny(target, "*?[]{}()") && !returned[target] {
+			returned[target] = true
+			missing = append(missing, target)
+		}
+	}
+	return missing
+}
+
+func (g *Client) renderRequests(targets []string, queryPart httpurl.Values, interval *TimeInterval, opts []QueryOption) (MultiDatapoints, error) {
+	o := newQueryOptions(opts)
+	targets = o.uniqueTargets(targets, queryPart)
+
+	if max := g.MaxTargetsPerRequest; max > 0 && len(targets) > max {
+		res := MultiDatapoints{}
+		var errs []error
+		for start := 0; start < len(targets); start += max {
+			batch := targets[start:min(start+max, len(targets))]
+			batchQuery := make(httpurl.Values, len(queryPart))
+			for k, v := range queryPart {
+				batchQuery[k] = v
+			}
+			batchQuery["target"] = batch
+
+			series, err := g.renderRequests(batch, batchQuery, interval, opts)
+			// Errors of partial responses are only attached to series.
+			if err != nil && len(series) == 0 {
+				return nil, err
+			}
+			res = append(res, series...)
+			errs = append(errs, err)
+		}
+		return res, errors.Join(errs...)
 	}
 
+	if err := o.validateTargets(targets); err != nil {
+		return nil, err
+	}
+	prepareRender(queryPart, interval, o)
+
+	var key string
+	if g.Cache != nil && !o.noCache {
+		key = g.Cache.key(g.cacheScope(o), queryPart)
+		if series, ok := g.Cache.get(key); ok {
+			return series, nil
+		}
+	}
+
+	body, err := g.get(o.ctx, "/render", queryPart, targets)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var series MultiDatapoints
+	switch o.format {
+	case FormatMsgpack:
+		series, err = decodeMsgpackResponse(body)
+	case FormatCSV:
+		series, err = decodeCSVResponse(body, o.location)
+	default:
+		series, err = decodeGraphiteResponse(body)
+	}
+	g.stats.observeDecode(o.ctx, err)
+	if err == nil && g.Cache != nil && !o.noCache {
+		g.Cache.put(key, series)
+	}
+	return series, err
+}
+
+// Issues a render request, returning the response body undecoded. The caller
+// must close the body.
+func (g *Client) renderBody(targets []string, queryPart httpurl.Values, interval *TimeInterval, o queryOptions) (io.ReadCloser, error) {
+	targets = o.uniqueTargets(targets, queryPart)
+	if err := o.validateTargets(targets); err != nil {
+		return nil, err
+	}
+	prepareRender(queryPart, interval, o)
+	return g.get(o.ctx, "/render", queryPart, targets)
+}
+
+// Adds the render parameters given by interval and o to queryPart.
+func prepareRender(queryPart httpurl.Values, interval *TimeInterval, o queryOptions) {
+	queryPart.Set("format", string(o.format))
+	if o.location != nil {
+		queryPart.Set("tz", o.location.String())
+	}
+	if o.maxDataPoints > 0 {
+		queryPart.Set("maxDataPoints", strconv.Itoa(o.maxDataPoints))
+	}
+	if o.noCache {
+		queryPart.Set("noCache", "true")
+	}
+	if interval != nil {
+		queryPart.Add("from", graphiteDateFormat(o.in(interval.From)))
+		queryPart.Add("until", graphiteDateFormat(o.in(interval.To)))
+	}
+}
+
+// Issues a GET request to endpoint, ie. "/render", returning the response
+// body. targets are only used for error reporting. The caller must close the
+// body.
+func (g *Client) get(ctx context.Context, endpoint string, query httpurl.Values, targets []string) (io.ReadCloser, error) {
+	resp, err := g.do(ctx, endpoint, query, targets)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// The URL of endpoint with query.
+func (g *Client) endpointURL(endpoint string, query httpurl.Values) httpurl.URL {
 	// Cloning to be able to modify.
 	url := g.URL
+	url.Path = path.Join(url.Path, endpoint)
+	url.RawQuery = encodeQuery(query)
+	return url
+}
 
-	url.Path = path.Join(url.Path, "/render")
+// Like query.Encode, but encodes spaces as %20 rather than '+', since some
+// proxies and older graphite-web versions decode '+' inside targets, ie.
+// alias(a,"b c"), literally. Encode escapes literal '+' as %2B, so every
+// remaining '+' is a space.
+func encodeQuery(query httpurl.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
 
-	queryPart := constructQueryPart([]string{q})
-	queryPart.Add("from", graphiteSinceString(ago))
-	url.RawQuery = queryPart.Encode()
+// Like get, but returning the whole response. Responses with a non-2xx
+// status fail with an *HTTPError. The body is decompressed and limited
+// according to the Client's settings. The caller must close the body.
+func (g *Client) do(ctx context.Context, endpoint string, query httpurl.Values, targets []string) (resp *http.Response, err error) {
+	select {
+	case <-g.closed():
+		return nil, ErrClientClosed
+	default:
+	}
+	url := g.endpointURL(endpoint, query)
 
-	resp, err := http.Get(url.String())
+	opts := requestOptionsFrom(ctx)
+	cancel := context.CancelFunc(func() {})
+	if opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+	}
+	// Cancelled when the body is closed on success.
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
 	if err != nil {
-		return Datapoints{err, "", nil}
+		return nil, err
+	}
+	if !g.DisableCompression {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	if g.basicAuth != nil {
+		password, _ := g.basicAuth.Password()
+		req.SetBasicAuth(g.basicAuth.Username(), password)
+	}
+	requestID := g.requestID(ctx)
+	req.Header.Set(g.requestIDHeaderName(), requestID)
+	for key, values := range opts.header {
+		req.Header[key] = values
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if client.CheckRedirect == nil {
+		// Copying, since the http.Client might be the user's.
+		c := *client
+		c.CheckRedirect = FollowRedirects
+		client = &c
+	}
+	firstStart := g.now()
+	for attempt := 1; ; attempt++ {
+		g.stats.start()
+		start := time.Now()
+		// Cloning, since a cookie jar adds its cookies to the request sent.
+		resp, err = client.Do(req.Clone(ctx))
+		g.stats.observe(endpoint, time.Since(start), resp, err)
+
+		retry, delay := g.shouldRetry(ctx, firstStart, attempt, req, resp, err)
+		if !retry {
+			break
+		}
+		if resp != nil {
+			// Draining to be able to reuse the connection.
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, retryDrainSize))
+			resp.Body.Close()
+			g.stats.finish()
+		}
+		g.stats.retry()
+		if err := g.sleep(ctx, delay); err != nil {
+			return nil, &RequestError{RequestID: requestID, Err: err}
+		}
+	}
 	if err != nil {
-		return Datapoints{err, "", nil}
+		return nil, &RequestError{RequestID: requestID, Err: err}
+	}
+
+	body := resp.Body
+	if g.stats != nil {
+		body = &countingBody{ReadCloser: body, stats: g.stats}
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipped, err := gzip.NewReader(body)
+		if err != nil {
+			body.Close()
+			return nil, err
+		}
+		body = &gzipBody{gzipped, body}
 	}
 
-	points, err := parseGraphiteResponse(body)
-	return parseSingleGraphiteResponse(points, err)
+	// Limiting decompressed bytes, since that's what ends up in memory.
+	if g.MaxResponseBytes > 0 {
+		body = newLimitedBody(body, g.MaxResponseBytes, targets)
+	}
+	resp.Body = &contextBody{body, ctx, cancel}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newHTTPError(resp, targets, requestID)
+	}
+	return resp, nil
+}
+
+// Closes both the gzip reader and the underlying response body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
 }
 
-func parseSingleGraphiteResponse(dpss []Datapoints, err error) (dps Datapoints) {
-	if len(dpss) == 0 {
-		dps.err = errors.New("Unexpected Graphite response. No targets were matched.")
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// Stops reading a response body as soon as ctx is done, failing with
+// ctx.Err() rather than whatever error cancellation caused further down.
+type contextBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (b *contextBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (b *contextBody) Read(p []byte) (int, error) {
+	if err := b.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		if ctxErr := b.ctx.Err(); ctxErr != nil {
+			return n, ctxErr
+		}
+	}
+	return n, err
+}
+
+// The only series of dpss. With requireDatapoints, a series without
+// datapoints fails with an *EmptySeriesError.
+func parseSingleGraphiteResponse(dpss []Datapoints, err error, requireDatapoints bool) (dps Datapoints) {
+	if err != nil {
+		dps.err = err
+		return
 	}
-	if len(dpss) > 1 {
-		dps.err = errors.New("Unexpected Graphite response. More than one target were returned.")
+	if dps.err = checkSingleTarget(len(dpss)); dps.err != nil {
+		return
 	}
-	if dps.err != nil {
+	if requireDatapoints && countDatapoints(dpss[0].points) == 0 {
+		dps.err = &EmptySeriesError{dpss[0].Target}
 		return
 	}
 
@@ -387,28 +1040,123 @@ func parseSingleGraphiteResponse(dpss []Datapoints, err error) (dps Datapoints)
 	return
 }
 
+// Whether single series queries made with opts fail for series without
+// datapoints.
+func (g *Client) requireDatapoints(opts []QueryOption) bool {
+	return g.emptySeriesError || newQueryOptions(opts).emptySeries
+}
+
 func parseGraphiteResponse(body []byte) (MultiDatapoints, error) {
-	var res []target
+	return decodeGraphiteResponse(bytes.NewReader(body))
+}
 
-	decoder := json.NewDecoder(bytes.NewBuffer(body))
+// Decodes a render response one target at a time, keeping memory usage
+// proportional to the largest target rather than the whole response.
+func decodeGraphiteResponse(r io.Reader) (MultiDatapoints, error) {
+	// Non-finite values become nulls.
+	decoder := json.NewDecoder(newNonFiniteReader(r))
 
 	// Important to distinguish between ints and floats.
 	decoder.UseNumber()
 
-	err := decoder.Decode(&res)
-	datapoints := make([]Datapoints, len(res))
-	for i, points := range res {
-		datapoints[i].Target = points.Target
-		datapoints[i].points = points.Datapoints
+	token, err := decoder.Token()
+	if err != nil {
+		return MultiDatapoints{}, err
+	}
+	if token == nil {
+		// A JSON null.
+		return MultiDatapoints{}, nil
+	}
+	if token != json.Delim('[') {
+		return MultiDatapoints{}, fmt.Errorf("Unexpected Graphite response. Expected array, got: %v", token)
+	}
+
+	var datapoints MultiDatapoints
+	var errs []error
+	for decoder.More() {
+		var t target
+		err := decoder.Decode(&t)
+		if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			return MultiDatapoints{}, err
+		}
+		if err == nil && len(t.Datapoints) > 0 {
+			// Not decoding, only making sure AsInts and AsFloats won't
+			// fail on syntax.
+			err = scanDatapoints(t.Datapoints, ignoreDatapoint)
+		}
+
+		// A malformed series doesn't fail the others.
+		d := Datapoints{Target: t.Target, Tags: t.Tags, points: t.Datapoints}
+		if err != nil {
+			d = Datapoints{err: err, Target: t.Target, Tags: t.Tags}
+			errs = append(errs, fmt.Errorf("Unable to decode %q: %w", t.Target, err))
+		}
+		datapoints = append(datapoints, d)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return MultiDatapoints{}, err
+	}
+
+	if datapoints == nil {
+		datapoints = MultiDatapoints{}
+	}
+	return datapoints, errors.Join(errs...)
+}
+
+func ignoreDatapoint([]byte, time.Time) error {
+	return nil
+}
+
+// Builds the raw datapoints of a Datapoints for response formats other than
+// JSON.
+type datapointsBuilder struct {
+	buf bytes.Buffer
+}
+
+// Appends a datapoint. value must be a JSON number, or nil for null.
+func (b *datapointsBuilder) add(value []byte, unixTime int64) {
+	if b.buf.Len() == 0 {
+		b.buf.WriteByte('[')
+	} else {
+		b.buf.WriteByte(',')
+	}
+	b.buf.WriteByte('[')
+	if value == nil {
+		b.buf.WriteString("null")
+	} else {
+		b.buf.Write(value)
 	}
+	b.buf.WriteByte(',')
+	b.buf.WriteString(strconv.FormatInt(unixTime, 10))
+	b.buf.WriteByte(']')
+}
 
-	return MultiDatapoints(datapoints), err
+// Formats f as a JSON number that is never mistaken for an int, or nil for
+// NaN and infinities.
+func formatFloatValue(f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	v := strconv.AppendFloat(nil, f, 'g', -1, 64)
+	if !bytes.ContainsAny(v, ".e") {
+		v = append(v, ".0"...)
+	}
+	return v
+}
+
+func (b *datapointsBuilder) datapoints(target string) Datapoints {
+	if b.buf.Len() == 0 {
+		return Datapoints{Target: target, points: json.RawMessage("[]")}
+	}
+	b.buf.WriteByte(']')
+	return Datapoints{Target: target, points: b.buf.Bytes()}
 }
 
 type queryResult []target
 
 type target struct {
-	Target string `json:"target"`
+	Target string            `json:"target"`
+	Tags   map[string]string `json:"tags,omitempty"`
 
 	// Datapoints are either
 	//
@@ -417,5 +1165,59 @@ type target struct {
 	// or
 	//
 	//     [[FLOAT, FLOAT], ..., [FLOAT, FLOAT]] (type []floatDatapoint).
-	Datapoints [][]interface{} `json:"datapoints"`
+	//
+	// Kept raw until converted by Datapoints.
+	Datapoints json.RawMessage `json:"datapoints"`
+}
+
+// Marshals to the Graphite render JSON shape,
+//
+//	{"target": "...", "tags": {...}, "datapoints": [[VALUE, TIMESTAMP], ...]}
+//
+// tags is left out if Tags is nil. Values are kept as returned by Graphite,
+// so ints stay ints. The error of a
+// failed query isn't marshalled.
+func (d Datapoints) MarshalJSON() ([]byte, error) {
+	t := target{Target: d.Target, Tags: d.Tags, Datapoints: d.points}
+	if len(t.Datapoints) == 0 {
+		t.Datapoints = json.RawMessage("[]")
+	}
+	return json.Marshal(t)
+}
+
+// Unmarshals the Graphite render JSON shape. See MarshalJSON.
+func (d *Datapoints) UnmarshalJSON(data []byte) error {
+	var t target
+	if err := json.Unmarshal(data, &t); err != nil {
+		return err
+	}
+	if len(t.Datapoints) == 0 || string(t.Datapoints) == "null" {
+		t.Datapoints = json.RawMessage("[]")
+	}
+	if err := scanDatapoints(t.Datapoints, func([]byte, time.Time) error { return nil }); err != nil {
+		return err
+	}
+	*d = Datapoints{Target: t.Target, Tags: t.Tags, points: t.Datapoints}
+	return nil
+}
+
+// Marshals to a Graphite render JSON response. nil becomes an empty array.
+func (m MultiDatapoints) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]Datapoints(m))
+}
+
+// Unmarshals a Graphite render JSON response. A JSON null becomes empty.
+func (m *MultiDatapoints) UnmarshalJSON(data []byte) error {
+	var dpss []Datapoints
+	if err := json.Unmarshal(data, &dpss); err != nil {
+		return err
+	}
+	if dpss == nil {
+		dpss = []Datapoints{}
+	}
+	*m = dpss
+	return nil
 }
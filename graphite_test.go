@@ -1,11 +1,25 @@
 package infrastructure
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,7 +48,7 @@ func TestIntegrationMulti(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	points := pointlist.asMap()
+	points := pointlist.AsMap()
 
 	if len(points) != 2 {
 		t.Fatal("Missing points:", len(points))
@@ -142,7 +156,7 @@ func TestParsingIntGraphiteResult(t *testing.T) {
 	if response[0].err != nil {
 		t.Error("Response should not have had any errors.")
 	}
-	if l := len(response[0].points); l != 4 {
+	if l := countDatapoints(response[0].points); l != 4 {
 		t.Fatal("Not enough points:", l)
 	}
 
@@ -225,10 +239,31 @@ func TestQueryRealGraphite(t *testing.T) {
 }
 
 func TestGraphiteDurationString(t *testing.T) {
-	aWeek := 7 * 24 * time.Hour
-	s := graphiteSinceString(aWeek)
-	if s != "-10080minutes" {
-		t.Error(s)
+	t.Parallel()
+
+	for _, test := range []struct {
+		ago      time.Duration
+		expected string
+	}{
+		{7 * 24 * time.Hour, "-7days"},
+		{30 * 24 * time.Hour, "-30days"},
+		{36 * time.Hour, "-36hours"},
+		{24*time.Hour + time.Minute, "-1441minutes"},
+		{time.Hour, "-1hours"},
+		{15 * time.Minute, "-15minutes"},
+		{90 * time.Second, "-90s"},
+		{30 * time.Second, "-30s"},
+		// Rounded to the nearest second.
+		{time.Hour + 499*time.Millisecond, "-1hours"},
+		{time.Hour - 500*time.Millisecond, "-1hours"},
+		{time.Hour + 500*time.Millisecond, "-3601s"},
+		{1500 * time.Millisecond, "-2s"},
+		// At least a second.
+		{time.Nanosecond, "-1s"},
+	} {
+		if s := graphiteSinceString(test.ago); s != test.expected {
+			t.Errorf("Unexpected string for %s: %s", test.ago, s)
+		}
 	}
 }
 
@@ -242,7 +277,7 @@ func TestFindRealGraphite(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res, err := c.Find("carbon.*", nil)
+	res, err := c.Find("carbon.*")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -251,3 +286,1446 @@ func TestFindRealGraphite(t *testing.T) {
 		t.Error("Expected more results.")
 	}
 }
+
+// The find fixtures mirror the /metrics/find responses of graphite-web 0.9
+// and 1.1, which encode booleans as 0 and 1, and of graphite-api, which uses
+// JSON booleans, for a "carbon.*" query.
+func TestDecodeFindResponseFixtures(t *testing.T) {
+	t.Parallel()
+
+	expected := []FindResultItem{
+		{Leaf: false, Text: "agents", Id: "carbon.agents", Expandable: true, AllowChildren: true},
+		{Leaf: true, Text: "cpuUsage", Id: "carbon.cpuUsage", Expandable: false, AllowChildren: false},
+	}
+	for _, fixture := range []string{"find_graphite_web_0.9.json", "find_graphite_web_1.1.json", "find_graphite_api.json"} {
+		f, err := os.Open(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		items, err := decodeFindResponse(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("Unable to decode %s: %v", fixture, err)
+			continue
+		}
+		if !reflect.DeepEqual(items, expected) {
+			t.Errorf("Unexpected items for %s: %+v", fixture, items)
+		}
+	}
+}
+
+// Mirrors a hosted Graphite leaving out "expandable" and "allowChildren", and
+// "id" for some branches.
+func TestDecodeFindResponseMissingFields(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/find_missing_fields.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	items, err := decodeFindResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []FindResultItem{
+		{Leaf: false, Text: "agents", Id: "agents", Expandable: true, AllowChildren: true, Defaulted: []string{"id", "expandable", "allowChildren"}},
+		{Leaf: true, Text: "cpuUsage", Id: "carbon.cpuUsage", Expandable: false, AllowChildren: false, Defaulted: []string{"expandable", "allowChildren"}},
+		{Leaf: false, Text: "relays", Id: "carbon.relays", Expandable: true, AllowChildren: true, Defaulted: []string{"allowChildren"}},
+	}
+	if !reflect.DeepEqual(items, expected) {
+		t.Errorf("Unexpected items: %+v", items)
+	}
+}
+
+func TestFlexibleBool(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		json     string
+		expected bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"1", true},
+		{"0", false},
+		{"2", true},
+		{"0.0", false},
+		{`"1"`, true},
+		{`"0"`, false},
+		{`"true"`, true},
+		{`"false"`, false},
+		{"null", false},
+	} {
+		var b flexibleBool
+		if err := json.Unmarshal([]byte(test.json), &b); err != nil || bool(b) != test.expected {
+			t.Errorf("Unexpected result for %s: %v %v", test.json, b, err)
+		}
+	}
+	for _, invalid := range []string{`"yes"`, `""`, "[]", "{}"} {
+		var b flexibleBool
+		if err := json.Unmarshal([]byte(invalid), &b); err == nil {
+			t.Error("Expected error for", invalid)
+		}
+	}
+}
+
+// testdata/render_tags.json mirrors a Graphite 1.1 render response, with a
+// tags object per series, and testdata/render_no_tags.json one of earlier
+// versions.
+func TestDecodeGraphiteResponseTags(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/render_tags.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	series, err := decodeGraphiteResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 {
+		t.Fatal("Unexpected number of series:", len(series))
+	}
+	if !reflect.DeepEqual(series[0].Tags, map[string]string{"name": "servers.web01.cpu"}) {
+		t.Error("Unexpected tags:", series[0].Tags)
+	}
+	if !reflect.DeepEqual(series[1].Tags, map[string]string{"name": "cpu", "dc": "eu", "host": "web02"}) {
+		t.Error("Unexpected tags:", series[1].Tags)
+	}
+	if points, err := series[1].AsInts(); err != nil || len(points) != 2 {
+		t.Error("Unexpected points:", points, err)
+	}
+
+	if eu := series.FilterByTag("dc", "eu"); len(eu) != 1 || eu[0].Target != "cpu;dc=eu;host=web02" {
+		t.Error("Unexpected series:", eu.Targets())
+	}
+	if cpu := series.FilterByTag("name", "cpu"); len(cpu) != 2 {
+		t.Error("Unexpected series:", cpu.Targets())
+	}
+	if none := series.FilterByTag("dc", "asia"); none == nil || len(none) != 0 {
+		t.Error("Unexpected series:", none)
+	}
+
+	// Marshalling keeps the tags.
+	b, err := json.Marshal(series[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshalled Datapoints
+	if err := json.Unmarshal(b, &unmarshalled); err != nil || !reflect.DeepEqual(unmarshalled.Tags, series[1].Tags) {
+		t.Error("Unexpected tags after marshalling:", string(b), err)
+	}
+
+	f, err = os.Open("testdata/render_no_tags.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	series, err = decodeGraphiteResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Tags != nil || series[1].Tags != nil {
+		t.Error("Unexpected series:", series)
+	}
+	if filtered := series.FilterByTag("name", "servers.web01.cpu"); len(filtered) != 0 {
+		t.Error("Unexpected series:", filtered.Targets())
+	}
+	if b, err := json.Marshal(series[0]); err != nil || strings.Contains(string(b), "tags") {
+		t.Error("Unexpected JSON:", string(b), err)
+	}
+}
+
+// A render response with the given number of targets and points per target.
+func syntheticGraphiteResponse(targets, points int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < targets; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"target": "machine%d.jvm.gc.PS-MarkSweep.runs", "datapoints": [`, i)
+		for j := 0; j < points; j++ {
+			if j > 0 {
+				buf.WriteString(",")
+			}
+			if j%10 == 0 {
+				fmt.Fprintf(&buf, "[null, %d]", 1409763000+j*60)
+			} else {
+				fmt.Fprintf(&buf, "[%d.5, %d]", j, 1409763000+j*60)
+			}
+		}
+		buf.WriteString("]}")
+	}
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+func TestDecodeGraphiteResponseStreaming(t *testing.T) {
+	t.Parallel()
+
+	response, err := decodeGraphiteResponse(bytes.NewReader(syntheticGraphiteResponse(3, 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 3 {
+		t.Fatal("Unexpected number of targets:", len(response))
+	}
+	if response[2].Target != "machine2.jvm.gc.PS-MarkSweep.runs" {
+		t.Error("Unexpected target:", response[2].Target)
+	}
+	if points, err := response[1].AsFloats(); err != nil || len(points) != 20 {
+		t.Error("Unexpected points:", len(points), err)
+	}
+
+	for _, s := range []string{`null`, `[]`} {
+		if response, err := decodeGraphiteResponse(strings.NewReader(s)); err != nil || response == nil || len(response) != 0 {
+			t.Errorf("Unexpected result for %s: %v %v", s, response, err)
+		}
+	}
+	for _, s := range []string{``, `{}`, `[{"target": "a", "datapoints": [[1, 2]]}`, `<html>`} {
+		if _, err := decodeGraphiteResponse(strings.NewReader(s)); err == nil {
+			t.Errorf("Expected error for %q.", s)
+		}
+	}
+}
+
+func BenchmarkDecodeGraphiteResponse(b *testing.B) {
+	body := syntheticGraphiteResponse(200, 1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeGraphiteResponse(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The previous approach of reading the whole body before decoding it, kept
+// for comparison.
+func BenchmarkReadAllThenDecodeGraphiteResponse(b *testing.B) {
+	body := syntheticGraphiteResponse(200, 1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		all, err := ioutil.ReadAll(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var res []target
+		decoder := json.NewDecoder(bytes.NewReader(all))
+		decoder.UseNumber()
+		if err := decoder.Decode(&res); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLazyDatapointsDecoding(t *testing.T) {
+	t.Parallel()
+
+	s := `[{"target": "good", "datapoints": [[1.5, 1409763000], [null, 1409763060]]}, {"target": "bad", "datapoints": [["x", 1409763000]]}, {"target": "missing"}]`
+	response, err := parseGraphiteResponse([]byte(s))
+	if err == nil || !strings.Contains(err.Error(), `"bad"`) {
+		t.Error("Expected error for malformed datapoints:", err)
+	}
+	m := response.AsMap()
+	if len(m) != 3 {
+		t.Fatal("Unexpected targets:", len(m))
+	}
+
+	if points, err := m["good"].AsFloats(); err != nil || len(points) != 2 || *points[0].Value != 1.5 || points[1].Value != nil {
+		t.Error("Unexpected points:", points, err)
+	}
+	if _, err := m["bad"].AsFloats(); err == nil {
+		t.Error("Expected malformed datapoints to fail on conversion.")
+	}
+	if points, err := m["missing"].AsInts(); err != nil || points == nil || len(points) != 0 {
+		t.Error("Unexpected points:", points, err)
+	}
+}
+
+func BenchmarkDecodeWideConvertAll(b *testing.B) {
+	benchmarkDecodeWide(b, 5000)
+}
+
+func BenchmarkDecodeWideConvertNarrow(b *testing.B) {
+	benchmarkDecodeWide(b, 10)
+}
+
+// Decodes a response with 5000 targets, converting only some of them.
+func benchmarkDecodeWide(b *testing.B, convert int) {
+	body := syntheticGraphiteResponse(5000, 100)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := decodeGraphiteResponse(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, dps := range response[:convert] {
+			if _, err := dps.AsFloats(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkQueryFloats(b *testing.B) {
+	body := syntheticGraphiteResponse(1, 10000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	interval := TimeInterval{now.Add(-time.Hour), now}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.QueryFloats("machine0.jvm.gc.PS-MarkSweep.runs", interval); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	t.Parallel()
+
+	body := syntheticGraphiteResponse(1, 1000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics/find" {
+			fmt.Fprint(w, `[{"leaf": 0, "text": "carbon", "id": "carbon", "expandable": 1, "allowChildren": 1}]`)
+			return
+		}
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.MaxResponseBytes = int64(len(body))
+	if _, err := c.QueryMultiSince([]string{"machine*.runs"}, time.Hour); err != nil {
+		t.Error("Unexpected error for response exactly at the limit:", err)
+	}
+
+	c.MaxResponseBytes = int64(len(body)) - 1
+	_, err = c.QueryMultiSince([]string{"machine*.runs", "other"}, time.Hour)
+	tooLarge, ok := err.(*ResponseTooLargeError)
+	if !ok {
+		t.Fatal("Unexpected error:", err)
+	}
+	if tooLarge.Limit != int64(len(body))-1 || strings.Join(tooLarge.Targets, ",") != "machine*.runs,other" {
+		t.Errorf("Unexpected error: %+v", tooLarge)
+	}
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Error("Expected error to wrap ErrResponseTooLarge.")
+	}
+
+	if _, err := c.QueryFloatsSince("machine0.jvm.gc.PS-MarkSweep.runs", time.Hour); !errors.Is(err, ErrResponseTooLarge) {
+		t.Error("Unexpected error:", err)
+	}
+
+	c.MaxResponseBytes = 10
+	if _, err := c.Find("carbon.*"); !errors.Is(err, ErrResponseTooLarge) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestGzipResponse(t *testing.T) {
+	t.Parallel()
+
+	body := syntheticGraphiteResponse(1, 1000)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(body)
+	gz.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Making sure the transport doesn't decompress on its own.
+	c.Client.Transport = &http.Transport{DisableCompression: true}
+
+	points, err := c.QueryFloatsSince("machine0.jvm.gc.PS-MarkSweep.runs", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 1000 {
+		t.Error("Unexpected number of points:", len(points))
+	}
+
+	// The limit applies to decompressed bytes.
+	c.MaxResponseBytes = int64(compressed.Len()) + 1
+	if _, err := c.QueryFloatsSince("machine0.jvm.gc.PS-MarkSweep.runs", time.Hour); !errors.Is(err, ErrResponseTooLarge) {
+		t.Error("Unexpected error:", err)
+	}
+	c.MaxResponseBytes = int64(len(body))
+	if _, err := c.QueryFloatsSince("machine0.jvm.gc.PS-MarkSweep.runs", time.Hour); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	c.DisableCompression = true
+	if _, err := c.QueryFloatsSince("machine0.jvm.gc.PS-MarkSweep.runs", time.Hour); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestQueryRaw(t *testing.T) {
+	t.Parallel()
+
+	// Deliberately odd field order and whitespace.
+	fixture := []byte(`[{"datapoints": [[1.0, 1409763000], [null,1409763060]],  "target": "a.b", "tags": {"name": "a.b"}}]` + "\n")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("format") != "json" {
+			t.Error("Unexpected format:", r.FormValue("format"))
+		}
+		w.Write(fixture)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	raw, err := c.QueryRaw([]string{"a.b"}, TimeInterval{now.Add(-time.Hour), now}, WithFormat(FormatMsgpack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, fixture) {
+		t.Errorf("Unexpected body: %s", raw)
+	}
+	if raw, err = c.QueryRawSince([]string{"a.b"}, time.Hour); err != nil || !bytes.Equal(raw, fixture) {
+		t.Errorf("Unexpected body: %s %v", raw, err)
+	}
+
+	c.MaxResponseBytes = int64(len(fixture)) - 1
+	if _, err := c.QueryRawSince([]string{"a.b"}, time.Hour); !errors.Is(err, ErrResponseTooLarge) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestMultiDatapointsLookup(t *testing.T) {
+	t.Parallel()
+
+	m := MultiDatapoints{
+		{Target: "a", points: []byte("[[1, 1409763000]]")},
+		{Target: "b"},
+		{Target: "a", points: []byte("[[2, 1409763000]]")},
+	}
+
+	asMap := m.AsMap()
+	if len(asMap) != 2 {
+		t.Error("Unexpected number of targets:", len(asMap))
+	}
+	if ints, _ := asMap["a"].AsInts(); len(ints) != 1 || *ints[0].Value != 2 {
+		t.Error("Expected last duplicate to win:", ints)
+	}
+
+	a, ok := m.ByTarget("a")
+	if !ok {
+		t.Fatal("Missing target.")
+	}
+	if ints, _ := a.AsInts(); len(ints) != 1 || *ints[0].Value != 2 {
+		t.Error("Expected last duplicate to win:", ints)
+	}
+	if _, ok := m.ByTarget("c"); ok {
+		t.Error("Unexpected target.")
+	}
+}
+
+func TestMultiDatapointsTargets(t *testing.T) {
+	t.Parallel()
+
+	m := MultiDatapoints{{Target: "b"}, {Target: "a"}, {Target: "b"}, {Target: "c"}}
+	if targets := m.Targets(); !reflect.DeepEqual(targets, []string{"b", "a", "c"}) {
+		t.Error("Unexpected targets:", targets)
+	}
+	if !m.ContainsTarget("c") || m.ContainsTarget("d") {
+		t.Error("Unexpected ContainsTarget result.")
+	}
+	if targets := (MultiDatapoints{}).Targets(); targets == nil || len(targets) != 0 {
+		t.Error("Unexpected targets:", targets)
+	}
+}
+
+func TestMultiDatapointsConvertMaps(t *testing.T) {
+	t.Parallel()
+
+	m := MultiDatapoints{
+		{Target: "ints", points: []byte("[[1, 1409763000], [null, 1409763060]]")},
+		{Target: "floats", points: []byte("[[1.5, 1409763000], [2.7, 1409763060]]")},
+	}
+
+	ints, err := m.AsIntsMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 2 || len(ints["ints"]) != 2 || *ints["floats"][1].Value != 2 {
+		t.Error("Unexpected ints:", ints)
+	}
+	floats, err := m.AsFloatsMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(floats) != 2 || *floats["ints"][0].Value != 1 || *floats["floats"][0].Value != 1.5 {
+		t.Error("Unexpected floats:", floats)
+	}
+
+	broken := append(MultiDatapoints{{Target: "broken", points: []byte(`[["a", 1409763000]]`)}}, m...)
+	if _, err := broken.AsFloatsMap(); err == nil || !strings.Contains(err.Error(), `"broken"`) {
+		t.Error("Unexpected error:", err)
+	}
+
+	partial, err := broken.AsIntsMap(PartialResults())
+	if err == nil || !strings.Contains(err.Error(), `"broken"`) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, ok := partial["broken"]; ok || len(partial) != 2 {
+		t.Error("Unexpected partial result:", partial)
+	}
+}
+
+func TestDatapointsLenAndTimeRange(t *testing.T) {
+	t.Parallel()
+
+	d := Datapoints{Target: "a", points: []byte("[[1.5, 1409763000], [null, 1409763060], [null, 1409763120]]")}
+	if d.Len() != 3 || d.IsEmpty() {
+		t.Error("Unexpected length:", d.Len())
+	}
+	from, to, ok := d.TimeRange()
+	if !ok || !from.Equal(time.Unix(1409763000, 0)) || !to.Equal(time.Unix(1409763120, 0)) {
+		t.Error("Unexpected time range:", from, to, ok)
+	}
+
+	single := Datapoints{Target: "a", points: []byte("[[null,1409763000]]")}
+	if from, to, ok := single.TimeRange(); !ok || !from.Equal(to) || single.Len() != 1 {
+		t.Error("Unexpected time range:", from, to, ok)
+	}
+
+	for _, empty := range []Datapoints{
+		{Target: "a", points: []byte("[]")},
+		{Target: "a"},
+		{err: errDatapointsSyntax, points: []byte("[[1, 1409763000]]")},
+	} {
+		if empty.Len() != 0 || !empty.IsEmpty() {
+			t.Error("Unexpected length:", empty.Len())
+		}
+		if _, _, ok := empty.TimeRange(); ok {
+			t.Error("Expected no time range.")
+		}
+	}
+}
+
+func TestAsIntsStrict(t *testing.T) {
+	t.Parallel()
+
+	exact := Datapoints{Target: "a", points: []byte("[[2.0, 1409763000], [3, 1409763060], [null, 1409763120], [-4e2, 1409763180]]")}
+	ints, err := exact.AsInts(StrictInts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 4 || *ints[0].Value != 2 || *ints[1].Value != 3 || ints[2].Value != nil || *ints[3].Value != -400 {
+		t.Error("Unexpected points:", ints)
+	}
+
+	for _, fixture := range []struct {
+		points string
+		value  string
+	}{
+		{"[[1, 1409763000], [1.5, 1409763060]]", "1.5"},
+		// Larger than 2^53, so not necessarily the value Graphite had.
+		{"[[9007199254740993.0, 1409763060]]", "9007199254740993.0"},
+		{"[[1e19, 1409763060]]", "1e19"},
+	} {
+		d := Datapoints{Target: "a", points: []byte(fixture.points)}
+		_, err := d.AsInts(StrictInts())
+		var notInteger *NotIntegerError
+		if !errors.As(err, &notInteger) {
+			t.Error("Unexpected error:", err)
+			continue
+		}
+		if notInteger.Target != "a" || notInteger.Value != fixture.value || notInteger.Time.Unix() != 1409763060 {
+			t.Errorf("Unexpected error: %+v", notInteger)
+		}
+
+		// Lenient by default, as long as the value fits.
+		if _, err := d.AsInts(); err != nil && !errors.Is(err, ErrValueOverflow) {
+			t.Error("Unexpected error:", err)
+		}
+	}
+}
+
+func TestValueOverflow(t *testing.T) {
+	t.Parallel()
+
+	for _, fixture := range []string{
+		// Larger than the largest int64.
+		`[[9223372036854775808, 1409763060]]`,
+		`[[1e19, 1409763060]]`,
+		`[[-9.3e18, 1409763060]]`,
+		// Within range, but not exactly representable as a float.
+		`[[9007199254740993.5, 1409763060]]`,
+	} {
+		d := Datapoints{Target: "bytes", points: []byte(fixture)}
+		_, err := d.AsInts()
+		if !errors.Is(err, ErrValueOverflow) {
+			t.Errorf("Unexpected error for %s: %v", fixture, err)
+			continue
+		}
+		var overflow *ValueOverflowError
+		if errors.As(err, &overflow); overflow.Target != "bytes" || overflow.Time.Unix() != 1409763060 || !strings.Contains(fixture, overflow.Value) {
+			t.Errorf("Unexpected error: %+v", overflow)
+		}
+
+		// Representable, if not exactly, as floats.
+		if _, err := d.AsFloats(); err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	// Larger than 2^53, but exact.
+	d := Datapoints{Target: "bytes", points: []byte(`[[9007199254740993, 1409763000], [18014398509481984.0, 1409763060], [9223372036854775807, 1409763120]]`)}
+	ints, err := d.AsInts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ints[0].Value != 9007199254740993 || *ints[1].Value != 18014398509481984 || *ints[2].Value != math.MaxInt64 {
+		t.Error("Unexpected values:", *ints[0].Value, *ints[1].Value, *ints[2].Value)
+	}
+
+	floats := Datapoints{Target: "bytes", points: []byte(`[[1e400, 1409763060]]`)}
+	if _, err := floats.AsFloats(); !errors.Is(err, ErrValueOverflow) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestDatapointsJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	response := `[{"target": "a", "datapoints": [[1, 1409763000], [null, 1409763060], [2.5, 1409763120]]}, {"target": "b", "datapoints": []}]`
+	original, err := parseGraphiteResponse([]byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"target":"a","datapoints":[[1,1409763000],[null,1409763060],[2.5,1409763120]]},{"target":"b","datapoints":[]}]`
+	if string(b) != expected {
+		t.Error("Unexpected JSON:", string(b))
+	}
+
+	var decoded MultiDatapoints
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].Target != "a" || decoded[1].Target != "b" {
+		t.Fatal("Unexpected datapoints:", decoded)
+	}
+	// Ints stay ints.
+	if ints, err := decoded[0].AsInts(StrictInts()); err == nil {
+		t.Error("Expected error for float value:", ints)
+	}
+	floats, err := decoded[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(floats) != 3 || *floats[0].Value != 1 || floats[1].Value != nil || *floats[2].Value != 2.5 {
+		t.Error("Unexpected points:", floats)
+	}
+	if !decoded[1].IsEmpty() {
+		t.Error("Expected no points.")
+	}
+
+	// The error isn't marshalled.
+	b, err = json.Marshal(Datapoints{err: errDatapointsSyntax, Target: "c"})
+	if err != nil || string(b) != `{"target":"c","datapoints":[]}` {
+		t.Error("Unexpected JSON:", string(b), err)
+	}
+	if b, err := json.Marshal(MultiDatapoints(nil)); err != nil || string(b) != "[]" {
+		t.Error("Unexpected JSON:", string(b), err)
+	}
+
+	var single Datapoints
+	if err := json.Unmarshal([]byte(`{"target": "a", "datapoints": [[1, 1409763000], [2, 1409763060]]}`), &single); err != nil {
+		t.Fatal(err)
+	}
+	if ints, err := single.AsInts(StrictInts()); err != nil || len(ints) != 2 || *ints[1].Value != 2 {
+		t.Error("Unexpected points:", ints, err)
+	}
+	if err := json.Unmarshal([]byte(`{"target": "a", "datapoints": [[1]]}`), &single); err == nil {
+		t.Error("Expected error for malformed datapoints.")
+	}
+}
+
+func TestMaxTargetsPerRequest(t *testing.T) {
+	t.Parallel()
+
+	var batches [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if len(r.Form["from"]) != 1 {
+			t.Error("Unexpected from:", r.Form["from"])
+		}
+		batches = append(batches, r.Form["target"])
+		var series []string
+		for _, target := range r.Form["target"] {
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": []}`, target))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxTargetsPerRequest = 2
+
+	targets := []string{"a", "b", "c", "d", "e"}
+	series, err := c.QueryMultiSince(targets, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 {
+		t.Error("Unexpected requests:", batches)
+	}
+	if !reflect.DeepEqual(series.Targets(), targets) || len(series) != len(targets) {
+		t.Error("Unexpected targets:", series.Targets())
+	}
+
+	// Single requests aren't affected.
+	batches = nil
+	if _, err := c.QueryMulti([]string{"a", "b"}, TimeInterval{time.Unix(1409763000, 0), time.Unix(1409763000, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Error("Unexpected requests:", batches)
+	}
+}
+
+func TestQueryMultiPartialResponse(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"target": "a", "datapoints": [[1, 1409763000]]},
+			{"target": "b", "datapoints": [[1, "yesterday"]]},
+			{"target": "c", "datapoints": {"not": "an array"}},
+			{"target": "d", "datapoints": [[2, 1409763000]]}
+		]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series, err := c.QueryMultiSince([]string{"*"}, time.Hour)
+	if err == nil || !strings.Contains(err.Error(), `"b"`) || !strings.Contains(err.Error(), `"c"`) || strings.Contains(err.Error(), `"a"`) {
+		t.Error("Unexpected error:", err)
+	}
+	if !reflect.DeepEqual(series.Targets(), []string{"a", "b", "c", "d"}) {
+		t.Fatal("Unexpected targets:", series.Targets())
+	}
+
+	var ok []string
+	for _, s := range series {
+		if s.Err() != nil {
+			if _, err := s.AsFloats(); err != s.Err() {
+				t.Error("Unexpected error:", err)
+			}
+			continue
+		}
+		ok = append(ok, s.Target)
+		if points, err := s.AsInts(); err != nil || len(points) != 1 {
+			t.Error("Unexpected points:", points, err)
+		}
+	}
+	if !reflect.DeepEqual(ok, []string{"a", "d"}) {
+		t.Error("Unexpected successful targets:", ok)
+	}
+
+	// Batches keep partial responses too.
+	c.MaxTargetsPerRequest = 1
+	series, err = c.QueryMultiSince([]string{"x", "y"}, time.Hour)
+	if err == nil || len(series) != 8 {
+		t.Error("Unexpected result:", len(series), err)
+	}
+}
+
+func TestCancelDuringBodyRead(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An endless response.
+		w.Write([]byte(`[{"target": "a", "datapoints": [`))
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-done:
+				return
+			default:
+			}
+			fmt.Fprintf(w, "[%d, %d],", i, 1409763000+i)
+			if i%1000 == 0 {
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, query := range map[string]func(ctx context.Context) error{
+		"QueryMultiSince": func(ctx context.Context) error {
+			_, err := c.QueryMultiSince([]string{"a"}, time.Hour, WithContext(ctx))
+			return err
+		},
+		"QueryRawSince": func(ctx context.Context) error {
+			_, err := c.QueryRawSince([]string{"a"}, time.Hour, WithContext(ctx))
+			return err
+		},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		err := query(ctx)
+		if err != context.Canceled {
+			t.Error(name, "unexpected error:", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Error(name, "took too long:", elapsed)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	t.Parallel()
+
+	base := &http.Client{Timeout: time.Minute}
+	c, err := New("http://graphite.example.com", WithHTTPClient(base), WithTimeout(time.Second), WithMaxResponseBytes(10), WithoutCompression(), WithMaxTargetsPerRequest(5), WithQueryCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Client == base || c.Client.Timeout != time.Second || base.Timeout != time.Minute {
+		t.Error("Expected a copy of the HTTP client:", c.Client.Timeout, base.Timeout)
+	}
+	if c.MaxResponseBytes != 10 || !c.DisableCompression || c.MaxTargetsPerRequest != 5 || c.Cache == nil {
+		t.Error("Unexpected client:", c)
+	}
+
+	// The zero value of the HTTP client works.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	if _, err := (&Client{URL: *u}).QueryMultiSince([]string{"a"}, time.Hour); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+
+	// So do options modifying it.
+	clone := (&Client{URL: *u}).Clone(WithTimeout(time.Second))
+	if clone.Client == nil || clone.Client == http.DefaultClient || clone.Client.Timeout != time.Second || http.DefaultClient.Timeout != 0 {
+		t.Error("Unexpected HTTP client:", clone.Client)
+	}
+	c, err = New(ts.URL, WithHTTPClient(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Client == nil || c.Client == http.DefaultClient {
+		t.Error("Unexpected HTTP client:", c.Client)
+	}
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics/find" {
+			w.Write([]byte(`[{"leaf": 1, "text": "b", "id": "a.b", "expandable": 0, "allowChildren": 0}]`))
+			return
+		}
+		r.ParseForm()
+		var series []string
+		for _, target := range r.Form["target"] {
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [[1, 1409763000]]}`, target))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL, WithTimeout(10*time.Second), WithMaxTargetsPerRequest(1), WithQueryCache(time.Minute, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				target := fmt.Sprintf("a.%d", j%3)
+				if points, err := c.QuerySince(target, time.Hour).AsInts(); err != nil || len(points) != 1 {
+					t.Error("Unexpected points:", points, err)
+				}
+				if series, err := c.QueryMulti([]string{"a.b", target}, TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}); err != nil || len(series) != 2 {
+					t.Error("Unexpected series:", series, err)
+				}
+				if items, err := c.Find("a.*"); err != nil || len(items) != 1 {
+					t.Error("Unexpected items:", items, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type countingRoundTripper struct {
+	requests atomic.Int32
+}
+
+func (rt *countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"target": "a", "datapoints": []}]`))
+	}))
+	defer ts.Close()
+
+	transport := &countingRoundTripper{}
+	parent, err := New(ts.URL, WithHTTPClient(&http.Client{Transport: transport}), WithMaxResponseBytes(1000), WithQueryCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := parent.Clone(WithTimeout(time.Second), WithMaxResponseBytes(2000))
+
+	if parent.Client.Timeout != 0 || clone.Client.Timeout != time.Second {
+		t.Error("Unexpected timeouts:", parent.Client.Timeout, clone.Client.Timeout)
+	}
+	if parent.MaxResponseBytes != 1000 || clone.MaxResponseBytes != 2000 {
+		t.Error("Unexpected limits:", parent.MaxResponseBytes, clone.MaxResponseBytes)
+	}
+	if clone.Cache == parent.Cache || clone.Cache.ttl != time.Minute {
+		t.Error("Expected a separate cache.")
+	}
+	clone.URL.Path = "/other"
+	clone.DisableCompression = true
+	if parent.URL.Path != "" || parent.DisableCompression {
+		t.Error("Parent modified:", parent)
+	}
+
+	// The transport is shared.
+	for _, c := range []*Client{parent, clone} {
+		if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := transport.requests.Load(); n != 2 {
+		t.Error("Unexpected number of requests:", n)
+	}
+}
+
+func TestNewFromURLPtr(t *testing.T) {
+	t.Parallel()
+
+	var auth []string
+	var requestURLs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		auth = append(auth, user+":"+password)
+		requestURLs = append(requestURLs, r.URL.String())
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL + "/graphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("user", "secret")
+	c := NewFromURLPtr(u)
+
+	// Modifying the original doesn't affect the client.
+	u.Path = "/other"
+	u.User = url.UserPassword("other", "other")
+	if c.URL.Path != "/graphite" || c.URL.User != nil {
+		t.Error("Unexpected URL:", c.URL.String())
+	}
+
+	_, err = c.QueryMultiSince([]string{"a"}, time.Hour)
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Error("Unexpected error:", err)
+	}
+	if len(auth) != 1 || auth[0] != "user:secret" || !strings.HasPrefix(requestURLs[0], "/graphite/render") {
+		t.Error("Unexpected requests:", auth, requestURLs)
+	}
+
+	c = NewFromURLPtr(u, WithBasicAuth("explicit", "pass"))
+	c.QueryMultiSince([]string{"a"}, time.Hour)
+	if auth[1] != "explicit:pass" {
+		t.Error("Unexpected auth:", auth[1])
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	socket := filepath.Join(t.TempDir(), "graphite.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skip("Unix domain sockets aren't supported:", err)
+	}
+	var mu sync.Mutex
+	var requests []string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Host+" "+r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/render":
+			w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+		case "/metrics/find":
+			w.Write([]byte(`[{"allowChildren": 0, "expandable": 0, "leaf": 1, "id": "a", "text": "a", "context": {}}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	for _, test := range []struct {
+		url  string
+		host string
+	}{
+		{"unix://" + socket, "localhost"},
+		{"unix://graphite.example.com" + socket, "graphite.example.com"},
+	} {
+		c, err := New(test.url, WithTimeout(5*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if points, err := c.QueryFloats("a", interval); err != nil || len(points) != 1 {
+			t.Error("Unexpected render result:", points, err)
+		}
+		if items, err := c.Find("a"); err != nil || len(items) != 1 {
+			t.Error("Unexpected find result:", items, err)
+		}
+		mu.Lock()
+		if fmt.Sprint(requests) != fmt.Sprintf("[%[1]s /render %[1]s /metrics/find]", test.host) {
+			t.Error("Unexpected requests:", requests)
+		}
+		requests = nil
+		mu.Unlock()
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	var requests, opened, closed atomic.Int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	waitFor := func(what string, done func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for", what)
+			}
+		}
+	}
+
+	c, err := New(ts.URL, WithMaxIdleConnsPerHost(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := c.Clone()
+	poller, err := NewPoller(c, "a", time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.Start(context.Background())
+	if result := <-poller.C; result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if _, err := c.QueryFloats("a", interval); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The poller stops, and the idle connection owned by c is closed.
+	waitFor("the poller", func() bool {
+		_, ok := <-poller.C
+		return !ok
+	})
+	waitFor("idle connections", func() bool { return closed.Load() == opened.Load() })
+
+	before := requests.Load()
+	if _, err := c.QueryFloats("a", interval); !errors.Is(err, ErrClientClosed) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.Find("a"); !errors.Is(err, ErrClientClosed) {
+		t.Error("Unexpected error:", err)
+	}
+	if requests.Load() != before {
+		t.Error("Closed client made requests.")
+	}
+	if err := c.Close(); err != nil {
+		t.Error("Unexpected error closing twice:", err)
+	}
+
+	// Clones are closed separately.
+	if _, err := clone.QueryFloats("a", interval); err != nil {
+		t.Error("Unexpected error for clone:", err)
+	}
+	clone.Close()
+
+	// A user supplied http.Client is left as is.
+	userClient := &http.Client{Transport: &http.Transport{}}
+	c, err = New(ts.URL, WithHTTPClient(userClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryFloats("a", interval); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	before = opened.Load()
+	resp, err := userClient.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if opened.Load() != before {
+		t.Error("Closed idle connections of user supplied client.")
+	}
+	userClient.CloseIdleConnections()
+
+	// Clients not created by a constructor can be closed, without effect.
+	if err := (&Client{}).Close(); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	t.Parallel()
+
+	const response = `[{"target": "a", "datapoints": [[1, 1409763000]]}]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("target") {
+		case "missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "garbage":
+			w.Write([]byte("{"))
+		default:
+			if r.URL.Path == "/metrics/find" {
+				w.Write([]byte("[]"))
+				return
+			}
+			w.Write([]byte(response))
+		}
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines, iterations = 10, 5
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				for _, target := range []string{"a", "missing", "broken", "garbage"} {
+					c.QueryMultiSince([]string{target}, time.Hour)
+				}
+				c.Find("a.*")
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.Stats()
+	const n = goroutines * iterations
+	if stats.RenderRequests != 4*n || stats.FindRequests != n {
+		t.Error("Unexpected request counts:", stats)
+	}
+	if stats.ClientErrors != n || stats.ServerErrors != n || stats.DecodeErrors != n || stats.NetworkErrors != 0 {
+		t.Error("Unexpected error counts:", stats)
+	}
+	if stats.BytesRead < int64(n*len(response)) {
+		t.Error("Unexpected bytes read:", stats.BytesRead)
+	}
+	if stats.TotalLatency <= 0 || stats.LastLatency <= 0 || stats.LastLatency > stats.TotalLatency {
+		t.Error("Unexpected latencies:", stats.TotalLatency, stats.LastLatency)
+	}
+
+	// Network errors.
+	ts.Close()
+	c.QueryMultiSince([]string{"a"}, time.Hour)
+	if stats := c.Stats(); stats.NetworkErrors != 1 {
+		t.Error("Unexpected network errors:", stats.NetworkErrors)
+	}
+
+	if stats := c.Clone().Stats(); stats != (ClientStats{}) {
+		t.Error("Expected clone to have its own stats:", stats)
+	}
+}
+
+// Expvars can't be removed, so every run of a test needs names of its own.
+var expvarNames atomic.Int64
+
+func uniqueExpvarName(t *testing.T, name string) string {
+	return fmt.Sprintf("%s_%s_%d", t.Name(), name, expvarNames.Add(1))
+}
+
+func TestPublishExpvar(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("target") == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": []}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL, WithQueryCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := uniqueExpvarName(t, "client")
+	if err := c.PublishExpvar(name); err != nil {
+		t.Fatal(err)
+	}
+	// Publishing twice doesn't panic.
+	if err := c.PublishExpvar(name); err != nil {
+		t.Fatal(err)
+	}
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	for i := 0; i < 3; i++ {
+		c.QueryMulti([]string{"a"}, interval)
+	}
+	c.QueryMulti([]string{"broken"}, interval)
+
+	var vars map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"requests": 2, "errors": 1, "server_errors": 1, "cache_hits": 2, "cache_misses": 2, "in_flight": 0}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("Unexpected %s: %d", name, vars[name])
+		}
+	}
+	if vars["bytes"] == 0 {
+		t.Error("Expected bytes to be counted.")
+	}
+
+	name = uniqueExpvarName(t, "int")
+	expvar.NewInt(name)
+	if err := c.PublishExpvar(name); err == nil {
+		t.Error("Expected error for existing expvar.")
+	}
+}
+
+func TestQueryBetweenAgo(t *testing.T) {
+	t.Parallel()
+
+	var from, until string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, until = r.FormValue("from"), r.FormValue("until")
+		_, hasUntil := r.Form["until"]
+		if until == "" && hasUntil {
+			t.Error("Unexpected empty until.")
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points, err := c.QueryBetweenAgo("a", 2*time.Hour, time.Hour).AsInts(); err != nil || len(points) != 1 {
+		t.Error("Unexpected response:", points, err)
+	}
+	if from != "-2hours" || until != "-1hours" {
+		t.Error("Unexpected interval:", from, until)
+	}
+	if _, err := c.QueryMultiBetweenAgo([]string{"a"}, 90*time.Minute, 90*time.Second); err != nil {
+		t.Error(err)
+	}
+	if from != "-90minutes" || until != "-90s" {
+		t.Error("Unexpected interval:", from, until)
+	}
+	// Until now.
+	if _, err := c.QueryMultiBetweenAgo([]string{"a"}, time.Hour, 0); err != nil {
+		t.Error(err)
+	}
+	if from != "-1hours" || until != "" {
+		t.Error("Unexpected interval:", from, until)
+	}
+
+	from = ""
+	for _, test := range [][2]time.Duration{{time.Hour, time.Hour}, {time.Hour, 2 * time.Hour}, {time.Hour, -time.Minute}, {0, 0}} {
+		if err := c.QueryBetweenAgo("a", test[0], test[1]).Err(); err == nil {
+			t.Error("Expected error:", test)
+		}
+		if _, err := c.QueryMultiBetweenAgo([]string{"a"}, test[0], test[1]); err == nil {
+			t.Error("Expected error:", test)
+		}
+	}
+	if from != "" {
+		t.Error("Unexpected request.")
+	}
+}
+
+func TestQueryFloatsMulti(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1.5, 1409763000], [null, 1409763060]]}, {"target": "b", "datapoints": [[1e20, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	for _, floats := range []func() (map[string][]FloatDatapoint, error){
+		func() (map[string][]FloatDatapoint, error) { return c.QueryFloatsMulti([]string{"a", "b"}, interval) },
+		func() (map[string][]FloatDatapoint, error) {
+			return c.QueryFloatsMultiSince([]string{"a", "b"}, time.Hour)
+		},
+	} {
+		m, err := floats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || len(m["a"]) != 2 || *m["a"][0].Value != 1.5 || m["a"][1].Value != nil || *m["b"][0].Value != 1e20 {
+			t.Error("Unexpected series:", m)
+		}
+	}
+
+	// b overflows int64.
+	for _, ints := range []func() (map[string][]IntDatapoint, error){
+		func() (map[string][]IntDatapoint, error) { return c.QueryIntsMulti([]string{"a", "b"}, interval) },
+		func() (map[string][]IntDatapoint, error) { return c.QueryIntsMultiSince([]string{"a", "b"}, time.Hour) },
+	} {
+		var overflow *ValueOverflowError
+		if _, err := ints(); !errors.As(err, &overflow) || overflow.Target != "b" || !strings.Contains(err.Error(), `"b"`) {
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	if _, err := c.QueryIntsMulti([]string{"a"}, TimeInterval{}); !errors.Is(err, ErrZeroTime) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+// Targets that are easily mangled by query encoding.
+var specialTargets = []string{
+	`alias(a.b,"requests per second")`,
+	`alias(a.b,'single "quoted"')`,
+	`alias(servers.bücher-ü.cpu,"日本 cpu")`,
+	`alias(a.b,"this & that")`,
+	`alias(a.b,"#1 + 1 = 2%")`,
+}
+
+func TestTargetEncoding(t *testing.T) {
+	t.Parallel()
+
+	var rawQuery string
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+		received = r.URL.Query()["target"]
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	if _, err := c.QueryMulti(specialTargets, interval); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, specialTargets) {
+		t.Errorf("Unexpected targets: %q", received)
+	}
+	if strings.ContainsAny(rawQuery, "+# \"") || !strings.Contains(rawQuery, "requests%20per%20second") {
+		t.Error("Unexpected query:", rawQuery)
+	}
+}
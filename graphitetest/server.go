@@ -0,0 +1,323 @@
+// Package graphitetest provides a fake Graphite server for integration tests.
+package graphitetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	httpurl "net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A datapoint. A nil Value means null.
+type Point struct {
+	Time  time.Time
+	Value *float64
+}
+
+// A series served by Server.
+type Series struct {
+	Target string
+	Points []Point
+
+	// Optional. Served as the "tags" of the series, with "name" set to Target
+	// unless given.
+	Tags map[string]string
+}
+
+// A request received by Server.
+type Request struct {
+	Method string
+	Path   string
+	// The query string and form parameters combined.
+	Form httpurl.Values
+}
+
+// A fake Graphite server serving registered series. It supports
+//
+//   - /render with format=json, any number of target parameters, wildcards
+//     (*, ?, [...] and {a,b}) and from/until filtering.
+//   - /metrics/find against the namespace of the registered series.
+//
+// Render functions aren't supported; a target is only matched against the
+// registered series. Safe for concurrent use.
+type Server struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	series   []Series
+	requests []Request
+}
+
+// Starts a Server, which is closed when the test finishes.
+func NewServer(t testing.TB) *Server {
+	s := &Server{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// The base URL of the server, ie. to pass to graphite.New.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Stops the server. Called automatically when the test finishes.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Registers series. Points are served sorted by time.
+func (s *Server) Add(series ...Series) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, serie := range series {
+		serie.Points = append([]Point(nil), serie.Points...)
+		sort.SliceStable(serie.Points, func(i, j int) bool { return serie.Points[i].Time.Before(serie.Points[j].Time) })
+		s.series = append(s.series, serie)
+	}
+}
+
+// The requests received so far, in order.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Form: r.Form})
+	series := s.series
+	s.lock.Unlock()
+
+	switch r.URL.Path {
+	case "/render", "/render/":
+		serveRender(w, r, series)
+	case "/metrics/find", "/metrics/find/":
+		serveFind(w, r, series)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type renderedSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Datapoints [][2]jsonValue    `json:"datapoints"`
+}
+
+// A nullable JSON number.
+type jsonValue struct {
+	v *float64
+}
+
+func (v jsonValue) MarshalJSON() ([]byte, error) {
+	if v.v == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(*v.v)
+}
+
+func serveRender(w http.ResponseWriter, r *http.Request, series []Series) {
+	if format := r.Form.Get("format"); format != "" && format != "json" {
+		http.Error(w, fmt.Sprintf("Unsupported format %q.", format), http.StatusBadRequest)
+		return
+	}
+
+	loc := time.Local
+	if tz := r.Form.Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	from, err := parseTime(r.Form.Get("from"), now.Add(-24*time.Hour), now, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseTime(r.Form.Get("until"), now, now, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res := []renderedSeries{}
+	for _, target := range r.Form["target"] {
+		for _, serie := range series {
+			if !matchTarget(target, serie.Target) {
+				continue
+			}
+			rendered := renderedSeries{Target: serie.Target, Datapoints: [][2]jsonValue{}}
+			if serie.Tags != nil {
+				rendered.Tags = map[string]string{"name": serie.Target}
+				for k, v := range serie.Tags {
+					rendered.Tags[k] = v
+				}
+			}
+			for _, p := range serie.Points {
+				if p.Time.Before(from) || p.Time.After(until) {
+					continue
+				}
+				ts := float64(p.Time.Unix())
+				rendered.Datapoints = append(rendered.Datapoints, [2]jsonValue{{p.Value}, {&ts}})
+			}
+			res = append(res, rendered)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+type findResult struct {
+	Leaf          int    `json:"leaf"`
+	Text          string `json:"text"`
+	Id            string `json:"id"`
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+}
+
+func serveFind(w http.ResponseWriter, r *http.Request, series []Series) {
+	query := r.Form.Get("query")
+	if query == "" {
+		http.Error(w, "Missing query.", http.StatusBadRequest)
+		return
+	}
+	patterns := strings.Split(query, ".")
+
+	nodes := make(map[string]findResult)
+	for _, serie := range series {
+		segments := strings.Split(serie.Target, ".")
+		if len(segments) < len(patterns) || !matchSegments(patterns, segments[:len(patterns)]) {
+			continue
+		}
+		id := strings.Join(segments[:len(patterns)], ".")
+		node := nodes[id]
+		node.Id = id
+		node.Text = segments[len(patterns)-1]
+		if len(segments) == len(patterns) {
+			node.Leaf = 1
+		} else {
+			node.Expandable = 1
+			node.AllowChildren = 1
+		}
+		nodes[id] = node
+	}
+
+	res := make([]findResult, 0, len(nodes))
+	for _, node := range nodes {
+		res = append(res, node)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+func matchTarget(pattern, target string) bool {
+	if pattern == target {
+		return true
+	}
+	patterns, segments := strings.Split(pattern, "."), strings.Split(target, ".")
+	return len(patterns) == len(segments) && matchSegments(patterns, segments)
+}
+
+func matchSegments(patterns, segments []string) bool {
+	for i, pattern := range patterns {
+		if !matchSegment(pattern, segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches a single path segment, expanding {a,b} alternatives.
+func matchSegment(pattern, segment string) bool {
+	open := strings.IndexByte(pattern, '{')
+	end := strings.IndexByte(pattern, '}')
+	if open >= 0 && end > open {
+		for _, alternative := range strings.Split(pattern[open+1:end], ",") {
+			if matchSegment(pattern[:open]+alternative+pattern[end+1:], segment) {
+				return true
+			}
+		}
+		return false
+	}
+	matched, _ := path.Match(pattern, segment)
+	return matched
+}
+
+var relativeTime = regexp.MustCompile(`^([+-]?)(\d+)([a-z]+)$`)
+
+// Parses the from and until formats of the render API.
+func parseTime(value string, def, now time.Time, loc *time.Location) (time.Time, error) {
+	switch value {
+	case "":
+		return def, nil
+	case "now":
+		return now, nil
+	}
+
+	if m := relativeTime.FindStringSubmatch(value); m != nil {
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return time.Time{}, err
+		}
+		unit, ok := relativeUnit(m[3])
+		if !ok {
+			return time.Time{}, fmt.Errorf("Unsupported time unit in %q.", value)
+		}
+		d := time.Duration(n) * unit
+		if m[1] == "-" {
+			d = -d
+		}
+		return now.Add(d), nil
+	}
+
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) != 8 {
+		return time.Unix(unix, 0), nil
+	}
+	for _, layout := range []string{"15:04_20060102", "20060102"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Unsupported time %q.", value)
+}
+
+func relativeUnit(unit string) (time.Duration, bool) {
+	switch {
+	case strings.HasPrefix(unit, "mon"):
+		return 30 * 24 * time.Hour, true
+	case strings.HasPrefix(unit, "s"):
+		return time.Second, true
+	case strings.HasPrefix(unit, "m"):
+		return time.Minute, true
+	case strings.HasPrefix(unit, "h"):
+		return time.Hour, true
+	case strings.HasPrefix(unit, "d"):
+		return 24 * time.Hour, true
+	case strings.HasPrefix(unit, "w"):
+		return 7 * 24 * time.Hour, true
+	case strings.HasPrefix(unit, "y"):
+		return 365 * 24 * time.Hour, true
+	}
+	return 0, false
+}
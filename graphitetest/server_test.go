@@ -0,0 +1,116 @@
+package graphitetest_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	graphite "github.com/JensRantil/graphite-client"
+	"github.com/JensRantil/graphite-client/graphitetest"
+)
+
+func float64Pointer(f float64) *float64 {
+	return &f
+}
+
+func newServer(t *testing.T) (*graphitetest.Server, *graphite.Client) {
+	srv := graphitetest.NewServer(t)
+	srv.Add(
+		graphitetest.Series{
+			Target: "servers.a.cpu",
+			Points: []graphitetest.Point{
+				{time.Unix(1409763060, 0), float64Pointer(2)},
+				{time.Unix(1409763000, 0), float64Pointer(1.5)},
+				{time.Unix(1409763120, 0), nil},
+			},
+			Tags: map[string]string{"dc": "eu"},
+		},
+		graphitetest.Series{Target: "servers.b.cpu", Points: []graphitetest.Point{{time.Unix(1409763000, 0), float64Pointer(3)}}},
+		graphitetest.Series{Target: "servers.b.mem"},
+	)
+	client, err := graphite.New(srv.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	srv, client := newServer(t)
+
+	interval := graphite.TimeInterval{From: time.Unix(1409763000, 0), To: time.Unix(1409763120, 0)}
+	points, err := client.Query("servers.a.cpu", interval).AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 || *points[0].Value != 1.5 || *points[1].Value != 2 || points[2].Value != nil {
+		t.Error("Unexpected points:", points)
+	}
+
+	multi, err := client.QueryMulti([]string{"servers.*.cpu", "servers.{b}.mem"}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := multi.Targets(); len(targets) != 3 || targets[0] != "servers.a.cpu" || targets[1] != "servers.b.cpu" || targets[2] != "servers.b.mem" {
+		t.Error("Unexpected targets:", targets)
+	}
+
+	raw, err := client.QueryRaw([]string{"servers.a.cpu"}, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), `"tags":{"dc":"eu","name":"servers.a.cpu"}`) {
+		t.Error("Unexpected response:", string(raw))
+	}
+
+	// Filtering on from and until.
+	interval.From = interval.From.Add(time.Minute)
+	interval.To = interval.From
+	if points, err := client.Query("servers.a.cpu", interval).AsFloats(); err != nil || len(points) != 1 || *points[0].Value != 2 {
+		t.Error("Unexpected points:", points, err)
+	}
+
+	// Relative from.
+	if points, err := client.QuerySince("servers.a.cpu", time.Hour).AsFloats(); err != nil || len(points) != 0 {
+		t.Error("Unexpected points:", points, err)
+	}
+
+	requests := srv.Requests()
+	if len(requests) != 5 {
+		t.Fatal("Unexpected number of requests:", len(requests))
+	}
+	if requests[1].Path != "/render" || len(requests[1].Form["target"]) != 2 {
+		t.Error("Unexpected request:", requests[1])
+	}
+	if requests[4].Form.Get("from") != "-1hours" {
+		t.Error("Unexpected from:", requests[4].Form.Get("from"))
+	}
+}
+
+func TestFind(t *testing.T) {
+	t.Parallel()
+
+	_, client := newServer(t)
+
+	items, err := client.Find("servers.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Id != "servers.a" || items[1].Id != "servers.b" || items[0].Leaf || !items[0].Expandable {
+		t.Error("Unexpected items:", items)
+	}
+
+	items, err = client.Find("servers.b.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Text != "cpu" || !items[0].Leaf || items[1].Id != "servers.b.mem" {
+		t.Error("Unexpected items:", items)
+	}
+
+	if items, err := client.Find("missing.*"); err != nil || len(items) != 0 {
+		t.Error("Unexpected items:", items, err)
+	}
+}
@@ -0,0 +1,113 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How far into the future an interval may start. Graphite has no data there,
+// so such intervals are most likely mistakes.
+const maxIntervalFuture = 365 * 24 * time.Hour
+
+var (
+	ErrZeroTime    = errors.New("From and To must be set.")
+	ErrFromAfterTo = errors.New("From must be before To.")
+	ErrFutureStart = errors.New("From is too far in the future.")
+)
+
+// Returned by TimeInterval.Check. Err is one of ErrZeroTime, ErrFromAfterTo
+// and ErrFutureStart.
+type IntervalError struct {
+	Interval TimeInterval
+	Err      error
+}
+
+func (e *IntervalError) Error() string {
+	return fmt.Sprintf("Invalid interval from %s to %s. %s", e.Interval.From.Format(time.RFC3339), e.Interval.To.Format(time.RFC3339), e.Err)
+}
+
+func (e *IntervalError) Unwrap() error {
+	return e.Err
+}
+
+type TimeInterval struct {
+	From time.Time
+	To   time.Time
+}
+
+// The last d, up until now.
+func LastDuration(d time.Duration) TimeInterval {
+	now := time.Now()
+	return TimeInterval{now.Add(-d), now}
+}
+
+// From from until now.
+func Since(from time.Time) TimeInterval {
+	return TimeInterval{from, time.Now()}
+}
+
+func Between(from, to time.Time) TimeInterval {
+	return TimeInterval{from, to}
+}
+
+// The calendar day of date, in the location of date. Not always 24 hours,
+// due to daylight saving time.
+func Day(date time.Time) TimeInterval {
+	year, month, day := date.Date()
+	from := time.Date(year, month, day, 0, 0, 0, 0, date.Location())
+	return TimeInterval{from, from.AddDate(0, 0, 1)}
+}
+
+func (t TimeInterval) Duration() time.Duration {
+	return t.To.Sub(t.From)
+}
+
+// Whether tm is within the interval. Intervals are half-open, including From
+// but not To, so that consecutive intervals don't overlap.
+func (t TimeInterval) Contains(tm time.Time) bool {
+	return !tm.Before(t.From) && tm.Before(t.To)
+}
+
+// Whether the intervals have any time in common. See Contains.
+func (t TimeInterval) Overlaps(other TimeInterval) bool {
+	return t.From.Before(other.To) && other.From.Before(t.To)
+}
+
+// Partitions the interval into consecutive sub-intervals of length chunk. The
+// last one is shorter if the interval isn't a multiple of chunk. The interval
+// itself is returned if chunk isn't shorter than it, or isn't positive.
+func (t TimeInterval) Split(chunk time.Duration) []TimeInterval {
+	if chunk <= 0 || chunk >= t.Duration() {
+		return []TimeInterval{t}
+	}
+	chunks := make([]TimeInterval, 0, (t.Duration()+chunk-1)/chunk)
+	for from := t.From; from.Before(t.To); from = from.Add(chunk) {
+		chunks = append(chunks, TimeInterval{from, minTime(from.Add(chunk), t.To)})
+	}
+	return chunks
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// Fails with an *IntervalError for intervals that Graphite can't make sense
+// of. Called by all queries, so it's usually not needed to call it directly.
+func (t *TimeInterval) Check() error {
+	var err error
+	switch {
+	case t.From.IsZero() || t.To.IsZero():
+		err = ErrZeroTime
+	case t.From.After(t.To):
+		err = ErrFromAfterTo
+	case t.From.After(time.Now().Add(maxIntervalFuture)):
+		err = ErrFutureStart
+	default:
+		return nil
+	}
+	return &IntervalError{*t, err}
+}
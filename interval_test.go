@@ -0,0 +1,179 @@
+package infrastructure
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIntervalCheck(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	for _, test := range []struct {
+		interval TimeInterval
+		expected error
+	}{
+		{TimeInterval{}, ErrZeroTime},
+		{TimeInterval{From: now}, ErrZeroTime},
+		{TimeInterval{To: now}, ErrZeroTime},
+		{TimeInterval{now, now.Add(-time.Minute)}, ErrFromAfterTo},
+		{TimeInterval{now.AddDate(2, 0, 0), now.AddDate(3, 0, 0)}, ErrFutureStart},
+		{TimeInterval{now, now}, nil},
+		{LastDuration(time.Hour), nil},
+		// Graphite handles an until in the future.
+		{TimeInterval{now, now.AddDate(10, 0, 0)}, nil},
+	} {
+		err := test.interval.Check()
+		if !errors.Is(err, test.expected) {
+			t.Errorf("Unexpected error for %v: %v", test.interval, err)
+		}
+		var intervalErr *IntervalError
+		if err != nil && (!errors.As(err, &intervalErr) || intervalErr.Interval != test.interval) {
+			t.Error("Expected *IntervalError:", err)
+		}
+	}
+}
+
+// The zero interval used to be sent as "00:00_00010101".
+func TestQueryZeroInterval(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request:", r.URL)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Query("a", TimeInterval{}).Err(); !errors.Is(err, ErrZeroTime) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.QueryMulti([]string{"a"}, TimeInterval{}); !errors.Is(err, ErrZeroTime) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.RenderPNG([]string{"a"}, TimeInterval{}, GraphOptions{}); !errors.Is(err, ErrZeroTime) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestIntervalConstructors(t *testing.T) {
+	t.Parallel()
+
+	before := time.Now()
+	last := LastDuration(time.Hour)
+	if last.To.Sub(last.From) != time.Hour || last.To.Before(before) || last.To.After(time.Now()) {
+		t.Error("Unexpected interval:", last)
+	}
+
+	from := time.Date(2014, 9, 3, 10, 0, 0, 0, time.UTC)
+	if since := Since(from); !since.From.Equal(from) || since.To.Before(before) {
+		t.Error("Unexpected interval:", since)
+	}
+	if between := Between(from, from.Add(time.Hour)); between != (TimeInterval{from, from.Add(time.Hour)}) {
+		t.Error("Unexpected interval:", between)
+	}
+
+	day := Day(from)
+	if !day.From.Equal(time.Date(2014, 9, 3, 0, 0, 0, 0, time.UTC)) || !day.To.Equal(time.Date(2014, 9, 4, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Unexpected interval:", day)
+	}
+
+	// Daylight saving time ends.
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip(err)
+	}
+	day = Day(time.Date(2014, 10, 26, 12, 0, 0, 0, stockholm))
+	if day.To.Sub(day.From) != 25*time.Hour {
+		t.Error("Unexpected interval:", day)
+	}
+}
+
+func TestIntervalSplit(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1409763000, 0)
+	interval := func(from, to time.Duration) TimeInterval {
+		return TimeInterval{start.Add(from), start.Add(to)}
+	}
+	for _, test := range []struct {
+		interval TimeInterval
+		chunk    time.Duration
+		expected []TimeInterval
+	}{
+		{interval(0, 3*time.Hour), time.Hour, []TimeInterval{interval(0, time.Hour), interval(time.Hour, 2*time.Hour), interval(2*time.Hour, 3*time.Hour)}},
+		{interval(0, 150*time.Minute), time.Hour, []TimeInterval{interval(0, time.Hour), interval(time.Hour, 2*time.Hour), interval(2*time.Hour, 150*time.Minute)}},
+		{interval(0, time.Hour+time.Nanosecond), time.Hour, []TimeInterval{interval(0, time.Hour), interval(time.Hour, time.Hour+time.Nanosecond)}},
+		{interval(0, 59*time.Minute), 7 * time.Minute, nil},
+		{interval(0, time.Hour), time.Hour, []TimeInterval{interval(0, time.Hour)}},
+		{interval(0, time.Hour), 2 * time.Hour, []TimeInterval{interval(0, time.Hour)}},
+		{interval(0, 0), time.Hour, []TimeInterval{interval(0, 0)}},
+		{interval(0, time.Hour), 0, []TimeInterval{interval(0, time.Hour)}},
+		{interval(0, time.Hour), -time.Minute, []TimeInterval{interval(0, time.Hour)}},
+	} {
+		chunks := test.interval.Split(test.chunk)
+		if test.expected != nil && len(chunks) != len(test.expected) {
+			t.Errorf("Unexpected chunks for %v and %s: %v", test.interval, test.chunk, chunks)
+			continue
+		}
+		for i, chunk := range chunks {
+			if test.expected != nil && chunk != test.expected[i] {
+				t.Errorf("Unexpected chunks for %v and %s: %v", test.interval, test.chunk, chunks)
+			}
+			if chunk.Duration() > test.chunk && len(chunks) > 1 {
+				t.Error("Chunk too long:", chunk)
+			}
+			if i > 0 && !chunk.From.Equal(chunks[i-1].To) {
+				t.Error("Gap or overlap:", chunks[i-1], chunk)
+			}
+			if i > 0 && chunk.Overlaps(chunks[i-1]) {
+				t.Error("Overlap:", chunks[i-1], chunk)
+			}
+		}
+		if !chunks[0].From.Equal(test.interval.From) || !chunks[len(chunks)-1].To.Equal(test.interval.To) {
+			t.Errorf("Chunks don't cover %v: %v", test.interval, chunks)
+		}
+	}
+}
+
+func TestIntervalContainsOverlaps(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1409763000, 0)
+	interval := TimeInterval{start, start.Add(time.Hour)}
+	if interval.Duration() != time.Hour {
+		t.Error("Unexpected duration:", interval.Duration())
+	}
+	for _, test := range []struct {
+		t        time.Time
+		expected bool
+	}{
+		{start, true},
+		{start.Add(30 * time.Minute), true},
+		{start.Add(time.Hour), false},
+		{start.Add(-time.Nanosecond), false},
+	} {
+		if interval.Contains(test.t) != test.expected {
+			t.Error("Unexpected Contains:", test.t)
+		}
+	}
+	for _, test := range []struct {
+		other    TimeInterval
+		expected bool
+	}{
+		{TimeInterval{start.Add(30 * time.Minute), start.Add(2 * time.Hour)}, true},
+		{TimeInterval{start.Add(-time.Hour), start.Add(time.Minute)}, true},
+		{TimeInterval{start.Add(10 * time.Minute), start.Add(20 * time.Minute)}, true},
+		{TimeInterval{start.Add(time.Hour), start.Add(2 * time.Hour)}, false},
+		{TimeInterval{start.Add(-time.Hour), start}, false},
+	} {
+		if interval.Overlaps(test.other) != test.expected || test.other.Overlaps(interval) != test.expected {
+			t.Error("Unexpected Overlaps:", test.other)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"errors"
+	"iter"
+	"time"
+)
+
+// Signals scanDatapoints that the consumer stopped iterating.
+var errStopIteration = errors.New("Iteration stopped.")
+
+// Iterates over the datapoints, decoding them one at a time without
+// allocating a slice. A nil value means null. To avoid an allocation per
+// datapoint, the value pointed to is only valid until the next iteration; copy
+// it to keep it. Iteration silently stops on errors, see FloatsWithErr.
+func (d Datapoints) Floats() iter.Seq2[time.Time, *float64] {
+	return values[float64](d)
+}
+
+// Like Floats, but for ints. Values are converted like AsInts.
+func (d Datapoints) Ints() iter.Seq2[time.Time, *int64] {
+	return values[int64](d)
+}
+
+// Like Floats, but yields an error, together with a zero datapoint, as the
+// last element if the query failed or a datapoint can't be decoded.
+func (d Datapoints) FloatsWithErr() iter.Seq2[FloatDatapoint, error] {
+	return valuesWithErr[float64](d)
+}
+
+// Like FloatsWithErr, but for ints.
+func (d Datapoints) IntsWithErr() iter.Seq2[IntDatapoint, error] {
+	return valuesWithErr[int64](d)
+}
+
+func values[T Number](d Datapoints) iter.Seq2[time.Time, *T] {
+	return func(yield func(time.Time, *T) bool) {
+		for point, err := range valuesWithErr[T](d) {
+			if err != nil || !yield(point.Time, point.Value) {
+				return
+			}
+		}
+	}
+}
+
+func valuesWithErr[T Number](d Datapoints) iter.Seq2[Datapoint[T], error] {
+	return func(yield func(Datapoint[T], error) bool) {
+		if d.err != nil {
+			yield(Datapoint[T]{}, d.err)
+			return
+		}
+		if len(d.points) == 0 {
+			return
+		}
+
+		// Reused for every datapoint.
+		var v T
+		err := scanDatapoints(d.points, func(value []byte, t time.Time) error {
+			point := Datapoint[T]{Time: t}
+			if value != nil {
+				var err error
+				if v, err = parseValue[T](value, t, false); err != nil {
+					return err
+				}
+				point.Value = &v
+			}
+			if !yield(point, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			yield(Datapoint[T]{}, d.withTarget(err))
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package infrastructure
+
+import (
+	"fmt"
+	"testing"
+)
+
+func ExampleDatapoints_Floats() {
+	d := Datapoints{Target: "a", points: []byte("[[1.5, 1409763000], [null, 1409763060], [3, 1409763120]]")}
+
+	sum := 0.0
+	for _, v := range d.Floats() {
+		if v != nil {
+			sum += *v
+		}
+	}
+	fmt.Println(sum)
+	// Output: 4.5
+}
+
+func ExampleDatapoints_FloatsWithErr() {
+	d := Datapoints{Target: "a", points: []byte(`[[1.5, 1409763000], ["oops", 1409763060]]`)}
+
+	for point, err := range d.FloatsWithErr() {
+		if err != nil {
+			fmt.Println("Error:", err)
+			break
+		}
+		fmt.Println(point.Time.Unix(), *point.Value)
+	}
+	// Output:
+	// 1409763000 1.5
+	// Error: Value not a number.
+}
+
+func TestIterators(t *testing.T) {
+	t.Parallel()
+
+	d := Datapoints{Target: "a", points: []byte("[[1.9, 1409763000], [null, 1409763060], [3, 1409763120]]")}
+
+	var ints []int64
+	for ts, v := range d.Ints() {
+		if v == nil {
+			if ts.Unix() != 1409763060 {
+				t.Error("Unexpected time:", ts)
+			}
+			continue
+		}
+		ints = append(ints, *v)
+	}
+	if len(ints) != 2 || ints[0] != 1 || ints[1] != 3 {
+		t.Error("Unexpected values:", ints)
+	}
+
+	// Breaking early.
+	n := 0
+	for range d.Floats() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Error("Unexpected number of iterations:", n)
+	}
+	for _, err := range d.IntsWithErr() {
+		if err != nil {
+			t.Error("Unexpected error:", err)
+		}
+		break
+	}
+}
+
+func TestIteratorErrors(t *testing.T) {
+	t.Parallel()
+
+	n := 0
+	for range (Datapoints{err: errDatapointsSyntax}).Floats() {
+		n++
+	}
+	if n != 0 {
+		t.Error("Expected no iterations:", n)
+	}
+	for _, err := range (Datapoints{err: errDatapointsSyntax}).FloatsWithErr() {
+		if err != errDatapointsSyntax {
+			t.Error("Unexpected error:", err)
+		}
+	}
+
+	overflowing := Datapoints{Target: "a", points: []byte("[[1, 1409763000], [1e19, 1409763060]]")}
+	var errs []error
+	for _, err := range overflowing.IntsWithErr() {
+		errs = append(errs, err)
+	}
+	if len(errs) != 2 || errs[0] != nil {
+		t.Fatal("Unexpected errors:", errs)
+	}
+	if overflow, ok := errs[1].(*ValueOverflowError); !ok || overflow.Target != "a" {
+		t.Error("Unexpected error:", errs[1])
+	}
+
+	for range (Datapoints{Target: "a"}).Ints() {
+		t.Error("Expected no datapoints.")
+	}
+}
@@ -0,0 +1,40 @@
+package infrastructure
+
+import (
+	"time"
+)
+
+// The non-null values of points keyed by time. Timestamps are truncated to
+// whole seconds and normalized as time.Unix does, making keys comparable with
+// time.Unix(ts, 0). For duplicate timestamps the last datapoint wins.
+func ToMap(points []FloatDatapoint) map[time.Time]float64 {
+	m := make(map[time.Time]float64, len(points))
+	for _, p := range points {
+		if p.Value != nil {
+			m[time.Unix(p.Time.Unix(), 0)] = *p.Value
+		}
+	}
+	return m
+}
+
+// Like ToMap, but keyed by Unix timestamp in seconds.
+func ToUnixMap(points []FloatDatapoint) map[int64]float64 {
+	m := make(map[int64]float64, len(points))
+	for _, p := range points {
+		if p.Value != nil {
+			m[p.Time.Unix()] = *p.Value
+		}
+	}
+	return m
+}
+
+// The inverse of ToMap. The datapoints are sorted by time and never null.
+func FromMap(m map[time.Time]float64) []FloatDatapoint {
+	points := make([]FloatDatapoint, 0, len(m))
+	for t, v := range m {
+		value := v
+		points = append(points, FloatDatapoint{Time: t, Value: &value})
+	}
+	sortPoints(points)
+	return points
+}
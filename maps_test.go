@@ -0,0 +1,51 @@
+package infrastructure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToMap(t *testing.T) {
+	t.Parallel()
+
+	points := []FloatDatapoint{
+		{time.Unix(1409763060, 0).UTC(), makeFloat64Pointer(1)},
+		{time.Unix(1409763120, 0), nil},
+		{time.Unix(1409763180, 500), makeFloat64Pointer(2)},
+		{time.Unix(1409763060, 0), makeFloat64Pointer(3)},
+		// Nulls never override.
+		{time.Unix(1409763180, 0), nil},
+	}
+
+	m := ToMap(points)
+	if len(m) != 2 {
+		t.Fatal("Unexpected map:", m)
+	}
+	if v, ok := m[time.Unix(1409763060, 0)]; !ok || v != 3 {
+		t.Error("Unexpected value:", v, ok)
+	}
+	if v, ok := m[time.Unix(1409763180, 0)]; !ok || v != 2 {
+		t.Error("Unexpected value:", v, ok)
+	}
+
+	unix := ToUnixMap(points)
+	if len(unix) != 2 || unix[1409763060] != 3 || unix[1409763180] != 2 {
+		t.Error("Unexpected map:", unix)
+	}
+
+	back := FromMap(m)
+	if len(back) != 2 || !IsSorted(back) {
+		t.Fatal("Unexpected points:", back)
+	}
+	if !back[0].Time.Equal(time.Unix(1409763060, 0)) || *back[0].Value != 3 || *back[1].Value != 2 {
+		t.Error("Unexpected points:", back)
+	}
+	// Values must not alias.
+	if back[0].Value == back[1].Value {
+		t.Error("Values share pointers.")
+	}
+
+	if len(ToMap(nil)) != 0 || len(FromMap(nil)) != 0 {
+		t.Error("Expected empty results.")
+	}
+}
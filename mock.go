@@ -0,0 +1,127 @@
+package infrastructure
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The read API of Client. Useful for mocking Graphite in tests, see
+// MockClient.
+type Querier interface {
+	Query(q string, interval TimeInterval, opts ...QueryOption) Datapoints
+	QuerySince(q string, ago time.Duration, opts ...QueryOption) Datapoints
+	QueryMulti(q []string, interval TimeInterval, opts ...QueryOption) (MultiDatapoints, error)
+	QueryMultiSince(q []string, ago time.Duration, opts ...QueryOption) (MultiDatapoints, error)
+	Find(query string, opts ...QueryOption) ([]FindResultItem, error)
+}
+
+var _ Querier = (*Client)(nil)
+
+// Creates datapoints for target, ie. for canned MockClient responses. Integer
+// types stay ints when converted with AsInts(StrictInts()). NaN and infinities
+// become nulls.
+func NewDatapoints[T Number](target string, points []Datapoint[T]) Datapoints {
+	isFloat := T(1)/2 != 0
+
+	var b datapointsBuilder
+	for _, p := range points {
+		var v []byte
+		switch {
+		case p.Value == nil:
+		case isFloat:
+			v = formatFloatValue(float64(*p.Value))
+		case *p.Value < 0:
+			v = strconv.AppendInt(nil, int64(*p.Value), 10)
+		default:
+			v = strconv.AppendUint(nil, uint64(*p.Value), 10)
+		}
+		b.add(v, p.Time.Unix())
+	}
+	return b.datapoints(target)
+}
+
+// A query received by MockClient.
+type MockQuery struct {
+	// The name of the called method, ie. "QueryMultiSince" or "Find".
+	Method  string
+	Targets []string
+
+	// Set for the methods taking an interval.
+	Interval TimeInterval
+	// Set for the Since methods.
+	Ago time.Duration
+}
+
+// A Querier serving canned responses, recording the queries it receives. Safe
+// for concurrent use.
+type MockClient struct {
+	// Canned render responses by target. Targets without a response match
+	// nothing.
+	Responses map[string]MultiDatapoints
+
+	// Canned find responses by query.
+	FindResults map[string][]FindResultItem
+
+	// If set, returned by every call.
+	Err error
+
+	lock    sync.Mutex
+	queries []MockQuery
+}
+
+var _ Querier = (*MockClient)(nil)
+
+// The queries received so far, in order.
+func (m *MockClient) Queries() []MockQuery {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]MockQuery(nil), m.queries...)
+}
+
+func (m *MockClient) record(q MockQuery) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.queries = append(m.queries, q)
+}
+
+func (m *MockClient) Query(q string, interval TimeInterval, opts ...QueryOption) Datapoints {
+	m.record(MockQuery{Method: "Query", Targets: []string{q}, Interval: interval})
+	series, err := m.respond([]string{q})
+	return parseSingleGraphiteResponse(series, err, newQueryOptions(opts).emptySeries)
+}
+
+func (m *MockClient) QuerySince(q string, ago time.Duration, opts ...QueryOption) Datapoints {
+	m.record(MockQuery{Method: "QuerySince", Targets: []string{q}, Ago: ago})
+	series, err := m.respond([]string{q})
+	return parseSingleGraphiteResponse(series, err, newQueryOptions(opts).emptySeries)
+}
+
+func (m *MockClient) QueryMulti(q []string, interval TimeInterval, opts ...QueryOption) (MultiDatapoints, error) {
+	m.record(MockQuery{Method: "QueryMulti", Targets: append([]string(nil), q...), Interval: interval})
+	return m.respond(q)
+}
+
+func (m *MockClient) QueryMultiSince(q []string, ago time.Duration, opts ...QueryOption) (MultiDatapoints, error) {
+	m.record(MockQuery{Method: "QueryMultiSince", Targets: append([]string(nil), q...), Ago: ago})
+	return m.respond(q)
+}
+
+func (m *MockClient) Find(query string, opts ...QueryOption) ([]FindResultItem, error) {
+	m.record(MockQuery{Method: "Find", Targets: []string{query}})
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	return append([]FindResultItem{}, m.FindResults[query]...), nil
+}
+
+func (m *MockClient) respond(targets []string) (MultiDatapoints, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	res := MultiDatapoints{}
+	for _, target := range targets {
+		res = append(res, m.Responses[target]...)
+	}
+	return res, nil
+}
@@ -0,0 +1,98 @@
+package infrastructure
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewDatapoints(t *testing.T) {
+	t.Parallel()
+
+	ints := NewDatapoints("a", []IntDatapoint{
+		{time.Unix(1409763000, 0), makeInt64Pointer(-3)},
+		{time.Unix(1409763060, 0), nil},
+	})
+	if ints.Target != "a" {
+		t.Error("Unexpected target:", ints.Target)
+	}
+	points, err := ints.AsInts(StrictInts())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || *points[0].Value != -3 || points[1].Value != nil || !points[1].Time.Equal(time.Unix(1409763060, 0)) {
+		t.Error("Unexpected points:", points)
+	}
+
+	floats := NewDatapoints("b", []FloatDatapoint{{time.Unix(1409763000, 0), makeFloat64Pointer(2)}})
+	if _, err := floats.AsInts(StrictInts()); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := NewDatapoints("c", []FloatDatapoint{{time.Unix(1409763000, 0), makeFloat64Pointer(2.5)}}).AsInts(StrictInts()); err == nil {
+		t.Error("Expected error for float value.")
+	}
+
+	if empty := NewDatapoints[uint8]("d", nil); !empty.IsEmpty() {
+		t.Error("Expected no datapoints.")
+	}
+}
+
+func TestMockClient(t *testing.T) {
+	t.Parallel()
+
+	m := &MockClient{
+		Responses: map[string]MultiDatapoints{
+			"a": {NewDatapoints("a", []FloatDatapoint{{time.Unix(1409763000, 0), makeFloat64Pointer(1)}})},
+			"b.*": {
+				NewDatapoints("b.x", []FloatDatapoint{}),
+				NewDatapoints("b.y", []FloatDatapoint{}),
+			},
+		},
+		FindResults: map[string][]FindResultItem{
+			"b.*": {{Leaf: true, Text: "x", Id: "b.x"}},
+		},
+	}
+	var q Querier = m
+
+	if points, err := q.QuerySince("a", time.Hour).AsFloats(); err != nil || len(points) != 1 || *points[0].Value != 1 {
+		t.Error("Unexpected points:", points, err)
+	}
+	if _, err := q.Query("b.*", TimeInterval{}).AsFloats(); err == nil {
+		t.Error("Expected error for multiple targets.")
+	}
+	if _, err := q.QuerySince("missing", time.Hour).AsFloats(); err == nil {
+		t.Error("Expected error for no targets.")
+	}
+	multi, err := q.QueryMultiSince([]string{"a", "b.*", "missing"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if targets := multi.Targets(); len(targets) != 3 || targets[0] != "a" || targets[2] != "b.y" {
+		t.Error("Unexpected targets:", targets)
+	}
+	if found, err := q.Find("b.*"); err != nil || len(found) != 1 || found[0].Id != "b.x" {
+		t.Error("Unexpected find result:", found, err)
+	}
+
+	queries := m.Queries()
+	if len(queries) != 5 {
+		t.Fatal("Unexpected queries:", queries)
+	}
+	if queries[0].Method != "QuerySince" || queries[0].Ago != time.Hour || queries[0].Targets[0] != "a" {
+		t.Error("Unexpected query:", queries[0])
+	}
+	if queries[3].Method != "QueryMultiSince" || len(queries[3].Targets) != 3 {
+		t.Error("Unexpected query:", queries[3])
+	}
+	if queries[4].Method != "Find" || queries[4].Targets[0] != "b.*" {
+		t.Error("Unexpected query:", queries[4])
+	}
+
+	m.Err = errors.New("Failure.")
+	if _, err := q.QueryMulti([]string{"a"}, TimeInterval{}); err != m.Err {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := q.Query("a", TimeInterval{}).AsFloats(); err != m.Err {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,269 @@
+package infrastructure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Decodes a format=msgpack render response. Graphite encodes it as a list of
+//
+//	{"name": ..., "start": ..., "end": ..., "step": ..., "values": [...], ...}
+//
+// maps. Every series is converted to the same representation as a JSON
+// response, with timestamps reconstructed from start and step. Integer values
+// stay integers and floats stay floats, so AsInts and AsFloats behave the same
+// regardless of response format.
+func decodeMsgpackResponse(r io.Reader) (MultiDatapoints, error) {
+	d := msgpackDecoder{bufio.NewReader(r)}
+	v, err := d.decode()
+	if err != nil {
+		return MultiDatapoints{}, err
+	}
+	if v == nil {
+		return MultiDatapoints{}, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return MultiDatapoints{}, errors.New("Unexpected Graphite response. Expected msgpack array.")
+	}
+
+	datapoints := make(MultiDatapoints, 0, len(list))
+	for _, item := range list {
+		series, ok := item.(map[string]interface{})
+		if !ok {
+			return MultiDatapoints{}, errors.New("Unexpected Graphite response. Expected msgpack map.")
+		}
+		dps, err := msgpackSeries(series)
+		if err != nil {
+			return MultiDatapoints{}, err
+		}
+		datapoints = append(datapoints, dps)
+	}
+	return datapoints, nil
+}
+
+func msgpackSeries(series map[string]interface{}) (Datapoints, error) {
+	name, _ := series["name"].(string)
+	start, ok := msgpackInt(series["start"])
+	if !ok {
+		return Datapoints{}, fmt.Errorf("Missing start for series %q.", name)
+	}
+	step, ok := msgpackInt(series["step"])
+	if !ok || step <= 0 {
+		return Datapoints{}, fmt.Errorf("Missing step for series %q.", name)
+	}
+	values, _ := series["values"].([]interface{})
+
+	var b datapointsBuilder
+	for i, value := range values {
+		var v []byte
+		switch n := value.(type) {
+		case nil:
+		case int64:
+			v = strconv.AppendInt(nil, n, 10)
+		case uint64:
+			v = strconv.AppendUint(nil, n, 10)
+		case float64:
+			v = formatFloatValue(n)
+		default:
+			return Datapoints{}, fmt.Errorf("Value not a number in series %q.", name)
+		}
+		b.add(v, start+int64(i)*step)
+	}
+	return b.datapoints(name), nil
+}
+
+func msgpackInt(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int64:
+		return i, true
+	case uint64:
+		return int64(i), i <= math.MaxInt64
+	}
+	return 0, false
+}
+
+// Minimal msgpack decoder supporting the types Graphite emits. Decodes into
+// nil, bool, int64, uint64, float64, string, []byte, []interface{} and
+// map[string]interface{}.
+type msgpackDecoder struct {
+	r *bufio.Reader
+}
+
+var errMsgpackSyntax = errors.New("Unexpected Graphite response. Malformed msgpack.")
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLength(c - 0xc4)
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xca:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.readBytes(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return bigEndianUint(b), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		b, err := d.readBytes(1 << (c - 0xd0))
+		if err != nil {
+			return nil, err
+		}
+		// Sign extending.
+		shift := 64 - 8*uint(len(b))
+		return int64(bigEndianUint(b)<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(c - 0xd9)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLength(c - 0xdc + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLength(c - 0xde + 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, errMsgpackSyntax
+}
+
+// Reads a 1, 2 or 4 byte length for sizeClass 0, 1 and 2 respectively.
+func (d *msgpackDecoder) readLength(sizeClass byte) (int, error) {
+	b, err := d.readBytes(1 << sizeClass)
+	if err != nil {
+		return 0, err
+	}
+	return int(bigEndianUint(b)), nil
+}
+
+// Lengths up to which readBytes allocates up front.
+const msgpackPreallocLimit = 64 << 10
+
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	if n > msgpackPreallocLimit {
+		// Not trusting n for preallocation, since it comes from the
+		// response. The buffer only grows as bytes arrive, so a truncated
+		// response can't make it allocate n bytes.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d *msgpackDecoder) decodeString(n int) (string, error) {
+	b, err := d.readBytes(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) decodeArray(n int) ([]interface{}, error) {
+	// Not trusting n for preallocation, since it comes from the response.
+	var a []interface{}
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, eofIsUnexpected(err)
+		}
+		switch key := k.(type) {
+		case string:
+			m[key] = v
+		case []byte:
+			m[string(key)] = v
+		default:
+			return nil, errMsgpackSyntax
+		}
+	}
+	return m, nil
+}
+
+func eofIsUnexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func bigEndianUint(b []byte) uint64 {
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u
+}
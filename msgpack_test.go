@@ -0,0 +1,173 @@
+package infrastructure
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testdata/render.msgpack mirrors what graphite-web 1.1 returns for
+// format=msgpack (msgpack-python with use_bin_type=True): two series matched
+// by "carbon.agents.*.cpuUsage" with start=1409763000, step=60 and the values
+// [1.5, None, 3.0, 2] and [None, -7] respectively. It also carries the extra
+// keys graphite-web includes, which are ignored.
+func readMsgpackFixture(t testing.TB) []byte {
+	b, err := ioutil.ReadFile("testdata/render.msgpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeMsgpackResponse(t *testing.T) {
+	t.Parallel()
+
+	response, err := decodeMsgpackResponse(bytes.NewReader(readMsgpackFixture(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 {
+		t.Fatal("Unexpected number of series:", len(response))
+	}
+	if response[0].Target != "carbon.agents.a.cpuUsage" || response[1].Target != "carbon.agents.b.cpuUsage" {
+		t.Error("Unexpected targets:", response[0].Target, response[1].Target)
+	}
+
+	floats, err := response[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFloats := []FloatDatapoint{
+		{time.Unix(1409763000, 0), makeFloat64Pointer(1.5)},
+		{time.Unix(1409763060, 0), nil},
+		{time.Unix(1409763120, 0), makeFloat64Pointer(3)},
+		{time.Unix(1409763180, 0), makeFloat64Pointer(2)},
+	}
+	if len(floats) != len(expectedFloats) {
+		t.Fatal("Unexpected number of points:", len(floats))
+	}
+	for i, expected := range expectedFloats {
+		point := floats[i]
+		if !point.Time.Equal(expected.Time) {
+			t.Error("Unexpected time:", i, point.Time)
+		}
+		if (point.Value == nil) != (expected.Value == nil) || point.Value != nil && *point.Value != *expected.Value {
+			t.Error("Unexpected value:", i, point.Value)
+		}
+	}
+
+	// Floats are truncated just like for JSON responses.
+	ints, err := response[0].AsInts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []*int64{makeInt64Pointer(1), nil, makeInt64Pointer(3), makeInt64Pointer(2)} {
+		if (ints[i].Value == nil) != (expected == nil) || expected != nil && *ints[i].Value != *expected {
+			t.Error("Unexpected value:", i, ints[i].Value)
+		}
+	}
+
+	ints, err = response[1].AsInts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 2 || ints[0].Value != nil || ints[1].Value == nil || *ints[1].Value != -7 {
+		t.Error("Unexpected points:", ints)
+	}
+	if !ints[1].Time.Equal(time.Unix(1409763060, 0)) {
+		t.Error("Unexpected time:", ints[1].Time)
+	}
+}
+
+func TestDecodeMsgpackResponseMalformed(t *testing.T) {
+	t.Parallel()
+
+	fixture := readMsgpackFixture(t)
+	for _, b := range [][]byte{
+		fixture[:len(fixture)/2],
+		fixture[:1],
+		{0xc1},
+		// A map instead of a list.
+		{0x80},
+		// A list of strings.
+		{0x91, 0xa1, 'a'},
+		// A series without step.
+		{0x91, 0x82, 0xa4, 'n', 'a', 'm', 'e', 0xa1, 'a', 0xa5, 's', 't', 'a', 'r', 't', 0x01},
+	} {
+		if _, err := decodeMsgpackResponse(bytes.NewReader(b)); err == nil || err == io.EOF {
+			t.Errorf("Expected error for %x: %v", b, err)
+		}
+	}
+
+	if response, err := decodeMsgpackResponse(bytes.NewReader([]byte{0xc0})); err != nil || len(response) != 0 {
+		t.Error("Unexpected response for nil:", response, err)
+	}
+}
+
+// Not parallel, to measure allocations.
+func TestDecodeMsgpackHugeLength(t *testing.T) {
+	for _, header := range [][]byte{
+		{0xc6, 0xff, 0xff, 0xff, 0xff},
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+	} {
+		b := append([]byte{0x91}, append(header, "truncated"...)...)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := decodeMsgpackResponse(bytes.NewReader(b))
+		runtime.ReadMemStats(&after)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("Unexpected error for %x: %v", header, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("Allocated %d bytes for %x.", allocated, header)
+		}
+	}
+}
+
+func TestQueryMsgpack(t *testing.T) {
+	t.Parallel()
+
+	fixture := readMsgpackFixture(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("format") != "msgpack" {
+			t.Error("Unexpected format:", r.FormValue("format"))
+		}
+		w.Header().Set("Content-Type", "application/x-msgpack")
+		w.Write(fixture)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points, err := c.QueryMultiSince([]string{"carbon.agents.*.cpuUsage"}, time.Hour, WithFormat(FormatMsgpack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Fatal("Unexpected number of series:", len(points))
+	}
+	if floats, err := points.AsMap()["carbon.agents.a.cpuUsage"].AsFloats(); err != nil || len(floats) != 4 {
+		t.Error("Unexpected points:", floats, err)
+	}
+
+	if ints, err := c.QuerySince("carbon.agents.*.cpuUsage", time.Hour, WithFormat(FormatMsgpack)).AsInts(); err == nil {
+		t.Error("Expected error for multiple targets:", ints)
+	}
+}
+
+func BenchmarkDecodeMsgpackResponse(b *testing.B) {
+	fixture := readMsgpackFixture(b)
+	b.SetBytes(int64(len(fixture)))
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeMsgpackResponse(bytes.NewReader(fixture)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package infrastructure
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// Bare tokens Python's json module emits for non-finite floats, ie. from
+// divideSeries by zero, which encoding/json rejects.
+var nonFiniteTokens = [][]byte{[]byte("NaN"), []byte("Infinity"), []byte("-Infinity")}
+
+// Replaces bare NaN, Infinity and -Infinity tokens outside of JSON strings
+// with null, so that a single non-finite value doesn't fail the whole
+// response.
+type nonFiniteReader struct {
+	r        *bufio.Reader
+	inString bool
+	escaped  bool
+	// Replacement bytes not yet returned.
+	pending []byte
+}
+
+func newNonFiniteReader(r io.Reader) *nonFiniteReader {
+	// Large reads keep the overhead on top of json.Decoder low.
+	return &nonFiniteReader{r: bufio.NewReaderSize(r, 32<<10)}
+}
+
+func (f *nonFiniteReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(f.pending) > 0 {
+			copied := copy(p[n:], f.pending)
+			f.pending = f.pending[copied:]
+			n += copied
+			continue
+		}
+
+		if f.r.Buffered() == 0 {
+			if _, err := f.r.Peek(1); err != nil {
+				if n > 0 {
+					return n, nil
+				}
+				return 0, err
+			}
+		}
+		chunk, _ := f.r.Peek(f.r.Buffered())
+		if len(chunk) > len(p)-n {
+			chunk = chunk[:len(p)-n]
+		}
+
+		// Copying everything up to the first byte that might start a
+		// non-finite token.
+		i := f.scan(chunk)
+		n += copy(p[n:], chunk[:i])
+		f.r.Discard(i)
+		if i == len(chunk) {
+			continue
+		}
+
+		c, _ := f.r.ReadByte()
+		if f.replaceToken(c) {
+			f.pending = []byte("null")
+			continue
+		}
+		p[n] = c
+		n++
+	}
+	return n, nil
+}
+
+// Returns the index of the first byte of chunk, outside of a string, that
+// might start a non-finite token. Keeps track of strings along the way.
+func (f *nonFiniteReader) scan(chunk []byte) int {
+	i := 0
+	for i < len(chunk) {
+		if f.inString {
+			if f.escaped {
+				f.escaped = false
+				i++
+				continue
+			}
+			j := bytes.IndexAny(chunk[i:], `"\\`)
+			if j < 0 {
+				return len(chunk)
+			}
+			i += j
+			if chunk[i] == '"' {
+				f.inString = false
+			} else {
+				f.escaped = true
+			}
+			i++
+			continue
+		}
+
+		j := bytes.IndexAny(chunk[i:], `"NI-`)
+		if j < 0 {
+			return len(chunk)
+		}
+		i += j
+		if chunk[i] != '"' {
+			return i
+		}
+		f.inString = true
+		i++
+	}
+	return len(chunk)
+}
+
+// Consumes the rest of a non-finite token starting with c, if there is one.
+func (f *nonFiniteReader) replaceToken(c byte) bool {
+	for _, token := range nonFiniteTokens {
+		if token[0] != c {
+			continue
+		}
+		rest, _ := f.r.Peek(len(token) - 1)
+		if bytes.Equal(rest, token[1:]) {
+			f.r.Discard(len(rest))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package infrastructure
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNonFiniteReader(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		`[[NaN, 1], [Infinity,2], [-Infinity, 3], [-1, 4]]`: `[[null, 1], [null,2], [null, 3], [-1, 4]]`,
+		`{"target": "NaN", "datapoints": [[NaN, 1]]}`:       `{"target": "NaN", "datapoints": [[null, 1]]}`,
+		`{"target": "a\"NaN\\", "x": Infinity}`:             `{"target": "a\"NaN\\", "x": null}`,
+		`[[Na, 1], [Inf`:                                    `[[Na, 1], [Inf`,
+		``:                                                  ``,
+	}
+	for input, expected := range tests {
+		// Reading one byte at a time to exercise tokens spanning reads.
+		actual, err := ioutil.ReadAll(iotest.OneByteReader(newNonFiniteReader(strings.NewReader(input))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expected {
+			t.Errorf("Unexpected output for %s: %s", input, actual)
+		}
+	}
+}
+
+func TestDecodeNonFiniteValues(t *testing.T) {
+	t.Parallel()
+
+	// As emitted by graphite-web for ie. divideSeries by zero.
+	body := `[{"target": "divideSeries(a,b)", "datapoints": [[NaN, 1409763000], [Infinity, 1409763060], [-Infinity, 1409763120], [0.5, 1409763180]]},` +
+		`{"target": "c", "datapoints": [[1, 1409763000]]}]`
+	response, err := parseGraphiteResponse([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 2 {
+		t.Fatal("Unexpected number of series:", len(response))
+	}
+	points, err := response[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFloatValues(t, "divideSeries", points, nil, nil, nil, makeFloat64Pointer(0.5))
+}
@@ -0,0 +1,514 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	httpurl "net/url"
+	"time"
+)
+
+// The format requested from Graphite's render API.
+type Format string
+
+const (
+	FormatJSON Format = "json"
+
+	// Requires Graphite 1.1 or later. Parses considerably faster than JSON
+	// and is much smaller for large responses.
+	FormatMsgpack Format = "msgpack"
+
+	// Rows of "target,datetime,value". Datetimes are in the server's time
+	// zone unless WithLocation is used.
+	FormatCSV Format = "csv"
+)
+
+// Configures a Client. Passed to New and NewFromURL.
+type ClientOption func(*Client)
+
+// Use a copy of c for all requests, ie. for a custom transport. Later changes
+// to c don't affect the Client. A nil c means http.DefaultClient.
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(g *Client) {
+		g.Client = copyHTTPClient(c)
+		g.ownsTransport = false
+	}
+}
+
+// Time limit for requests, including reading the response body. See
+// http.Client.Timeout.
+func WithTimeout(timeout time.Duration) ClientOption {
+	return func(g *Client) {
+		g.Client = copyHTTPClient(g.Client)
+		g.Client.Timeout = timeout
+	}
+}
+
+// Store cookies set by Graphite in jar and send them with later requests, ie.
+// the session cookie of an SSO proxy in front of Graphite. The jar is shared
+// with clones of the Client. Cookies are never included in errors.
+func WithCookieJar(jar http.CookieJar) ClientOption {
+	return func(g *Client) {
+		g.Client = copyHTTPClient(g.Client)
+		g.Client.Jar = jar
+	}
+}
+
+// Like WithCookieJar, with a new in-memory cookiejar.Jar for every Client
+// the option is applied to.
+func WithInMemoryCookies() ClientOption {
+	return func(g *Client) {
+		// Never fails without options.
+		jar, _ := cookiejar.New(nil)
+		WithCookieJar(jar)(g)
+	}
+}
+
+// A copy of c, or of http.DefaultClient if c is nil.
+func copyHTTPClient(c *http.Client) *http.Client {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	client := *c
+	return &client
+}
+
+// Keep up to n idle connections to Graphite, rather than
+// http.DefaultTransport's 2, ie. to avoid reconnecting when running many
+// queries in parallel. Like the other transport options, only applies if the
+// Client's transport is an *http.Transport or nil, ie. http.DefaultTransport,
+// and modifies a copy of it, so it composes with the other options.
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(g *Client) {
+		g.modifyTransport(func(t *http.Transport) {
+			t.MaxIdleConnsPerHost = n
+		})
+	}
+}
+
+// Close idle connections after d. See WithMaxIdleConnsPerHost.
+func WithIdleConnTimeout(d time.Duration) ClientOption {
+	return func(g *Client) {
+		g.modifyTransport(func(t *http.Transport) {
+			t.IdleConnTimeout = d
+		})
+	}
+}
+
+// Use every connection for a single request. See WithMaxIdleConnsPerHost.
+func WithDisableKeepAlives() ClientOption {
+	return func(g *Client) {
+		g.modifyTransport(func(t *http.Transport) {
+			t.DisableKeepAlives = true
+		})
+	}
+}
+
+// Whether to attempt HTTP/2 over TLS, which http.DefaultTransport does. See
+// http.Transport.ForceAttemptHTTP2 and WithMaxIdleConnsPerHost.
+func WithForceHTTP2(force bool) ClientOption {
+	return func(g *Client) {
+		g.modifyTransport(func(t *http.Transport) {
+			t.ForceAttemptHTTP2 = force
+		})
+	}
+}
+
+// Applies modify to a copy of the transport of g, which must be an
+// *http.Transport or nil, ie. http.DefaultTransport. Other transports are left
+// as is.
+func (g *Client) modifyTransport(modify func(t *http.Transport)) {
+	g.Client = copyHTTPClient(g.Client)
+	transport := g.Client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if t, ok := transport.(*http.Transport); ok {
+		t = t.Clone()
+		modify(t)
+		g.Client.Transport = t
+		g.ownsTransport = true
+	}
+}
+
+// Makes the transport of g connect using dial. See modifyTransport.
+func (g *Client) setDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) {
+	g.modifyTransport(func(t *http.Transport) {
+		t.DialContext = dial
+	})
+}
+
+// Authenticate every request using basic auth.
+func WithBasicAuth(username, password string) ClientOption {
+	return func(g *Client) {
+		g.basicAuth = httpurl.UserPassword(username, password)
+	}
+}
+
+// See Client.RetryPolicy.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(g *Client) {
+		g.RetryPolicy = p
+	}
+}
+
+// See Client.MaxResponseBytes.
+func WithMaxResponseBytes(n int64) ClientOption {
+	return func(g *Client) {
+		g.MaxResponseBytes = n
+	}
+}
+
+// See Client.DisableCompression.
+func WithoutCompression() ClientOption {
+	return func(g *Client) {
+		g.DisableCompression = true
+	}
+}
+
+// See Client.MaxTargetsPerRequest.
+func WithMaxTargetsPerRequest(n int) ClientOption {
+	return func(g *Client) {
+		g.MaxTargetsPerRequest = n
+	}
+}
+
+// Cache decoded render responses. See NewQueryCache.
+func WithQueryCache(ttl time.Duration, maxEntries int) ClientOption {
+	return func(g *Client) {
+		g.Cache = NewQueryCache(ttl, maxEntries)
+	}
+}
+
+// Generate request IDs using generate rather than randomly. See
+// WithRequestID.
+func WithRequestIDGenerator(generate func() string) ClientOption {
+	return func(g *Client) {
+		g.requestIDGenerator = generate
+	}
+}
+
+// Send request IDs in the given header, ie. "X-Correlation-ID". Defaults to
+// "X-Request-ID".
+func WithRequestIDHeader(name string) ClientOption {
+	return func(g *Client) {
+		g.requestIDHeader = name
+	}
+}
+
+// Apply WithEmptySeriesError to every query.
+func WithDefaultEmptySeriesError() ClientOption {
+	return func(g *Client) {
+		g.emptySeriesError = true
+	}
+}
+
+// Make QueryDefault and QueryMultiDefault query the last d, like QuerySince.
+// Replaces any WithDefaultInterval.
+func WithDefaultLookback(d time.Duration) ClientOption {
+	return func(g *Client) {
+		g.defaultLookback = d
+		g.defaultInterval = nil
+	}
+}
+
+// Make QueryDefault and QueryMultiDefault query interval, like Query.
+// Replaces any WithDefaultLookback.
+func WithDefaultInterval(interval TimeInterval) ClientOption {
+	return func(g *Client) {
+		g.defaultInterval = &interval
+		g.defaultLookback = 0
+	}
+}
+
+// Modifies a single query. Passed to the Query* methods of Client.
+type QueryOption func(*queryOptions)
+
+type queryOptions struct {
+	ctx           context.Context
+	format        Format
+	location      *time.Location
+	requestID     string
+	maxDataPoints int
+	noCache       bool
+	validate      bool
+	duplicates    bool
+	emptySeries   bool
+	requireAll    bool
+
+	// Only used by Find.
+	findFrom, findUntil *time.Time
+
+	// Passed on to Client.do through ctx.
+	request requestOptions
+}
+
+// Options of the HTTP request itself.
+type requestOptions struct {
+	header  http.Header
+	timeout time.Duration
+}
+
+type requestOptionsKey struct{}
+
+func newQueryOptions(opts []QueryOption) queryOptions {
+	o := queryOptions{
+		ctx:    context.Background(),
+		format: FormatJSON,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.requestID != "" {
+		o.ctx = withRequestID(o.ctx, o.requestID)
+	}
+	if o.request.header != nil || o.request.timeout > 0 {
+		o.ctx = context.WithValue(o.ctx, requestOptionsKey{}, o.request)
+	}
+	return o
+}
+
+func requestOptionsFrom(ctx context.Context) requestOptions {
+	o, _ := ctx.Value(requestOptionsKey{}).(requestOptions)
+	return o
+}
+
+// Request the render response in the given format. The result is the same
+// regardless of format. Defaults to FormatJSON.
+func WithFormat(f Format) QueryOption {
+	return func(o *queryOptions) {
+		o.format = f
+	}
+}
+
+// Make the request use ctx. Cancelling it aborts the request.
+func WithContext(ctx context.Context) QueryOption {
+	return func(o *queryOptions) {
+		o.ctx = ctx
+	}
+}
+
+// Send id as the request ID of the query, rather than a generated one. Every
+// request carries a request ID header, which is included in the errors of
+// failed requests to correlate them with Graphite's logs. A query split into
+// several requests uses id for all of them.
+func WithRequestID(id string) QueryOption {
+	return func(o *queryOptions) {
+		o.requestID = id
+	}
+}
+
+// Make Graphite interpret and return datetimes in loc, by passing it as the tz
+// parameter. Absolute intervals are sent in loc and CSV datetimes are parsed
+// in loc. Without it, Graphite uses its configured TIME_ZONE and CSV datetimes
+// are assumed to be in time.Local.
+func WithLocation(loc *time.Location) QueryOption {
+	return func(o *queryOptions) {
+		o.location = loc
+	}
+}
+
+// Let Graphite consolidate every series into at most n datapoints, by
+// passing it as the maxDataPoints parameter. Ignored by Find.
+func WithMaxDataPoints(n int) QueryOption {
+	return func(o *queryOptions) {
+		o.maxDataPoints = n
+	}
+}
+
+// Send an additional header with the request, ie. for an authenticating
+// proxy. Replaces any header set by the Client with the same name.
+func WithHeader(key, value string) QueryOption {
+	return func(o *queryOptions) {
+		// Copying, since the options might be reused by concurrent queries.
+		header := o.request.header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		header.Add(key, value)
+		o.request.header = header
+	}
+}
+
+// Time limit for the query, including reading the response body. Applies in
+// addition to the timeout of the Client and the deadline of the context.
+func WithQueryTimeout(timeout time.Duration) QueryOption {
+	return func(o *queryOptions) {
+		o.request.timeout = timeout
+	}
+}
+
+// Bypass Client.Cache and ask Graphite to bypass its render cache, by passing
+// the noCache parameter. Ignored by Find.
+func WithoutCache() QueryOption {
+	return func(o *queryOptions) {
+		o.noCache = true
+	}
+}
+
+// Check every target using ValidateTarget before querying, failing the query
+// without a request if any is invalid.
+func WithValidation() QueryOption {
+	return func(o *queryOptions) {
+		o.validate = true
+	}
+}
+
+// Request targets given more than once as many times as they're given.
+// Graphite then returns their series more than once, too. By default, only
+// the first occurrence of a target is requested, so its series are only
+// returned once. Either way, series are returned in Graphite's order and
+// aren't tied to the positions of the targets.
+func WithDuplicateTargets() QueryOption {
+	return func(o *queryOptions) {
+		o.duplicates = true
+	}
+}
+
+// Fail single series queries, ie. Query and QueryFloats, with an
+// *EmptySeriesError if the series has no datapoints at all, ie. due to a
+// deleted whisper file. Unlike a series of nulls, which is what a quiet
+// metric looks like. See WithDefaultEmptySeriesError.
+func WithEmptySeriesError() QueryOption {
+	return func(o *queryOptions) {
+		o.emptySeries = true
+	}
+}
+
+// Make QueryMulti and the other multi series queries fail with a
+// *MissingTargetsError, together with the series that were returned, if any
+// target has no series named after it. Only applies to targets that are
+// plain metric paths, ie. "a.b", since there's no telling what globs and
+// functions, ie. "a.*" or "sumSeries(a.b)", should return.
+func WithRequireAllTargets() QueryOption {
+	return func(o *queryOptions) {
+		o.requireAll = true
+	}
+}
+
+// Only find metrics with data since from. Replaces FindOpts.From.
+func WithFindFrom(from time.Time) QueryOption {
+	return func(o *queryOptions) {
+		o.findFrom = &from
+	}
+}
+
+// Only find metrics with data until until. Replaces FindOpts.Until.
+func WithFindUntil(until time.Time) QueryOption {
+	return func(o *queryOptions) {
+		o.findUntil = &until
+	}
+}
+
+// Validates targets if requested using WithValidation.
+func (o queryOptions) validateTargets(targets []string) error {
+	if !o.validate {
+		return nil
+	}
+	var errs []error
+	for _, target := range targets {
+		errs = append(errs, ValidateTarget(target))
+	}
+	return errors.Join(errs...)
+}
+
+// Removes targets given more than once from targets and the "target" parameter
+// of queryPart, unless WithDuplicateTargets was given.
+func (o queryOptions) uniqueTargets(targets []string, queryPart httpurl.Values) []string {
+	if o.duplicates || len(targets) < 2 {
+		return targets
+	}
+	seen := make(map[string]bool, len(targets))
+	unique := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if !seen[target] {
+			seen[target] = true
+			unique = append(unique, target)
+		}
+	}
+	if len(unique) == len(targets) {
+		return targets
+	}
+	queryPart["target"] = unique
+	return unique
+}
+
+// t in the requested location, if any.
+func (o queryOptions) in(t time.Time) time.Time {
+	if o.location == nil {
+		return t
+	}
+	return t.In(o.location)
+}
+
+// Modifies how datapoints are converted, ie. by AsFloats, AsFloatsMap and
+// Aggregate.
+type ConvertOption func(*convertOptions)
+
+type convertOptions struct {
+	partial     bool
+	nullsAsZero bool
+
+	sortDedup   bool
+	dedupPolicy DedupPolicy
+
+	strictInts bool
+}
+
+func newConvertOptions(opts []ConvertOption) convertOptions {
+	var o convertOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Keep converting when a series fails to convert, returning the series that
+// could be converted together with an error joining all failures. By default,
+// conversion stops at the first failure.
+func PartialResults() ConvertOption {
+	return func(o *convertOptions) {
+		o.partial = true
+	}
+}
+
+// Treat nulls as zero when aggregating, instead of ignoring them.
+func NullsAsZero() ConvertOption {
+	return func(o *convertOptions) {
+		o.nullsAsZero = true
+	}
+}
+
+// Modifies how AlignSeries and AlignMany join series.
+type AlignOption func(*alignOptions)
+
+type alignOptions struct {
+	inner bool
+}
+
+// Only keep timestamps present in every series, including as nulls. By
+// default, the union of all timestamps is kept.
+func InnerJoin() AlignOption {
+	return func(o *alignOptions) {
+		o.inner = true
+	}
+}
+
+// Sort the datapoints by time and remove duplicate timestamps according to
+// policy. The datapoints are only sorted if they aren't already.
+func SortAndDedup(policy DedupPolicy) ConvertOption {
+	return func(o *convertOptions) {
+		o.sortDedup = true
+		o.dedupPolicy = policy
+	}
+}
+
+// Make AsInts fail with a *NotIntegerError for values that aren't exact
+// integers, instead of truncating them towards zero.
+func StrictInts() ConvertOption {
+	return func(o *convertOptions) {
+		o.strictInts = true
+	}
+}
@@ -0,0 +1,418 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryOptionsCompose(t *testing.T) {
+	t.Parallel()
+
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("maxDataPoints") != "100" {
+			t.Error("Unexpected maxDataPoints:", r.FormValue("maxDataPoints"))
+		}
+		if r.Header.Get("X-Scope") != "ops" || len(r.Header["X-Scope"]) != 1 || r.Header.Get("X-Other") != "a" {
+			t.Error("Unexpected headers:", r.Header)
+		}
+		if r.FormValue("target") == "slow" {
+			<-block
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	c, err := New(ts.URL, WithQueryCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []QueryOption{WithMaxDataPoints(100), WithHeader("X-Scope", "ops"), WithHeader("X-Other", "a"), WithQueryTimeout(time.Minute)}
+	if points, err := c.Query("a", TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}, opts...).AsInts(); err != nil || len(points) != 1 {
+		t.Error("Unexpected response:", points, err)
+	}
+
+	// The timeout applies to the slow query only.
+	start := time.Now()
+	_, err = c.QueryMultiSince([]string{"slow"}, time.Hour, append(opts, WithQueryTimeout(50*time.Millisecond))...)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected deadline to be exceeded:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Error("Timeout not applied:", elapsed)
+	}
+	if points, err := c.QuerySince("a", time.Hour, opts...).AsInts(); err != nil || len(points) != 1 {
+		t.Error("Unexpected response:", points, err)
+	}
+}
+
+func TestWithoutCache(t *testing.T) {
+	t.Parallel()
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if noCache := r.FormValue("noCache"); (requests == 2) != (noCache == "true") {
+			t.Error("Unexpected noCache:", requests, noCache)
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithQueryCache(time.Minute, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	c.Query("a", interval)
+	c.Query("a", interval)
+	if requests != 1 {
+		t.Fatal("Expected cached response:", requests)
+	}
+	c.Query("a", interval, WithoutCache())
+	if requests != 2 {
+		t.Error("Expected cache to be bypassed:", requests)
+	}
+}
+
+func TestFindOptions(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("from") != "10:00_20140903" || r.FormValue("until") != "" {
+			t.Error("Unexpected interval:", r.Form)
+		}
+		if r.Header.Get("X-Scope") != "ops" {
+			t.Error("Unexpected headers:", r.Header)
+		}
+		w.Write([]byte(`[{"leaf": 1, "text": "b", "id": "a.b", "expandable": 0, "allowChildren": 0}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.Find("a.*", WithFindFrom(time.Date(2014, 9, 3, 10, 0, 0, 0, time.Local)), WithHeader("X-Scope", "ops"), WithQueryTimeout(time.Minute))
+	if err != nil || len(items) != 1 || items[0].Id != "a.b" || !items[0].Leaf {
+		t.Error("Unexpected items:", items, err)
+	}
+}
+
+func TestDuplicateTargets(t *testing.T) {
+	t.Parallel()
+
+	var received [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = append(received, r.Form["target"])
+		var series []string
+		for _, target := range r.Form["target"] {
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [[1, 1409763000]]}`, target))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := []string{"a", "b", "a", "c", "b", "a"}
+	series, err := c.QueryMultiSince(targets, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received[0], []string{"a", "b", "c"}) || !reflect.DeepEqual(series.Targets(), []string{"a", "b", "c"}) || len(series) != 3 {
+		t.Error("Unexpected targets:", received[0], series.Targets())
+	}
+	// The targets of the caller are left alone.
+	if !reflect.DeepEqual(targets, []string{"a", "b", "a", "c", "b", "a"}) {
+		t.Error("Modified targets:", targets)
+	}
+
+	if _, err := c.QueryRawSince(targets, time.Hour); err != nil || !reflect.DeepEqual(received[1], []string{"a", "b", "c"}) {
+		t.Error("Unexpected targets:", received[1], err)
+	}
+
+	// Batches are made of unique targets.
+	c.MaxTargetsPerRequest = 2
+	if series, err := c.QueryMultiSince(targets, time.Hour); err != nil || len(series) != 3 || len(received) != 4 {
+		t.Error("Unexpected series:", series.Targets(), err)
+	}
+	c.MaxTargetsPerRequest = 0
+
+	series, err = c.QueryMultiSince(targets, time.Hour, WithDuplicateTargets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received[4], targets) || len(series) != len(targets) {
+		t.Error("Unexpected targets:", received[4], len(series))
+	}
+}
+
+func TestEmptySeriesError(t *testing.T) {
+	t.Parallel()
+
+	responses := map[string]string{
+		"empty":   `[{"target": "empty", "datapoints": []}]`,
+		"null":    `[{"target": "null", "datapoints": null}]`,
+		"nulls":   `[{"target": "nulls", "datapoints": [[null, 1409763000]]}]`,
+		"missing": `[]`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(responses[r.FormValue("target")]))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := c.Clone(WithDefaultEmptySeriesError())
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	// Empty series look like quiet ones by default.
+	if points, err := c.QueryFloats("empty", interval); err != nil || len(points) != 0 {
+		t.Error("Unexpected result:", points, err)
+	}
+
+	for name, query := range map[string]func(q string) error{
+		"option": func(q string) error {
+			_, err := c.QueryFloats(q, interval, WithEmptySeriesError())
+			return err
+		},
+		"client": func(q string) error {
+			_, err := strict.QueryFloatsSince(q, time.Hour)
+			return err
+		},
+		"typed": func(q string) error {
+			_, err := c.QueryTypedInts(q, interval, WithEmptySeriesError())
+			return err
+		},
+	} {
+		for _, q := range []string{"empty", "null"} {
+			err := query(q)
+			var emptyErr *EmptySeriesError
+			if !errors.As(err, &emptyErr) || !errors.Is(err, ErrEmptySeries) || emptyErr.Target != q {
+				t.Error("Unexpected error:", name, q, err)
+			}
+		}
+		if err := query("nulls"); err != nil {
+			t.Error("Unexpected error for nulls:", name, err)
+		}
+		if err := query("missing"); !errors.Is(err, ErrNoTargets) || errors.Is(err, ErrEmptySeries) {
+			t.Error("Unexpected error for missing:", name, err)
+		}
+	}
+}
+
+func TestRequireAllTargets(t *testing.T) {
+	t.Parallel()
+
+	series := map[string]string{
+		"a.b":            `{"target": "a.b", "datapoints": [[1, 1409763000]]}`,
+		"a.*":            `{"target": "a.c", "datapoints": [[2, 1409763000]]}`,
+		"sumSeries(z.*)": `{"target": "sumSeries(z.*)", "datapoints": []}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var found []string
+		for _, target := range r.Form["target"] {
+			if s, ok := series[target]; ok {
+				found = append(found, s)
+			}
+		}
+		w.Write([]byte("[" + strings.Join(found, ",") + "]"))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The check covers all batches at once.
+	c.MaxTargetsPerRequest = 2
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	targets := []string{"a.b", "x.y", "a.*", "x.*", "sumSeries(z.*)", "y.z"}
+
+	if points, err := c.QueryMulti(targets, interval); err != nil || len(points) != 3 {
+		t.Error("Unexpected result:", points, err)
+	}
+
+	points, err := c.QueryMulti(targets, interval, WithRequireAllTargets())
+	var missingErr *MissingTargetsError
+	if !errors.As(err, &missingErr) || !errors.Is(err, ErrMissingTargets) {
+		t.Fatal("Unexpected error:", err)
+	}
+	if !reflect.DeepEqual(missingErr.Targets, []string{"x.y", "y.z"}) {
+		t.Error("Unexpected missing targets:", missingErr.Targets)
+	}
+	if len(points) != 3 {
+		t.Error("Unexpected points:", points)
+	}
+
+	if _, err := c.QueryMulti([]string{"a.b", "a.*"}, interval, WithRequireAllTargets()); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	t.Parallel()
+
+	const parallel = 8
+	var mu sync.Mutex
+	var round *sync.WaitGroup
+	var conns atomic.Int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Making every request of a round wait for the others, so that they
+		// need a connection each.
+		mu.Lock()
+		wg := round
+		mu.Unlock()
+		if wg != nil {
+			wg.Done()
+			wg.Wait()
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	// The number of connections opened for three rounds of parallel queries.
+	connections := func(opts ...ClientOption) int64 {
+		c, err := New(ts.URL, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Client.CloseIdleConnections()
+		before := conns.Load()
+		for i := 0; i < 3; i++ {
+			wg := &sync.WaitGroup{}
+			wg.Add(parallel)
+			mu.Lock()
+			round = wg
+			mu.Unlock()
+			if _, err := c.QueryManyParallel(context.Background(), strings.Split("a b c d e f g h", " "), interval, ParallelOpts{BatchSize: 1, Concurrency: parallel}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return conns.Load() - before
+	}
+
+	// http.DefaultTransport only keeps 2 idle connections.
+	if n := connections(); n <= parallel {
+		t.Error("Unexpected connections by default:", n)
+	}
+	if n := connections(WithMaxIdleConnsPerHost(parallel), WithIdleConnTimeout(time.Minute)); n != parallel {
+		t.Error("Unexpected connections with idle connections:", n)
+	}
+	if n := connections(WithDisableKeepAlives()); n != 3*parallel {
+		t.Error("Unexpected connections without keep-alives:", n)
+	}
+
+	// The options compose, and with options replacing the dialer.
+	c, err := New(ts.URL, WithMaxIdleConnsPerHost(10), WithRoundRobin(time.Minute), WithIdleConnTimeout(time.Minute), WithForceHTTP2(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := c.Client.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 10 || transport.IdleConnTimeout != time.Minute || transport.ForceAttemptHTTP2 || transport.DialContext == nil {
+		t.Error("Unexpected transport:", transport)
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost != 0 {
+		t.Error("Modified http.DefaultTransport.")
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	t.Parallel()
+
+	// Like an SSO proxy, redirecting to set a session cookie.
+	var logins, retried atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "secret" {
+			logins.Add(1)
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret", Path: "/"})
+			http.Redirect(w, r, r.URL.String(), http.StatusFound)
+			return
+		}
+		if r.Header.Get("Cookie") != "session=secret" {
+			t.Error("Unexpected cookies:", r.Header["Cookie"])
+		}
+		if r.URL.Path == "/metrics/find" && retried.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/render":
+			w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+		case "/metrics/find":
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer ts.Close()
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	// Without cookies, the redirects never end.
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryFloats("a", interval); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Error("Unexpected error:", err)
+	}
+
+	logins.Store(0)
+	c, err = New(ts.URL, WithInMemoryCookies(), WithTimeout(5*time.Second), WithRetryPolicy(DefaultRetryPolicy{BaseDelay: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.QueryFloats("a", interval); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Retried requests send the cookie once.
+	if _, err := c.Find("a.*"); err != nil {
+		t.Fatal(err)
+	}
+	// The jar is shared with clones.
+	if _, err := c.Clone().QueryFloats("a", interval); err != nil {
+		t.Fatal(err)
+	}
+	if logins.Load() != 1 {
+		t.Error("Unexpected logins:", logins.Load())
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = New(ts.URL, WithCookieJar(jar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryFloats("a", interval); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := jar.Cookies(&c.URL); len(cookies) != 1 || cookies[0].Value != "secret" {
+		t.Error("Unexpected cookies:", cookies)
+	}
+}
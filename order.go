@@ -0,0 +1,194 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Which datapoint DedupPoints keeps when several share a timestamp.
+type DedupPolicy int
+
+const (
+	// Keep the last non-null datapoint, or the last one if all are null.
+	KeepLastNonNull DedupPolicy = iota
+	KeepFirst
+	KeepLast
+)
+
+// Whether points are sorted by time, with duplicates allowed. Cheap, making it
+// possible to skip SortPoints in the common case.
+func IsSorted(points []FloatDatapoint) bool {
+	return isSortedPoints(points)
+}
+
+// Like IsSorted, but for ints.
+func IsSortedInts(points []IntDatapoint) bool {
+	return isSortedPoints(points)
+}
+
+// Sorts points by time, in place. Datapoints with the same timestamp keep
+// their relative order.
+func SortPoints(points []FloatDatapoint) {
+	sortPoints(points)
+}
+
+// Like SortPoints, but for ints.
+func SortIntPoints(points []IntDatapoint) {
+	sortPoints(points)
+}
+
+// A copy of sorted points with only one datapoint per timestamp, chosen
+// according to policy. Relays and overlapping caches occasionally return the
+// same timestamp twice.
+func DedupPoints(points []FloatDatapoint, policy DedupPolicy) []FloatDatapoint {
+	return dedupPoints(points, policy)
+}
+
+// Like DedupPoints, but for ints.
+func DedupIntPoints(points []IntDatapoint, policy DedupPolicy) []IntDatapoint {
+	return dedupPoints(points, policy)
+}
+
+func isSortedPoints[T Number](points []Datapoint[T]) bool {
+	return sort.SliceIsSorted(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+}
+
+func sortPoints[T Number](points []Datapoint[T]) {
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+}
+
+// Keeps one datapoint per run of equal timestamps.
+func dedupPoints[T Number](points []Datapoint[T], policy DedupPolicy) []Datapoint[T] {
+	var deduped []Datapoint[T]
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[start].Time.Equal(points[end].Time) {
+			end++
+		}
+
+		k := end - 1
+		switch policy {
+		case KeepFirst:
+			k = start
+		case KeepLastNonNull:
+			for i := end - 1; i >= start; i-- {
+				if points[i].Value != nil {
+					k = i
+					break
+				}
+			}
+		}
+		deduped = append(deduped, points[k])
+		start = end
+	}
+	return deduped
+}
+
+// How DedupTargets handles series sharing the same target.
+type TargetPolicy int
+
+const (
+	// Keep the last series, like AsMap.
+	TargetKeepLast TargetPolicy = iota
+	TargetKeepFirst
+	// Fail with a *DuplicateTargetError.
+	TargetError
+	// Merge the datapoints of all series, sorted by time. Datapoints with the
+	// same timestamp are deduplicated using KeepLastNonNull.
+	TargetMerge
+)
+
+// A copy of m with only one series per target, chosen or merged according to
+// policy. Every target is kept at its first position.
+func (m MultiDatapoints) DedupTargets(policy TargetPolicy) (MultiDatapoints, error) {
+	var res MultiDatapoints
+	positions := make(map[string]int, len(m))
+	for _, d := range m {
+		i, seen := positions[d.Target]
+		if !seen {
+			positions[d.Target] = len(res)
+			res = append(res, d)
+			continue
+		}
+
+		switch policy {
+		case TargetKeepLast:
+			res[i] = d
+		case TargetError:
+			return nil, &DuplicateTargetError{d.Target}
+		case TargetMerge:
+			merged, err := mergeDatapoints(res[i], d)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = merged
+		}
+	}
+	if res == nil {
+		res = MultiDatapoints{}
+	}
+	return res, nil
+}
+
+// Like AsMap, but handles series sharing the same target according to policy.
+func (m MultiDatapoints) AsMapWith(policy TargetPolicy) (map[string]Datapoints, error) {
+	deduped, err := m.DedupTargets(policy)
+	if err != nil {
+		return nil, err
+	}
+	return deduped.AsMap(), nil
+}
+
+// Returned by DedupTargets for TargetError.
+type DuplicateTargetError struct {
+	Target string
+}
+
+func (e *DuplicateTargetError) Error() string {
+	return fmt.Sprintf("Target %q was returned more than once.", e.Target)
+}
+
+type rawDatapoint struct {
+	value    []byte
+	unixTime int64
+}
+
+func mergeDatapoints(a, b Datapoints) (Datapoints, error) {
+	if a.err != nil || b.err != nil {
+		return Datapoints{err: errors.Join(a.err, b.err), Target: a.Target, Tags: a.Tags}, nil
+	}
+
+	var points []rawDatapoint
+	for _, d := range []Datapoints{a, b} {
+		err := scanDatapoints(d.points, func(value []byte, t time.Time) error {
+			points = append(points, rawDatapoint{value, t.Unix()})
+			return nil
+		})
+		if err != nil {
+			return Datapoints{}, d.withTarget(err)
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].unixTime < points[j].unixTime })
+
+	var builder datapointsBuilder
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[end].unixTime == points[start].unixTime {
+			end++
+		}
+		k := end - 1
+		for i := end - 1; i >= start; i-- {
+			if points[i].value != nil {
+				k = i
+				break
+			}
+		}
+		builder.add(points[k].value, points[k].unixTime)
+		start = end
+	}
+	merged := builder.datapoints(a.Target)
+	merged.Tags = a.Tags
+	return merged, nil
+}
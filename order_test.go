@@ -0,0 +1,165 @@
+package infrastructure
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestSortPoints(t *testing.T) {
+	t.Parallel()
+
+	points := minutelyFloatDatapoints(2, 0, 1, 0)
+	points[1].Value = makeFloat64Pointer(1)
+	if IsSorted(points) {
+		t.Error("Expected unsorted.")
+	}
+	SortPoints(points)
+	if !IsSorted(points) {
+		t.Error("Expected sorted.")
+	}
+	// Stable, so the first duplicate stays first.
+	if points[0].Value == nil || points[1].Value != nil {
+		t.Error("Expected stable sort:", points)
+	}
+
+	ints := []IntDatapoint{{Time: time.Unix(2, 0)}, {Time: time.Unix(1, 0)}}
+	if IsSortedInts(ints) {
+		t.Error("Expected unsorted.")
+	}
+	SortIntPoints(ints)
+	if !IsSortedInts(ints) || ints[0].Time.Unix() != 1 {
+		t.Error("Unexpected order:", ints)
+	}
+}
+
+func TestDedupPoints(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	start := time.Unix(1409763000, 0)
+	points := []FloatDatapoint{
+		{start, v(1)},
+		{start, nil},
+		{start.Add(time.Minute), nil},
+		{start.Add(time.Minute), v(2)},
+		{start.Add(time.Minute), v(3)},
+		{start.Add(2 * time.Minute), nil},
+		{start.Add(2 * time.Minute), nil},
+	}
+
+	assertFloatValues(t, "KeepLastNonNull", DedupPoints(points, KeepLastNonNull), v(1), v(3), nil)
+	assertFloatValues(t, "KeepFirst", DedupPoints(points, KeepFirst), v(1), nil, nil)
+	assertFloatValues(t, "KeepLast", DedupPoints(points, KeepLast), nil, v(3), nil)
+
+	deduped := DedupPoints(points, KeepLast)
+	for i, expected := range []time.Duration{0, time.Minute, 2 * time.Minute} {
+		if !deduped[i].Time.Equal(start.Add(expected)) {
+			t.Error("Unexpected time:", i, deduped[i].Time)
+		}
+	}
+	if len(DedupPoints(nil, KeepLast)) != 0 {
+		t.Error("Expected no points.")
+	}
+
+	ints := []IntDatapoint{{start, makeInt64Pointer(1)}, {start, nil}}
+	if deduped := DedupIntPoints(ints, KeepLastNonNull); len(deduped) != 1 || *deduped[0].Value != 1 {
+		t.Error("Unexpected points:", deduped)
+	}
+}
+
+func TestAsFloatsSortAndDedup(t *testing.T) {
+	t.Parallel()
+
+	d := Datapoints{Target: "a", points: []byte("[[3, 1409763120], [1, 1409763000], [null, 1409763060], [2, 1409763060], [null, 1409763000]]")}
+	points, err := d.AsFloats(SortAndDedup(KeepLastNonNull))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFloatValues(t, "AsFloats", points, makeFloat64Pointer(1), makeFloat64Pointer(2), makeFloat64Pointer(3))
+
+	ints, err := d.AsInts(SortAndDedup(KeepFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 3 || *ints[0].Value != 1 || ints[1].Value != nil || *ints[2].Value != 3 {
+		t.Error("Unexpected points:", ints)
+	}
+
+	if points, _ := d.AsFloats(); len(points) != 5 {
+		t.Error("Expected no dedup by default:", points)
+	}
+}
+
+func TestDedupTargets(t *testing.T) {
+	t.Parallel()
+
+	b, err := ioutil.ReadFile("testdata/duplicate_targets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseGraphiteResponse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Server order is preserved.
+	if len(m) != 3 || m[0].Target != "a" || m[1].Target != "b" || m[2].Target != "a" {
+		t.Fatal("Unexpected order:", m)
+	}
+
+	firstValue := func(d Datapoints) float64 {
+		points, err := d.AsFloats()
+		if err != nil || len(points) == 0 {
+			t.Fatal("Unexpected points:", points, err)
+		}
+		return *points[0].Value
+	}
+
+	for policy, expected := range map[TargetPolicy]float64{TargetKeepFirst: 1, TargetKeepLast: 2} {
+		deduped, err := m.DedupTargets(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deduped) != 2 || deduped[0].Target != "a" || deduped[1].Target != "b" {
+			t.Error("Unexpected targets:", policy, deduped.Targets())
+		}
+		if v := firstValue(deduped[0]); v != expected {
+			t.Error("Unexpected value:", policy, v)
+		}
+
+		byTarget, err := m.AsMapWith(policy)
+		if err != nil || len(byTarget) != 2 || firstValue(byTarget["a"]) != expected {
+			t.Error("Unexpected map:", policy, byTarget, err)
+		}
+	}
+
+	var dupErr *DuplicateTargetError
+	if _, err := m.DedupTargets(TargetError); !errors.As(err, &dupErr) || dupErr.Target != "a" {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := m.AsMapWith(TargetError); err == nil {
+		t.Error("Expected error.")
+	}
+
+	merged, err := m.DedupTargets(TargetMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 {
+		t.Fatal("Unexpected targets:", merged.Targets())
+	}
+	points, err := merged[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFloatValues(t, "merged", points, makeFloat64Pointer(1), makeFloat64Pointer(2), makeFloat64Pointer(4), makeFloat64Pointer(5.5))
+	if !IsSorted(points) || points[3].Time.Unix() != 1409763180 {
+		t.Error("Unexpected times:", points)
+	}
+	// Ints stay ints.
+	if _, err := merged[1].AsInts(StrictInts()); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,150 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type ParallelOpts struct {
+	// Number of targets per request. Defaults to 100.
+	BatchSize int
+	// Maximum number of concurrent requests. Defaults to 4.
+	Concurrency int
+	// If set, failing batches don't abort the others. Their errors are
+	// joined and returned together with the series of the successful
+	// batches. By default, the first failure cancels all other requests.
+	ContinueOnError bool
+
+	// Passed to every request.
+	QueryOptions []QueryOption
+}
+
+// Like QueryMulti, but splits targets into batches queried concurrently.
+// Useful for thousands of targets, which are too many for a single request.
+// The series are returned in the order of targets.
+func (g *Client) QueryManyParallel(ctx context.Context, targets []string, interval TimeInterval, opts ParallelOpts) (MultiDatapoints, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+
+	var batches [][]string
+	for start := 0; start < len(targets); start += opts.BatchSize {
+		end := min(start+opts.BatchSize, len(targets))
+		batches = append(batches, targets[start:end])
+	}
+
+	results := make([]MultiDatapoints, len(batches))
+	err := runConcurrently(ctx, len(batches), opts.Concurrency, opts.ContinueOnError, func(ctx context.Context, i int) error {
+		batch := batches[i]
+		queryOpts := append(opts.QueryOptions[:len(opts.QueryOptions):len(opts.QueryOptions)], WithContext(ctx))
+		series, err := g.QueryMulti(batch, interval, queryOpts...)
+		// Keeping the series decoded despite an error, see QueryMulti.
+		results[i] = series
+		if err != nil {
+			return fmt.Errorf("Unable to query %d targets starting with %q: %w", len(batch), batch[0], err)
+		}
+		return nil
+	})
+	if err != nil && !opts.ContinueOnError {
+		return nil, err
+	}
+
+	res := MultiDatapoints{}
+	for _, series := range results {
+		res = append(res, series...)
+	}
+	return res, err
+}
+
+// Queries every expression of qs in a request of its own, returning the
+// series keyed by the expression they resulted from. Unlike QueryMulti,
+// series of overlapping expressions, ie. "a.*" and "*.b", are thus returned
+// for each. Expressions matching nothing map to an empty MultiDatapoints. At
+// most 4 requests are made at a time. The first failure cancels the other
+// requests.
+func (g *Client) QueryMultiGrouped(qs []string, interval TimeInterval, opts ...QueryOption) (map[string]MultiDatapoints, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+
+	var unique []string
+	res := make(map[string]MultiDatapoints, len(qs))
+	for _, q := range qs {
+		if _, seen := res[q]; !seen {
+			res[q] = MultiDatapoints{}
+			unique = append(unique, q)
+		}
+	}
+
+	results := make([]MultiDatapoints, len(unique))
+	err := runConcurrently(newQueryOptions(opts).ctx, len(unique), 4, false, func(ctx context.Context, i int) error {
+		queryOpts := append(opts[:len(opts):len(opts)], WithContext(ctx))
+		series, err := g.QueryMulti(unique[i:i+1], interval, queryOpts...)
+		if err != nil {
+			return fmt.Errorf("Unable to query %q: %w", unique[i], err)
+		}
+		results[i] = series
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, q := range unique {
+		res[q] = results[i]
+	}
+	return res, nil
+}
+
+// Calls fn for every i in [0, n), with at most concurrency calls at a time.
+// With continueOnError, returns all errors joined. Otherwise, the first
+// failure cancels the ctx of the other calls and is returned, rather than the
+// cancellations it caused.
+func runConcurrently(ctx context.Context, n, concurrency int, continueOnError bool, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, n)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-semaphore }()
+
+			if errs[i] = fn(ctx, i); errs[i] != nil && !continueOnError {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if continueOnError {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
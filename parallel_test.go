@@ -0,0 +1,219 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JensRantil/graphite-client/graphitetest"
+)
+
+func TestQueryManyParallel(t *testing.T) {
+	t.Parallel()
+
+	var lock sync.Mutex
+	var batchSizes []int
+	concurrent, maxConcurrent := 0, 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		lock.Lock()
+		batchSizes = append(batchSizes, len(r.Form["target"]))
+		concurrent++
+		maxConcurrent = max(maxConcurrent, concurrent)
+		lock.Unlock()
+
+		// Giving other requests a chance to run concurrently.
+		time.Sleep(20 * time.Millisecond)
+
+		var series []string
+		for _, target := range r.Form["target"] {
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [[1, 1409763000]]}`, target))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+
+		lock.Lock()
+		concurrent--
+		lock.Unlock()
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var targets []string
+	for i := 0; i < 95; i++ {
+		targets = append(targets, fmt.Sprintf("a.%d", i))
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409763060, 0)}
+	series, err := c.QueryManyParallel(context.Background(), targets, interval, ParallelOpts{BatchSize: 10, Concurrency: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(series) != len(targets) {
+		t.Fatal("Unexpected number of series:", len(series))
+	}
+	for i, s := range series {
+		if s.Target != targets[i] {
+			t.Fatal("Unexpected order:", i, s.Target)
+		}
+	}
+	if len(batchSizes) != 10 {
+		t.Error("Unexpected number of requests:", len(batchSizes))
+	}
+	fives := 0
+	for _, size := range batchSizes {
+		if size == 5 {
+			fives++
+		} else if size != 10 {
+			t.Error("Unexpected batch size:", size)
+		}
+	}
+	if fives != 1 {
+		t.Error("Expected one partial batch:", batchSizes)
+	}
+	if maxConcurrent > 3 {
+		t.Error("Too many concurrent requests:", maxConcurrent)
+	}
+	if maxConcurrent < 2 {
+		t.Error("Requests weren't concurrent:", maxConcurrent)
+	}
+}
+
+func TestQueryManyParallelFailure(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("target") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `[{"target": %q, "datapoints": []}]`, r.Form.Get("target"))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{"a", "bad", "c"}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409763060, 0)}
+
+	series, err := c.QueryManyParallel(context.Background(), targets, interval, ParallelOpts{BatchSize: 1})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || series != nil {
+		t.Error("Unexpected result:", series, err)
+	}
+
+	series, err = c.QueryManyParallel(context.Background(), targets, interval, ParallelOpts{BatchSize: 1, ContinueOnError: true})
+	if !errors.As(err, &httpErr) || !strings.Contains(err.Error(), `"bad"`) {
+		t.Error("Unexpected error:", err)
+	}
+	if len(series) != 2 || series[0].Target != "a" || series[1].Target != "c" {
+		t.Error("Unexpected series:", series)
+	}
+}
+
+func TestQueryManyParallelPartial(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var series []string
+		for _, target := range r.Form["target"] {
+			timestamp := "1409763000"
+			if target == "broken" {
+				timestamp = `"malformed"`
+			}
+			series = append(series, fmt.Sprintf(`{"target": %q, "datapoints": [[1, %s]]}`, target, timestamp))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(series, ","))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409763060, 0)}
+	series, err := c.QueryManyParallel(context.Background(), []string{"a", "broken", "c"}, interval, ParallelOpts{BatchSize: 2, ContinueOnError: true})
+	if err == nil || !strings.Contains(err.Error(), `"a"`) {
+		t.Error("Unexpected error:", err)
+	}
+	// The series decoded alongside the failure are kept.
+	if len(series) != 3 || series[0].Target != "a" || series[1].Target != "broken" || series[2].Target != "c" {
+		t.Fatal("Unexpected series:", series)
+	}
+	if series[0].Err() != nil || series[1].Err() == nil || series[2].Err() != nil {
+		t.Error("Unexpected errors:", series[0].Err(), series[1].Err(), series[2].Err())
+	}
+}
+
+func TestQueryMultiGrouped(t *testing.T) {
+	t.Parallel()
+
+	server := graphitetest.NewServer(t)
+	value := 1.0
+	point := []graphitetest.Point{{Time: time.Unix(1409763000, 0), Value: &value}}
+	for _, target := range []string{"web01.cpu", "web01.mem", "web02.cpu", "db01.cpu"} {
+		server.Add(graphitetest.Series{Target: target, Points: point})
+	}
+	c, err := New(server.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overlapping globs, web01.cpu matches both.
+	groups, err := c.QueryMultiGrouped([]string{"web01.*", "*.cpu", "missing.*", "web01.*"}, TimeInterval{time.Unix(1409762000, 0), time.Unix(1409764000, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Error("Unexpected groups:", groups)
+	}
+	if targets := groups["web01.*"].Targets(); !reflect.DeepEqual(targets, []string{"web01.cpu", "web01.mem"}) {
+		t.Error("Unexpected targets:", targets)
+	}
+	if targets := groups["*.cpu"].Targets(); !reflect.DeepEqual(targets, []string{"web01.cpu", "web02.cpu", "db01.cpu"}) {
+		t.Error("Unexpected targets:", targets)
+	}
+	if missing, ok := groups["missing.*"]; !ok || missing == nil || len(missing) != 0 {
+		t.Error("Unexpected series:", missing, ok)
+	}
+	// Every expression is requested once.
+	if requests := server.Requests(); len(requests) != 3 {
+		t.Error("Unexpected number of requests:", len(requests))
+	}
+}
+
+func TestQueryMultiGroupedError(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("target") == "bad" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `[{"target": %q, "datapoints": [[1, 1409763000]]}]`, r.FormValue("target"))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.QueryMultiGrouped([]string{"a", "bad", "c"}, TimeInterval{time.Unix(1409762000, 0), time.Unix(1409764000, 0)})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || !strings.Contains(err.Error(), `"bad"`) {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,170 @@
+package infrastructure
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Make s safe to use as a single segment of a metric path. Carbon and
+// graphite-web mishandle many characters, so the policy is strict:
+//
+//   - ASCII letters, digits, '-' and '_' are kept.
+//   - '/' and '\' become '-'.
+//   - Control characters, except whitespace, are dropped.
+//   - Everything else, including whitespace, '.' and non-ASCII characters,
+//     becomes '_'.
+//
+// Finally, runs of '_' are collapsed into one and leading/trailing '_' are
+// trimmed. "web server #3" thus becomes "web_server_3". Note that the result
+// might be empty.
+func SanitizeMetricSegment(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	lastUnderscore := false
+	for _, r := range s {
+		switch {
+		case unicode.IsControl(r) && !unicode.IsSpace(r):
+			continue
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '-':
+			b.WriteRune(r)
+			lastUnderscore = false
+		case r == '/' || r == '\\':
+			b.WriteByte('-')
+			lastUnderscore = false
+		default:
+			if !lastUnderscore {
+				b.WriteByte('_')
+			}
+			lastUnderscore = true
+		}
+	}
+	return strings.Trim(b.String(), "_")
+}
+
+// Sanitize every segment using SanitizeMetricSegment and join them using dots.
+// Segments that are empty after sanitization are skipped.
+func JoinMetricPath(segments ...string) string {
+	sanitized := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if s := SanitizeMetricSegment(segment); s != "" {
+			sanitized = append(sanitized, s)
+		}
+	}
+	return strings.Join(sanitized, ".")
+}
+
+// Sanitize every dot separated segment of path.
+func sanitizeMetricPath(path string) string {
+	return JoinMetricPath(strings.Split(path, ".")...)
+}
+
+// Join prefix and path using exactly one dot.
+func prefixMetricPath(prefix, path string) string {
+	prefix = strings.TrimRight(prefix, ".")
+	if prefix == "" {
+		return path
+	}
+	return prefix + "." + strings.TrimLeft(path, ".")
+}
+
+// The hostname of this machine as a single metric path segment, ie.
+// "web01_example_com" for "web01.example.com". Conventionally used in
+// prefixes such as "prod.myservice.<host>".
+func HostnameSegment() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return SanitizeMetricSegment(hostname), nil
+}
+
+// Check that key and value form a valid Graphite tag. Keys can't contain ';',
+// '!', '^' or '='. Values can't contain ';' nor start with '~'. Neither can be
+// empty nor contain whitespace or control characters (which would break the
+// plaintext protocol).
+func ValidateTag(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("Empty tag key for value %q.", value)
+	}
+	if value == "" {
+		return fmt.Errorf("Empty value for tag %q.", key)
+	}
+	if i := strings.IndexFunc(key, invalidTagKeyRune); i >= 0 {
+		return fmt.Errorf("Invalid character %q in tag key %q.", key[i], key)
+	}
+	if i := strings.IndexFunc(value, invalidTagValueRune); i >= 0 {
+		return fmt.Errorf("Invalid character %q in value of tag %q.", value[i], key)
+	}
+	if value[0] == '~' {
+		return fmt.Errorf("Value of tag %q can't start with '~'.", key)
+	}
+	return nil
+}
+
+func invalidTagValueRune(r rune) bool {
+	return r == ';' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func invalidTagKeyRune(r rune) bool {
+	return r == '!' || r == '^' || r == '=' || invalidTagValueRune(r)
+}
+
+// Make s safe to use as either a tag key or a tag value. ';', '!', '^', '='
+// and whitespace become '_', other control characters and leading '~' are
+// dropped. Note that the result might be empty.
+func SanitizeTag(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r) || r == ';' || r == '!' || r == '^' || r == '=':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimLeft(s, "~")
+}
+
+// Sanitizes the keys and values of tags. If several keys sanitize to the same
+// key, ie. "a b" and "a_b", the value of the one sorting first is kept.
+func sanitizeTags(tags map[string]string) map[string]string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sanitized := make(map[string]string, len(tags))
+	for _, key := range keys {
+		s := SanitizeTag(key)
+		if _, ok := sanitized[s]; !ok {
+			sanitized[s] = SanitizeTag(tags[key])
+		}
+	}
+	return sanitized
+}
+
+// Append tags to path the way Graphite expects, sorted by key.
+func taggedMetricPath(path string, tags map[string]string) (string, error) {
+	keys := make([]string, 0, len(tags))
+	for key, value := range tags {
+		if err := ValidateTag(key, value); err != nil {
+			return "", err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(path)
+	for _, key := range keys {
+		b.WriteByte(';')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(tags[key])
+	}
+	return b.String(), nil
+}
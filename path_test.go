@@ -0,0 +1,195 @@
+package infrastructure
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeMetricSegment(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"web01", "web01"},
+		{"web server #3", "web_server_3"},
+		{"web01.example.com", "web01_example_com"},
+		{"/var/log", "-var-log"},
+		{`C:\Temp`, "C_-Temp"},
+		{"tab\there", "tab_here"},
+		{"bell\x07", "bell"},
+		{"snake_case", "snake_case"},
+		{"__a__b__", "a_b"},
+		{"Grüße", "Gr_e"},
+		{"dash-ok", "dash-ok"},
+		{"", ""},
+		{"   ", ""},
+		{"...", ""},
+		{"ü", ""},
+		{"\x00\x01", ""},
+	} {
+		if s := SanitizeMetricSegment(test.input); s != test.expected {
+			t.Errorf("Input: %q Got: %q Expected: %q", test.input, s, test.expected)
+		}
+	}
+}
+
+func TestJoinMetricPath(t *testing.T) {
+	if s := JoinMetricPath("prod", "web server #3", "", "...", "cpu.load"); s != "prod.web_server_3.cpu_load" {
+		t.Error(s)
+	}
+	if s := JoinMetricPath(); s != "" {
+		t.Error(s)
+	}
+}
+
+func TestCarbonWriterSanitize(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	w.Sanitize = true
+	if err := w.Send("servers.web server #3..load avg", 1, time.Unix(1409763000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if s := l.next(t); s != "servers.web_server_3.load_avg 1 1409763000\n" {
+		t.Errorf("Unexpected line: %q", s)
+	}
+}
+
+func TestPrefixMetricPath(t *testing.T) {
+	for _, test := range []struct {
+		prefix   string
+		path     string
+		expected string
+	}{
+		{"", "cpu", "cpu"},
+		{"", ".cpu", ".cpu"},
+		{"prod", "cpu", "prod.cpu"},
+		{"prod.", "cpu", "prod.cpu"},
+		{"prod", ".cpu", "prod.cpu"},
+		{"prod..", "..cpu", "prod.cpu"},
+		{".", "cpu", "cpu"},
+	} {
+		if s := prefixMetricPath(test.prefix, test.path); s != test.expected {
+			t.Errorf("Prefix: %q Path: %q Got: %q Expected: %q", test.prefix, test.path, s, test.expected)
+		}
+	}
+}
+
+func TestHostnameSegment(t *testing.T) {
+	s, err := HostnameSegment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == "" || strings.Contains(s, ".") {
+		t.Errorf("Unexpected segment: %q", s)
+	}
+}
+
+func TestCarbonWriterPrefix(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	w.Prefix = "prod.myservice."
+	w.SendMany([]Metric{
+		{Path: "cpu", Value: 1, Time: time.Unix(1409763000, 0)},
+		{Path: ".mem", Value: 2, Time: time.Unix(1409763000, 0)},
+	})
+	w.Close()
+
+	s := l.next(t)
+	if s != "prod.myservice.cpu 1 1409763000\nprod.myservice.mem 2 1409763000\n" {
+		t.Errorf("Unexpected lines: %q", s)
+	}
+	if strings.Contains(s, "..") {
+		t.Error("Double dots:", s)
+	}
+}
+
+func TestValidateTag(t *testing.T) {
+	for _, test := range []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{"host", "web01", true},
+		{"path", "/var/log=x", true},
+		{"", "web01", false},
+		{"host", "", false},
+		{"ho;st", "web01", false},
+		{"ho=st", "web01", false},
+		{"ho!st", "web01", false},
+		{"ho^st", "web01", false},
+		{"ho st", "web01", false},
+		{"host", "web;01", false},
+		{"host", "web 01", false},
+		{"host", "web\t01", false},
+		{"host", "~web01", false},
+		{"host", "web~01", true},
+	} {
+		if err := ValidateTag(test.key, test.value); (err == nil) != test.valid {
+			t.Errorf("Key: %q Value: %q Error: %v", test.key, test.value, err)
+		}
+	}
+}
+
+func TestSanitizeTag(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"web01", "web01"},
+		{"web server;3", "web_server_3"},
+		{"a=b!c^d", "a_b_c_d"},
+		{"~~tilde", "tilde"},
+		{"bell\x07", "bell"},
+		{"~", ""},
+	} {
+		if s := SanitizeTag(test.input); s != test.expected {
+			t.Errorf("Input: %q Got: %q Expected: %q", test.input, s, test.expected)
+		}
+	}
+}
+
+func TestSanitizeTagsCollision(t *testing.T) {
+	tags := map[string]string{"a_b": "2", "a b": "1", "a;b": "3", "a=b": "4"}
+	for i := 0; i < 20; i++ {
+		if sanitized := sanitizeTags(tags); len(sanitized) != 1 || sanitized["a_b"] != "1" {
+			t.Fatal("Unexpected tags:", sanitized)
+		}
+	}
+}
+
+func TestCarbonWriterTagged(t *testing.T) {
+	t.Parallel()
+
+	l := newCarbonListener(t)
+	defer l.Close()
+
+	w := NewCarbonWriter(l.Addr().String(), PlaintextProtocol)
+	tags := map[string]string{"host": "web01", "dc": "dc1", "az": "b"}
+	if err := w.SendTagged("disk.used", tags, 42, time.Unix(1409763000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SendTagged("disk.used", map[string]string{"host": "web 01"}, 42, time.Unix(1409763000, 0)); err == nil {
+		t.Error("Expected invalid tag value to fail.")
+	}
+	w.Sanitize = true
+	if err := w.SendTagged("disk.used", map[string]string{"host": "web 01"}, 43, time.Unix(1409763000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	expected := "disk.used;az=b;dc=dc1;host=web01 42 1409763000\ndisk.used;host=web_01 43 1409763000\n"
+	if s := l.next(t); s != expected {
+		t.Errorf("Got: %q Expected: %q", s, expected)
+	}
+}
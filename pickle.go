@@ -0,0 +1,127 @@
+package infrastructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Pickle opcodes. Only the narrow subset needed to serialize
+// [(path, (timestamp, value)), ...] using protocol 2 is implemented.
+const (
+	pickleProto      = 0x80
+	pickleStop       = '.'
+	pickleMark       = '('
+	pickleEmptyList  = ']'
+	pickleAppend     = 'a'
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleBinInt1    = 'K'
+	pickleBinInt2    = 'M'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+)
+
+// Python's pickler emits list items in batches of this size.
+const pickleBatchSize = 1000
+
+// Encodes metrics the way Python's `pickle.dumps(metrics, protocol=2)` would,
+// minus the memoization opcodes (which carbon doesn't need).
+func pickleMetrics(metrics []Metric) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(pickleProto)
+	buf.WriteByte(2)
+	buf.WriteByte(pickleEmptyList)
+
+	if len(metrics) == 1 {
+		pickleMetric(&buf, metrics[0])
+		buf.WriteByte(pickleAppend)
+		buf.WriteByte(pickleStop)
+		return buf.Bytes()
+	}
+
+	for start := 0; start < len(metrics); start += pickleBatchSize {
+		end := start + pickleBatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		buf.WriteByte(pickleMark)
+		for _, m := range metrics[start:end] {
+			pickleMetric(&buf, m)
+		}
+		buf.WriteByte(pickleAppends)
+	}
+
+	buf.WriteByte(pickleStop)
+	return buf.Bytes()
+}
+
+// Prepends the 4 byte big-endian length header expected by carbon's pickle
+// receiver.
+func pickleFrame(metrics []Metric) []byte {
+	payload := pickleMetrics(metrics)
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	return frame
+}
+
+func pickleMetric(buf *bytes.Buffer, m Metric) {
+	pickleString(buf, m.Path)
+	pickleInt(buf, m.Time.Unix())
+	pickleFloat(buf, m.Value)
+	buf.WriteByte(pickleTuple2)
+	buf.WriteByte(pickleTuple2)
+}
+
+func pickleString(buf *bytes.Buffer, s string) {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(s)))
+	buf.WriteByte(pickleBinUnicode)
+	buf.Write(length[:])
+	buf.WriteString(s)
+}
+
+func pickleInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(pickleBinInt1)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		var b [2]byte
+		binary.LittleEndian.PutUint16(b[:], uint16(i))
+		buf.WriteByte(pickleBinInt2)
+		buf.Write(b[:])
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(int32(i)))
+		buf.WriteByte(pickleBinInt)
+		buf.Write(b[:])
+	default:
+		// LONG1 stores a minimal little-endian two's complement
+		// representation.
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(i))
+		n := 8
+		for n > 1 {
+			last, next := b[n-1], b[n-2]
+			if (last == 0x00 && next&0x80 == 0) || (last == 0xff && next&0x80 != 0) {
+				n--
+				continue
+			}
+			break
+		}
+		buf.WriteByte(pickleLong1)
+		buf.WriteByte(byte(n))
+		buf.Write(b[:n])
+	}
+}
+
+func pickleFloat(buf *bytes.Buffer, f float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	buf.WriteByte(pickleBinFloat)
+	buf.Write(b[:])
+}
@@ -0,0 +1,83 @@
+package infrastructure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Fixtures were generated using
+//
+//	pickletools.optimize(pickle.dumps(metrics, protocol=2))
+//
+// in Python 3, which strips the (unused) memoization opcodes.
+var pickleFixtures = []struct {
+	metrics  []Metric
+	expected string
+}{
+	{
+		[]Metric{},
+		"\x80\x02].",
+	},
+	{
+		[]Metric{{Path: "a.b", Value: 1.5, Time: time.Unix(1409763000, 0)}},
+		"\x80\x02]X\x03\x00\x00\x00a.bJ\xb8F\x07TG?\xf8\x00\x00\x00\x00\x00\x00\x86\x86a.",
+	},
+	{
+		[]Metric{
+			{Path: "foo.bar", Value: -2.25, Time: time.Unix(1409763000, 0)},
+			{Path: "x", Value: 0.0, Time: time.Unix(5, 0)},
+			{Path: "y", Value: 1e20, Time: time.Unix(300, 0)},
+			{Path: "ü", Value: 3.0, Time: time.Unix(1<<40, 0)},
+		},
+		"\x80\x02](X\x07\x00\x00\x00foo.barJ\xb8F\x07TG\xc0\x02\x00\x00\x00\x00\x00\x00\x86\x86X\x01\x00\x00\x00xK\x05G\x00\x00\x00\x00\x00\x00\x00\x00\x86\x86X\x01\x00\x00\x00yM,\x01GD\x15\xaf\x1dx\xb5\x8c@\x86\x86X\x02\x00\x00\x00\xc3\xbc\x8a\x06\x00\x00\x00\x00\x00\x01G@\x08\x00\x00\x00\x00\x00\x00\x86\x86e.",
+	},
+	{
+		[]Metric{
+			{Path: "neg", Value: 1.0, Time: time.Unix(-5, 0)},
+			{Path: "big", Value: 2.0, Time: time.Unix(-(1 << 40), 0)},
+		},
+		"\x80\x02](X\x03\x00\x00\x00negJ\xfb\xff\xff\xffG?\xf0\x00\x00\x00\x00\x00\x00\x86\x86X\x03\x00\x00\x00big\x8a\x06\x00\x00\x00\x00\x00\xffG@\x00\x00\x00\x00\x00\x00\x00\x86\x86e.",
+	},
+}
+
+func TestPickleMetrics(t *testing.T) {
+	for i, fixture := range pickleFixtures {
+		if b := pickleMetrics(fixture.metrics); !bytes.Equal(b, []byte(fixture.expected)) {
+			t.Errorf("Fixture %d mismatch. Got: %q Expected: %q", i, b, fixture.expected)
+		}
+	}
+}
+
+// Python emits APPENDS in batches of 1000 items. The expected digest comes from
+//
+//	[('m.%d' % i, (1409763000 + i, float(i))) for i in range(1001)]
+func TestPickleMetricsBatching(t *testing.T) {
+	metrics := make([]Metric, 1001)
+	for i := range metrics {
+		metrics[i] = Metric{Path: fmt.Sprintf("m.%d", i), Value: float64(i), Time: time.Unix(1409763000+int64(i), 0)}
+	}
+
+	b := pickleMetrics(metrics)
+	if len(b) != 25925 {
+		t.Error("Unexpected length:", len(b))
+	}
+	digest := sha256.Sum256(b)
+	if s := hex.EncodeToString(digest[:]); s != "af00164646c6dd314a4262635e26c87571932cd95befb59a79d6825dc33e289a" {
+		t.Error("Unexpected digest:", s)
+	}
+}
+
+func TestPickleFrame(t *testing.T) {
+	frame := pickleFrame(pickleFixtures[1].metrics)
+	payload := pickleFixtures[1].expected
+	if !bytes.Equal(frame[:4], []byte{0, 0, 0, byte(len(payload))}) {
+		t.Errorf("Unexpected header: %q", frame[:4])
+	}
+	if string(frame[4:]) != payload {
+		t.Errorf("Unexpected payload: %q", frame[4:])
+	}
+}
@@ -0,0 +1,74 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The aggregate of a series, as rendered by a pie chart.
+type PieSlice struct {
+	Name  string
+	Value float64
+}
+
+// The aggregation functions accepted by Graphite's pieMode.
+var pieModes = map[string]bool{"average": true, "maximum": true, "minimum": true}
+
+// Fetches one aggregate per series matched by targets using Graphite's pie
+// charts, ie. graphType=pie, with pieMode, ie. "average", "maximum" or
+// "minimum", as the aggregation. Slices are in the order Graphite returns
+// them.
+//
+// Graphite reports series without non-null datapoints as 0. Slices that are
+// null or non-finite, ie. NaN from a divideSeries by zero, are skipped.
+func (g *Client) QueryPie(targets []string, interval TimeInterval, pieMode string, opts ...QueryOption) ([]PieSlice, error) {
+	if !pieModes[pieMode] {
+		return nil, fmt.Errorf("Unknown pie mode %q.", pieMode)
+	}
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+	o := newQueryOptions(opts)
+	o.format = FormatJSON
+
+	queryPart := constructQueryPart(targets)
+	queryPart.Set("graphType", "pie")
+	queryPart.Set("pieMode", pieMode)
+	body, err := g.renderBody(targets, queryPart, &interval, o)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return decodePieResponse(body)
+}
+
+// Decodes a graphType=pie render response, which is an array of
+// [name, value] pairs.
+func decodePieResponse(r io.Reader) ([]PieSlice, error) {
+	// Non-finite values become nulls.
+	var pairs [][]json.RawMessage
+	if err := json.NewDecoder(newNonFiniteReader(r)).Decode(&pairs); err != nil {
+		return nil, fmt.Errorf("Unable to decode pie response: %w", err)
+	}
+
+	slices := []PieSlice{}
+	for _, pair := range pairs {
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected Graphite response. Expected [name, value] pair, got %d elements.", len(pair))
+		}
+		var name string
+		var value *float64
+		if err := json.Unmarshal(pair[0], &name); err != nil {
+			return nil, fmt.Errorf("Unable to decode pie slice name %s: %w", pair[0], err)
+		}
+		if err := json.Unmarshal(pair[1], &value); err != nil {
+			return nil, fmt.Errorf("Unable to decode pie slice %q: %w", name, err)
+		}
+		if value != nil {
+			slices = append(slices, PieSlice{Name: name, Value: *value})
+		}
+	}
+	return slices, nil
+}
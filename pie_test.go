@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	httpurl "net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryPie(t *testing.T) {
+	t.Parallel()
+
+	fixture, err := ioutil.ReadFile("testdata/render_pie.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query httpurl.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write(fixture)
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	slices, err := c.QueryPie([]string{"servers.*.requests", "total:42"}, interval, "maximum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PieSlice{
+		{"servers.web1.requests", 1234.5},
+		{"servers.web2.requests", 987},
+		{"servers.web3.requests", 0},
+		{"total:42", 42},
+	}
+	if !reflect.DeepEqual(slices, expected) {
+		t.Error("Unexpected slices:", slices)
+	}
+	if query.Get("graphType") != "pie" || query.Get("pieMode") != "maximum" || query.Get("format") != "json" {
+		t.Error("Unexpected query:", query)
+	}
+	if !reflect.DeepEqual(query["target"], []string{"servers.*.requests", "total:42"}) {
+		t.Error("Unexpected targets:", query["target"])
+	}
+
+	if _, err := c.QueryPie([]string{"a"}, interval, "median"); err == nil {
+		t.Error("Expected unknown pie mode to fail.")
+	}
+}
+
+func TestDecodePieResponse(t *testing.T) {
+	t.Parallel()
+
+	for _, body := range []string{
+		`{"a": 1}`,
+		`[["a"]]`,
+		`[["a", 1, 2]]`,
+		`[[1, 1]]`,
+		`[["a", "1"]]`,
+	} {
+		if slices, err := decodePieResponse(strings.NewReader(body)); err == nil {
+			t.Error("Expected error:", body, slices)
+		}
+	}
+
+	if slices, err := decodePieResponse(strings.NewReader(`[]`)); err != nil || slices == nil || len(slices) != 0 {
+		t.Error("Unexpected result:", slices, err)
+	}
+}
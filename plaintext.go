@@ -0,0 +1,127 @@
+package infrastructure
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Writes the non-null datapoints to w in Carbon's plaintext format, ie.
+// "path value timestamp\n" lines, using the time of every datapoint as its
+// timestamp. Values are formatted like strconv.FormatFloat(v, 'g', -1, 64),
+// ie. with the fewest digits that represent them exactly, so 2.0 is "2" and
+// 123456789.0 is "1.23456789e+08". Lines are written one at a time, so wrap w
+// in a bufio.Writer when writing to a file. Returns the number of lines
+// written.
+func WritePlaintext(w io.Writer, path string, points []FloatDatapoint) (int, error) {
+	n := 0
+	for _, point := range points {
+		if point.Value == nil {
+			continue
+		}
+		if _, err := io.WriteString(w, plaintextLine(Metric{Path: path, Value: *point.Value, Time: point.Time})); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Like WritePlaintext, but for every series, using its Target as path.
+// Series are written one at a time, in order, stopping at the first that
+// fails to convert.
+func (m MultiDatapoints) WritePlaintext(w io.Writer) (int, error) {
+	n := 0
+	for _, series := range m {
+		points, err := series.AsFloats()
+		if err != nil {
+			return n, err
+		}
+		written, err := WritePlaintext(w, series.Target, points)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// A malformed line of Carbon plaintext.
+type PlaintextSyntaxError struct {
+	// 1-based.
+	Line   int
+	Reason string
+}
+
+func (e *PlaintextSyntaxError) Error() string {
+	return fmt.Sprintf("Malformed plaintext on line %d: %s.", e.Line, e.Reason)
+}
+
+// Reads Carbon plaintext, ie. "path value timestamp\n" lines as written by
+// WritePlaintext, grouping the datapoints by path. See ScanPlaintext.
+func ParsePlaintext(r io.Reader) (map[string][]FloatDatapoint, error) {
+	res := make(map[string][]FloatDatapoint)
+	err := ScanPlaintext(r, func(m Metric) error {
+		value := m.Value
+		res[m.Path] = append(res[m.Path], FloatDatapoint{Time: m.Time, Value: &value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Like ParsePlaintext, but calls fn for every line rather than keeping them
+// all in memory, ie. for large spool files. Stops at the first error returned
+// by fn.
+//
+// Blank lines and lines starting with '#' are skipped. Timestamps may have
+// decimals, which are truncated like Carbon does. Lines with a NaN or
+// infinite value, which Carbon can't store, are rejected like any other
+// malformed line, with a *PlaintextSyntaxError.
+func ScanPlaintext(r io.Reader, fn func(m Metric) error) error {
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			m, perr := parsePlaintextLine(trimmed)
+			if perr != "" {
+				return &PlaintextSyntaxError{n, perr}
+			}
+			if ferr := fn(m); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Returns a reason for malformed lines.
+func parsePlaintextLine(line string) (Metric, string) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Metric{}, fmt.Sprintf("expected 3 fields, got %d", len(fields))
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return Metric{}, fmt.Sprintf("value %q not a number", fields[1])
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Metric{}, fmt.Sprintf("value %q not finite", fields[1])
+	}
+	timestamp, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(timestamp) || math.Abs(timestamp) >= 1<<63/float64(time.Second) {
+		return Metric{}, fmt.Sprintf("timestamp %q not a Unix time", fields[2])
+	}
+	return Metric{Path: fields[0], Value: value, Time: time.Unix(int64(timestamp), 0)}, ""
+}
@@ -0,0 +1,182 @@
+package infrastructure
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePlaintext(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/plaintext.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	series, err := decodeGraphiteResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := ioutil.ReadFile("testdata/plaintext.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := series.WritePlaintext(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != string(golden) {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+	if n != 7 {
+		t.Error("Unexpected number of lines:", n)
+	}
+
+	buf.Reset()
+	points, err := series[0].AsFloats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := WritePlaintext(&buf, "a.b", points[:2]); err != nil || n != 1 || buf.String() != "a.b 2 1409763000\n" {
+		t.Errorf("Unexpected output: %q %d %v", buf.String(), n, err)
+	}
+}
+
+type failingWriter struct {
+	remaining int
+}
+
+var errWriteFailed = errors.New("Write failed.")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.remaining == 0 {
+		return 0, errWriteFailed
+	}
+	w.remaining--
+	return len(p), nil
+}
+
+func TestWritePlaintextFailure(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	points := []FloatDatapoint{{time.Unix(1, 0), v(1)}, {time.Unix(2, 0), v(2)}, {time.Unix(3, 0), v(3)}}
+	if n, err := WritePlaintext(&failingWriter{remaining: 2}, "a", points); err != errWriteFailed || n != 2 {
+		t.Error("Unexpected result:", n, err)
+	}
+}
+
+func TestParsePlaintextRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/plaintext.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	series, err := decodeGraphiteResponse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := series.WritePlaintext(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePlaintext(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nulls aren't written, so the all-null series is missing.
+	if len(parsed) != 2 {
+		t.Error("Unexpected series:", parsed)
+	}
+	for _, s := range series {
+		points, err := s.AsFloats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []FloatDatapoint
+		for _, point := range points {
+			if point.Value != nil {
+				expected = append(expected, point)
+			}
+		}
+		actual, ok := parsed[s.Target]
+		if ok != (len(expected) > 0) || len(actual) != len(expected) {
+			t.Fatal("Unexpected points:", s.Target, formatFloatPoints(actual))
+		}
+		for i := range expected {
+			if !actual[i].Time.Equal(expected[i].Time) || *actual[i].Value != *expected[i].Value {
+				t.Error("Unexpected point:", s.Target, i, formatFloatPoints(actual[i:i+1]))
+			}
+		}
+	}
+}
+
+func TestParsePlaintext(t *testing.T) {
+	t.Parallel()
+
+	input := "# Comment\n\n  a.b 1.5 1409763000\r\n\t# Indented comment\nc.d -2 1409763060.9\na.b 3 1409763060"
+	parsed, err := ParsePlaintext(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := formatFloatPoints(parsed["a.b"]); len(s) != 2 || s[0] != "1409763000:1.5" || s[1] != "1409763060:3" {
+		t.Error("Unexpected points:", s)
+	}
+	// Decimals of timestamps are truncated.
+	if s := formatFloatPoints(parsed["c.d"]); len(s) != 1 || s[0] != "1409763060:-2" {
+		t.Error("Unexpected points:", s)
+	}
+
+	// Stopping at the first error of the callback.
+	lines := 0
+	err = ScanPlaintext(strings.NewReader(input), func(m Metric) error {
+		lines++
+		return errWriteFailed
+	})
+	if err != errWriteFailed || lines != 1 {
+		t.Error("Unexpected result:", lines, err)
+	}
+}
+
+func TestParsePlaintextMalformed(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open("testdata/plaintext_malformed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = ParsePlaintext(f)
+	var syntaxErr *PlaintextSyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Line != 4 {
+		t.Error("Unexpected error:", err)
+	}
+
+	for _, line := range []string{
+		"a.b 1",
+		"a.b",
+		"a.b one 1409763000",
+		"a.b 1 yesterday",
+		"a.b nan 1409763000",
+		"a.b NaN 1409763000",
+		"a.b inf 1409763000",
+		"a.b -Inf 1409763000",
+		"a.b 1 1e300",
+		"a.b 1 nan",
+	} {
+		_, err := ParsePlaintext(strings.NewReader("a.b 1 1409763000\n" + line + "\n"))
+		if !errors.As(err, &syntaxErr) || syntaxErr.Line != 2 {
+			t.Errorf("Unexpected error for %q: %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The outcome of a single poll.
+type PollResult struct {
+	// When the poll started.
+	Time   time.Time
+	Points []FloatDatapoint
+	Err    error
+}
+
+// Queries a target periodically, delivering every result on C. At most one
+// query is in flight at a time; a tick arriving while the previous query is
+// still running, or its result still hasn't been received from C, is skipped.
+type Poller struct {
+	// Results are delivered here. Closed once the poller has stopped.
+	C <-chan PollResult
+
+	// Delays every poll by a random duration of up to Jitter, spreading out
+	// pollers started at the same time. Must be set before Start.
+	Jitter time.Duration
+
+	// Options for every query. Must be set before Start.
+	QueryOptions []QueryOption
+
+	client   *Client
+	query    string
+	lookback time.Duration
+	every    time.Duration
+
+	results chan PollResult
+	skipped atomic.Uint64
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	// Closed once C has been closed.
+	done chan struct{}
+
+	// Returns a random number in [0, n). Replaced in tests.
+	random func(n int64) int64
+}
+
+// Creates a Poller querying the last lookback of q every every, which must be
+// positive. Polling doesn't begin until Start.
+func NewPoller(c *Client, q string, lookback, every time.Duration) (*Poller, error) {
+	if every <= 0 {
+		return nil, errors.New("Interval is expected to be positive.")
+	}
+
+	results := make(chan PollResult)
+	return &Poller{
+		C:        results,
+		client:   c,
+		query:    q,
+		lookback: lookback,
+		every:    every,
+		results:  results,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Starts polling, beginning immediately. Polling continues until ctx is done,
+// Stop is called or the Client is closed, after which C is closed. Only the
+// first call has an effect.
+func (p *Poller) Start(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return
+	}
+	p.started = true
+	ctx, p.cancel = context.WithCancel(ctx)
+	go p.run(ctx)
+}
+
+// Stops polling, cancelling any query in flight, and waits for C to be
+// closed. Results not yet received are discarded.
+func (p *Poller) Stop() {
+	p.mu.Lock()
+	if !p.started {
+		// Making sure a later Start has no effect.
+		p.started = true
+		p.cancel = func() {}
+		close(p.results)
+		close(p.done)
+	}
+	cancel := p.cancel
+	p.mu.Unlock()
+
+	cancel()
+	<-p.done
+}
+
+// The number of ticks skipped since a poll was still in flight.
+func (p *Poller) Skipped() uint64 {
+	return p.skipped.Load()
+}
+
+func (p *Poller) run(ctx context.Context) {
+	defer close(p.done)
+	var inFlight sync.WaitGroup
+	defer func() {
+		inFlight.Wait()
+		close(p.results)
+	}()
+
+	var busy atomic.Bool
+	timer := time.NewTimer(p.jitter())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.client.closed():
+			// Cancelling any poll in flight. Set by Start before running.
+			p.cancel()
+			return
+		case <-timer.C:
+		}
+		timer.Reset(p.every + p.jitter())
+
+		if !busy.CompareAndSwap(false, true) {
+			p.skipped.Add(1)
+			continue
+		}
+		inFlight.Add(1)
+		go func() {
+			defer inFlight.Done()
+			defer busy.Store(false)
+			p.poll(ctx)
+		}()
+	}
+}
+
+func (p *Poller) poll(ctx context.Context) {
+	result := PollResult{Time: p.client.now()}
+	opts := append(p.QueryOptions[:len(p.QueryOptions):len(p.QueryOptions)], WithContext(ctx))
+	result.Points, result.Err = p.client.QueryFloatsSince(p.query, p.lookback, opts...)
+	if ctx.Err() != nil {
+		// Stopping. The error would only be due to the cancellation.
+		return
+	}
+
+	select {
+	case p.results <- result:
+	case <-ctx.Done():
+	}
+}
+
+func (p *Poller) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+	random := p.random
+	if random == nil {
+		random = rand.Int63n
+	}
+	return time.Duration(random(int64(p.Jitter) + 1))
+}
@@ -0,0 +1,157 @@
+package infrastructure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoller(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("target") != "a" || r.FormValue("from") != "-1hours" {
+			t.Error("Unexpected query:", r.Form)
+		}
+		if requests.Add(1) == 1 {
+			w.Write([]byte(`[{"target": "a", "datapoints": [[1, "malformed"]]}]`))
+			return
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000], [2, 1409763060]]}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPoller(c, "a", time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Jitter = time.Millisecond
+	p.Start(context.Background())
+
+	// Errors are delivered rather than swallowed.
+	if result := <-p.C; result.Err == nil {
+		t.Error("Expected error:", result.Points)
+	}
+	for i := 0; i < 3; i++ {
+		result := <-p.C
+		if result.Err != nil || len(result.Points) != 2 || *result.Points[1].Value != 2 {
+			t.Error("Unexpected result:", result.Points, result.Err)
+		}
+		if result.Time.IsZero() {
+			t.Error("Expected time.")
+		}
+	}
+
+	p.Stop()
+	if _, ok := <-p.C; ok {
+		t.Error("Expected C to be closed.")
+	}
+	// Stopping again is harmless.
+	p.Stop()
+}
+
+func TestPollerSkipsOverlap(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int64
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			<-release
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPoller(c, "a", time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(context.Background())
+	defer p.Stop()
+
+	for p.Skipped() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Error("Unexpected number of requests while one was in flight:", n)
+	}
+	close(release)
+
+	if result := <-p.C; result.Err != nil {
+		t.Error(result.Err)
+	}
+	// Not receiving the result blocks the next poll, too.
+	skipped := p.Skipped()
+	for p.Skipped() < skipped+5 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Error("Unexpected number of requests while a result was pending:", n)
+	}
+}
+
+func TestPollerShutdown(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Blocking until the poll is cancelled.
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := NewPoller(c, "a", time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(ctx)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	for result := range p.C {
+		t.Error("Unexpected result:", result)
+	}
+
+	p, err = NewPoller(c, "a", time.Hour, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Stop()
+	p.Start(context.Background())
+	if _, ok := <-p.C; ok {
+		t.Error("Expected C to be closed.")
+	}
+}
+
+func TestNewPollerNonPositiveInterval(t *testing.T) {
+	t.Parallel()
+
+	c, err := New("http://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, every := range []time.Duration{0, -time.Second} {
+		if _, err := NewPoller(c, "a", time.Hour, every); err == nil {
+			t.Error("Expected an error for interval:", every)
+		}
+		if _, err := c.Watch(context.Background(), "a", time.Hour, every, WatchOpts{}); err == nil {
+			t.Error("Expected an error for interval:", every)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package infrastructure
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	httpurl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const formatRaw Format = "raw"
+
+// A series as returned by Graphite's raw format. Unlike the other formats, it
+// carries the actual resolution of the series, ie. the step after whisper
+// aggregation.
+type RawSeries struct {
+	Target string
+	Start  time.Time
+	Stop   time.Time
+	Step   time.Duration
+
+	// One value per step, starting at Start. nil means null.
+	Values []*float64
+}
+
+// The datapoints of the series, with timestamps synthesized from Start and
+// Step.
+func (s RawSeries) AsFloats() []FloatDatapoint {
+	points := make([]FloatDatapoint, len(s.Values))
+	for i, value := range s.Values {
+		points[i] = FloatDatapoint{Time: s.Start.Add(time.Duration(i) * s.Step), Value: value}
+	}
+	return points
+}
+
+// Fetches one or multiple Graphite series using the raw format, which exposes
+// the start, stop and step of every series.
+func (g *Client) QueryRawSeries(q []string, interval TimeInterval, opts ...QueryOption) ([]RawSeries, error) {
+	if err := interval.Check(); err != nil {
+		return nil, err
+	}
+	return g.queryRawSeries(q, constructQueryPart(q), &interval, opts)
+}
+
+// Like QueryRawSeries, but for the last ago.
+func (g *Client) QueryRawSeriesSince(q []string, ago time.Duration, opts ...QueryOption) ([]RawSeries, error) {
+	queryPart, err := sinceQueryPart(q, ago)
+	if err != nil {
+		return nil, err
+	}
+	return g.queryRawSeries(q, queryPart, nil, opts)
+}
+
+func (g *Client) queryRawSeries(q []string, queryPart httpurl.Values, interval *TimeInterval, opts []QueryOption) ([]RawSeries, error) {
+	o := newQueryOptions(opts)
+	o.format = formatRaw
+
+	body, err := g.renderBody(q, queryPart, interval, o)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return decodeRawResponse(body)
+}
+
+// Decodes a format=raw render response. Every line is a series:
+//
+//	target,start,stop,step|value,value,None,...
+//
+// Targets might contain commas, ie. "sumSeries(a,b)", so the header is parsed
+// from the right.
+func decodeRawResponse(r io.Reader) ([]RawSeries, error) {
+	reader := bufio.NewReader(r)
+	series := []RawSeries{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			s, perr := parseRawSeries(line)
+			if perr != nil {
+				return nil, perr
+			}
+			series = append(series, s)
+		}
+		if err == io.EOF {
+			return series, nil
+		}
+	}
+}
+
+func parseRawSeries(line string) (RawSeries, error) {
+	var s RawSeries
+
+	sep := strings.LastIndexByte(line, '|')
+	if sep < 0 {
+		return s, errors.New("Unexpected Graphite response. Missing '|' in raw series.")
+	}
+	header, values := line[:sep], line[sep+1:]
+
+	var fields [3]int64
+	for i := len(fields) - 1; i >= 0; i-- {
+		comma := strings.LastIndexByte(header, ',')
+		if comma < 0 {
+			return s, fmt.Errorf("Unexpected Graphite response. Malformed raw series header %q.", line[:sep])
+		}
+		n, err := strconv.ParseInt(header[comma+1:], 10, 64)
+		if err != nil {
+			return s, fmt.Errorf("Unexpected Graphite response. Malformed raw series header %q.", line[:sep])
+		}
+		fields[i] = n
+		header = header[:comma]
+	}
+	if fields[2] <= 0 {
+		return s, fmt.Errorf("Unexpected Graphite response. Non-positive step for %q.", header)
+	}
+
+	s.Target = header
+	s.Start = time.Unix(fields[0], 0)
+	s.Stop = time.Unix(fields[1], 0)
+	s.Step = time.Duration(fields[2]) * time.Second
+
+	if values == "" {
+		return s, nil
+	}
+	tokens := strings.Split(values, ",")
+	s.Values = make([]*float64, len(tokens))
+	backing := make([]float64, len(tokens))
+	for i, token := range tokens {
+		if token == "None" {
+			continue
+		}
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return s, errors.New("Value not proper number.")
+		}
+		backing[i] = f
+		s.Values[i] = &backing[i]
+	}
+	return s, nil
+}
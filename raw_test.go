@@ -0,0 +1,89 @@
+package infrastructure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rawFixture = "a.b,1409763000,1409763180,60|1.5,None,3.0\n" +
+	"sumSeries(c.d,e.f),1409760000,1409763600,600|None,None,None,None,None,7\n" +
+	"g.h,1409763000,1409763000,60|\n"
+
+func TestDecodeRawResponse(t *testing.T) {
+	t.Parallel()
+
+	series, err := decodeRawResponse(strings.NewReader(rawFixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 {
+		t.Fatal("Unexpected number of series:", len(series))
+	}
+
+	a := series[0]
+	if a.Target != "a.b" || !a.Start.Equal(time.Unix(1409763000, 0)) || !a.Stop.Equal(time.Unix(1409763180, 0)) || a.Step != time.Minute {
+		t.Errorf("Unexpected series: %+v", a)
+	}
+	if len(a.Values) != 3 || *a.Values[0] != 1.5 || a.Values[1] != nil || *a.Values[2] != 3 {
+		t.Error("Unexpected values:", a.Values)
+	}
+
+	sum := series[1]
+	if sum.Target != "sumSeries(c.d,e.f)" || sum.Step != 10*time.Minute {
+		t.Errorf("Unexpected series: %+v", sum)
+	}
+	points := sum.AsFloats()
+	if len(points) != 6 || points[4].Value != nil || *points[5].Value != 7 {
+		t.Error("Unexpected points:", points)
+	}
+	if !points[5].Time.Equal(time.Unix(1409763000, 0)) {
+		t.Error("Unexpected time:", points[5].Time)
+	}
+
+	if len(series[2].Values) != 0 {
+		t.Error("Expected no values:", series[2].Values)
+	}
+}
+
+func TestDecodeRawResponseMalformed(t *testing.T) {
+	t.Parallel()
+
+	for _, body := range []string{
+		"a.b,1409763000,1409763180,60\n",
+		"a.b,1409763000,60|1\n",
+		"a.b,1409763000,1409763180,0|1\n",
+		"a.b,1409763000,1409763180,x|1\n",
+		"a.b,1409763000,1409763180,60|1,null\n",
+	} {
+		if _, err := decodeRawResponse(strings.NewReader(body)); err == nil {
+			t.Errorf("Expected error for %q.", body)
+		}
+	}
+}
+
+func TestQueryRawSeries(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("format") != "raw" {
+			t.Error("Unexpected format:", r.FormValue("format"))
+		}
+		w.Write([]byte(rawFixture))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := c.QueryRawSeriesSince([]string{"a.b", "sumSeries(c.d,e.f)"}, time.Hour, WithFormat(FormatMsgpack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 3 {
+		t.Error("Unexpected number of series:", len(series))
+	}
+}
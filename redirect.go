@@ -0,0 +1,52 @@
+package infrastructure
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Decides whether a redirect is followed, like http.Client.CheckRedirect.
+// req is the request about to be made and via the requests made so far,
+// oldest first. See WithRedirectPolicy.
+type RedirectPolicy func(req *http.Request, via []*http.Request) error
+
+// The maximum number of redirects FollowRedirects follows, like http.Client.
+const maxRedirects = 10
+
+// Follows up to 10 redirects, like http.Client, but sends the Authorization
+// header, ie. basic auth, with every redirect to the host of the original
+// request. http.Client drops it once a redirect has left that host, even
+// when a later redirect returns to it. The header is never sent to other
+// hosts, nor from https to http, where http.Client would send it in
+// plaintext. The default unless the Client's http.Client has a CheckRedirect
+// of its own.
+func FollowRedirects(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("Stopped after %d redirects.", maxRedirects)
+	}
+	original := via[0]
+	auth := original.Header.Get("Authorization")
+	switch {
+	case original.URL.Scheme == "https" && req.URL.Scheme != "https":
+		req.Header.Del("Authorization")
+	case auth != "" && req.Header.Get("Authorization") == "" && req.URL.Hostname() == original.URL.Hostname():
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// Fails requests on their first redirect with a *RedirectError, ie. to catch
+// a base URL lacking a trailing path or using http rather than https.
+func NoRedirects(req *http.Request, via []*http.Request) error {
+	return &RedirectError{StatusCode: req.Response.StatusCode, Location: req.URL.String()}
+}
+
+// Decide whether to follow redirects using p, ie. FollowRedirects,
+// NoRedirects or an http.Client.CheckRedirect. Applies to all requests,
+// including those to the find API.
+func WithRedirectPolicy(p RedirectPolicy) ClientOption {
+	return func(g *Client) {
+		g.Client = copyHTTPClient(g.Client)
+		g.Client.CheckRedirect = p
+	}
+}
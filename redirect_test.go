@@ -0,0 +1,239 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFollowRedirectsAuth(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var auth []string
+	record := func(name string, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		auth = append(auth, fmt.Sprintf("%s:%q", name, r.Header.Get("Authorization")))
+	}
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("final", r)
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer final.Close()
+	// Another host, which redirects back to the original one.
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("other", r)
+		http.Redirect(w, r, final.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer other.Close()
+	original := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("original", r)
+		otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+		http.Redirect(w, r, otherURL+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}))
+	defer original.Close()
+
+	c, err := New(strings.Replace(original.URL, "http://", "http://user:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryFloats("a", TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	// http.Client alone wouldn't send it to the final server.
+	if fmt.Sprint(auth) != `[original:"Basic dXNlcjpzZWNyZXQ=" other:"" final:"Basic dXNlcjpzZWNyZXQ="]` {
+		t.Error("Unexpected requests:", auth)
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	t.Parallel()
+
+	request := func(url string, auth string) *http.Request {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return req
+	}
+	for _, test := range []struct {
+		original string
+		redirect string
+		expected string
+	}{
+		{"http://graphite/render", "https://graphite/render", "Basic a"},
+		{"http://graphite/render", "http://graphite:8080/render", "Basic a"},
+		{"https://graphite/render", "https://graphite/graphite/render", "Basic a"},
+		{"https://graphite/render", "http://graphite/render", ""},
+		{"http://graphite/render", "http://evil/render", ""},
+		{"http://graphite/render", "http://sub.graphite/render", ""},
+	} {
+		req := request(test.redirect, "")
+		if err := FollowRedirects(req, []*http.Request{request(test.original, "Basic a")}); err != nil {
+			t.Fatal(err)
+		}
+		if auth := req.Header.Get("Authorization"); auth != test.expected {
+			t.Errorf("Unexpected auth redirecting from %s to %s: %q", test.original, test.redirect, auth)
+		}
+	}
+
+	// http.Client keeps the header on downgrades to the same host.
+	req := request("http://graphite/render", "Basic a")
+	FollowRedirects(req, []*http.Request{request("https://graphite/render", "Basic a")})
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		t.Error("Unexpected auth on downgrade:", auth)
+	}
+
+	// An Authorization header of the redirect itself is kept.
+	req = request("http://graphite/render", "Bearer b")
+	FollowRedirects(req, []*http.Request{request("http://graphite/render", "Basic a")})
+	if auth := req.Header.Get("Authorization"); auth != "Bearer b" {
+		t.Error("Unexpected auth:", auth)
+	}
+
+	via := make([]*http.Request, maxRedirects)
+	for i := range via {
+		via[i] = request("http://graphite/render", "")
+	}
+	if err := FollowRedirects(request("http://graphite/render", ""), via); err == nil {
+		t.Error("Expected too many redirects to fail.")
+	}
+}
+
+func TestFollowRedirectsScheme(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var auth []string
+	handler := func(name string, redirect func() string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			auth = append(auth, fmt.Sprintf("%s:%q", name, r.Header.Get("Authorization")))
+			mu.Unlock()
+			if target := redirect(); target != "" && !strings.HasPrefix(r.URL.Path, "/redirected/") {
+				http.Redirect(w, r, target+"/redirected"+r.URL.RequestURI(), http.StatusMovedPermanently)
+				return
+			}
+			w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+		}
+	}
+	var plainTarget, tlsTarget string
+	plain := httptest.NewServer(handler("http", func() string { return plainTarget }))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler("https", func() string { return tlsTarget }))
+	defer secure.Close()
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	for _, test := range []struct {
+		from     string
+		expected string
+	}{
+		// Upgrades keep auth.
+		{plain.URL, `[http:"Basic dXNlcjpzZWNyZXQ=" https:"Basic dXNlcjpzZWNyZXQ="]`},
+		// Downgrades drop it.
+		{secure.URL, `[https:"Basic dXNlcjpzZWNyZXQ=" http:""]`},
+	} {
+		mu.Lock()
+		auth = nil
+		plainTarget, tlsTarget = "", ""
+		if test.from == plain.URL {
+			plainTarget = secure.URL
+		} else {
+			tlsTarget = plain.URL
+		}
+		mu.Unlock()
+
+		c, err := New(test.from, WithHTTPClient(secure.Client()), WithBasicAuth("user", "secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Query("a", interval).Err(); err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if fmt.Sprint(auth) != test.expected {
+			t.Error("Unexpected requests:", auth)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestRedirectPolicies(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/graphite/") {
+			http.Redirect(w, r, "/graphite"+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		switch r.URL.Path {
+		case "/graphite/render":
+			w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+		case "/graphite/metrics/find":
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer ts.Close()
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryFloats("a", interval); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = New(ts.URL, WithRedirectPolicy(NoRedirects), WithRetryPolicy(DefaultRetryPolicy{BaseDelay: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, query := range map[string]func() error{
+		"render": func() error {
+			_, err := c.QueryFloats("a", interval)
+			return err
+		},
+		"find": func() error {
+			_, err := c.Find("a.*")
+			return err
+		},
+	} {
+		err := query()
+		var redirectErr *RedirectError
+		if !errors.As(err, &redirectErr) || !errors.Is(err, ErrRedirect) {
+			t.Fatal("Unexpected error:", name, err)
+		}
+		if redirectErr.StatusCode != http.StatusMovedPermanently || !strings.HasPrefix(redirectErr.Location, ts.URL+"/graphite/") {
+			t.Error("Unexpected redirect:", name, redirectErr)
+		}
+	}
+	if c.Stats().Retries != 0 {
+		t.Error("Retried redirects:", c.Stats().Retries)
+	}
+
+	// Any http.Client.CheckRedirect can be used.
+	var checked []string
+	c, err = New(ts.URL, WithRedirectPolicy(func(req *http.Request, via []*http.Request) error {
+		checked = append(checked, req.URL.Path)
+		return http.ErrUseLastResponse
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var httpErr *HTTPError
+	if _, err := c.QueryFloats("a", interval); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusMovedPermanently {
+		t.Error("Unexpected error:", err)
+	}
+	if fmt.Sprint(checked) != "[/graphite/render]" {
+		t.Error("Unexpected redirects:", checked)
+	}
+}
@@ -0,0 +1,40 @@
+package infrastructure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+const defaultRequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// The request ID given by WithRequestID, or a generated one.
+func (g *Client) requestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	if g.requestIDGenerator != nil {
+		return g.requestIDGenerator()
+	}
+	return randomRequestID()
+}
+
+func (g *Client) requestIDHeaderName() string {
+	if g.requestIDHeader == "" {
+		return defaultRequestIDHeader
+	}
+	return g.requestIDHeader
+}
+
+// 16 random hex digits.
+func randomRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
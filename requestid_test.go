@@ -0,0 +1,70 @@
+package infrastructure
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	var ids []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Request-ID"))
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.QueryMultiSince([]string{"a"}, time.Hour, WithRequestID("abc123"))
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RequestID != "abc123" || !strings.Contains(err.Error(), "abc123") {
+		t.Error("Unexpected error:", err)
+	}
+	if len(ids) != 1 || ids[0] != "abc123" {
+		t.Fatal("Unexpected request IDs:", ids)
+	}
+
+	// Generated.
+	c.Find("a.*")
+	c.Find("a.*")
+	if len(ids[1]) != 16 || ids[1] == ids[2] {
+		t.Error("Unexpected generated request IDs:", ids[1:])
+	}
+}
+
+func TestRequestIDHeaderAndGenerator(t *testing.T) {
+	t.Parallel()
+
+	var ids []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Correlation-ID"))
+		w.Write([]byte("[]"))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL, WithRequestIDHeader("X-Correlation-ID"), WithRequestIDGenerator(func() string { return "generated" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "generated" {
+		t.Error("Unexpected request IDs:", ids)
+	}
+
+	// Network errors carry the request ID too.
+	ts.Close()
+	_, err = c.QueryMultiSince([]string{"a"}, time.Hour, WithRequestID("xyz"))
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) || requestErr.RequestID != "xyz" || !strings.Contains(err.Error(), "xyz") {
+		t.Error("Unexpected error:", err)
+	}
+}
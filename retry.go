@@ -0,0 +1,172 @@
+package infrastructure
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Number of bytes of a response body read before retrying, making it possible
+// to reuse the connection.
+const retryDrainSize = 64 << 10
+
+// Decides whether a failed request is retried. Consulted for network errors,
+// where resp is nil, and for non-2xx responses, where err is nil. attempt is
+// the number of attempts made so far, starting at 1. Requests are never
+// retried once their context is done.
+type RetryPolicy interface {
+	ShouldRetry(attempt int, req *http.Request, resp *http.Response, err error) (retry bool, delay time.Duration)
+}
+
+// Optionally implemented by a RetryPolicy to limit the total time spent on a
+// request, from the start of the first attempt. A retry whose delay would end
+// after the limit isn't made. Zero means no limit.
+type RetryBudget interface {
+	MaxElapsed() time.Duration
+}
+
+// How DefaultRetryPolicy randomizes delays, spreading out the retries of
+// many clients failing at the same time.
+type Jitter int
+
+const (
+	// The delays are exactly as computed.
+	NoJitter Jitter = iota
+	// A random delay between zero and the computed one.
+	FullJitter
+	// Half the computed delay plus a random delay of up to the other half.
+	EqualJitter
+)
+
+// Retries GET requests failing with network errors, or with a 502, 503 or 504
+// status, using exponential backoff. With the zero value, a request is
+// attempted at most 3 times, waiting 100 and 200 milliseconds before the
+// retries, without jitter and without limiting the total time.
+type DefaultRetryPolicy struct {
+	// Maximum number of attempts, including the first one. Defaults to 3.
+	MaxAttempts int
+	// Delay before the first retry, doubled for every retry. Defaults to 100
+	// milliseconds.
+	BaseDelay time.Duration
+	// Maximum delay before a single retry, applied before jitter. Defaults
+	// to 10 seconds.
+	MaxDelay time.Duration
+	// Defaults to NoJitter.
+	Jitter Jitter
+	// Limits the total time of a request, including all retries and delays.
+	// Zero, the default, means unlimited. A context deadline applies
+	// regardless.
+	MaxElapsedTime time.Duration
+
+	// Returns a random number in [0, n). Replaced in tests.
+	random func(n int64) int64
+}
+
+var _ RetryBudget = DefaultRetryPolicy{}
+
+func (p DefaultRetryPolicy) MaxElapsed() time.Duration {
+	return p.MaxElapsedTime
+}
+
+func (p DefaultRetryPolicy) ShouldRetry(attempt int, req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	if attempt >= maxAttempts || req.Method != http.MethodGet {
+		return false, 0
+	}
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return false, 0
+		}
+	}
+
+	return true, p.delay(attempt)
+}
+
+// The delay before retrying after the given attempt.
+func (p DefaultRetryPolicy) delay(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 10 * time.Second
+	}
+
+	delay := maxDelay
+	// Avoiding overflow for many attempts.
+	if attempt-1 < 62 && base < maxDelay>>(attempt-1) {
+		delay = base << (attempt - 1)
+	}
+
+	random := p.random
+	if random == nil {
+		random = rand.Int63n
+	}
+	switch p.Jitter {
+	case FullJitter:
+		return time.Duration(random(int64(delay) + 1))
+	case EqualJitter:
+		return delay/2 + time.Duration(random(int64(delay-delay/2)+1))
+	}
+	return delay
+}
+
+// Whether to retry a request whose first attempt started at start.
+func (g *Client) shouldRetry(ctx context.Context, start time.Time, attempt int, req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	if g.RetryPolicy == nil || ctx.Err() != nil {
+		return false, 0
+	}
+	if err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, 0
+	}
+	retry, delay := g.RetryPolicy.ShouldRetry(attempt, req, resp, err)
+	if !retry {
+		return false, 0
+	}
+
+	// Not retrying if the delay alone would exceed the budget or deadline.
+	retryAt := g.now().Add(delay)
+	if budget, ok := g.RetryPolicy.(RetryBudget); ok && budget.MaxElapsed() > 0 && retryAt.Sub(start) > budget.MaxElapsed() {
+		return false, 0
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false, 0
+	}
+	return true, delay
+}
+
+func (g *Client) now() time.Time {
+	if g.clock != nil {
+		return g.clock()
+	}
+	return time.Now()
+}
+
+func (g *Client) sleep(ctx context.Context, d time.Duration) error {
+	if g.sleeper != nil {
+		return g.sleeper(ctx, d)
+	}
+	return sleepContext(ctx, d)
+}
+
+// Sleeps for d, failing with ctx.Err() if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,224 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Never retries 500s, but always retries network errors up to a limit.
+type noServerErrorRetries struct {
+	attempts int
+}
+
+func (p *noServerErrorRetries) ShouldRetry(attempt int, req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	p.attempts = attempt
+	if resp != nil && resp.StatusCode == http.StatusInternalServerError {
+		return false, 0
+	}
+	return attempt < 4, time.Millisecond
+}
+
+func TestCustomRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	policy := &noServerErrorRetries{}
+	c, err := New(ts.URL, WithRetryPolicy(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); err == nil {
+		t.Error("Expected error.")
+	}
+	if requests != 1 || policy.attempts != 1 {
+		t.Error("Unexpected number of requests:", requests, policy.attempts)
+	}
+
+	// Connection refused.
+	ts.Close()
+	policy.attempts = 0
+	_, err = c.QueryMultiSince([]string{"a"}, time.Hour)
+	var requestErr *RequestError
+	if !errors.As(err, &requestErr) {
+		t.Error("Unexpected error:", err)
+	}
+	if policy.attempts != 4 || c.Stats().Retries != 3 || c.Stats().NetworkErrors != 4 {
+		t.Error("Unexpected attempts:", policy.attempts, c.Stats())
+	}
+}
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": []}]`))
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithRetryPolicy(DefaultRetryPolicy{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	c.sleeper = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	if series, err := c.QueryMultiSince([]string{"a"}, time.Hour); err != nil || len(series) != 1 {
+		t.Fatal("Unexpected result:", series, err)
+	}
+	if requests != 3 || len(delays) != 2 || delays[0] != 100*time.Millisecond || delays[1] != 200*time.Millisecond {
+		t.Error("Unexpected retries:", requests, delays)
+	}
+	if stats := c.Stats(); stats.InFlight != 0 || stats.Retries != 2 || stats.RenderRequests != 3 {
+		t.Error("Unexpected stats:", stats)
+	}
+
+	// Gives up after MaxAttempts.
+	atomic.StoreInt32(&requests, -10)
+	var httpErr *HTTPError
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Unexpected error:", err)
+	}
+	if requests != -7 {
+		t.Error("Unexpected number of requests:", requests)
+	}
+
+	policy := DefaultRetryPolicy{}
+	for _, status := range []int{http.StatusInternalServerError, http.StatusNotFound} {
+		if retry, _ := policy.ShouldRetry(1, &http.Request{Method: "GET"}, &http.Response{StatusCode: status}, nil); retry {
+			t.Error("Unexpected retry for:", status)
+		}
+	}
+	if retry, _ := policy.ShouldRetry(1, &http.Request{Method: "POST"}, nil, errors.New("Failure.")); retry {
+		t.Error("Unexpected retry for POST.")
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL, WithRetryPolicy(DefaultRetryPolicy{BaseDelay: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour, WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestRetryDelays(t *testing.T) {
+	t.Parallel()
+
+	// Returns the largest possible value.
+	maxRandom := func(n int64) int64 { return n - 1 }
+	halfRandom := func(n int64) int64 { return n / 2 }
+
+	for _, test := range []struct {
+		name     string
+		policy   DefaultRetryPolicy
+		expected []time.Duration
+	}{
+		{"defaults", DefaultRetryPolicy{MaxAttempts: 10}, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond, 3200 * time.Millisecond, 6400 * time.Millisecond, 10 * time.Second, 10 * time.Second}},
+		{"capped", DefaultRetryPolicy{MaxAttempts: 4, BaseDelay: time.Second, MaxDelay: 3 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}},
+		{"full jitter", DefaultRetryPolicy{MaxAttempts: 4, BaseDelay: time.Second, Jitter: FullJitter, random: halfRandom}, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}},
+		{"full jitter max", DefaultRetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, Jitter: FullJitter, random: maxRandom}, []time.Duration{time.Second, 2 * time.Second}},
+		{"equal jitter", DefaultRetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, Jitter: EqualJitter, random: halfRandom}, []time.Duration{750 * time.Millisecond, 1500 * time.Millisecond}},
+	} {
+		var delays []time.Duration
+		for attempt := 1; ; attempt++ {
+			retry, delay := test.policy.ShouldRetry(attempt, &http.Request{Method: "GET"}, nil, errors.New("Failure."))
+			if !retry {
+				break
+			}
+			delays = append(delays, delay)
+		}
+		if len(delays) != len(test.expected) {
+			t.Errorf("%s: unexpected delays: %v", test.name, delays)
+			continue
+		}
+		for i := range delays {
+			if delays[i] != test.expected[i] {
+				t.Errorf("%s: unexpected delays: %v", test.name, delays)
+				break
+			}
+		}
+	}
+
+	// Real randomness stays within bounds.
+	policy := DefaultRetryPolicy{MaxAttempts: 2, Jitter: EqualJitter}
+	for i := 0; i < 100; i++ {
+		if _, delay := policy.ShouldRetry(1, &http.Request{Method: "GET"}, nil, errors.New("Failure.")); delay < 50*time.Millisecond || delay > 100*time.Millisecond {
+			t.Fatal("Delay out of bounds:", delay)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL, WithRetryPolicy(DefaultRetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxElapsedTime: 5 * time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1409763000, 0)
+	c.clock = func() time.Time { return now }
+	var delays []time.Duration
+	c.sleeper = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour); err == nil {
+		t.Error("Expected error.")
+	}
+	// 1s and 2s fit in the 5s budget, 4s more doesn't.
+	if requests != 3 || len(delays) != 2 {
+		t.Error("Unexpected retries:", requests, delays)
+	}
+
+	// A context deadline applies too.
+	atomic.StoreInt32(&requests, 0)
+	delays = nil
+	c.RetryPolicy = DefaultRetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := c.QueryMultiSince([]string{"a"}, time.Hour, WithContext(ctx)); err == nil {
+		t.Error("Expected error.")
+	}
+	if requests != 1 || len(delays) != 0 {
+		t.Error("Unexpected retries:", requests, delays)
+	}
+}
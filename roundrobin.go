@@ -0,0 +1,147 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Spread connections across all addresses the Graphite host resolves to,
+// rather than the one Go would pick, ie. to balance several graphite-web
+// frontends behind one DNS name. Every new connection goes to the next
+// address in turn. The host is re-resolved once the addresses are older than
+// reresolve. An address failing to connect is skipped until the next
+// re-resolution, unless all addresses have failed.
+//
+// Only new connections are spread, and idle connections are reused, so
+// requests are spread as evenly as the connections they reuse. Replaces the
+// DialContext of the Client's transport, which must be an *http.Transport or
+// nil, ie. http.DefaultTransport. Other transports are left as is.
+func WithRoundRobin(reresolve time.Duration) ClientOption {
+	return func(g *Client) {
+		d := &roundRobinDialer{
+			dial:      (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			lookup:    net.DefaultResolver.LookupIPAddr,
+			reresolve: reresolve,
+			now:       time.Now,
+		}
+		g.setDialContext(d.DialContext)
+	}
+}
+
+// Dials the resolved addresses of hosts in turn.
+type roundRobinDialer struct {
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	lookup    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	reresolve time.Duration
+	now       func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+type resolvedHost struct {
+	addrs    []string
+	resolved time.Time
+	// The index of the address to dial next.
+	next int
+	// Addresses that failed to connect since the host was resolved.
+	failed map[string]bool
+}
+
+func (d *roundRobinDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		d.fail(host, addr)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// The addresses of host in the order to try them, starting with the next one
+// in turn and with failed addresses last. Re-resolves host if needed.
+func (d *roundRobinDialer) resolve(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	h := d.hosts[host]
+	d.mu.Unlock()
+	if h == nil || d.now().Sub(h.resolved) >= d.reresolve {
+		// Not holding the lock, since lookups might be slow.
+		ips, err := d.lookup(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		// The previous addresses are used until a lookup succeeds.
+		if err != nil && h == nil {
+			return nil, err
+		}
+		if err == nil {
+			d.update(host, ips)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h = d.hosts[host]
+	var healthy, failed []string
+	for i := range h.addrs {
+		addr := h.addrs[(h.next+i)%len(h.addrs)]
+		if h.failed[addr] {
+			failed = append(failed, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	h.next = (h.next + 1) % len(h.addrs)
+	return append(healthy, failed...), nil
+}
+
+// Replaces the addresses of host, forgetting failures but keeping its turn.
+func (d *roundRobinDialer) update(host string, ips []net.IPAddr) {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	next := 0
+	if h := d.hosts[host]; h != nil {
+		next = h.next % len(addrs)
+	}
+	if d.hosts == nil {
+		d.hosts = make(map[string]*resolvedHost)
+	}
+	d.hosts[host] = &resolvedHost{addrs: addrs, resolved: d.now(), next: next}
+}
+
+// Marks addr of host as failed until host is re-resolved.
+func (d *roundRobinDialer) fail(host, addr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.hosts[host]
+	if h.failed == nil {
+		h.failed = make(map[string]bool)
+	}
+	h.failed[addr] = true
+}
@@ -0,0 +1,162 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeDialer struct {
+	mu     sync.Mutex
+	dialed []string
+	down   map[string]bool
+}
+
+func (f *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dialed = append(f.dialed, address)
+	if f.down[address] {
+		return nil, fmt.Errorf("Connection to %s refused.", address)
+	}
+	client, server := net.Pipe()
+	server.Close()
+	return client, nil
+}
+
+// The addresses dialed since the previous call.
+func (f *fakeDialer) take() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dialed := strings.Join(f.dialed, " ")
+	f.dialed = nil
+	return dialed
+}
+
+func TestRoundRobinDialer(t *testing.T) {
+	t.Parallel()
+
+	resolved := map[string][]string{"graphite": {"10.0.0.1", "10.0.0.2", "::1"}}
+	var lookups int
+	var lookupErr error
+	now := time.Unix(0, 0)
+	dialer := &fakeDialer{down: map[string]bool{}}
+	d := &roundRobinDialer{
+		dial: dialer.DialContext,
+		lookup: func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			var addrs []net.IPAddr
+			for _, ip := range resolved[host] {
+				addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+			}
+			return addrs, nil
+		},
+		reresolve: time.Minute,
+		now:       func() time.Time { return now },
+	}
+	dial := func() error {
+		conn, err := d.DialContext(context.Background(), "tcp", "graphite:8080")
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.1:8080 10.0.0.2:8080 [::1]:8080 10.0.0.1:8080" || lookups != 1 {
+		t.Error("Unexpected dials:", dialed, lookups)
+	}
+
+	// A failing address is skipped from then on.
+	dialer.down["10.0.0.2:8080"] = true
+	for i := 0; i < 3; i++ {
+		if err := dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.2:8080 [::1]:8080 [::1]:8080 10.0.0.1:8080" {
+		t.Error("Unexpected dials:", dialed)
+	}
+
+	// Re-resolving replaces the addresses and forgets failures, but keeps the
+	// turn.
+	now = now.Add(time.Minute)
+	resolved["graphite"] = []string{"10.0.0.2", "10.0.0.3"}
+	dialer.down = map[string]bool{}
+	for i := 0; i < 2; i++ {
+		if err := dial(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.3:8080 10.0.0.2:8080" || lookups != 2 {
+		t.Error("Unexpected dials:", dialed, lookups)
+	}
+
+	// Failed lookups keep the previous addresses.
+	now = now.Add(time.Minute)
+	lookupErr = errors.New("DNS is down.")
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.3:8080" || lookups != 3 {
+		t.Error("Unexpected dials:", dialed, lookups)
+	}
+
+	// All addresses are tried before failing.
+	dialer.down = map[string]bool{"10.0.0.2:8080": true, "10.0.0.3:8080": true}
+	if err := dial(); err == nil || !strings.Contains(err.Error(), "10.0.0.3:8080") {
+		t.Error("Unexpected error:", err)
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.2:8080 10.0.0.3:8080" {
+		t.Error("Unexpected dials:", dialed)
+	}
+
+	// IP addresses aren't resolved.
+	if _, err := d.DialContext(context.Background(), "tcp", "10.0.0.9:80"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "unknown:80"); !errors.Is(err, lookupErr) {
+		t.Error("Unexpected error:", err)
+	}
+	if dialed := dialer.take(); dialed != "10.0.0.9:80" {
+		t.Error("Unexpected dials:", dialed)
+	}
+}
+
+func TestWithRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+	// localhost might also resolve to an address the server isn't listening
+	// on, which is skipped.
+	c, err := New(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), WithRoundRobin(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport, ok := c.Client.Transport.(*http.Transport); !ok || transport == http.DefaultTransport {
+		t.Fatal("Unexpected transport:", c.Client.Transport)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	for i := 0; i < 3; i++ {
+		if _, err := c.QueryFloats("a", interval); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returned, wrapped in a *NoDataError, by QueryScalar and QueryAggregate
+// when the target matches no series or only null values.
+var ErrNoData = errors.New("No data.")
+
+type NoDataError struct {
+	Target string
+}
+
+func (e *NoDataError) Error() string {
+	return fmt.Sprintf("No non-null values for %q.", e.Target)
+}
+
+func (e *NoDataError) Unwrap() error {
+	return ErrNoData
+}
+
+// Returned, wrapped in a *StaleDataError, by QueryScalar when the latest
+// value is older than allowed by WithMaxAge.
+var ErrStaleData = errors.New("Stale data.")
+
+type StaleDataError struct {
+	Target string
+	// The timestamp of the latest non-null value.
+	Time   time.Time
+	MaxAge time.Duration
+}
+
+func (e *StaleDataError) Error() string {
+	return fmt.Sprintf("Latest value for %q at %s is older than %s.", e.Target, e.Time.Format(time.RFC3339), e.MaxAge)
+}
+
+func (e *StaleDataError) Unwrap() error {
+	return ErrStaleData
+}
+
+// Modifies how QueryScalar picks its value.
+type ScalarOption func(*scalarOptions)
+
+type scalarOptions struct {
+	maxAge time.Duration
+	query  []QueryOption
+}
+
+// Fail with a *StaleDataError if the latest value is older than maxAge.
+func WithMaxAge(maxAge time.Duration) ScalarOption {
+	return func(o *scalarOptions) {
+		o.maxAge = maxAge
+	}
+}
+
+// Query options for the underlying query.
+func WithScalarQueryOptions(opts ...QueryOption) ScalarOption {
+	return func(o *scalarOptions) {
+		o.query = append(o.query, opts...)
+	}
+}
+
+// The latest non-null value of q within lookback and its timestamp, ie. for
+// status pages. Fails with a *NoDataError if q matches nothing or every value
+// is null.
+func (g *Client) QueryScalar(q string, lookback time.Duration, opts ...ScalarOption) (float64, time.Time, error) {
+	var o scalarOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	value, t, ok, err := g.QuerySince(q, lookback, o.query...).LastNonNullFloat()
+	if errors.Is(err, ErrNoTargets) {
+		return 0, time.Time{}, &NoDataError{q}
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if !ok {
+		return 0, time.Time{}, &NoDataError{q}
+	}
+	if o.maxAge > 0 && g.now().Sub(t) > o.maxAge {
+		return value, t, &StaleDataError{q, t, o.maxAge}
+	}
+	return value, t, nil
+}
+
+// Aggregates the non-null values of q within interval into a single number
+// using agg, ie. Avg or Percentile(95). Fails with a *NoDataError if q
+// matches nothing or every value is null.
+func (g *Client) QueryAggregate(q string, interval TimeInterval, agg AggFunc, opts ...QueryOption) (float64, error) {
+	points, err := g.QueryFloats(q, interval, opts...)
+	if errors.Is(err, ErrNoTargets) {
+		return 0, &NoDataError{q}
+	}
+	if err != nil {
+		return 0, err
+	}
+	var values []float64
+	for _, point := range points {
+		if point.Value != nil {
+			values = append(values, *point.Value)
+		}
+	}
+	if len(values) == 0 {
+		return 0, &NoDataError{q}
+	}
+	return agg(values), nil
+}
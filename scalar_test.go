@@ -0,0 +1,111 @@
+package infrastructure
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryScalar(t *testing.T) {
+	t.Parallel()
+
+	responses := map[string]string{
+		"trailing": `[{"target": "trailing", "datapoints": [[1, 1409760000], [2.5, 1409760060], [null, 1409760120], [null, 1409760180]]}]`,
+		"empty":    `[{"target": "empty", "datapoints": [[null, 1409760000], [null, 1409760060]]}]`,
+		"missing":  `[]`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("from") != "-5minutes" {
+			t.Error("Unexpected from:", r.FormValue("from"))
+		}
+		w.Write([]byte(responses[r.FormValue("target")]))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1409760200, 0)
+	c.clock = func() time.Time { return now }
+
+	value, at, err := c.QueryScalar("trailing", 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 2.5 || !at.Equal(time.Unix(1409760060, 0)) {
+		t.Error("Unexpected value:", value, at)
+	}
+
+	if _, _, err := c.QueryScalar("trailing", 5*time.Minute, WithMaxAge(3*time.Minute)); err != nil {
+		t.Error(err)
+	}
+	value, _, err = c.QueryScalar("trailing", 5*time.Minute, WithMaxAge(time.Minute))
+	var staleErr *StaleDataError
+	if !errors.As(err, &staleErr) || !errors.Is(err, ErrStaleData) || !staleErr.Time.Equal(time.Unix(1409760060, 0)) {
+		t.Error("Unexpected error:", err)
+	}
+	if value != 2.5 {
+		t.Error("Unexpected value:", value)
+	}
+
+	for _, target := range []string{"empty", "missing"} {
+		_, _, err := c.QueryScalar(target, 5*time.Minute)
+		var noDataErr *NoDataError
+		if !errors.As(err, &noDataErr) || !errors.Is(err, ErrNoData) || noDataErr.Target != target {
+			t.Error("Unexpected error:", target, err)
+		}
+	}
+}
+
+func TestQueryAggregate(t *testing.T) {
+	t.Parallel()
+
+	responses := map[string]string{
+		// The values 40, 15, 50, 35 and 20, as in TestStats.
+		"a":       `[{"target": "a", "datapoints": [[40, 1409760000], [null, 1409760060], [15, 1409760120], [50, 1409760180], [null, 1409760240], [35, 1409760300], [20, 1409760360]]}]`,
+		"empty":   `[{"target": "empty", "datapoints": [[null, 1409760000], [null, 1409760060]]}]`,
+		"missing": `[]`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(responses[r.FormValue("target")]))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409760000, 0), time.Unix(1409760400, 0)}
+
+	for name, test := range map[string]struct {
+		agg      AggFunc
+		expected float64
+	}{
+		"avg":   {Avg, 32},
+		"sum":   {Sum, 160},
+		"min":   {Min, 15},
+		"max":   {Max, 50},
+		"last":  {Last, 20},
+		"count": {Count, 5},
+		"p30":   {Percentile(30), 20},
+		"p50":   {Percentile(50), 35},
+		"p95":   {Percentile(95), 50},
+	} {
+		if actual, err := c.QueryAggregate("a", interval, test.agg); err != nil || actual != test.expected {
+			t.Error("Unexpected aggregate:", name, actual, err)
+		}
+	}
+	if actual, err := c.QueryAggregate("a", interval, Percentile(101)); err != nil || !math.IsNaN(actual) {
+		t.Error("Expected NaN:", actual, err)
+	}
+
+	for _, target := range []string{"empty", "missing"} {
+		_, err := c.QueryAggregate(target, interval, Avg)
+		var noDataErr *NoDataError
+		if !errors.As(err, &noDataErr) || !errors.Is(err, ErrNoData) || noDataErr.Target != target {
+			t.Error("Unexpected error:", target, err)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The resolution of the series, ie. the most common positive difference
+// between consecutive timestamps. Fails for series with less than two
+// datapoints or if less than half of the differences agree on a step.
+func (d Datapoints) Step() (time.Duration, error) {
+	points, err := d.AsFloats()
+	if err != nil {
+		return 0, err
+	}
+	return FloatDatapointsStep(points)
+}
+
+// Like Datapoints.Step, but for already converted datapoints.
+func FloatDatapointsStep(points []FloatDatapoint) (time.Duration, error) {
+	return inferStep(len(points), func(i int) time.Time { return points[i].Time })
+}
+
+// Like Datapoints.Step, but for already converted datapoints.
+func IntDatapointsStep(points []IntDatapoint) (time.Duration, error) {
+	return inferStep(len(points), func(i int) time.Time { return points[i].Time })
+}
+
+func inferStep(n int, timeAt func(i int) time.Time) (time.Duration, error) {
+	if n < 2 {
+		return 0, errors.New("At least two datapoints are required to infer step.")
+	}
+
+	counts := make(map[time.Duration]int)
+	diffs := 0
+	for i := 1; i < n; i++ {
+		if diff := timeAt(i).Sub(timeAt(i - 1)); diff > 0 {
+			counts[diff]++
+			diffs++
+		}
+	}
+
+	var step time.Duration
+	best := 0
+	for diff, count := range counts {
+		// Preferring the smaller step on ties to be deterministic.
+		if count > best || count == best && diff < step {
+			step, best = diff, count
+		}
+	}
+	if best == 0 || 2*best < diffs {
+		return 0, errors.New("Datapoints are too inconsistently spaced to infer step.")
+	}
+	return step, nil
+}
+
+// The last non-null value and its timestamp. ok is false if every value is
+// null, which is common for short intervals since the newest bucket usually
+// is still empty.
+func (d Datapoints) LastNonNullFloat() (value float64, t time.Time, ok bool, err error) {
+	points, err := d.AsFloats()
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Value != nil {
+			return *points[i].Value, points[i].Time, true, nil
+		}
+	}
+	return 0, time.Time{}, false, nil
+}
+
+// Like LastNonNullFloat, but using AsInts.
+func (d Datapoints) LastNonNullInt() (value int64, t time.Time, ok bool, err error) {
+	points, err := d.AsInts()
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Value != nil {
+			return *points[i].Value, points[i].Time, true, nil
+		}
+	}
+	return 0, time.Time{}, false, nil
+}
+
+// points without leading and trailing nulls, which Graphite pads intervals
+// with before the first and after the last write. Interior nulls are kept. The
+// result shares its backing array with points.
+func TrimNulls(points []FloatDatapoint) []FloatDatapoint {
+	return TrimTrailingNulls(TrimLeadingNulls(points))
+}
+
+// Like TrimNulls, but only trims leading nulls.
+func TrimLeadingNulls(points []FloatDatapoint) []FloatDatapoint {
+	return points[leadingNulls(len(points), func(i int) bool { return points[i].Value == nil }):]
+}
+
+// Like TrimNulls, but only trims trailing nulls.
+func TrimTrailingNulls(points []FloatDatapoint) []FloatDatapoint {
+	return points[:len(points)-trailingNulls(len(points), func(i int) bool { return points[i].Value == nil })]
+}
+
+// Like TrimNulls, but for ints.
+func TrimIntNulls(points []IntDatapoint) []IntDatapoint {
+	return TrimTrailingIntNulls(TrimLeadingIntNulls(points))
+}
+
+// Like TrimLeadingNulls, but for ints.
+func TrimLeadingIntNulls(points []IntDatapoint) []IntDatapoint {
+	return points[leadingNulls(len(points), func(i int) bool { return points[i].Value == nil }):]
+}
+
+// Like TrimTrailingNulls, but for ints.
+func TrimTrailingIntNulls(points []IntDatapoint) []IntDatapoint {
+	return points[:len(points)-trailingNulls(len(points), func(i int) bool { return points[i].Value == nil })]
+}
+
+func leadingNulls(n int, isNull func(i int) bool) int {
+	i := 0
+	for i < n && isNull(i) {
+		i++
+	}
+	return i
+}
+
+func trailingNulls(n int, isNull func(i int) bool) int {
+	i := 0
+	for i < n && isNull(n-1-i) {
+		i++
+	}
+	return i
+}
+
+// How FillNulls replaces nulls.
+type FillStrategy struct {
+	kind     fillKind
+	constant float64
+}
+
+type fillKind int
+
+const (
+	fillConstant fillKind = iota
+	fillPrevious
+	fillLinear
+)
+
+var (
+	// Replaces a null with the previous non-null value. Leading nulls, having
+	// no previous value, are kept.
+	FillPrevious = FillStrategy{kind: fillPrevious}
+
+	// Replaces a null by interpolating linearly, by time, between the
+	// surrounding non-null values. Leading and trailing nulls, lacking a value
+	// on one side, are kept.
+	FillLinear = FillStrategy{kind: fillLinear}
+)
+
+// Replaces every null with v.
+func FillConstant(v float64) FillStrategy {
+	return FillStrategy{kind: fillConstant, constant: v}
+}
+
+// A copy of points with nulls replaced according to strategy. points is left
+// untouched.
+func FillNulls(points []FloatDatapoint, strategy FillStrategy) []FloatDatapoint {
+	filled := make([]FloatDatapoint, len(points))
+	values := make([]float64, len(points))
+	previous := -1
+	for i, point := range points {
+		filled[i].Time = point.Time
+		if point.Value != nil {
+			values[i] = *point.Value
+			filled[i].Value = &values[i]
+			if strategy.kind == fillLinear && previous >= 0 && previous < i-1 {
+				interpolate(filled, values, previous, i)
+			}
+			previous = i
+			continue
+		}
+
+		switch strategy.kind {
+		case fillConstant:
+			values[i] = strategy.constant
+			filled[i].Value = &values[i]
+		case fillPrevious:
+			if previous >= 0 {
+				values[i] = values[previous]
+				filled[i].Value = &values[i]
+			}
+		}
+	}
+	return filled
+}
+
+// Fills the nulls between the non-null datapoints at from and to.
+func interpolate(points []FloatDatapoint, values []float64, from, to int) {
+	span := float64(points[to].Time.Sub(points[from].Time))
+	for i := from + 1; i < to; i++ {
+		fraction := 0.0
+		if span > 0 {
+			fraction = float64(points[i].Time.Sub(points[from].Time)) / span
+		}
+		values[i] = values[from] + fraction*(values[to]-values[from])
+		points[i].Value = &values[i]
+	}
+}
+
+// Aggregates the non-null values of a bucket into one. Never called with an
+// empty slice.
+type AggFunc func(values []float64) float64
+
+// An AggFunc averaging values.
+func Avg(values []float64) float64 {
+	return moments(values).Mean
+}
+
+// An AggFunc summing values.
+func Sum(values []float64) float64 {
+	return moments(values).Sum
+}
+
+// An AggFunc picking the smallest value.
+func Min(values []float64) float64 {
+	return moments(values).Min
+}
+
+// An AggFunc picking the largest value.
+func Max(values []float64) float64 {
+	return moments(values).Max
+}
+
+// An AggFunc picking the last value.
+func Last(values []float64) float64 {
+	return values[len(values)-1]
+}
+
+// An AggFunc counting values.
+func Count(values []float64) float64 {
+	return float64(len(values))
+}
+
+// An AggFunc picking the median value, or the mean of the two middle values.
+func Median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// Downsamples points into buckets of step, aggregating the non-null values of
+// every bucket using agg. Buckets are aligned to the Unix epoch and are
+// half-open, ie. a datapoint exactly on a boundary belongs to the bucket
+// starting there. Every bucket is timestamped with its start. Buckets without
+// non-null values become nulls.
+//
+// points must be sorted by time. If points already are as coarse as step, or
+// step isn't positive, points are returned unchanged.
+func Resample(points []FloatDatapoint, step time.Duration, agg AggFunc) []FloatDatapoint {
+	return ResampleAnchored(points, step, time.Unix(0, 0), agg)
+}
+
+// Like Resample, but aligns buckets to anchor instead of the Unix epoch.
+func ResampleAnchored(points []FloatDatapoint, step time.Duration, anchor time.Time, agg AggFunc) []FloatDatapoint {
+	if len(points) == 0 || step <= 0 {
+		return points
+	}
+	if current, err := FloatDatapointsStep(points); err == nil && current >= step {
+		return points
+	}
+
+	bucketStart := func(t time.Time) time.Time {
+		offset := t.Sub(anchor) % step
+		if offset < 0 {
+			offset += step
+		}
+		return t.Add(-offset)
+	}
+
+	first := bucketStart(points[0].Time)
+	last := bucketStart(points[len(points)-1].Time)
+	n := int(last.Sub(first)/step) + 1
+
+	resampled := make([]FloatDatapoint, n)
+	values := make([]float64, n)
+	for i := range resampled {
+		resampled[i].Time = first.Add(time.Duration(i) * step)
+	}
+
+	var bucket []float64
+	current := 0
+	flush := func() {
+		if len(bucket) > 0 {
+			values[current] = agg(bucket)
+			resampled[current].Value = &values[current]
+			bucket = bucket[:0]
+		}
+	}
+	for _, point := range points {
+		if i := int(bucketStart(point.Time).Sub(first) / step); i != current {
+			flush()
+			current = i
+		}
+		if point.Value != nil {
+			bucket = append(bucket, *point.Value)
+		}
+	}
+	flush()
+
+	return resampled
+}
+
+// Combines all series into one by aggregating the values of every timestamp
+// using agg. Series are aligned on the union of their timestamps, so series
+// with different lengths, steps or offsets are fine. Nulls are treated as
+// absent unless NullsAsZero is given. Timestamps without any values become
+// nulls.
+func (m MultiDatapoints) Aggregate(agg AggFunc, opts ...ConvertOption) ([]FloatDatapoint, error) {
+	o := newConvertOptions(opts)
+
+	buckets := make(map[int64][]float64)
+	for _, d := range m {
+		points, err := d.AsFloats()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to convert %q: %w", d.Target, err)
+		}
+		for _, point := range points {
+			unix := point.Time.Unix()
+			switch {
+			case point.Value != nil:
+				buckets[unix] = append(buckets[unix], *point.Value)
+			case o.nullsAsZero:
+				buckets[unix] = append(buckets[unix], 0)
+			default:
+				// Making sure the timestamp is part of the result.
+				if _, ok := buckets[unix]; !ok {
+					buckets[unix] = nil
+				}
+			}
+		}
+	}
+
+	timestamps := make([]int64, 0, len(buckets))
+	for unix := range buckets {
+		timestamps = append(timestamps, unix)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	aggregated := make([]FloatDatapoint, len(timestamps))
+	values := make([]float64, len(timestamps))
+	for i, unix := range timestamps {
+		aggregated[i].Time = time.Unix(unix, 0)
+		if bucket := buckets[unix]; len(bucket) > 0 {
+			values[i] = agg(bucket)
+			aggregated[i].Value = &values[i]
+		}
+	}
+	return aggregated, nil
+}
+
+// A timestamp of two aligned series. A value is nil if it was null, or
+// missing from its series.
+type AlignedPoint struct {
+	Time time.Time
+	A    *float64
+	B    *float64
+}
+
+// A timestamp of N aligned series. Values holds one value per series, in the
+// order given to AlignMany.
+type AlignedRow struct {
+	Time   time.Time
+	Values []*float64
+}
+
+// Joins two series on their timestamps, ie. to compute a ratio between them.
+// The result is sorted by time. By default, every timestamp of either series
+// is kept (an outer join). See InnerJoin. Fails if a series has the same
+// timestamp more than once.
+func AlignSeries(a, b []FloatDatapoint, opts ...AlignOption) ([]AlignedPoint, error) {
+	rows, err := AlignMany([][]FloatDatapoint{a, b}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	aligned := make([]AlignedPoint, len(rows))
+	for i, row := range rows {
+		aligned[i] = AlignedPoint{Time: row.Time, A: row.Values[0], B: row.Values[1]}
+	}
+	return aligned, nil
+}
+
+// Like AlignSeries, but for any number of series.
+func AlignMany(series [][]FloatDatapoint, opts ...AlignOption) ([]AlignedRow, error) {
+	var o alignOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// Series indexed by unix time, and in how many series every timestamp
+	// occurs.
+	indexed := make([]map[int64]*float64, len(series))
+	occurrences := make(map[int64]int)
+	for i, points := range series {
+		indexed[i] = make(map[int64]*float64, len(points))
+		for _, point := range points {
+			unix := point.Time.Unix()
+			if _, ok := indexed[i][unix]; ok {
+				return nil, fmt.Errorf("Series %d has timestamp %d more than once.", i, unix)
+			}
+			indexed[i][unix] = point.Value
+			occurrences[unix]++
+		}
+	}
+
+	timestamps := make([]int64, 0, len(occurrences))
+	for unix, n := range occurrences {
+		if !o.inner || n == len(series) {
+			timestamps = append(timestamps, unix)
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	rows := make([]AlignedRow, len(timestamps))
+	values := make([]*float64, len(timestamps)*len(series))
+	for i, unix := range timestamps {
+		row := values[i*len(series) : (i+1)*len(series) : (i+1)*len(series)]
+		for j := range series {
+			row[j] = indexed[j][unix]
+		}
+		rows[i] = AlignedRow{Time: time.Unix(unix, 0), Values: row}
+	}
+	return rows, nil
+}
+
+// Fetches q for interval and for interval shifted back by shift, ie. a week,
+// for comparing the two. The timestamps of the shifted series are moved
+// forward by shift, and the series are joined on timestamps like by
+// AlignSeries, so current[i] and shifted[i] always have the same Time.
+// Timestamps missing from one series, ie. because the shifted interval is
+// partly beyond retention, get a nil Value in it.
+func (g *Client) QueryWithShift(q string, interval TimeInterval, shift time.Duration, opts ...QueryOption) (current, shifted []FloatDatapoint, err error) {
+	shiftedInterval := TimeInterval{interval.From.Add(-shift), interval.To.Add(-shift)}
+	if err := shiftedInterval.Check(); err != nil {
+		return nil, nil, err
+	}
+	currentPoints, err := g.QueryFloats(q, interval, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	shiftedPoints, err := g.QueryFloats(q, shiftedInterval, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range shiftedPoints {
+		shiftedPoints[i].Time = shiftedPoints[i].Time.Add(shift)
+	}
+	aligned, err := AlignSeries(currentPoints, shiftedPoints)
+	if err != nil {
+		return nil, nil, err
+	}
+	current = make([]FloatDatapoint, len(aligned))
+	shifted = make([]FloatDatapoint, len(aligned))
+	for i, point := range aligned {
+		current[i] = FloatDatapoint{Time: point.Time, Value: point.A}
+		shifted[i] = FloatDatapoint{Time: point.Time, Value: point.B}
+	}
+	return current, shifted, nil
+}
+
+// The difference between every value and the previous one. The first
+// datapoint, and every datapoint where either value is null, becomes null, so
+// gaps are never bridged.
+func Derivative(points []FloatDatapoint) []FloatDatapoint {
+	return difference(points, func(previous, current FloatDatapoint) (float64, bool) {
+		return *current.Value - *previous.Value, true
+	})
+}
+
+// Like Derivative, but divided by the number of seconds between the two
+// datapoints, ie. turning a counter into a rate.
+func PerSecond(points []FloatDatapoint) []FloatDatapoint {
+	return difference(points, func(previous, current FloatDatapoint) (float64, bool) {
+		seconds := current.Time.Sub(previous.Time).Seconds()
+		if seconds <= 0 {
+			return 0, false
+		}
+		return (*current.Value - *previous.Value) / seconds, true
+	})
+}
+
+// How NonNegativeDerivative handles a decreasing value.
+type CounterReset int
+
+const (
+	// A decrease becomes null.
+	ResetToNull CounterReset = iota
+	// A decrease is assumed to be a counter restarting from zero, so the
+	// difference is the new value itself.
+	ResetFromZero
+)
+
+// Like Derivative, but for counters that only increase. A decrease is treated
+// as a counter reset according to reset.
+func NonNegativeDerivative(points []FloatDatapoint, reset CounterReset) []FloatDatapoint {
+	return difference(points, func(previous, current FloatDatapoint) (float64, bool) {
+		diff := *current.Value - *previous.Value
+		if diff >= 0 {
+			return diff, true
+		}
+		if reset == ResetFromZero {
+			return *current.Value, true
+		}
+		return 0, false
+	})
+}
+
+// Calls diff for every pair of consecutive non-null datapoints. diff returning
+// false makes the datapoint null.
+func difference(points []FloatDatapoint, diff func(previous, current FloatDatapoint) (float64, bool)) []FloatDatapoint {
+	result := make([]FloatDatapoint, len(points))
+	values := make([]float64, len(points))
+	for i, point := range points {
+		result[i].Time = point.Time
+		if i == 0 || point.Value == nil || points[i-1].Value == nil {
+			continue
+		}
+		if v, ok := diff(points[i-1], point); ok {
+			values[i] = v
+			result[i].Value = &values[i]
+		}
+	}
+	return result
+}
+
+// Smooths points by averaging every datapoint with the window-1 datapoints
+// before it. Nulls within a window are skipped, so the average is over the
+// non-null values; a window with only nulls gives a null. The first window-1
+// datapoints, lacking a full window, are null. The result has the same length
+// as points. A window less than one gives only nulls.
+func MovingAverage(points []FloatDatapoint, window int) []FloatDatapoint {
+	return movingWindow(points, window, Avg)
+}
+
+// Like MovingAverage, but using the median of every window.
+func MovingMedian(points []FloatDatapoint, window int) []FloatDatapoint {
+	return movingWindow(points, window, Median)
+}
+
+// Like MovingAverage, but the window of a datapoint at time t covers the
+// datapoints in (t-window, t]. Datapoints less than window after the first
+// datapoint are null.
+func MovingAverageDuration(points []FloatDatapoint, window time.Duration) []FloatDatapoint {
+	start := 0
+	return moving(points, Avg, func(i int) (int, bool) {
+		if window <= 0 {
+			return i, false
+		}
+		for points[start].Time.Add(window).Compare(points[i].Time) <= 0 {
+			start++
+		}
+		return start, points[i].Time.Sub(points[0].Time) >= window
+	})
+}
+
+func movingWindow(points []FloatDatapoint, window int, agg AggFunc) []FloatDatapoint {
+	return moving(points, agg, func(i int) (int, bool) {
+		return i - window + 1, window > 0 && i >= window-1
+	})
+}
+
+// Aggregates the non-null values of points[start:i+1] for every i, where
+// window returns start and whether the window is full.
+func moving(points []FloatDatapoint, agg AggFunc, window func(i int) (start int, full bool)) []FloatDatapoint {
+	result := make([]FloatDatapoint, len(points))
+	values := make([]float64, len(points))
+	var bucket []float64
+	for i, point := range points {
+		result[i].Time = point.Time
+		start, full := window(i)
+		if !full {
+			continue
+		}
+		bucket = bucket[:0]
+		for _, p := range points[start : i+1] {
+			if p.Value != nil {
+				bucket = append(bucket, *p.Value)
+			}
+		}
+		if len(bucket) > 0 {
+			values[i] = agg(bucket)
+			result[i].Value = &values[i]
+		}
+	}
+	return result
+}
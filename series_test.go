@@ -0,0 +1,542 @@
+package infrastructure
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func minutelyFloatDatapoints(minutes ...int) []FloatDatapoint {
+	start := time.Unix(1409763000, 0)
+	points := make([]FloatDatapoint, len(minutes))
+	for i, m := range minutes {
+		points[i] = FloatDatapoint{Time: start.Add(time.Duration(m) * time.Minute)}
+	}
+	return points
+}
+
+func TestStep(t *testing.T) {
+	t.Parallel()
+
+	d := Datapoints{Target: "a", points: []byte("[[1, 1409763000], [null, 1409763060], [3, 1409763120]]")}
+	if step, err := d.Step(); err != nil || step != time.Minute {
+		t.Error("Unexpected step:", step, err)
+	}
+
+	// A single gap.
+	if step, err := FloatDatapointsStep(minutelyFloatDatapoints(0, 1, 2, 5, 6, 7)); err != nil || step != time.Minute {
+		t.Error("Unexpected step:", step, err)
+	}
+
+	ints := []IntDatapoint{{Time: time.Unix(0, 0)}, {Time: time.Unix(10, 0)}}
+	if step, err := IntDatapointsStep(ints); err != nil || step != 10*time.Second {
+		t.Error("Unexpected step:", step, err)
+	}
+}
+
+func TestStepFailures(t *testing.T) {
+	t.Parallel()
+
+	if _, err := FloatDatapointsStep(minutelyFloatDatapoints(0)); err == nil {
+		t.Error("Expected error for single datapoint.")
+	}
+	if _, err := FloatDatapointsStep(nil); err == nil {
+		t.Error("Expected error for no datapoints.")
+	}
+	if _, err := FloatDatapointsStep(minutelyFloatDatapoints(0, 1, 3, 6, 10)); err == nil {
+		t.Error("Expected error for inconsistent spacing.")
+	}
+	if _, err := FloatDatapointsStep(minutelyFloatDatapoints(0, 0, 0)); err == nil {
+		t.Error("Expected error for identical timestamps.")
+	}
+	if _, err := (Datapoints{err: errDatapointsSyntax}).Step(); err != errDatapointsSyntax {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestLastNonNull(t *testing.T) {
+	t.Parallel()
+
+	trailingNulls := Datapoints{Target: "a", points: []byte("[[1, 1409763000], [2.5, 1409763060], [null, 1409763120], [null, 1409763180]]")}
+	value, ts, ok, err := trailingNulls.LastNonNullFloat()
+	if err != nil || !ok || value != 2.5 || !ts.Equal(time.Unix(1409763060, 0)) {
+		t.Error("Unexpected last value:", value, ts, ok, err)
+	}
+	i, ts, ok, err := trailingNulls.LastNonNullInt()
+	if err != nil || !ok || i != 2 || !ts.Equal(time.Unix(1409763060, 0)) {
+		t.Error("Unexpected last value:", i, ts, ok, err)
+	}
+
+	allNulls := Datapoints{Target: "a", points: []byte("[[null, 1409763000], [null, 1409763060]]")}
+	if _, _, ok, err := allNulls.LastNonNullFloat(); ok || err != nil {
+		t.Error("Expected no value:", ok, err)
+	}
+	if _, _, ok, err := (Datapoints{Target: "a"}).LastNonNullInt(); ok || err != nil {
+		t.Error("Expected no value:", ok, err)
+	}
+	if _, _, _, err := (Datapoints{err: errDatapointsSyntax}).LastNonNullFloat(); err != errDatapointsSyntax {
+		t.Error("Unexpected error:", err)
+	}
+}
+
+func TestLatestFloat(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("from") != "-5minutes" {
+			t.Error("Unexpected from:", r.FormValue("from"))
+		}
+		fmt.Fprint(w, `[{"target": "a", "datapoints": [[3, 1409763000], [null, 1409763060]]}]`)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _, ok, err := c.LatestFloat("a", 5*time.Minute); err != nil || !ok || value != 3 {
+		t.Error("Unexpected latest value:", value, ok, err)
+	}
+	if value, _, ok, err := c.LatestInt("a", 5*time.Minute); err != nil || !ok || value != 3 {
+		t.Error("Unexpected latest value:", value, ok, err)
+	}
+}
+
+// Minutely datapoints with the given values, where nil means null.
+func floatDatapointsOf(values ...*float64) []FloatDatapoint {
+	start := time.Unix(1409763000, 0)
+	points := make([]FloatDatapoint, len(values))
+	for i, value := range values {
+		points[i] = FloatDatapoint{Time: start.Add(time.Duration(i) * time.Minute), Value: value}
+	}
+	return points
+}
+
+func TestTrimNulls(t *testing.T) {
+	t.Parallel()
+
+	one, two := makeFloat64Pointer(1), makeFloat64Pointer(2)
+	padded := floatDatapointsOf(nil, nil, one, nil, two, nil)
+
+	if trimmed := TrimNulls(padded); len(trimmed) != 3 || trimmed[0].Value != one || trimmed[1].Value != nil || trimmed[2].Value != two {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimLeadingNulls(padded); len(trimmed) != 4 || trimmed[0].Value != one {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimTrailingNulls(padded); len(trimmed) != 5 || trimmed[4].Value != two {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimNulls(padded); &trimmed[0] != &padded[2] {
+		t.Error("Expected no copy.")
+	}
+
+	interior := floatDatapointsOf(one, nil, nil, two)
+	if trimmed := TrimNulls(interior); len(trimmed) != 4 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimNulls(floatDatapointsOf(nil, nil, nil)); len(trimmed) != 0 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimNulls(nil); len(trimmed) != 0 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+}
+
+func TestTrimIntNulls(t *testing.T) {
+	t.Parallel()
+
+	one := makeInt64Pointer(1)
+	padded := []IntDatapoint{{Value: nil}, {Value: one}, {Value: nil}, {Value: one}, {Value: nil}}
+	if trimmed := TrimIntNulls(padded); len(trimmed) != 3 || trimmed[1].Value != nil {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimLeadingIntNulls(padded); len(trimmed) != 4 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimTrailingIntNulls(padded); len(trimmed) != 4 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+	if trimmed := TrimIntNulls([]IntDatapoint{{}, {}}); len(trimmed) != 0 {
+		t.Error("Unexpected trimmed points:", trimmed)
+	}
+}
+
+func TestFillNulls(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	tests := []struct {
+		name     string
+		points   []*float64
+		strategy FillStrategy
+		expected []*float64
+	}{
+		{"constant", []*float64{nil, v(1), nil, nil, v(4), nil}, FillConstant(-1), []*float64{v(-1), v(1), v(-1), v(-1), v(4), v(-1)}},
+		{"constant all nulls", []*float64{nil, nil}, FillConstant(0), []*float64{v(0), v(0)}},
+		{"previous", []*float64{nil, v(1), nil, nil, v(4), nil}, FillPrevious, []*float64{nil, v(1), v(1), v(1), v(4), v(4)}},
+		{"previous all nulls", []*float64{nil, nil}, FillPrevious, []*float64{nil, nil}},
+		{"linear", []*float64{nil, v(1), nil, nil, v(4), nil}, FillLinear, []*float64{nil, v(1), v(2), v(3), v(4), nil}},
+		{"linear single gap", []*float64{v(0), nil, v(-1)}, FillLinear, []*float64{v(0), v(-0.5), v(-1)}},
+		{"linear no gaps", []*float64{v(1), v(2)}, FillLinear, []*float64{v(1), v(2)}},
+		{"empty", nil, FillLinear, nil},
+	}
+	for _, test := range tests {
+		points := floatDatapointsOf(test.points...)
+		filled := FillNulls(points, test.strategy)
+		if len(filled) != len(test.expected) {
+			t.Errorf("%s: unexpected number of points: %d", test.name, len(filled))
+			continue
+		}
+		for i, expected := range test.expected {
+			actual := filled[i].Value
+			if (actual == nil) != (expected == nil) || actual != nil && *actual != *expected {
+				t.Errorf("%s: unexpected value at %d: %v", test.name, i, actual)
+			}
+			if !filled[i].Time.Equal(points[i].Time) {
+				t.Errorf("%s: unexpected time at %d: %v", test.name, i, filled[i].Time)
+			}
+		}
+		for i, value := range test.points {
+			if points[i].Value != value {
+				t.Errorf("%s: input modified at %d.", test.name, i)
+			}
+		}
+	}
+}
+
+func TestFillLinearUsesTime(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1409763000, 0)
+	points := []FloatDatapoint{
+		{start, makeFloat64Pointer(0)},
+		{start.Add(time.Minute), nil},
+		{start.Add(4 * time.Minute), makeFloat64Pointer(4)},
+	}
+	if filled := FillNulls(points, FillLinear); *filled[1].Value != 1 {
+		t.Error("Unexpected value:", *filled[1].Value)
+	}
+}
+
+func TestAggFuncs(t *testing.T) {
+	t.Parallel()
+
+	values := []float64{3, -1, 4, 2}
+	for name, test := range map[string]struct {
+		agg      AggFunc
+		expected float64
+	}{
+		"Avg":  {Avg, 2},
+		"Sum":  {Sum, 8},
+		"Min":  {Min, -1},
+		"Max":  {Max, 4},
+		"Last": {Last, 2},
+	} {
+		if actual := test.agg(values); actual != test.expected {
+			t.Errorf("%s: unexpected value: %v", name, actual)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	// Minutely, starting on a five minute boundary. The third bucket is entirely
+	// null.
+	points := floatDatapointsOf(v(1), v(2), v(3), v(4), v(5), v(6), nil, v(8), nil, v(10), nil, nil, nil, nil, nil, v(16))
+
+	resampled := Resample(points, 5*time.Minute, Sum)
+	expected := []*float64{v(15), v(24), nil, v(16)}
+	if len(resampled) != len(expected) {
+		t.Fatal("Unexpected number of points:", len(resampled))
+	}
+	start := time.Unix(1409763000, 0)
+	for i, e := range expected {
+		if !resampled[i].Time.Equal(start.Add(time.Duration(i) * 5 * time.Minute)) {
+			t.Error("Unexpected time:", i, resampled[i].Time)
+		}
+		if (resampled[i].Value == nil) != (e == nil) || e != nil && *resampled[i].Value != *e {
+			t.Error("Unexpected value:", i, resampled[i].Value)
+		}
+	}
+
+	// A point exactly on a boundary starts a new bucket.
+	if r := Resample(points[4:7], 5*time.Minute, Last); len(r) != 2 || *r[0].Value != 5 || *r[1].Value != 6 {
+		t.Error("Unexpected boundary handling:", r)
+	}
+
+	// Anchoring buckets two minutes past the boundary.
+	anchored := ResampleAnchored(points[:6], 5*time.Minute, start.Add(2*time.Minute), Max)
+	if len(anchored) != 2 || !anchored[0].Time.Equal(start.Add(-3*time.Minute)) || *anchored[0].Value != 2 || *anchored[1].Value != 6 {
+		t.Error("Unexpected anchored result:", anchored)
+	}
+}
+
+func TestResampleUnchanged(t *testing.T) {
+	t.Parallel()
+
+	points := minutelyFloatDatapoints(0, 10, 20)
+	if r := Resample(points, 5*time.Minute, Avg); &r[0] != &points[0] || len(r) != 3 {
+		t.Error("Expected coarser input to be returned unchanged:", r)
+	}
+	if r := Resample(points, 0, Avg); len(r) != 3 {
+		t.Error("Expected input to be returned unchanged:", r)
+	}
+	if r := Resample(nil, time.Minute, Avg); len(r) != 0 {
+		t.Error("Unexpected result:", r)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	t.Parallel()
+
+	m := MultiDatapoints{
+		{Target: "a", points: []byte("[[1, 1409763000], [null, 1409763060], [3, 1409763120]]")},
+		{Target: "b", points: []byte("[[10, 1409763000], [20, 1409763060], [null, 1409763120], [40, 1409763180]]")},
+		// Offset by 30 seconds.
+		{Target: "c", points: []byte("[[null, 1409763030]]")},
+	}
+
+	tests := []struct {
+		name     string
+		agg      AggFunc
+		opts     []ConvertOption
+		expected []*float64
+	}{
+		{"sum", Sum, nil, []*float64{makeFloat64Pointer(11), nil, makeFloat64Pointer(20), makeFloat64Pointer(3), makeFloat64Pointer(40)}},
+		{"avg", Avg, nil, []*float64{makeFloat64Pointer(5.5), nil, makeFloat64Pointer(20), makeFloat64Pointer(3), makeFloat64Pointer(40)}},
+		{"count", Count, nil, []*float64{makeFloat64Pointer(2), nil, makeFloat64Pointer(1), makeFloat64Pointer(1), makeFloat64Pointer(1)}},
+		{"avg nulls as zero", Avg, []ConvertOption{NullsAsZero()}, []*float64{makeFloat64Pointer(5.5), makeFloat64Pointer(0), makeFloat64Pointer(10), makeFloat64Pointer(1.5), makeFloat64Pointer(40)}},
+	}
+	timestamps := []int64{1409763000, 1409763030, 1409763060, 1409763120, 1409763180}
+	for _, test := range tests {
+		aggregated, err := m.Aggregate(test.agg, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(aggregated) != len(test.expected) {
+			t.Errorf("%s: unexpected number of points: %d", test.name, len(aggregated))
+			continue
+		}
+		for i, expected := range test.expected {
+			actual := aggregated[i].Value
+			if (actual == nil) != (expected == nil) || actual != nil && *actual != *expected {
+				t.Errorf("%s: unexpected value at %d: %v", test.name, i, actual)
+			}
+			if aggregated[i].Time.Unix() != timestamps[i] {
+				t.Errorf("%s: unexpected time at %d: %v", test.name, i, aggregated[i].Time)
+			}
+		}
+	}
+
+	broken := MultiDatapoints{{Target: "broken", points: []byte("[[1]]")}}
+	if _, err := broken.Aggregate(Sum); err == nil {
+		t.Error("Expected error.")
+	}
+}
+
+func TestAlignSeries(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1409763000, 0)
+	failures := []FloatDatapoint{
+		{start, makeFloat64Pointer(1)},
+		{start.Add(time.Minute), makeFloat64Pointer(2)},
+		{start.Add(2 * time.Minute), nil},
+	}
+	// One point shorter, and one point offset by 30 seconds.
+	requests := []FloatDatapoint{
+		{start, makeFloat64Pointer(10)},
+		{start.Add(90 * time.Second), makeFloat64Pointer(20)},
+	}
+
+	outer, err := AlignSeries(failures, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outer) != 4 {
+		t.Fatal("Unexpected number of points:", len(outer))
+	}
+	expectedTimes := []time.Duration{0, time.Minute, 90 * time.Second, 2 * time.Minute}
+	for i, expected := range expectedTimes {
+		if !outer[i].Time.Equal(start.Add(expected)) {
+			t.Error("Unexpected time:", i, outer[i].Time)
+		}
+	}
+	if *outer[0].A != 1 || *outer[0].B != 10 || *outer[1].A != 2 || outer[1].B != nil || outer[2].A != nil || *outer[2].B != 20 || outer[3].A != nil || outer[3].B != nil {
+		t.Errorf("Unexpected points: %+v", outer)
+	}
+
+	inner, err := AlignSeries(failures, requests, InnerJoin())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner) != 1 || !inner[0].Time.Equal(start) || *inner[0].A != 1 || *inner[0].B != 10 {
+		t.Errorf("Unexpected points: %+v", inner)
+	}
+
+	duplicated := append(requests, requests[0])
+	if _, err := AlignSeries(failures, duplicated); err == nil {
+		t.Error("Expected error for duplicate timestamps.")
+	}
+}
+
+func TestAlignMany(t *testing.T) {
+	t.Parallel()
+
+	series := [][]FloatDatapoint{
+		minutelyFloatDatapoints(0, 1, 2),
+		minutelyFloatDatapoints(1, 2),
+		minutelyFloatDatapoints(2, 3),
+	}
+	rows, err := AlignMany(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatal("Unexpected number of rows:", len(rows))
+	}
+	for _, row := range rows {
+		if len(row.Values) != 3 {
+			t.Error("Unexpected number of values:", len(row.Values))
+		}
+	}
+
+	rows, err = AlignMany(series, InnerJoin())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || !rows[0].Time.Equal(time.Unix(1409763000, 0).Add(2*time.Minute)) {
+		t.Error("Unexpected rows:", rows)
+	}
+}
+
+func assertFloatValues(t *testing.T, name string, points []FloatDatapoint, expected ...*float64) {
+	t.Helper()
+	if len(points) != len(expected) {
+		t.Errorf("%s: unexpected number of points: %d", name, len(points))
+		return
+	}
+	for i, e := range expected {
+		actual := points[i].Value
+		if (actual == nil) != (e == nil) || actual != nil && *actual != *e {
+			t.Errorf("%s: unexpected value at %d: %v", name, i, actual)
+		}
+	}
+}
+
+func TestDerivatives(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	start := time.Unix(1409763000, 0)
+	// A counter with a gap, irregular spacing and a reset.
+	counter := []FloatDatapoint{
+		{start, v(100)},
+		{start.Add(10 * time.Second), v(160)},
+		{start.Add(20 * time.Second), nil},
+		{start.Add(30 * time.Second), v(200)},
+		{start.Add(60 * time.Second), v(260)},
+		{start.Add(70 * time.Second), v(20)},
+		{start.Add(80 * time.Second), v(50)},
+	}
+
+	assertFloatValues(t, "Derivative", Derivative(counter), nil, v(60), nil, nil, v(60), v(-240), v(30))
+	assertFloatValues(t, "PerSecond", PerSecond(counter), nil, v(6), nil, nil, v(2), v(-24), v(3))
+	assertFloatValues(t, "ResetToNull", NonNegativeDerivative(counter, ResetToNull), nil, v(60), nil, nil, v(60), nil, v(30))
+	assertFloatValues(t, "ResetFromZero", NonNegativeDerivative(counter, ResetFromZero), nil, v(60), nil, nil, v(60), v(20), v(30))
+
+	rates := PerSecond(counter)
+	for i := range counter {
+		if !rates[i].Time.Equal(counter[i].Time) {
+			t.Error("Unexpected time:", i, rates[i].Time)
+		}
+	}
+	if len(Derivative(nil)) != 0 {
+		t.Error("Expected no points.")
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	points := floatDatapointsOf(v(1), v(2), v(6), nil, v(4), nil, nil, nil, v(9))
+
+	assertFloatValues(t, "window 3", MovingAverage(points, 3), nil, nil, v(3), v(4), v(5), v(4), v(4), nil, v(9))
+	assertFloatValues(t, "window 1", MovingAverage(points, 1), points[0].Value, points[1].Value, points[2].Value, nil, points[4].Value, nil, nil, nil, points[8].Value)
+	assertFloatValues(t, "window larger than series", MovingAverage(points, 10), nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	assertFloatValues(t, "window 0", MovingAverage(points[:2], 0), nil, nil)
+	assertFloatValues(t, "median", MovingMedian(points, 4), nil, nil, nil, v(2), v(4), v(5), v(4), v(4), v(9))
+
+	// Minutely datapoints, so a three minute window is the same as three
+	// datapoints except for when it's considered full.
+	assertFloatValues(t, "duration", MovingAverageDuration(points, 3*time.Minute), nil, nil, nil, v(4), v(5), v(4), v(4), nil, v(9))
+	assertFloatValues(t, "duration larger than series", MovingAverageDuration(points, time.Hour), nil, nil, nil, nil, nil, nil, nil, nil, nil)
+
+	smoothed := MovingAverage(points, 3)
+	for i := range points {
+		if !smoothed[i].Time.Equal(points[i].Time) {
+			t.Error("Unexpected time:", i, smoothed[i].Time)
+		}
+	}
+}
+
+func TestMedian(t *testing.T) {
+	t.Parallel()
+
+	values := []float64{5, 1, 3}
+	if Median(values) != 3 || Median([]float64{4, 1, 3, 2}) != 2.5 {
+		t.Error("Unexpected median.")
+	}
+	if values[0] != 5 {
+		t.Error("Input modified.")
+	}
+}
+
+func TestQueryWithShift(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1409763000, 0)
+	week := 7 * 24 * time.Hour
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("from") {
+		case graphiteDateFormat(start):
+			fmt.Fprintf(w, `[{"target": "a", "datapoints": [[1, %d], [2, %d], [3, %d]]}]`, start.Unix(), start.Unix()+60, start.Unix()+120)
+		case graphiteDateFormat(start.Add(-week)):
+			// Retention only covers the last two datapoints.
+			old := start.Add(-week).Unix()
+			fmt.Fprintf(w, `[{"target": "a", "datapoints": [[20, %d], [30, %d]]}]`, old+60, old+120)
+		default:
+			t.Error("Unexpected from:", r.FormValue("from"))
+		}
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, shifted, err := c.QueryWithShift("a", TimeInterval{start, start.Add(3 * time.Minute)}, week)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current) != 3 || len(shifted) != 3 {
+		t.Fatal("Unexpected lengths:", len(current), len(shifted))
+	}
+	for i := range current {
+		if !current[i].Time.Equal(shifted[i].Time) || !current[i].Time.Equal(start.Add(time.Duration(i)*time.Minute)) {
+			t.Error("Unexpected times:", i, current[i].Time, shifted[i].Time)
+		}
+		if current[i].Value == nil || *current[i].Value != float64(i+1) {
+			t.Error("Unexpected current value:", i, current[i].Value)
+		}
+	}
+	if shifted[0].Value != nil || *shifted[1].Value != 20 || *shifted[2].Value != 30 {
+		t.Error("Unexpected shifted values:", shifted)
+	}
+}
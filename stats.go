@@ -0,0 +1,90 @@
+package infrastructure
+
+import (
+	"math"
+	"sort"
+)
+
+// Summary statistics of a series. Everything but NullCount ignores nulls. If
+// Count is zero, ie. for empty and all-null series, the other fields are zero
+// and should not be used.
+type SeriesStats struct {
+	Count     int
+	NullCount int
+	Min       float64
+	Max       float64
+	Mean      float64
+	Sum       float64
+	// Population standard deviation.
+	StdDev float64
+
+	// The non-null values, sorted.
+	sorted []float64
+}
+
+// Computes summary statistics of points.
+func Stats(points []FloatDatapoint) SeriesStats {
+	values := make([]float64, 0, len(points))
+	for _, point := range points {
+		if point.Value != nil {
+			values = append(values, *point.Value)
+		}
+	}
+	s := sortedStats(values)
+	s.NullCount = len(points) - len(values)
+	return s
+}
+
+// Like Stats, but for non-null values. Sorts values in place.
+func sortedStats(values []float64) SeriesStats {
+	s := moments(values)
+	sort.Float64s(values)
+	s.sorted = values
+	return s
+}
+
+// Computes everything but the percentiles of values. Shared by Stats and the
+// AggFuncs.
+func moments(values []float64) SeriesStats {
+	s := SeriesStats{Count: len(values)}
+	if s.Count == 0 {
+		return s
+	}
+
+	s.Min, s.Max = values[0], values[0]
+	for _, v := range values {
+		s.Sum += v
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+	}
+	s.Mean = s.Sum / float64(s.Count)
+	var squares float64
+	for _, v := range values {
+		squares += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(squares / float64(s.Count))
+	return s
+}
+
+// The p:th percentile, 0 <= p <= 100, using the nearest-rank method. That is,
+// the smallest value such that at least p percent of the values are less than
+// or equal to it. Percentile(0) is Min and Percentile(100) is Max. Returns NaN
+// if Count is zero or p is out of range.
+func (s SeriesStats) Percentile(p float64) float64 {
+	if s.Count == 0 || p < 0 || p > 100 || math.IsNaN(p) {
+		return math.NaN()
+	}
+	// Dividing last, since ie. 7 / 100 * 100 is slightly more than 7.
+	rank := int(math.Ceil(p * float64(s.Count) / 100))
+	if rank < 1 {
+		rank = 1
+	}
+	return s.sorted[rank-1]
+}
+
+// Aggregates values into their p:th percentile. See SeriesStats.Percentile.
+func Percentile(p float64) AggFunc {
+	return func(values []float64) float64 {
+		return sortedStats(append([]float64(nil), values...)).Percentile(p)
+	}
+}
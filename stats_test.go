@@ -0,0 +1,76 @@
+package infrastructure
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	// Values 15, 20, 35, 40 and 50, as in the Wikipedia example of the
+	// nearest-rank method, shuffled and interleaved with nulls.
+	s := Stats(floatDatapointsOf(v(40), nil, v(15), v(50), nil, v(35), v(20)))
+
+	if s.Count != 5 || s.NullCount != 2 {
+		t.Error("Unexpected counts:", s.Count, s.NullCount)
+	}
+	if s.Min != 15 || s.Max != 50 || s.Sum != 160 || s.Mean != 32 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	// Squared deviations 289, 144, 9, 64, 324 sum to 830.
+	if math.Abs(s.StdDev-math.Sqrt(830.0/5)) > 1e-12 {
+		t.Error("Unexpected standard deviation:", s.StdDev)
+	}
+
+	for p, expected := range map[float64]float64{0: 15, 5: 15, 30: 20, 40: 20, 50: 35, 95: 50, 100: 50} {
+		if actual := s.Percentile(p); actual != expected {
+			t.Errorf("Unexpected percentile %v: %v", p, actual)
+		}
+	}
+	if !math.IsNaN(s.Percentile(101)) || !math.IsNaN(s.Percentile(-1)) {
+		t.Error("Expected NaN for percentiles out of range.")
+	}
+}
+
+func TestStatsPercentileRounding(t *testing.T) {
+	t.Parallel()
+
+	var values []*float64
+	for i := 1; i <= 100; i++ {
+		values = append(values, makeFloat64Pointer(float64(i)))
+	}
+	s := Stats(floatDatapointsOf(values...))
+	for _, p := range []float64{1, 7, 14, 28, 29, 55, 56, 57, 99} {
+		if actual := s.Percentile(p); actual != p {
+			t.Errorf("Unexpected percentile %v: %v", p, actual)
+		}
+	}
+}
+
+func TestStatsSingleValue(t *testing.T) {
+	t.Parallel()
+
+	s := Stats(floatDatapointsOf(nil, makeFloat64Pointer(-3)))
+	if s.Count != 1 || s.NullCount != 1 || s.Min != -3 || s.Max != -3 || s.Mean != -3 || s.Sum != -3 || s.StdDev != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if s.Percentile(0) != -3 || s.Percentile(95) != -3 {
+		t.Error("Unexpected percentile.")
+	}
+}
+
+func TestStatsNoValues(t *testing.T) {
+	t.Parallel()
+
+	for _, points := range [][]FloatDatapoint{nil, floatDatapointsOf(nil, nil)} {
+		s := Stats(points)
+		if s.Count != 0 || s.NullCount != len(points) {
+			t.Errorf("Unexpected stats: %+v", s)
+		}
+		if !math.IsNaN(s.Percentile(50)) {
+			t.Error("Expected NaN percentile.")
+		}
+	}
+}
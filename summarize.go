@@ -0,0 +1,54 @@
+package infrastructure
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// An aggregate of the datapoints from Start, inclusive, to End, exclusive.
+type Bucket struct {
+	Start time.Time
+	End   time.Time
+	// nil if the bucket had no datapoints.
+	Value *float64
+}
+
+// The aggregation functions accepted by Graphite's summarize().
+var summarizeFuncs = map[string]bool{
+	"sum": true, "total": true, "avg": true, "average": true, "avg_zero": true,
+	"median": true, "min": true, "max": true, "diff": true, "stddev": true,
+	"count": true, "range": true, "rangeOf": true, "multiply": true,
+	"first": true, "last": true, "current": true,
+}
+
+// Fetches q aggregated into buckets of length bucket using Graphite's
+// summarize(), with agg as the aggregation function, ie. "sum" or "max". q
+// must result in a single series.
+//
+// Graphite timestamps every bucket with its start. With alignToFrom, buckets
+// start at interval.From. Otherwise, they're aligned to multiples of bucket
+// since the Unix epoch, so the first bucket might start before interval.From
+// and the last one end after interval.To.
+func (g *Client) QuerySummarized(q string, interval TimeInterval, bucket time.Duration, agg string, alignToFrom bool, opts ...QueryOption) ([]Bucket, error) {
+	if bucket < time.Second {
+		return nil, fmt.Errorf("Bucket %s is shorter than a second.", bucket)
+	}
+	if !summarizeFuncs[agg] {
+		return nil, fmt.Errorf("Unknown summarize function %q.", agg)
+	}
+
+	points, err := g.QueryFloats(summarizeTarget(q, bucket, agg, alignToFrom), interval, opts...)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]Bucket, len(points))
+	for i, point := range points {
+		buckets[i] = Bucket{Start: point.Time, End: point.Time.Add(bucket), Value: point.Value}
+	}
+	return buckets, nil
+}
+
+func summarizeTarget(q string, bucket time.Duration, agg string, alignToFrom bool) string {
+	return fmt.Sprintf("summarize(%s,%q,%q,%s)", q, graphiteDuration(bucket), agg, strconv.FormatBool(alignToFrom))
+}
@@ -0,0 +1,64 @@
+package infrastructure
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuerySummarized(t *testing.T) {
+	t.Parallel()
+
+	var target string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.FormValue("target")
+		w.Write([]byte(`[{"target": "summarize(a, \"1hour\", \"sum\")", "datapoints": [[10, 1409760000], [null, 1409763600], [30.5, 1409767200]]}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409761000, 0), time.Unix(1409768000, 0)}
+
+	buckets, err := c.QuerySummarized("sumSeries(a.*)", interval, time.Hour, "sum", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != `summarize(sumSeries(a.*),"1hours","sum",false)` {
+		t.Error("Unexpected target:", target)
+	}
+	if len(buckets) != 3 {
+		t.Fatal("Unexpected buckets:", buckets)
+	}
+	for i, bucket := range buckets {
+		start := time.Unix(1409760000+int64(i)*3600, 0)
+		if !bucket.Start.Equal(start) || !bucket.End.Equal(start.Add(time.Hour)) {
+			t.Error("Unexpected bucket boundaries:", i, bucket.Start, bucket.End)
+		}
+	}
+	if *buckets[0].Value != 10 || buckets[1].Value != nil || *buckets[2].Value != 30.5 {
+		t.Error("Unexpected values:", buckets)
+	}
+
+	if _, err := c.QuerySummarized("a", interval, 90*time.Second, "max", true); err != nil {
+		t.Fatal(err)
+	}
+	if target != `summarize(a,"90s","max",true)` {
+		t.Error("Unexpected target:", target)
+	}
+
+	target = ""
+	for _, agg := range []string{"", "mean", "sum)", "Sum"} {
+		if _, err := c.QuerySummarized("a", interval, time.Hour, agg, false); err == nil {
+			t.Error("Expected error for", agg)
+		}
+	}
+	if _, err := c.QuerySummarized("a", interval, time.Millisecond, "sum", false); err == nil {
+		t.Error("Expected error.")
+	}
+	if target != "" {
+		t.Error("Unexpected request:", target)
+	}
+}
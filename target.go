@@ -0,0 +1,372 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The maximum number of paths ExpandBraces expands a pattern into.
+const DefaultMaxBraceExpansions = 4096
+
+// Expands the brace groups of a metric path pattern the way Graphite does, ie.
+// "a.{b,c}.d" into "a.b.d" and "a.c.d". Groups can be nested and a pattern can
+// contain several groups, whose alternatives are combined left to right. A
+// group without commas, "{b}", is the same as "b". Duplicate paths are only
+// returned once, at their first position. Other wildcards are left as is.
+// Fails for unbalanced braces and for patterns expanding into more than
+// DefaultMaxBraceExpansions paths. See ExpandBracesLimit.
+func ExpandBraces(pattern string) ([]string, error) {
+	return ExpandBracesLimit(pattern, DefaultMaxBraceExpansions)
+}
+
+// Like ExpandBraces, but fails for patterns expanding into more than limit
+// paths.
+func ExpandBracesLimit(pattern string, limit int) ([]string, error) {
+	p := braceParser{pattern: pattern, limit: limit}
+	paths, err := p.sequence(false)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(paths))
+	res := paths[:0]
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			res = append(res, path)
+		}
+	}
+	return res, nil
+}
+
+type braceParser struct {
+	pattern string
+	i       int
+	limit   int
+}
+
+// Expands the pattern from i up until the end, or in a group, up until the
+// ',' or '}' ending the alternative.
+func (p *braceParser) sequence(inGroup bool) ([]string, error) {
+	res := []string{""}
+	start := p.i
+	appendLiteral := func() {
+		for j := range res {
+			res[j] += p.pattern[start:p.i]
+		}
+	}
+
+	for p.i < len(p.pattern) {
+		switch p.pattern[p.i] {
+		case '{':
+			appendLiteral()
+			p.i++
+			alternatives, err := p.group()
+			if err != nil {
+				return nil, err
+			}
+			if len(res)*len(alternatives) > p.limit {
+				return nil, p.tooManyError()
+			}
+			product := make([]string, 0, len(res)*len(alternatives))
+			for _, prefix := range res {
+				for _, alternative := range alternatives {
+					product = append(product, prefix+alternative)
+				}
+			}
+			res = product
+			start = p.i
+		case '}':
+			if !inGroup {
+				return nil, fmt.Errorf("Unbalanced '}' at position %d in %q.", p.i, p.pattern)
+			}
+			appendLiteral()
+			return res, nil
+		case ',':
+			if inGroup {
+				appendLiteral()
+				return res, nil
+			}
+			p.i++
+		default:
+			p.i++
+		}
+	}
+	if inGroup {
+		return nil, fmt.Errorf("Unbalanced '{' in %q.", p.pattern)
+	}
+	appendLiteral()
+	return res, nil
+}
+
+// Expands the alternatives of a group, having consumed its '{'. Consumes the
+// closing '}'.
+func (p *braceParser) group() ([]string, error) {
+	var alternatives []string
+	for {
+		expanded, err := p.sequence(true)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, expanded...)
+		if len(alternatives) > p.limit {
+			return nil, p.tooManyError()
+		}
+
+		c := p.pattern[p.i]
+		p.i++
+		if c == '}' {
+			return alternatives, nil
+		}
+	}
+}
+
+func (p *braceParser) tooManyError() error {
+	return fmt.Errorf("Expanding %q results in more than %d paths.", p.pattern, p.limit)
+}
+
+// Returned by ValidateTarget.
+type TargetSyntaxError struct {
+	Target string
+	// The byte offset of the problem in Target.
+	Offset int
+	Reason string
+}
+
+func (e *TargetSyntaxError) Error() string {
+	return fmt.Sprintf("Invalid target %q at offset %d: %s", e.Target, e.Offset, e.Reason)
+}
+
+var closingBrackets = map[byte]byte{'(': ')', '{': '}'}
+
+// Checks a target for errors that would make Graphite fail it: emptiness,
+// control characters, unterminated strings, unbalanced parentheses and braces
+// and unterminated character classes, ie. "cpu[0-3". Fails with a
+// *TargetSyntaxError. Only definitely invalid targets are rejected, so a
+// target passing the check might still fail, ie. due to an unknown function.
+// See WithValidation.
+func ValidateTarget(q string) error {
+	fail := func(offset int, reason string) error {
+		return &TargetSyntaxError{Target: q, Offset: offset, Reason: reason}
+	}
+	if q == "" {
+		return fail(0, "Empty target.")
+	}
+	for i, r := range q {
+		if unicode.IsControl(r) {
+			return fail(i, "Control character.")
+		}
+	}
+
+	// Offsets of the unclosed opening brackets.
+	var open []int
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '"' || c == '\'':
+			end := quoteEnd(q, i)
+			if end < 0 {
+				return fail(i, fmt.Sprintf("Unterminated string starting with %q.", c))
+			}
+			i = end
+		case c == '[':
+			end := classEnd(q, i)
+			if end < 0 {
+				return fail(i, "Unbalanced '['.")
+			}
+			i = end
+		case c == '(' || c == '{':
+			open = append(open, i)
+		case c == ')' || c == '}':
+			if len(open) == 0 {
+				return fail(i, fmt.Sprintf("Unbalanced %q.", c))
+			}
+			if last := open[len(open)-1]; closingBrackets[q[last]] != c {
+				return fail(i, fmt.Sprintf("Expected %q closing %q at offset %d, got %q.", closingBrackets[q[last]], q[last], last, c))
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 {
+		last := open[len(open)-1]
+		return fail(last, fmt.Sprintf("Unbalanced %q.", q[last]))
+	}
+	return nil
+}
+
+// The offset of the ']' ending the character class starting at start, or -1.
+// Like in Python's fnmatch, a ']' first in the class, or after a negating '!',
+// is part of the class.
+func classEnd(q string, start int) int {
+	i := start + 1
+	if i < len(q) && q[i] == '!' {
+		i++
+	}
+	if i < len(q) && q[i] == ']' {
+		i++
+	}
+	if end := strings.IndexByte(q[i:], ']'); end >= 0 {
+		return i + end
+	}
+	return -1
+}
+
+// The offset of the quote ending the string starting at start, or -1.
+// Backslashes escape the next character.
+func quoteEnd(q string, start int) int {
+	for i := start + 1; i < len(q); i++ {
+		switch q[i] {
+		case '\\':
+			i++
+		case q[start]:
+			return i
+		}
+	}
+	return -1
+}
+
+// Makes s match only itself when used as a segment of a metric path in a
+// target, ie. for interpolating a hostname. graphite-web matches segments
+// using Python's fnmatch, after expanding braces, so the wildcards '*', '?',
+// '[' and ']' are escaped as the character classes "[*]", "[?]", "[[]" and
+// "[]]". The characters that graphite-web's target grammar doesn't allow in a
+// path, "(){},=.'\"\\", can't be escaped reliably and fail, as do
+// whitespace, control characters and empty segments.
+func QuoteSegment(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("Empty segment.")
+	}
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '*' || r == '?' || r == '[' || r == ']':
+			b.WriteByte('[')
+			b.WriteRune(r)
+			b.WriteByte(']')
+		case strings.ContainsRune("(){},=.'\"\\", r) || unicode.IsSpace(r) || unicode.IsControl(r):
+			return "", fmt.Errorf("Segment %q contains %q, which can't be quoted.", s, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// Quotes every segment using QuoteSegment and joins them using dots.
+func QuotePath(segments ...string) (string, error) {
+	quoted := make([]string, len(segments))
+	for i, segment := range segments {
+		q, err := QuoteSegment(segment)
+		if err != nil {
+			return "", err
+		}
+		quoted[i] = q
+	}
+	return strings.Join(quoted, "."), nil
+}
+
+// Quotes s as a string argument of a Graphite function, ie. the name passed to
+// alias(), so that graphite-web passes s on as is. Commas, parentheses and
+// spaces are safe within quotes, but split arguments or break parsing
+// without them.
+//
+// graphite-web parses strings using pyparsing's quotedString and only removes
+// the quotes: a string is either double or single quoted, a backslash pairs
+// with the character after it, and escapes are left as is rather than
+// unescaped. So a quote can't be escaped, but a string containing one is quoted
+// using the other quote character. Fails for strings containing both quote
+// characters, control characters, ie. newlines, a trailing backslash or a "\x"
+// that isn't followed by a hex digit, none of which can be quoted.
+func QuoteString(s string) (string, error) {
+	quote := `"`
+	if strings.Contains(s, quote) {
+		quote = "'"
+	}
+	if strings.Contains(s, quote) {
+		return "", fmt.Errorf("String %q contains both quote characters, which can't be quoted.", s)
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("String %q contains %q, which can't be quoted.", s, r)
+		}
+	}
+	if i := invalidEscape(s); i >= 0 {
+		return "", fmt.Errorf("String %q contains an invalid escape at offset %d.", s, i)
+	}
+	return quote + s + quote, nil
+}
+
+// Quotes a Python regular expression as a string argument of a Graphite
+// function, ie. the pattern passed to aliasSub() or grep(). Backslashes are
+// left as is, like QuoteString does, so "(\d+)" stays "(\d+)". Unlike with
+// QuoteString, any quote character and control character can be quoted, since
+// double quotes are rewritten as the regular expression escape "\x22" and
+// control characters as escapes like "\n" or "\x00". Fails for patterns
+// ending in a backslash or containing a "\x" that isn't followed by a hex
+// digit, which Python rejects anyway.
+func QuoteRegex(pattern string) (string, error) {
+	if i := invalidEscape(pattern); i >= 0 {
+		return "", fmt.Errorf("Regular expression %q contains an invalid escape at offset %d.", pattern, i)
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case unicode.IsControl(r):
+			// An escaped control character means the character itself, so
+			// any pending backslash is dropped.
+			escaped = false
+			writeRegexEscape(&b, r)
+		case escaped:
+			escaped = false
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			b.WriteString(`\x22`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String(), nil
+}
+
+// Writes the Python regular expression escape matching the control character
+// r, which is below U+0100.
+func writeRegexEscape(b *strings.Builder, r rune) {
+	switch r {
+	case '\t':
+		b.WriteString(`\t`)
+	case '\n':
+		b.WriteString(`\n`)
+	case '\r':
+		b.WriteString(`\r`)
+	default:
+		fmt.Fprintf(b, `\x%02x`, r)
+	}
+}
+
+// The offset of the first backslash in s that pyparsing's quotedString
+// rejects, or -1. A backslash must be followed by a character, and "\x" by a
+// hex digit.
+func invalidEscape(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			continue
+		}
+		if i+1 == len(s) || s[i+1] == 'x' && (i+2 == len(s) || !isHexDigit(s[i+2])) {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
@@ -0,0 +1,303 @@
+package infrastructure
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandBraces(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		pattern  string
+		expected []string
+	}{
+		{"a.b.c", []string{"a.b.c"}},
+		{"", []string{""}},
+		{"a.{b,c}.d", []string{"a.b.d", "a.c.d"}},
+		{"{a,b}", []string{"a", "b"}},
+		{"a.{b}.c", []string{"a.b.c"}},
+		{"a.{}.c", []string{"a..c"}},
+		{"a.{,b}", []string{"a.", "a.b"}},
+		// Several groups.
+		{"{a,b}.{c,d}", []string{"a.c", "a.d", "b.c", "b.d"}},
+		{"x{a,b}{c,d}y", []string{"xacy", "xady", "xbcy", "xbdy"}},
+		// Nested groups.
+		{"a.{b,c{d,e}}.f", []string{"a.b.f", "a.cd.f", "a.ce.f"}},
+		{"{a,{b,{c,d}}}", []string{"a", "b", "c", "d"}},
+		{"{a{b,c}{d,e},f}", []string{"abd", "abe", "acd", "ace", "f"}},
+		// Duplicates.
+		{"{a,a,b}", []string{"a", "b"}},
+		{"{a,b}{,a}", []string{"a", "aa", "b", "ba"}},
+		// Other wildcards and commas outside braces are left alone.
+		{"servers.*.cpu[0-3].{user,system}", []string{"servers.*.cpu[0-3].user", "servers.*.cpu[0-3].system"}},
+		{"sumSeries(a.{b,c},d)", []string{"sumSeries(a.b,d)", "sumSeries(a.c,d)"}},
+	} {
+		expanded, err := ExpandBraces(test.pattern)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("Unexpected expansion of %q: %q", test.pattern, expanded)
+		}
+	}
+}
+
+func TestExpandBracesErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, pattern := range []string{"{", "a.{b,c", "a.b}", "{a,b}}", "{{a,b}", "a.{b,{c}", "}{"} {
+		if expanded, err := ExpandBraces(pattern); err == nil || !strings.Contains(err.Error(), "Unbalanced") {
+			t.Errorf("Expected error for %q: %q %v", pattern, expanded, err)
+		}
+	}
+
+	// 4^6 = 4096 paths are fine, 4^7 aren't.
+	pattern := strings.Repeat("{a,b,c,d}", 6)
+	if expanded, err := ExpandBraces(pattern); err != nil || len(expanded) != 4096 {
+		t.Error("Unexpected expansion:", len(expanded), err)
+	}
+	if _, err := ExpandBraces(pattern + "{a,b,c,d}"); err == nil {
+		t.Error("Expected error.")
+	}
+	if _, err := ExpandBracesLimit("{a,b}.{c,d}", 3); err == nil {
+		t.Error("Expected error.")
+	}
+	if _, err := ExpandBracesLimit("{a,b,c,d}", 3); err == nil {
+		t.Error("Expected error.")
+	}
+	if expanded, err := ExpandBracesLimit("{a,b}.{c,d}", 4); err != nil || len(expanded) != 4 {
+		t.Error("Unexpected expansion:", expanded, err)
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	t.Parallel()
+
+	for _, target := range []string{
+		"a.b.c",
+		"servers.*.cpu[0-3].{user,system}",
+		"sumSeries(a.{b,c}.d)",
+		`alias(a.b, 'it\'s (fine')`,
+		`alias(a.b, "unbalanced ) { [ in strings")`,
+		`alias(a.b, "escaped \" quote")`,
+		"seriesByTag('name=a', 'dc=~eu-.*')",
+		"movingAverage(a.b, '5min')",
+		"a.b;tag=value",
+		"ünïcödé.metric",
+		// Might still fail in Graphite, but not definitely.
+		"unknownFunction(a.b)",
+		"a..b",
+		"a.cpu[!]x].b",
+		"a.cpu[]].b",
+		"a.[{(].b",
+		// Like in fnmatch, a ']' alone is literal.
+		"a.b]",
+	} {
+		if err := ValidateTarget(target); err != nil {
+			t.Errorf("Unexpected error for %q: %v", target, err)
+		}
+	}
+
+	for _, test := range []struct {
+		target string
+		offset int
+	}{
+		{"", 0},
+		{"sumSeries(a.b", 9},
+		{"sumSeries(a.b))", 14},
+		{"a.b)", 3},
+		{"a.{b,c", 2},
+		{"a.b,c}", 5},
+		{"a.cpu[0-3.b", 5},
+		{"a.cpu[].b", 5},
+		{"sumSeries(a.{b,c)}", 16},
+		{"alias(a.b, 'x)", 11},
+		{`alias(a.b, "x\")`, 11},
+		{"a.b\n", 3},
+		{"a.\x00b", 2},
+		{"alias(a, 'x\ty')", 11},
+	} {
+		err := ValidateTarget(test.target)
+		var syntaxErr *TargetSyntaxError
+		if !errors.As(err, &syntaxErr) || syntaxErr.Target != test.target || syntaxErr.Offset != test.offset {
+			t.Errorf("Unexpected error for %q: %v", test.target, err)
+		}
+	}
+}
+
+func TestWithValidation(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics/find" {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 1409763000]]}]`))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var syntaxErr *TargetSyntaxError
+	if _, err := c.QueryMultiSince([]string{"a", "sumSeries(b"}, time.Hour, WithValidation()); !errors.As(err, &syntaxErr) || syntaxErr.Target != "sumSeries(b" {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.QueryRawSince([]string{"a{"}, time.Hour, WithValidation()); !errors.As(err, &syntaxErr) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.Find("a.{b", WithValidation()); !errors.As(err, &syntaxErr) {
+		t.Error("Unexpected error:", err)
+	}
+	if _, err := c.QueryMultiSince([]string{"a", "sumSeries(b)"}, time.Hour, WithValidation()); err != nil {
+		t.Error(err)
+	}
+	// Not validated by default.
+	if _, err := c.QueryMultiSince([]string{"sumSeries(b"}, time.Hour); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuoteSegment(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		segment  string
+		expected string
+	}{
+		{"web01", "web01"},
+		{"web-01_a", "web-01_a"},
+		{"*", "[*]"},
+		{"web?", "web[?]"},
+		{"fe80::1[eth0]", "fe80::1[[]eth0[]]"},
+		{"[*?]", "[[][*][?][]]"},
+		{"a]", "a[]]"},
+		{"ünïcödé", "ünïcödé"},
+		{"a;b", "a;b"},
+	} {
+		quoted, err := QuoteSegment(test.segment)
+		if err != nil || quoted != test.expected {
+			t.Errorf("Unexpected quoting of %q: %q %v", test.segment, quoted, err)
+		}
+		// Quoted segments are valid targets.
+		if err := ValidateTarget(quoted); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, segment := range []string{"", "a.b", "{a,b}", "a,b", "a}", "sumSeries(a)", "a=b", "it's", `"a"`, `a\b`, "a b", "a\tb", "a\x00"} {
+		if quoted, err := QuoteSegment(segment); err == nil {
+			t.Errorf("Expected error for %q: %q", segment, quoted)
+		}
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	t.Parallel()
+
+	path, err := QuotePath("servers", "web*", "cpu")
+	if err != nil || path != "servers.web[*].cpu" {
+		t.Error("Unexpected path:", path, err)
+	}
+	if path, err := QuotePath("servers", "a,b"); err == nil {
+		t.Error("Expected error:", path)
+	}
+	if path, err := QuotePath(); err != nil || path != "" {
+		t.Error("Unexpected path:", path, err)
+	}
+}
+
+// pyparsing's quotedString, which graphite-web only strips the quotes of.
+var graphiteString = regexp.MustCompile(`^(?:"(?:[^"\n\r\\]|""|\\(?:[^x]|x[0-9a-fA-F]+))*"|'(?:[^'\n\r\\]|''|\\(?:[^x]|x[0-9a-fA-F]+))*')$`)
+
+func TestQuoteString(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		s        string
+		expected string
+	}{
+		{"", `""`},
+		{"requests per second", `"requests per second"`},
+		{"a,b(c)", `"a,b(c)"`},
+		{`my "quoted" name`, `'my "quoted" name'`},
+		{"it's", `"it's"`},
+		{`C:\temp`, `"C:\temp"`},
+		{`\\`, `"\\"`},
+		{`a\"b`, `'a\"b'`},
+		{`a\'b`, `"a\'b"`},
+		{`\x41`, `"\x41"`},
+		{"日本 ü", `"日本 ü"`},
+	} {
+		quoted, err := QuoteString(test.s)
+		if err != nil || quoted != test.expected {
+			t.Errorf("Unexpected quoting of %q: %q %v", test.s, quoted, err)
+			continue
+		}
+		if !graphiteString.MatchString(quoted) || quoted[1:len(quoted)-1] != test.s {
+			t.Errorf("Graphite wouldn't parse %q as %q.", quoted, test.s)
+		}
+		if err := ValidateTarget("alias(a.b," + quoted + ")"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, s := range []string{`both " and '`, "a\nb", "a\rb", "tab\there", "a\x00", `a\`, `a\\\`, `\x`, `\xg`} {
+		if quoted, err := QuoteString(s); err == nil {
+			t.Errorf("Expected error for %q: %q", s, quoted)
+		}
+	}
+}
+
+func TestQuoteRegex(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		pattern  string
+		expected string
+	}{
+		{`^.*TCP(\d+)`, `"^.*TCP(\d+)"`},
+		{`\1`, `"\1"`},
+		{`a,b`, `"a,b"`},
+		{`say "hi"`, `"say \x22hi\x22"`},
+		{`it's`, `"it's"`},
+		{`both " and '`, `"both \x22 and '"`},
+		{`\"`, `"\""`},
+		{`\\"`, `"\\\x22"`},
+		{`\\`, `"\\"`},
+		{"a\nb", `"a\nb"`},
+		{"a\r\n", `"a\r\n"`},
+		{`\x2e`, `"\x2e"`},
+		{"a\tb\x00\u0085", `"a\tb\x00\x85"`},
+		{"\\\n\\\t", `"\n\t"`},
+		{`\é`, `"\é"`},
+	} {
+		quoted, err := QuoteRegex(test.pattern)
+		if err != nil || quoted != test.expected {
+			t.Errorf("Unexpected quoting of %q: %q %v", test.pattern, quoted, err)
+			continue
+		}
+		if !graphiteString.MatchString(quoted) {
+			t.Errorf("Graphite wouldn't parse %q.", quoted)
+		}
+		if err := ValidateTarget("aliasSub(a.b," + quoted + ",'\\1')"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, pattern := range []string{`a\`, `\x`, `\xz`} {
+		if quoted, err := QuoteRegex(pattern); err == nil {
+			t.Errorf("Expected error for %q: %q", pattern, quoted)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package infrastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+var errDatapointsSyntax = errors.New("Unexpected Graphite response. Malformed datapoints.")
+
+// Like QueryFloats, but decodes the datapoints straight into FloatDatapoints
+// while parsing the response, skipping the intermediate representation kept by
+// Datapoints. Considerably faster and less memory hungry for large responses.
+// Always requests FormatJSON. If Client.Cache is used, it's just QueryFloats,
+// since the cache holds Datapoints.
+func (g *Client) QueryTypedFloats(q string, interval TimeInterval, opts ...QueryOption) ([]FloatDatapoint, error) {
+	if g.usesCache(opts) {
+		return g.QueryFloats(q, interval, opts...)
+	}
+	var res []struct {
+		Target     string      `json:"target"`
+		Datapoints floatPoints `json:"datapoints"`
+	}
+	if err := g.queryTyped(q, interval, opts, &res); err != nil {
+		return nil, err
+	}
+	if err := checkSingleTarget(len(res)); err != nil {
+		return nil, err
+	}
+	if len(res[0].Datapoints) == 0 && g.requireDatapoints(opts) {
+		return nil, &EmptySeriesError{res[0].Target}
+	}
+	return res[0].Datapoints, nil
+}
+
+// Like QueryTypedFloats, but for QueryInts.
+func (g *Client) QueryTypedInts(q string, interval TimeInterval, opts ...QueryOption) ([]IntDatapoint, error) {
+	if g.usesCache(opts) {
+		return g.QueryInts(q, interval, opts...)
+	}
+	var res []struct {
+		Target     string    `json:"target"`
+		Datapoints intPoints `json:"datapoints"`
+	}
+	if err := g.queryTyped(q, interval, opts, &res); err != nil {
+		return nil, err
+	}
+	if err := checkSingleTarget(len(res)); err != nil {
+		return nil, err
+	}
+	if len(res[0].Datapoints) == 0 && g.requireDatapoints(opts) {
+		return nil, &EmptySeriesError{res[0].Target}
+	}
+	return res[0].Datapoints, nil
+}
+
+func (g *Client) usesCache(opts []QueryOption) bool {
+	return g.Cache != nil && !newQueryOptions(opts).noCache
+}
+
+func (g *Client) queryTyped(q string, interval TimeInterval, opts []QueryOption, res interface{}) error {
+	if err := interval.Check(); err != nil {
+		return err
+	}
+	o := newQueryOptions(opts)
+	o.format = FormatJSON
+
+	body, err := g.renderBody([]string{q}, constructQueryPart([]string{q}), &interval, o)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return json.NewDecoder(newNonFiniteReader(body)).Decode(res)
+}
+
+func checkSingleTarget(n int) error {
+	if n == 0 {
+		return ErrNoTargets
+	}
+	if n > 1 {
+		return errors.New("Unexpected Graphite response. More than one target were returned.")
+	}
+	return nil
+}
+
+type floatPoints []FloatDatapoint
+
+func (p *floatPoints) UnmarshalJSON(data []byte) error {
+	points, err := parsePoints[float64](data, false)
+	*p = points
+	return err
+}
+
+type intPoints []IntDatapoint
+
+func (p *intPoints) UnmarshalJSON(data []byte) error {
+	points, err := parsePoints[int64](data, false)
+	*p = points
+	return err
+}
+
+// Parses a JSON number, failing with a *ValueOverflowError if it's out of
+// range for a float64.
+func parseFloatValue(value []byte, t time.Time) (float64, error) {
+	f, err := strconv.ParseFloat(string(value), 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, &ValueOverflowError{Time: t, Value: string(value)}
+	}
+	if err != nil {
+		return 0, errors.New("Value not proper number.")
+	}
+	return f, nil
+}
+
+// Truncates value, already parsed into f, towards zero. Not ok if the result
+// doesn't fit in an int64, or if f has lost precision such that truncating it
+// would give a different integer than truncating value itself.
+func truncateFloatValue(value []byte, f float64) (int64, bool) {
+	if math.Abs(f) < 1<<53 {
+		return int64(f), true
+	}
+	if f >= 1<<63 || f < -(1<<63) {
+		return 0, false
+	}
+	exact, ok := new(big.Rat).SetString(string(value))
+	if !ok {
+		return 0, false
+	}
+	truncated := new(big.Int).Quo(exact.Num(), exact.Denom())
+	return truncated.Int64(), truncated.IsInt64() && truncated.Int64() == int64(f)
+}
+
+// Number of datapoints in a datapoints array. Every datapoint starts with
+// '[', and since only numbers and nulls are allowed there are no strings that
+// could contain one.
+func countDatapoints(data []byte) int {
+	n := bytes.Count(data, []byte("[")) - 1
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Parses only the first and last timestamp of a datapoints array.
+func firstAndLastTimestamps(data []byte) (first, last int64, ok bool) {
+	s := datapointScanner{data: data}
+	if !s.consume('[') {
+		return 0, 0, false
+	}
+	if first, ok = s.datapointTimestamp(); !ok {
+		return 0, 0, false
+	}
+	// Values are numbers or nulls, so the last '[' starts the last datapoint.
+	s = datapointScanner{data: data, pos: bytes.LastIndexByte(data, '[')}
+	if last, ok = s.datapointTimestamp(); !ok {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+// Hand rolled scanner for a datapoints array, ie.
+//
+//	[[VALUE, TIMESTAMP], ..., [VALUE, TIMESTAMP]]
+//
+// calling fn for every datapoint. A null value is passed as nil.
+func scanDatapoints(data []byte, fn func(value []byte, t time.Time) error) error {
+	s := datapointScanner{data: data}
+	if s.null() {
+		return s.end()
+	}
+	if !s.consume('[') {
+		return errDatapointsSyntax
+	}
+	if s.consume(']') {
+		return s.end()
+	}
+	for {
+		if !s.consume('[') {
+			return errDatapointsSyntax
+		}
+		value, ok := s.number()
+		if !ok {
+			return errors.New("Value not a number.")
+		}
+		if !s.consume(',') {
+			return errDatapointsSyntax
+		}
+		timestamp, ok := s.number()
+		if !ok || timestamp == nil {
+			return errors.New("Unix timestamp not number.")
+		}
+		if !s.consume(']') {
+			return errDatapointsSyntax
+		}
+
+		unixTime, err := strconv.ParseInt(string(timestamp), 10, 64)
+		if err != nil {
+			return errors.New("Unix time not proper number.")
+		}
+		if err := fn(value, time.Unix(unixTime, 0)); err != nil {
+			return err
+		}
+
+		if s.consume(',') {
+			continue
+		}
+		if s.consume(']') {
+			return s.end()
+		}
+		return errDatapointsSyntax
+	}
+}
+
+type datapointScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *datapointScanner) skipWhitespace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *datapointScanner) consume(c byte) bool {
+	s.skipWhitespace()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+func (s *datapointScanner) null() bool {
+	s.skipWhitespace()
+	if bytes.HasPrefix(s.data[s.pos:], []byte("null")) {
+		s.pos += len("null")
+		return true
+	}
+	return false
+}
+
+// Consumes a JSON number or null. Returns nil for null.
+func (s *datapointScanner) number() ([]byte, bool) {
+	if s.null() {
+		return nil, true
+	}
+	start := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		if (c < '0' || c > '9') && c != '-' && c != '+' && c != '.' && c != 'e' && c != 'E' {
+			break
+		}
+		s.pos++
+	}
+	token := s.data[start:s.pos]
+	return token, isJSONNumber(token)
+}
+
+// Consumes a single datapoint, returning its timestamp.
+func (s *datapointScanner) datapointTimestamp() (int64, bool) {
+	if !s.consume('[') {
+		return 0, false
+	}
+	if _, ok := s.number(); !ok || !s.consume(',') {
+		return 0, false
+	}
+	timestamp, ok := s.number()
+	if !ok || timestamp == nil || !s.consume(']') {
+		return 0, false
+	}
+	unixTime, err := strconv.ParseInt(string(timestamp), 10, 64)
+	return unixTime, err == nil
+}
+
+func (s *datapointScanner) end() error {
+	s.skipWhitespace()
+	if s.pos != len(s.data) {
+		return errDatapointsSyntax
+	}
+	return nil
+}
+
+// Whether b is a number according to the JSON grammar, which is stricter
+// than what strconv accepts.
+func isJSONNumber(b []byte) bool {
+	i := 0
+	if i < len(b) && b[i] == '-' {
+		i++
+	}
+	digits := func() int {
+		start := i
+		for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+
+	if i < len(b) && b[i] == '0' {
+		i++
+	} else if digits() == 0 {
+		return false
+	}
+	if i < len(b) && b[i] == '.' {
+		i++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(b)
+}
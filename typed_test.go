@@ -0,0 +1,223 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func decodeTypedFloats(r io.Reader) (map[string][]FloatDatapoint, error) {
+	var res []struct {
+		Target     string      `json:"target"`
+		Datapoints floatPoints `json:"datapoints"`
+	}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, err
+	}
+	m := make(map[string][]FloatDatapoint, len(res))
+	for _, t := range res {
+		m[t.Target] = t.Datapoints
+	}
+	return m, nil
+}
+
+func TestTypedPointsMatchLazyConversion(t *testing.T) {
+	for _, s := range []string{
+		`[]`,
+		`[[185, 1409763000], [741, 1409790300], [null, 1409790600], [756, 1409790900]]`,
+		`[[185.0, 1409763000], [-1.9, 1409790300], [null, 1409790600], [1e3, 1409790900]]`,
+		` [ [ 1 , 2 ] , [ null , 3 ] ] `,
+	} {
+		response, err := parseGraphiteResponse([]byte(`[{"target": "a", "datapoints": ` + s + `}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedFloats, err := response[0].AsFloats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedInts, err := response[0].AsInts()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var floats floatPoints
+		if err := json.Unmarshal([]byte(s), &floats); err != nil {
+			t.Fatal(s, err)
+		}
+		var ints intPoints
+		if err := json.Unmarshal([]byte(s), &ints); err != nil {
+			t.Fatal(s, err)
+		}
+
+		if fmt.Sprint(floatValues(floats)) != fmt.Sprint(floatValues(expectedFloats)) {
+			t.Errorf("Float mismatch for %s: %v", s, floatValues(floats))
+		}
+		if fmt.Sprint(intValues(ints)) != fmt.Sprint(intValues(expectedInts)) {
+			t.Errorf("Int mismatch for %s: %v", s, intValues(ints))
+		}
+		for i := range floats {
+			if !floats[i].Time.Equal(expectedFloats[i].Time) || !ints[i].Time.Equal(expectedInts[i].Time) {
+				t.Errorf("Time mismatch for %s at %d", s, i)
+			}
+		}
+	}
+}
+
+func TestTypedPointsInvalid(t *testing.T) {
+	for _, s := range []string{
+		`[[1, 2]`,
+		`[[1, 2],]`,
+		`[[1]]`,
+		`[[1, 2, 3]]`,
+		`[["1", 2]]`,
+		`[[1, null]]`,
+		`[[1, 2.5]]`,
+		`[[01, 2]]`,
+		`[[1., 2]]`,
+		`[[0x10, 2]]`,
+		`[[true, 2]]`,
+		`{}`,
+	} {
+		var floats floatPoints
+		if err := json.Unmarshal([]byte(s), &floats); err == nil {
+			t.Errorf("Expected error for %s.", s)
+		}
+	}
+}
+
+func TestQueryTypedFloats(t *testing.T) {
+	t.Parallel()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `[{"target": "machine.jvm.gc.PS-MarkSweep.runs", "datapoints": [[185.5, 1409763000], [null, 1409790600]]}]`)
+	}))
+	defer ts.Close()
+
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	floats, err := c.QueryTypedFloats("machine.jvm.gc.PS-MarkSweep.runs", TimeInterval{now.Add(-time.Hour), now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(floats) != 2 || *floats[0].Value != 185.5 || floats[1].Value != nil || floats[1].Time.Unix() != 1409790600 {
+		t.Error("Unexpected points:", floatValues(floats))
+	}
+	ints, err := c.QueryTypedInts("machine.jvm.gc.PS-MarkSweep.runs", TimeInterval{now.Add(-time.Hour), now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ints) != 2 || *ints[0].Value != 185 {
+		t.Error("Unexpected points:", intValues(ints))
+	}
+}
+
+func TestQueryTypedOptions(t *testing.T) {
+	t.Parallel()
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.FormValue("format") != "json" || r.FormValue("tz") != "UTC" || r.FormValue("maxDataPoints") != "10" {
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+		fmt.Fprintln(w, `[{"target": "a", "datapoints": [[1.5, 1409763000]]}]`)
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interval := TimeInterval{time.Unix(1409763000, 0), time.Unix(1409766600, 0)}
+	opts := []QueryOption{WithLocation(time.UTC), WithMaxDataPoints(10), WithFormat(FormatMsgpack)}
+
+	if floats, err := c.QueryTypedFloats("a", interval, opts...); err != nil || len(floats) != 1 || *floats[0].Value != 1.5 {
+		t.Error("Unexpected result:", floats, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.QueryTypedInts("a", interval, WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Error("Expected cancellation:", err)
+	}
+	if _, err := c.QueryTypedFloats("a(", interval, WithValidation()); err == nil {
+		t.Error("Expected validation error.")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Error("Unexpected number of requests:", n)
+	}
+
+	// Served from the cache like the other queries.
+	c.Cache = NewQueryCache(time.Minute, 10)
+	opts = opts[:2]
+	for i := 0; i < 2; i++ {
+		if ints, err := c.QueryTypedInts("a", interval, opts...); err != nil || len(ints) != 1 || *ints[0].Value != 1 {
+			t.Error("Unexpected result:", ints, err)
+		}
+	}
+	if floats, err := c.QueryFloats("a", interval, opts...); err != nil || len(floats) != 1 {
+		t.Error("Unexpected result:", floats, err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Error("Unexpected number of requests:", n)
+	}
+}
+
+func floatValues(points []FloatDatapoint) []interface{} {
+	values := make([]interface{}, len(points))
+	for i, p := range points {
+		if p.Value != nil {
+			values[i] = *p.Value
+		}
+	}
+	return values
+}
+
+func intValues(points []IntDatapoint) []interface{} {
+	values := make([]interface{}, len(points))
+	for i, p := range points {
+		if p.Value != nil {
+			values[i] = *p.Value
+		}
+	}
+	return values
+}
+
+func BenchmarkDecodeTypedFloats(b *testing.B) {
+	body := syntheticGraphiteResponse(1, 1000000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeTypedFloats(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeThenAsFloats(b *testing.B) {
+	body := syntheticGraphiteResponse(1, 1000000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := decodeGraphiteResponse(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := response[0].AsFloats(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
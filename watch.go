@@ -0,0 +1,81 @@
+package infrastructure
+
+import (
+	"context"
+	"time"
+)
+
+type WatchOpts struct {
+	// Points newer than Settle before the poll aren't emitted yet, since the
+	// newest buckets keep changing until Carbon has flushed them, ie. two
+	// steps. Should exceed how late writes arrive.
+	Settle time.Duration
+
+	// Points at or before From are never emitted. By default, the first poll
+	// emits the whole lookback.
+	From time.Time
+
+	// See Poller.
+	Jitter       time.Duration
+	QueryOptions []QueryOption
+}
+
+// Polls the last lookback of q every every, like a Poller, but only emits the
+// non-null datapoints strictly newer than any emitted before. Polls without
+// new datapoints aren't emitted, unless they failed. Datapoints are never
+// emitted twice, even if Graphite starts returning older timestamps, ie.
+// after a restart. A null is emitted once it's filled in, unless a newer
+// datapoint has been emitted first. The returned channel is closed once ctx
+// is done or the Client is closed. Fails if every isn't positive.
+func (g *Client) Watch(ctx context.Context, q string, lookback, every time.Duration, opts WatchOpts) (<-chan PollResult, error) {
+	p, err := NewPoller(g, q, lookback, every)
+	if err != nil {
+		return nil, err
+	}
+	p.Jitter = opts.Jitter
+	p.QueryOptions = opts.QueryOptions
+	p.Start(ctx)
+
+	results := make(chan PollResult)
+	go func() {
+		defer close(results)
+		w := watermark{high: opts.From, settle: opts.Settle}
+		for result := range p.C {
+			if result.Err == nil {
+				result.Points = w.advance(result.Points, result.Time)
+				if len(result.Points) == 0 {
+					continue
+				}
+			}
+			select {
+			case results <- result:
+			case <-ctx.Done():
+				// Draining until the poller has closed its channel.
+			case <-g.closed():
+			}
+		}
+	}()
+	return results, nil
+}
+
+// Tracks the newest datapoint emitted by a Watch.
+type watermark struct {
+	high   time.Time
+	settle time.Duration
+}
+
+// The non-null points newer than the watermark and settled at now, moving
+// the watermark to the newest of them. Nulls don't move the watermark, since
+// they might still be filled in.
+func (w *watermark) advance(points []FloatDatapoint, now time.Time) []FloatDatapoint {
+	cutoff := now.Add(-w.settle)
+	var fresh []FloatDatapoint
+	for _, point := range points {
+		if point.Value == nil || !point.Time.After(w.high) || point.Time.After(cutoff) {
+			continue
+		}
+		fresh = append(fresh, point)
+		w.high = point.Time
+	}
+	return fresh
+}
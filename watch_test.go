@@ -0,0 +1,143 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatermark(t *testing.T) {
+	t.Parallel()
+
+	v := makeFloat64Pointer
+	at := func(seconds int64, value *float64) FloatDatapoint {
+		return FloatDatapoint{time.Unix(seconds, 0), value}
+	}
+	w := watermark{settle: 2 * time.Minute}
+
+	for i, poll := range []struct {
+		now      int64
+		points   []FloatDatapoint
+		expected []FloatDatapoint
+	}{
+		// The newest bucket is still empty.
+		{
+			400,
+			[]FloatDatapoint{at(0, v(1)), at(60, v(2)), at(120, v(3)), at(180, v(4)), at(240, v(5)), at(300, nil)},
+			[]FloatDatapoint{at(0, v(1)), at(60, v(2)), at(120, v(3)), at(180, v(4)), at(240, v(5))},
+		},
+		// 300 has been flushed. 360 and 420 aren't settled yet.
+		{
+			460,
+			[]FloatDatapoint{at(60, v(2)), at(120, v(3)), at(180, v(4)), at(240, v(5)), at(300, v(6)), at(360, v(7)), at(420, v(8))},
+			[]FloatDatapoint{at(300, v(6))},
+		},
+		// 360 changed since the previous poll and is emitted with its
+		// settled value.
+		{
+			520,
+			[]FloatDatapoint{at(300, v(6)), at(360, v(7.5)), at(420, nil), at(480, v(9))},
+			[]FloatDatapoint{at(360, v(7.5))},
+		},
+		// 420 is settled but still null, so it might be filled in later.
+		{
+			580,
+			[]FloatDatapoint{at(360, v(7.5)), at(420, nil), at(480, v(9))},
+			nil,
+		},
+		{
+			600,
+			[]FloatDatapoint{at(360, v(7.5)), at(420, v(8.5)), at(480, v(9))},
+			[]FloatDatapoint{at(420, v(8.5)), at(480, v(9))},
+		},
+		// The gap at 540 is skipped once a newer datapoint is emitted.
+		{
+			760,
+			[]FloatDatapoint{at(480, v(9)), at(540, nil), at(600, v(11)), at(660, nil)},
+			[]FloatDatapoint{at(600, v(11))},
+		},
+		// Graphite restarted and serves old timestamps.
+		{
+			820,
+			[]FloatDatapoint{at(0, v(1)), at(60, v(2)), at(300, v(6))},
+			nil,
+		},
+		{
+			880,
+			[]FloatDatapoint{at(540, v(10)), at(600, v(11)), at(660, v(12)), at(720, v(13))},
+			[]FloatDatapoint{at(660, v(12)), at(720, v(13))},
+		},
+	} {
+		actual := w.advance(poll.points, time.Unix(poll.now, 0))
+		if fmt.Sprint(formatFloatPoints(actual)) != fmt.Sprint(formatFloatPoints(poll.expected)) {
+			t.Errorf("Unexpected points for poll %d: %v", i, formatFloatPoints(actual))
+		}
+	}
+}
+
+func formatFloatPoints(points []FloatDatapoint) []string {
+	var s []string
+	for _, point := range points {
+		if point.Value == nil {
+			s = append(s, fmt.Sprintf("%d:null", point.Time.Unix()))
+		} else {
+			s = append(s, fmt.Sprintf("%d:%v", point.Time.Unix(), *point.Value))
+		}
+	}
+	return s
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	responses := []string{
+		`[{"target": "a", "datapoints": [[1, 0], [2, 60], [null, 120]]}]`,
+		`[{"target": "a", "datapoints": [[1, 0], [2, 60], [3, 120]]}]`,
+		`[{"target": "a", "datapoints": [[2, 60], [3, 120]]}]`,
+		`[{"target": "a", "datapoints": [[3, 120], [4, 180], [5, 240]]}]`,
+	}
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		w.Write([]byte(responses[min(n, len(responses)-1)]))
+	}))
+	defer ts.Close()
+	c, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.clock = func() time.Time { return time.Unix(1000, 0) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, err := c.Watch(ctx, "a", time.Hour, time.Millisecond, WatchOpts{Settle: time.Minute, From: time.Unix(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var points []string
+	for len(points) < 4 {
+		var result PollResult
+		select {
+		case result = <-results:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for points:", points)
+		}
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		points = append(points, formatFloatPoints(result.Points)...)
+	}
+	if fmt.Sprint(points) != "[60:2 120:3 180:4 240:5]" {
+		t.Error("Unexpected points:", points)
+	}
+
+	cancel()
+	for result := range results {
+		t.Error("Unexpected result:", result)
+	}
+}